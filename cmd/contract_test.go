@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"urlshortn/pkg/api"
+	"urlshortn/pkg/event"
+	"urlshortn/pkg/hash"
+	"urlshortn/pkg/storage"
+	"urlshortn/pkg/token"
+)
+
+// errBlock makes the fake stores wait until the store timeout
+var errBlock = errors.New("block")
+
+type contractTest struct {
+	name string
+	// operation is the method and path of the spec the request is for
+	operation string
+	method    string
+	target    string
+	body      string
+	// contentType is the Content-Type of the request, none when empty
+	contentType string
+	// host is the Host header of the request, the default domain when empty
+	host     string
+	accept   string
+	storeErr error
+	// fallback is how unknown hosts are answered, api.UnknownHostDefault when empty
+	fallback string
+	// withoutStores builds the handler without a click store and a domain store
+	withoutStores bool
+	wantStatus    int
+}
+
+// legacyAliases has the legacy operation of the spec that aliases each operation of the current api
+var legacyAliases = map[string]string{
+	"POST /api/v1/links":             "POST /shortn",
+	"POST /api/v1/links/batch":       "POST /shortn/batch",
+	"DELETE /api/v1/links/{code}":    "DELETE /shortn/{code}",
+	"GET /api/v1/links/{code}/stats": "GET /shortn/{code}/stats",
+	"GET /{code}":                    "GET /shortn/{code}",
+}
+
+// legacyTarget returns the target of the legacy route aliasing the one of target
+func legacyTarget(target string) string {
+	if rest, ok := strings.CutPrefix(target, "/api/v1/links"); ok {
+		return "/shortn" + rest
+	}
+	return "/shortn" + target
+}
+
+// TestUrlHandler_Contract drives every status the OpenAPI spec documents for every operation through
+// the router, legacy aliases included, and fails if a response is not the one the spec describes or a documented status is
+// never reached.
+func TestUrlHandler_Contract(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	specValidator, err := api.NewSpecValidator(false, nil, logger)
+	assert.Nil(t, err)
+
+	tests := []contractTest{
+		{name: "shorten url", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar"}`, wantStatus: http.StatusOK},
+		{name: "shorten url to an alias", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar","alias":"meli"}`, wantStatus: http.StatusOK},
+		{name: "shorten url to a taken alias", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://google.com","alias":"abc"}`, wantStatus: http.StatusConflict},
+		{name: "shorten url to a reserved alias", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar","alias":"healthz"}`, wantStatus: http.StatusBadRequest},
+		{name: "shorten url to an invalid alias", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar","alias":"a/b"}`, wantStatus: http.StatusBadRequest},
+		{name: "shorten url without url", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "shorten url with an empty url", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":""}`, wantStatus: http.StatusBadRequest},
+		{name: "shorten url with invalid json", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":`, wantStatus: http.StatusBadRequest},
+		{name: "shorten url without body", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", wantStatus: http.StatusBadRequest},
+		{name: "shorten url with a body too large", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar/` + strings.Repeat("a", 5<<20) + `"}`, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "shorten url conflict", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar"}`, storeErr: storage.ErrConflict, wantStatus: http.StatusConflict},
+		{name: "shorten url store error", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar"}`, storeErr: errors.New("boom"), wantStatus: http.StatusInternalServerError},
+		{name: "shorten url store unavailable", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar"}`, storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "shorten url store timeout", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar"}`, storeErr: errBlock, wantStatus: http.StatusGatewayTimeout},
+
+		{name: "shorten url on a domain", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar","domain":"go.brand-a.com"}`, wantStatus: http.StatusOK},
+		{name: "shorten url on an unregistered domain", operation: "POST /api/v1/links", method: http.MethodPost, target: "/api/v1/links", body: `{"url":"http://mercadolibre.com.ar","domain":"lnk.brand-b.io"}`, wantStatus: http.StatusBadRequest},
+
+		{name: "shorten urls", operation: "POST /api/v1/links/batch", method: http.MethodPost, target: "/api/v1/links/batch", body: `[{"url":"http://mercadolibre.com.ar"},{"url":"http://mercadolibre.com.ar","alias":"meli","expires_at":"2099-01-01T00:00:00Z"}]`, wantStatus: http.StatusOK},
+		{name: "shorten urls with invalid items", operation: "POST /api/v1/links/batch", method: http.MethodPost, target: "/api/v1/links/batch", body: `[{"url":"http://google.com","alias":"abc"},{"url":""},"http://google.com"]`, wantStatus: http.StatusOK},
+		{name: "shorten urls streamed", operation: "POST /api/v1/links/batch", method: http.MethodPost, target: "/api/v1/links/batch", contentType: "application/x-ndjson", body: "{\"url\":\"http://mercadolibre.com.ar\"}\n{\"url\":\"\"}\n", wantStatus: http.StatusOK},
+		{name: "shorten urls streamed past the limit", operation: "POST /api/v1/links/batch", method: http.MethodPost, target: "/api/v1/links/batch", contentType: "application/x-ndjson", body: strings.Repeat("{\"url\":\"http://mercadolibre.com.ar\"}\n", 4), wantStatus: http.StatusOK},
+		{name: "shorten urls store unavailable", operation: "POST /api/v1/links/batch", method: http.MethodPost, target: "/api/v1/links/batch", body: `[{"url":"http://mercadolibre.com.ar"}]`, storeErr: storage.ErrUnavailable, wantStatus: http.StatusOK},
+		{name: "shorten urls not in an array", operation: "POST /api/v1/links/batch", method: http.MethodPost, target: "/api/v1/links/batch", body: `{"url":"http://mercadolibre.com.ar"}`, wantStatus: http.StatusBadRequest},
+		{name: "shorten urls without items", operation: "POST /api/v1/links/batch", method: http.MethodPost, target: "/api/v1/links/batch", body: `[]`, wantStatus: http.StatusBadRequest},
+		{name: "shorten too many urls", operation: "POST /api/v1/links/batch", method: http.MethodPost, target: "/api/v1/links/batch", body: `[{"url":"http://a.com"},{"url":"http://b.com"},{"url":"http://c.com"},{"url":"http://d.com"}]`, wantStatus: http.StatusRequestEntityTooLarge},
+
+		{name: "get link", operation: "GET /api/v1/links/{code}", method: http.MethodGet, target: "/api/v1/links/abc", wantStatus: http.StatusOK},
+		{name: "get link on a domain", operation: "GET /api/v1/links/{code}", method: http.MethodGet, target: "/api/v1/links/abc?domain=go.brand-a.com", wantStatus: http.StatusOK},
+		{name: "get link not found on a domain", operation: "GET /api/v1/links/{code}", method: http.MethodGet, target: "/api/v1/links/abc?domain=lnk.brand-b.io", wantStatus: http.StatusNotFound},
+		{name: "get link not found", operation: "GET /api/v1/links/{code}", method: http.MethodGet, target: "/api/v1/links/missing", wantStatus: http.StatusNotFound},
+		{name: "get link expired", operation: "GET /api/v1/links/{code}", method: http.MethodGet, target: "/api/v1/links/abc", storeErr: storage.ErrExpired, wantStatus: http.StatusGone},
+		{name: "get link store error", operation: "GET /api/v1/links/{code}", method: http.MethodGet, target: "/api/v1/links/abc", storeErr: errors.New("boom"), wantStatus: http.StatusInternalServerError},
+		{name: "get link store unavailable", operation: "GET /api/v1/links/{code}", method: http.MethodGet, target: "/api/v1/links/abc", storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "get link store timeout", operation: "GET /api/v1/links/{code}", method: http.MethodGet, target: "/api/v1/links/abc", storeErr: errBlock, wantStatus: http.StatusGatewayTimeout},
+
+		{name: "get long url", operation: "GET /{code}", method: http.MethodGet, target: "/abc", wantStatus: http.StatusFound},
+		{name: "get long url on a domain", operation: "GET /{code}", method: http.MethodGet, target: "/abc", host: "go.brand-a.com", wantStatus: http.StatusFound},
+		{name: "get long url on an unknown host served as the default domain", operation: "GET /{code}", method: http.MethodGet, target: "/abc", host: "lnk.brand-b.io", wantStatus: http.StatusFound},
+		{name: "get long url on an unknown host redirected to the fallback", operation: "GET /{code}", method: http.MethodGet, target: "/abc", host: "lnk.brand-b.io", fallback: "https://www.brand-b.io", wantStatus: http.StatusFound},
+		{name: "get long url on an unknown host not found", operation: "GET /{code}", method: http.MethodGet, target: "/abc", host: "lnk.brand-b.io", fallback: api.UnknownHostNotFound, wantStatus: http.StatusNotFound},
+		{name: "get long url on a domain store unavailable", operation: "GET /{code}", method: http.MethodGet, target: "/abc", host: "go.brand-a.com", storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "get long url not found", operation: "GET /{code}", method: http.MethodGet, target: "/missing", wantStatus: http.StatusNotFound},
+		{name: "get long url not found from a browser", operation: "GET /{code}", method: http.MethodGet, target: "/missing", accept: "text/html,application/xhtml+xml", wantStatus: http.StatusNotFound},
+		{name: "get long url expired", operation: "GET /{code}", method: http.MethodGet, target: "/abc", storeErr: storage.ErrExpired, wantStatus: http.StatusGone},
+		{name: "get long url store error", operation: "GET /{code}", method: http.MethodGet, target: "/abc", storeErr: errors.New("boom"), wantStatus: http.StatusInternalServerError},
+		{name: "get long url store unavailable", operation: "GET /{code}", method: http.MethodGet, target: "/abc", storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "get long url store timeout", operation: "GET /{code}", method: http.MethodGet, target: "/abc", storeErr: errBlock, wantStatus: http.StatusGatewayTimeout},
+
+		{name: "delete short url", operation: "DELETE /api/v1/links/{code}", method: http.MethodDelete, target: "/api/v1/links/abc", wantStatus: http.StatusOK},
+		{name: "delete short url not found", operation: "DELETE /api/v1/links/{code}", method: http.MethodDelete, target: "/api/v1/links/missing", wantStatus: http.StatusNotFound},
+		{name: "delete short url store error", operation: "DELETE /api/v1/links/{code}", method: http.MethodDelete, target: "/api/v1/links/abc", storeErr: errors.New("boom"), wantStatus: http.StatusInternalServerError},
+		{name: "delete short url store unavailable", operation: "DELETE /api/v1/links/{code}", method: http.MethodDelete, target: "/api/v1/links/abc", storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "delete short url store timeout", operation: "DELETE /api/v1/links/{code}", method: http.MethodDelete, target: "/api/v1/links/abc", storeErr: errBlock, wantStatus: http.StatusGatewayTimeout},
+
+		{name: "delete short url on a domain", operation: "DELETE /api/v1/links/{code}", method: http.MethodDelete, target: "/api/v1/links/abc?domain=go.brand-a.com", wantStatus: http.StatusOK},
+
+		{name: "get click stats", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats", wantStatus: http.StatusOK},
+		{name: "get daily click stats", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats?granularity=day&from=2024-01-01&to=2024-01-31T12:00:00Z", wantStatus: http.StatusOK},
+		{name: "get click stats on a domain", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats?domain=go.brand-a.com", wantStatus: http.StatusOK},
+		{name: "get click stats by minute", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats?granularity=minute", wantStatus: http.StatusBadRequest},
+		{name: "get click stats from an invalid time", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats?from=yesterday", wantStatus: http.StatusBadRequest},
+		{name: "get click stats from after to", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats?from=2024-02-01&to=2024-01-01", wantStatus: http.StatusBadRequest},
+		{name: "get click stats not found", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/missing/stats", wantStatus: http.StatusNotFound},
+		{name: "get click stats store error", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats", storeErr: errors.New("boom"), wantStatus: http.StatusInternalServerError},
+		{name: "get click stats store unavailable", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats", storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "get click stats store timeout", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats", storeErr: errBlock, wantStatus: http.StatusGatewayTimeout},
+		{name: "get click stats without a click store", operation: "GET /api/v1/links/{code}/stats", method: http.MethodGet, target: "/api/v1/links/abc/stats", withoutStores: true, wantStatus: http.StatusNotImplemented},
+
+		{name: "register domain", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{"domain":"lnk.brand-b.io"}`, wantStatus: http.StatusOK},
+		{name: "register domain with a body too large", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{"domain":"` + strings.Repeat("a", 5<<20) + `"}`, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "register domain with a port", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{"domain":"lnk.brand-b.io:8080"}`, wantStatus: http.StatusBadRequest},
+		{name: "register the default domain", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{"domain":"sho.rt"}`, wantStatus: http.StatusBadRequest},
+		{name: "register domain without domain", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "register domain store error", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{"domain":"lnk.brand-b.io"}`, storeErr: errors.New("boom"), wantStatus: http.StatusInternalServerError},
+		{name: "register domain store unavailable", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{"domain":"lnk.brand-b.io"}`, storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "register domain store timeout", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{"domain":"lnk.brand-b.io"}`, storeErr: errBlock, wantStatus: http.StatusGatewayTimeout},
+		{name: "register domain without a domain store", operation: "POST /api/v1/domains", method: http.MethodPost, target: "/api/v1/domains", body: `{"domain":"lnk.brand-b.io"}`, withoutStores: true, wantStatus: http.StatusNotImplemented},
+
+		{name: "list domains", operation: "GET /api/v1/domains", method: http.MethodGet, target: "/api/v1/domains", wantStatus: http.StatusOK},
+		{name: "list domains store error", operation: "GET /api/v1/domains", method: http.MethodGet, target: "/api/v1/domains", storeErr: errors.New("boom"), wantStatus: http.StatusInternalServerError},
+		{name: "list domains store unavailable", operation: "GET /api/v1/domains", method: http.MethodGet, target: "/api/v1/domains", storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "list domains store timeout", operation: "GET /api/v1/domains", method: http.MethodGet, target: "/api/v1/domains", storeErr: errBlock, wantStatus: http.StatusGatewayTimeout},
+		{name: "list domains without a domain store", operation: "GET /api/v1/domains", method: http.MethodGet, target: "/api/v1/domains", withoutStores: true, wantStatus: http.StatusNotImplemented},
+
+		{name: "delete domain", operation: "DELETE /api/v1/domains/{domain}", method: http.MethodDelete, target: "/api/v1/domains/go.brand-a.com", wantStatus: http.StatusOK},
+		{name: "delete domain not registered", operation: "DELETE /api/v1/domains/{domain}", method: http.MethodDelete, target: "/api/v1/domains/lnk.brand-b.io", wantStatus: http.StatusNotFound},
+		{name: "delete domain store error", operation: "DELETE /api/v1/domains/{domain}", method: http.MethodDelete, target: "/api/v1/domains/go.brand-a.com", storeErr: errors.New("boom"), wantStatus: http.StatusInternalServerError},
+		{name: "delete domain store unavailable", operation: "DELETE /api/v1/domains/{domain}", method: http.MethodDelete, target: "/api/v1/domains/go.brand-a.com", storeErr: storage.ErrUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "delete domain store timeout", operation: "DELETE /api/v1/domains/{domain}", method: http.MethodDelete, target: "/api/v1/domains/go.brand-a.com", storeErr: errBlock, wantStatus: http.StatusGatewayTimeout},
+		{name: "delete domain without a domain store", operation: "DELETE /api/v1/domains/{domain}", method: http.MethodDelete, target: "/api/v1/domains/go.brand-a.com", withoutStores: true, wantStatus: http.StatusNotImplemented},
+	}
+
+	covered := map[string]bool{}
+	run := func(name string, operation string, target string, tt contractTest) {
+		t.Run(name, func(t *testing.T) {
+			urlHandler := newContractUrlHandler(t, tt.storeErr, logger)
+			if tt.fallback != "" {
+				urlHandler.UnknownHostFallback = tt.fallback
+			}
+			if tt.withoutStores {
+				urlHandler.ClickStore = nil
+				urlHandler.Domains = nil
+			}
+			router := newRouter(&urlHandler, specValidator)
+
+			r := httptest.NewRequest(tt.method, target, strings.NewReader(tt.body))
+			if tt.host != "" {
+				r.Host = tt.host
+			}
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, r)
+
+			assert.Equal(t, tt.wantStatus, rr.Code, rr.Body.String())
+			assert.Nil(t, specValidator.CheckResponse(r, rr.Code, rr.Header(), rr.Body.Bytes()))
+			covered[operation+" "+strconv.Itoa(rr.Code)] = true
+		})
+	}
+	for _, tt := range tests {
+		run(tt.name, tt.operation, tt.target, tt)
+		// the legacy routes have to behave as the ones they are aliases of
+		if alias, ok := legacyAliases[tt.operation]; ok {
+			run(tt.name+" through the legacy route", alias, legacyTarget(tt.target), tt)
+		}
+	}
+
+	for _, documented := range documentedResponses(t, specValidator) {
+		assert.True(t, covered[documented], "no test reaches %s", documented)
+	}
+}
+
+// documentedResponses returns the method, path and status of every response in the spec served by
+// the router
+func documentedResponses(t *testing.T, specValidator *api.SpecValidator) []string {
+	rr := httptest.NewRecorder()
+	newRouter(nil, specValidator).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Responses map[string]any `json:"responses"`
+		} `json:"paths"`
+	}
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&spec))
+	var documented []string
+	for path, operations := range spec.Paths {
+		for method, operation := range operations {
+			for status := range operation.Responses {
+				documented = append(documented, strings.ToUpper(method)+" "+path+" "+status)
+			}
+		}
+	}
+	assert.NotEmpty(t, documented)
+	return documented
+}
+
+// newContractUrlHandler returns a handler storing urls synchronously in memory, where the short url
+// abc exists on the default domain and on the registered domain go.brand-a.com, which takes batches
+// of 3 urls at most, and whose stores all fail with storeErr when set
+func newContractUrlHandler(t *testing.T, storeErr error, logger *slog.Logger) api.UrlHandler {
+	tokenGen, err := token.NewSnowflakeTokenGenerator(defaultEpoch, logger)
+	assert.Nil(t, err)
+	urls := map[string]string{"abc": "http://mercadolibre.com.ar", "go.brand-a.com/abc": "http://mercadolibre.com.ar"}
+	registered := map[string]bool{"go.brand-a.com": true}
+	fail := func(ctx context.Context) error {
+		if storeErr == errBlock {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return storeErr
+	}
+	urlStore := &storage.FakeUrlStore{
+		FetchFn: func(ctx context.Context, key string) (string, error) {
+			if err := fail(ctx); err != nil {
+				return "", err
+			}
+			url, ok := urls[key]
+			if !ok {
+				return "", storage.ErrNotFound
+			}
+			return url, nil
+		},
+		RemoveFn: func(ctx context.Context, key string) error {
+			if err := fail(ctx); err != nil {
+				return err
+			}
+			if _, ok := urls[key]; !ok {
+				return storage.ErrNotFound
+			}
+			delete(urls, key)
+			return nil
+		},
+	}
+	outbox := &storage.FakeOutbox{
+		StoreWithOutboxFn: func(ctx context.Context, key string, link storage.Link, entry storage.OutboxEntry) error {
+			if err := fail(ctx); err != nil {
+				return err
+			}
+			if existing, ok := urls[key]; ok && existing != link.LongUrl {
+				return storage.ErrConflict
+			}
+			urls[key] = link.LongUrl
+			return nil
+		},
+		StoreBatchWithOutboxFn: func(ctx context.Context, links map[string]storage.Link, entries map[string]storage.OutboxEntry) error {
+			if err := fail(ctx); err != nil {
+				return err
+			}
+			var taken []string
+			for key, link := range links {
+				if existing, ok := urls[key]; ok && existing != link.LongUrl {
+					taken = append(taken, key)
+					continue
+				}
+				urls[key] = link.LongUrl
+			}
+			if len(taken) > 0 {
+				return &storage.ConflictError{Keys: taken}
+			}
+			return nil
+		},
+	}
+	clickStore := &storage.FakeClickStore{
+		ClickStatsFn: func(ctx context.Context, shortUrl string, from time.Time, to time.Time, granularity string, top int) (storage.ClickStats, error) {
+			return storage.ClickStats{
+				Total:          3,
+				Bots:           1,
+				Series:         []storage.ClickBucket{{Time: from, Clicks: 3}},
+				UniqueVisitors: 2,
+				DailyVisitors:  []storage.ClickBucket{{Time: from, Clicks: 2}},
+				TopReferrers:   []storage.ClickCount{{Value: "google.com", Clicks: 2}},
+				TopBrowsers:    []storage.ClickCount{{Value: "Firefox", Clicks: 3}},
+				TopCountries:   []storage.ClickCount{{Value: "AR", Clicks: 3}},
+			}, nil
+		},
+	}
+	domains := &storage.FakeDomainStore{
+		RegisterFn: func(ctx context.Context, domain string) error {
+			if err := fail(ctx); err != nil {
+				return err
+			}
+			registered[domain] = true
+			return nil
+		},
+		IsRegisteredFn: func(ctx context.Context, domain string) (bool, error) {
+			if err := fail(ctx); err != nil {
+				return false, err
+			}
+			return registered[domain], nil
+		},
+		DomainsFn: func(ctx context.Context) ([]string, error) {
+			if err := fail(ctx); err != nil {
+				return nil, err
+			}
+			var domains []string
+			for domain := range registered {
+				domains = append(domains, domain)
+			}
+			return domains, nil
+		},
+		RemoveFn: func(ctx context.Context, domain string) error {
+			if err := fail(ctx); err != nil {
+				return err
+			}
+			if !registered[domain] {
+				return storage.ErrNotFound
+			}
+			delete(registered, domain)
+			return nil
+		},
+	}
+	return api.NewUrlHandler(api.UrlHandlerConfigs{
+		TokenGen:            tokenGen,
+		TokenHasher:         hash.NewUrlTokenHash(logger),
+		UrlStore:            urlStore,
+		EventContentType:    event.ContentTypeJSON,
+		Outbox:              outbox,
+		ClickStore:          clickStore,
+		PublicBaseUrl:       "https://sho.rt",
+		Domains:             domains,
+		UnknownHostFallback: api.UnknownHostDefault,
+		MaxBatchItems:       3,
+		StoreTimeout:        50 * time.Millisecond,
+	}, nil, logger)
+}
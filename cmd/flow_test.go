@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"urlshortn/pkg/api"
+	"urlshortn/pkg/event"
+	"urlshortn/pkg/hash"
+	"urlshortn/pkg/storage"
+	"urlshortn/pkg/token"
+)
+
+func TestShortenConsumeStoreFlow(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	urlStore := newMapStore()
+	bus, err := event.NewBus(event.BusConfigs{
+		Transport: event.TransportMemory,
+		Memory:    event.MemoryConfigs{Topic: "shortn", BufferSize: 10},
+	}, nil, logger)
+	assert.Nil(t, err)
+	subscription, err := bus.Subscribe()
+	assert.Nil(t, err)
+	consumer := event.NewShortUrlConsumer(subscription, urlStore, event.ConsumerConfigs{
+		Retry:        event.RetryPolicy{MaxAttempts: 1},
+		BatchSize:    10,
+		BatchTimeout: 10 * time.Millisecond,
+	}, nil, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	consumerDone := make(chan struct{})
+	go func() {
+		consumer.Start(ctx)
+		close(consumerDone)
+	}()
+	defer func() {
+		cancel()
+		<-consumerDone
+	}()
+
+	tokenGen, err := token.NewSnowflakeTokenGenerator(defaultEpoch, logger)
+	assert.Nil(t, err)
+	urlHandler := api.NewUrlHandler(api.UrlHandlerConfigs{
+		TokenGen:              tokenGen,
+		TokenHasher:           hash.NewUrlTokenHash(logger),
+		UrlStore:              urlStore,
+		ShortUrlEventProducer: bus,
+		EventContentType:      event.ContentTypeProtobuf,
+		PublicBaseUrl:         "https://sho.rt",
+		UnknownHostFallback:   api.UnknownHostDefault,
+		MaxBatchItems:         1000,
+	}, nil, logger)
+	specValidator, err := api.NewSpecValidator(true, nil, logger)
+	assert.Nil(t, err)
+	router := newRouter(&urlHandler, specValidator)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/links", bytes.NewReader([]byte("{\"url\":\"http://mercadolibre.com.ar\"}"))))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response api.ShortenUrlResponse
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "https://sho.rt/"+response.Code, response.ShortUrl)
+
+	// the short url becomes available once the consumer stored it
+	assert.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+response.Code, nil))
+		return rr.Code == http.StatusFound && rr.Header().Get("Location") == "http://mercadolibre.com.ar"
+	}, time.Second, 10*time.Millisecond)
+}
+
+// newMapStore returns a storage.Store kept in memory
+func newMapStore() *storage.FakeUrlStore {
+	var mu sync.Mutex
+	urls := map[string]string{}
+	return &storage.FakeUrlStore{
+		FetchFn: func(ctx context.Context, key string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			url, ok := urls[key]
+			if !ok {
+				return "", storage.ErrNotFound
+			}
+			return url, nil
+		},
+		StoreFn: func(ctx context.Context, key string, link storage.Link) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if existing, ok := urls[key]; ok && existing != link.LongUrl {
+				return storage.ErrConflict
+			}
+			urls[key] = link.LongUrl
+			return nil
+		},
+		StoreBatchFn: func(ctx context.Context, entries map[string]storage.Link) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for key, link := range entries {
+				urls[key] = link.LongUrl
+			}
+			return nil
+		},
+		RemoveFn: func(ctx context.Context, key string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := urls[key]; !ok {
+				return storage.ErrNotFound
+			}
+			delete(urls, key)
+			return nil
+		},
+	}
+}
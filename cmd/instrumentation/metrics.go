@@ -1,42 +1,51 @@
 package instrumentation
 
 import (
-	"context"
-	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"strconv"
 	"time"
 	"urlshortn/pkg/metrics"
 )
 
-const (
-	shortenUrlStartName          = "shorten_started"
-	shortenEndpointName          = "shorten"
-	getLongUrlStartName          = "get_long_url_started"
-	getLongUrlEndpointName       = "get_long_url"
-	deleteShortenUrlStartName    = "delete_shorten_url"
-	deleteShortenUrlEndpointName = "delete_shorten"
-)
-
 type Metrics struct {
-	totalRequests    *prometheus.CounterVec
-	totalErrors      *prometheus.CounterVec
-	requestsDuration *prometheus.HistogramVec
+	totalRequests      *prometheus.CounterVec
+	totalErrors        *prometheus.CounterVec
+	requestsDuration   *prometheus.HistogramVec
+	responseSize       *prometheus.HistogramVec
+	requestsInFlight   prometheus.Gauge
+	batchSize          prometheus.Histogram
+	batchFlushDuration *prometheus.HistogramVec
+	eventsProduced     *prometheus.CounterVec
+	deliveryDuration   *prometheus.HistogramVec
+	eventsConsumed     *prometheus.CounterVec
+	eventFailures      *prometheus.CounterVec
+	consumerLag        *prometheus.GaugeVec
+	outboxDepth        prometheus.Gauge
+	clicks             *prometheus.CounterVec
+	clicksDropped      *prometheus.CounterVec
+	topLinkVisitors    *prometheus.GaugeVec
+	endToEndDuration   prometheus.Histogram
+	topLinks           *TopK
+	logger             *slog.Logger
 }
 
-func NewMetrics() *Metrics {
+// NewMetrics registers the metrics. When topLinks is above 0, the redirects of that many of the most
+// redirected links are tracked in memory and exported in top_link_redirects.
+func NewMetrics(topLinks int, logger *slog.Logger) *Metrics {
 	totalRequests := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
 			Help: "Total number of HTTP requests",
 		},
-		[]string{"method", "endpoint", "url"},
+		[]string{"method", "endpoint", "code_class"},
 	)
 	totalErrors := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "http_requests_errors",
-			Help: "Total number of errors",
+			Name: "http_request_errors_total",
+			Help: "Total number of failed HTTP requests, by the reason they failed",
 		},
-		[]string{"method", "endpoint", "url"},
+		[]string{"kind"},
 	)
 	requestsDuration := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -46,61 +55,208 @@ func NewMetrics() *Metrics {
 		},
 		[]string{"method", "endpoint"},
 	)
+	responseSize := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Histogram of response body size in bytes",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		},
+		[]string{"method", "endpoint"},
+	)
+	requestsInFlight := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests being served",
+		},
+	)
+
+	batchSize := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "consumer_batch_size",
+			Help:    "Histogram of the number of events written per consumer batch",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		},
+	)
+	batchFlushDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "consumer_batch_flush_duration_seconds",
+			Help:    "Histogram of the time taken to write a consumer batch in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"result"},
+	)
+	eventsProduced := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "events_produced_total",
+			Help: "Total number of events produced, by delivery result",
+		},
+		[]string{"topic", "result"},
+	)
+	deliveryDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "event_delivery_duration_seconds",
+			Help:    "Histogram of the time between producing an event and the broker acknowledging it in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"topic"},
+	)
+	eventsConsumed := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "events_consumed_total",
+			Help: "Total number of events consumed",
+		},
+		[]string{"topic"},
+	)
+	eventFailures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "event_processing_failures_total",
+			Help: "Total number of failures processing consumed events, by reason",
+		},
+		[]string{"reason"},
+	)
+	consumerLag := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "consumer_lag",
+			Help: "Number of events in a partition not processed by the consumer yet",
+		},
+		[]string{"topic", "partition"},
+	)
+	outboxDepth := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "outbox_depth",
+			Help: "Number of outbox entries not published yet",
+		},
+	)
+	clicks := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clicks_total",
+			Help: "Total number of redirects recorded as clicks, by whether a bot made them",
+		},
+		[]string{"is_bot"},
+	)
+	clicksDropped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "click_events_dropped_total",
+			Help: "Number of clicks dropped because a click buffer was full, by buffer",
+		},
+		[]string{"buffer"},
+	)
+	topLinkVisitors := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "top_link_unique_visitors",
+			Help: "Estimated unique visitors today of the most clicked links today",
+		},
+		[]string{"short_url"},
+	)
+	endToEndDuration := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "event_end_to_end_duration_seconds",
+			Help:    "Histogram of the time between a shorten request and its short url being stored in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		},
+	)
 
 	prometheus.MustRegister(totalRequests)
 	prometheus.MustRegister(totalErrors)
 	prometheus.MustRegister(requestsDuration)
+	prometheus.MustRegister(responseSize)
+	prometheus.MustRegister(requestsInFlight)
+	prometheus.MustRegister(batchSize)
+	prometheus.MustRegister(batchFlushDuration)
+	prometheus.MustRegister(eventsProduced)
+	prometheus.MustRegister(deliveryDuration)
+	prometheus.MustRegister(eventsConsumed)
+	prometheus.MustRegister(eventFailures)
+	prometheus.MustRegister(consumerLag)
+	prometheus.MustRegister(outboxDepth)
+	prometheus.MustRegister(clicks)
+	prometheus.MustRegister(clicksDropped)
+	prometheus.MustRegister(topLinkVisitors)
+	prometheus.MustRegister(endToEndDuration)
+
+	var topLinkRedirects *TopK
+	if topLinks > 0 {
+		topLinkRedirects = NewTopK(topLinks, "top_link_redirects", "Approximate number of redirects of the most redirected links since the start of this instance")
+		prometheus.MustRegister(topLinkRedirects)
+	}
 
 	return &Metrics{
-		totalRequests:    totalRequests,
-		totalErrors:      totalErrors,
-		requestsDuration: requestsDuration,
+		totalRequests:      totalRequests,
+		totalErrors:        totalErrors,
+		requestsDuration:   requestsDuration,
+		responseSize:       responseSize,
+		requestsInFlight:   requestsInFlight,
+		batchSize:          batchSize,
+		batchFlushDuration: batchFlushDuration,
+		eventsProduced:     eventsProduced,
+		deliveryDuration:   deliveryDuration,
+		eventsConsumed:     eventsConsumed,
+		eventFailures:      eventFailures,
+		consumerLag:        consumerLag,
+		outboxDepth:        outboxDepth,
+		clicks:             clicks,
+		clicksDropped:      clicksDropped,
+		topLinkVisitors:    topLinkVisitors,
+		endToEndDuration:   endToEndDuration,
+		topLinks:           topLinkRedirects,
+		logger:             logger,
 	}
 }
 
 func (m *Metrics) GetHooks() *metrics.MetricsHooks {
 	return &metrics.MetricsHooks{
-		OnShortenUrlCalledFn: func(ctx context.Context, longUrl string) context.Context {
-			return context.WithValue(ctx, shortenUrlStartName, time.Now())
-		},
-		OnShortenUrlFinishedFn: func(ctx context.Context, longUrl string, err error) {
-			fmt.Println(fmt.Printf("OnShortenUrlFinishedFn with context %v", ctx))
-			if startedAt, ok := ctx.Value(shortenUrlStartName).(time.Time); ok {
-				fmt.Printf("Roundtrip for %s time is %v\n", shortenEndpointName, time.Since(startedAt).Seconds())
-				m.requestsDuration.WithLabelValues("POST", shortenEndpointName).Observe(time.Since(startedAt).Seconds())
-			}
+		OnRequestFailedFn: func(errorKind string) {
+			m.totalErrors.WithLabelValues(errorKind).Inc()
+		},
+		OnBatchFlushedFn: func(size int, duration time.Duration, err error) {
+			result := "ok"
 			if err != nil {
-				m.totalErrors.WithLabelValues("POST", shortenEndpointName, longUrl).Inc()
+				result = "error"
 			}
-			m.totalRequests.WithLabelValues("POST", shortenEndpointName, longUrl).Inc()
-		},
-		OnGetLongUrlCalledFn: func(ctx context.Context, shortenUrl string) context.Context {
-			return context.WithValue(ctx, getLongUrlStartName, time.Now())
+			m.batchSize.Observe(float64(size))
+			m.batchFlushDuration.WithLabelValues(result).Observe(duration.Seconds())
 		},
-		OnGetLongUrlFinishedFn: func(ctx context.Context, shortenUrl string, err error) {
-			fmt.Println(fmt.Printf("OnGetLongUrlFinishedFn with context %v", ctx))
-			if startedAt, ok := ctx.Value(getLongUrlStartName).(time.Time); ok {
-				fmt.Printf("Roundtrip for %s time is %v\n", getLongUrlEndpointName, time.Since(startedAt).Seconds())
-				m.requestsDuration.WithLabelValues("GET", getLongUrlEndpointName).Observe(time.Since(startedAt).Seconds())
-			}
+		OnEventDeliveredFn: func(topic string, latency time.Duration, err error) {
 			if err != nil {
-				m.totalErrors.WithLabelValues("GET", getLongUrlEndpointName, shortenUrl).Inc()
+				m.eventsProduced.WithLabelValues(topic, "error").Inc()
+				return
 			}
-			m.totalRequests.WithLabelValues("GET", getLongUrlEndpointName, shortenUrl).Inc()
+			m.eventsProduced.WithLabelValues(topic, "ok").Inc()
+			m.deliveryDuration.WithLabelValues(topic).Observe(latency.Seconds())
 		},
-		OnDeleteShortenUrlCalledFn: func(ctx context.Context, shortenUrl string) context.Context {
-			return context.WithValue(ctx, deleteShortenUrlStartName, time.Now())
+		OnEventConsumedFn: func(topic string) {
+			m.eventsConsumed.WithLabelValues(topic).Inc()
 		},
-		OnDeleteShortenUrlFinishedFn: func(ctx context.Context, shortenUrl string, err error) {
-			fmt.Println(fmt.Printf("OnDeleteShortenUrlFinishedFn with context %v", ctx))
-			if startedAt, ok := ctx.Value(deleteShortenUrlStartName).(time.Time); ok {
-				fmt.Printf("Roundtrip for %s time is %v\n", deleteShortenUrlEndpointName, time.Since(startedAt).Seconds())
-				m.requestsDuration.WithLabelValues("DELETE", deleteShortenUrlEndpointName).Observe(time.Since(startedAt).Seconds())
-			}
-			if err != nil {
-				m.totalErrors.WithLabelValues("DELETE", deleteShortenUrlEndpointName, shortenUrl).Inc()
+		OnEventFailedFn: func(reason string, err error) {
+			m.eventFailures.WithLabelValues(reason).Inc()
+		},
+		OnEventStoredFn: func(createdAt time.Time) {
+			m.endToEndDuration.Observe(time.Since(createdAt).Seconds())
+		},
+		OnConsumerLagFn: func(topic string, partition int32, lag int64) {
+			m.consumerLag.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(lag))
+		},
+		OnOutboxDepthFn: func(depth int64) {
+			m.outboxDepth.Set(float64(depth))
+		},
+		OnClickRecordedFn: func(shortUrl string, isBot bool) {
+			m.clicks.WithLabelValues(strconv.FormatBool(isBot)).Inc()
+			m.topLinks.Add(shortUrl)
+		},
+		OnClickDroppedFn: func(buffer string) {
+			m.clicksDropped.WithLabelValues(buffer).Inc()
+		},
+		OnTopLinkVisitorsFn: func(visitors map[string]int64) {
+			// links that left the top ones are removed, so the number of series stays bounded
+			m.topLinkVisitors.Reset()
+			for shortUrl, count := range visitors {
+				m.topLinkVisitors.WithLabelValues(shortUrl).Set(float64(count))
 			}
-			m.totalRequests.WithLabelValues("DELETE", deleteShortenUrlEndpointName, shortenUrl).Inc()
 		},
 	}
 }
+
+// statusClass groups status codes by their first digit, e.g. 404 is 4xx.
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
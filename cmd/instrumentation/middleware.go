@@ -0,0 +1,79 @@
+package instrumentation
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// unmatchedEndpoint labels the requests that no route of the router matched
+const unmatchedEndpoint = "unmatched"
+
+// Middleware records the status, latency and response size of every request served by next, along
+// with the number of requests in flight. next is expected to be an http.ServeMux, whose matched
+// pattern is used as the endpoint label so the number of series stays bounded.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.requestsInFlight.Inc()
+		defer m.requestsInFlight.Dec()
+		startedAt := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		duration := time.Since(startedAt)
+
+		endpoint := endpointOf(r)
+		status := recorder.Status()
+		m.logger.Debug("Request finished", "method", r.Method, "endpoint", endpoint, "status", status, "duration", duration)
+		m.totalRequests.WithLabelValues(r.Method, endpoint, statusClass(status)).Inc()
+		m.requestsDuration.WithLabelValues(r.Method, endpoint).Observe(duration.Seconds())
+		m.responseSize.WithLabelValues(r.Method, endpoint).Observe(float64(recorder.size))
+	})
+}
+
+// endpointOf returns the path of the pattern the ServeMux matched for r, e.g. /shortn/{code}/stats.
+func endpointOf(r *http.Request) string {
+	if r.Pattern == "" {
+		return unmatchedEndpoint
+	}
+	// patterns may start with a method, which is already a label of its own
+	if _, path, found := strings.Cut(r.Pattern, " "); found {
+		return path
+	}
+	return r.Pattern
+}
+
+// responseRecorder keeps the status and the number of bytes written to a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Status returns the status sent to the client, which is 200 when the handler wrote nothing.
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
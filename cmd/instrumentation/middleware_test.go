@@ -0,0 +1,83 @@
+package instrumentation
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMetrics_Middleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	m := &Metrics{
+		totalRequests:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests"}, []string{"method", "endpoint", "code_class"}),
+		requestsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_duration"}, []string{"method", "endpoint"}),
+		responseSize:     prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_size", Buckets: []float64{1, 10}}, []string{"method", "endpoint"}),
+		requestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_in_flight"}),
+		logger:           logger,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shortn/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.requestsInFlight), "the request should be in flight")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("bad"))
+	})
+	mux.HandleFunc("GET /shortn/{code}/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	handler := m.Middleware(mux)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		endpoint  string
+		codeClass string
+		size      float64
+	}{
+		{
+			name:      "when a handler writes a status, its class is recorded",
+			method:    http.MethodDelete,
+			path:      "/shortn/abc",
+			endpoint:  "/shortn/",
+			codeClass: "4xx",
+			size:      3,
+		},
+		{
+			name:      "when a handler only writes a body, the status is 200 and the method is dropped from the pattern",
+			method:    http.MethodGet,
+			path:      "/shortn/abc/stats",
+			endpoint:  "/shortn/{code}/stats",
+			codeClass: "2xx",
+			size:      2,
+		},
+		{
+			name:      "when no route matches, the endpoint is unmatched",
+			method:    http.MethodGet,
+			path:      "/unknown/abc",
+			endpoint:  unmatchedEndpoint,
+			codeClass: "4xx",
+			size:      float64(len("404 page not found\n")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+
+			assert.Equal(t, float64(1), testutil.ToFloat64(m.totalRequests.WithLabelValues(tt.method, tt.endpoint, tt.codeClass)))
+			assert.Equal(t, float64(0), testutil.ToFloat64(m.requestsInFlight))
+			size := m.responseSize.WithLabelValues(tt.method, tt.endpoint).(prometheus.Histogram)
+			var sizeMetric dto.Metric
+			assert.Nil(t, size.Write(&sizeMetric))
+			assert.Equal(t, uint64(1), sizeMetric.GetHistogram().GetSampleCount())
+			assert.Equal(t, tt.size, sizeMetric.GetHistogram().GetSampleSum())
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package instrumentation
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+// TopK approximates the most frequent links with the Space-Saving algorithm: it keeps counts for at
+// most k links, and a link not tracked yet replaces the least counted one, inheriting its count. The
+// count of a link is an upper bound, over by at most the count it inherited.
+type TopK struct {
+	k    int
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// NewTopK returns a collector exporting the counts as name{short_url}, so the metric never has more
+// than k series.
+func NewTopK(k int, name string, help string) *TopK {
+	return &TopK{
+		k:      k,
+		desc:   prometheus.NewDesc(name, help, []string{"short_url"}, nil),
+		counts: make(map[string]uint64, k),
+	}
+}
+
+// Add counts one more occurrence of shortUrl. A nil *TopK counts nothing.
+func (t *TopK) Add(shortUrl string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.counts[shortUrl]; ok || len(t.counts) < t.k {
+		t.counts[shortUrl]++
+		return
+	}
+	var minUrl string
+	var minCount uint64
+	for url, count := range t.counts {
+		if minUrl == "" || count < minCount {
+			minUrl, minCount = url, count
+		}
+	}
+	delete(t.counts, minUrl)
+	t.counts[shortUrl] = minCount + 1
+}
+
+// Top returns a copy of the tracked counts.
+func (t *TopK) Top() map[string]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	top := make(map[string]uint64, len(t.counts))
+	for url, count := range t.counts {
+		top[url] = count
+	}
+	return top
+}
+
+func (t *TopK) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.desc
+}
+
+func (t *TopK) Collect(ch chan<- prometheus.Metric) {
+	for url, count := range t.Top() {
+		ch <- prometheus.MustNewConstMetric(t.desc, prometheus.GaugeValue, float64(count), url)
+	}
+}
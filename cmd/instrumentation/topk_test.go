@@ -0,0 +1,32 @@
+package instrumentation
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTopK_Add(t *testing.T) {
+	top := NewTopK(2, "test_top_links", "test")
+	for _, url := range []string{"a", "a", "a", "b", "c", "a", "c"} {
+		top.Add(url)
+	}
+	// c replaced b, inheriting its count of 1
+	assert.Equal(t, map[string]uint64{"a": 4, "c": 3}, top.Top())
+
+	var nilTop *TopK
+	nilTop.Add("a")
+}
+
+func TestTopK_Collect(t *testing.T) {
+	top := NewTopK(3, "test_top_links", "test")
+	for i := 0; i < 100; i++ {
+		top.Add(string(rune('a' + i%10)))
+	}
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(top))
+	count, err := testutil.GatherAndCount(registry, "test_top_links")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count, "the metric should not have more series than tracked links")
+}
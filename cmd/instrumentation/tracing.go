@@ -0,0 +1,60 @@
+package instrumentation
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"os"
+)
+
+// values of OTEL_TRACES_EXPORTER
+const (
+	TracesExporterNone    = "none"
+	TracesExporterOtlp    = "otlp"
+	TracesExporterConsole = "console"
+)
+
+// SetupTracing installs the global tracer provider exporting spans with exporter, and the W3C trace
+// context propagator used to carry traces through http and event headers. The OTLP exporter is
+// configured with the standard OTEL_EXPORTER_OTLP_* variables. The returned function flushes the
+// pending spans and stops the provider.
+func SetupTracing(ctx context.Context, exporter string, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case TracesExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case TracesExporterOtlp:
+		spanExporter, err = otlptracehttp.New(ctx)
+	case TracesExporterConsole:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the attributes set in OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 	"urlshortn/cmd/instrumentation"
 	"urlshortn/pkg/api"
+	"urlshortn/pkg/bot"
 	"urlshortn/pkg/event"
 	"urlshortn/pkg/hash"
 	"urlshortn/pkg/storage"
@@ -18,6 +31,11 @@ import (
 const (
 	appName      = "shortn"
 	defaultEpoch = "2010-11-04T00:00:00Z" //this seems to be twitter's default epoch. Using the same
+
+	// writeModeAsync leaves storing urls to the event consumer, writeModeSync stores them in the
+	// request along with an outbox entry for the event
+	writeModeAsync = "async"
+	writeModeSync  = "sync"
 )
 
 func main() {
@@ -25,75 +43,381 @@ func main() {
 }
 
 func runApp(name string, args ...string) int {
+	if len(args) > 0 && args[0] == redriveCommand {
+		return runRedrive(name, args[1:]...)
+	}
+
 	port := getEnvVarOrDefault("PORT", "8080")
-	fmt.Println("Starting http server on port " + port)
+	shutdownTimeout := getEnvDurationOrDefault("SHUTDOWN_TIMEOUT", 15*time.Second)
+	publicBaseUrl := getEnvVarOrDefault("PUBLIC_BASE_URL", "http://localhost:"+port)
+	unknownHostFallback := getEnvVarOrDefault("UNKNOWN_HOST_FALLBACK", api.UnknownHostDefault)
+	batchMaxItems := getEnvIntOrDefault("BATCH_MAX_ITEMS", 1000)
 
 	redisAddr := getEnvVarOrDefault("REDIS_ADDR", "localhost:6379")
 	redisPassword := getEnvVarOrDefault("REDIS_PASSWORD", "")
+	storeTimeout := getEnvDurationOrDefault("STORE_TIMEOUT", 2*time.Second)
+	storageWriteMode := getEnvVarOrDefault("STORAGE_WRITE_MODE", writeModeAsync)
+	outboxRelayInterval := getEnvDurationOrDefault("OUTBOX_RELAY_INTERVAL", 100*time.Millisecond)
+	outboxBatchSize := getEnvIntOrDefault("OUTBOX_BATCH_SIZE", 100)
+	outboxMaxBackoff := getEnvDurationOrDefault("OUTBOX_MAX_BACKOFF", 5*time.Second)
+	outboxLeaseTTL := getEnvDurationOrDefault("OUTBOX_LEASE_TTL", 10*time.Second)
+
+	eventBusTransport := getEnvVarOrDefault("EVENT_BUS", event.TransportKafka)
+	memoryBusBufferSize := getEnvIntOrDefault("MEMORY_BUS_BUFFER_SIZE", 10000)
+	eventContentType := getEnvVarOrDefault("EVENT_CONTENT_TYPE", event.ContentTypeJSON)
+
+	hostname, _ := os.Hostname()
+	redisStream := getEnvVarOrDefault("REDIS_STREAM", "shortn")
+	redisStreamGroup := getEnvVarOrDefault("REDIS_STREAM_GROUP", "shortn")
+	redisStreamConsumer := getEnvVarOrDefault("REDIS_STREAM_CONSUMER", hostname)
+	redisStreamDeadLetter := getEnvVarOrDefault("REDIS_STREAM_DLQ", "shortn-dlq")
+	redisStreamMinIdle := getEnvDurationOrDefault("REDIS_STREAM_MIN_IDLE", time.Minute)
+	redisStreamMaxLen := getEnvIntOrDefault("REDIS_STREAM_MAXLEN", 1000000)
+
+	natsUrl := getEnvVarOrDefault("NATS_URL", "nats://localhost:4222")
+	natsStream := getEnvVarOrDefault("NATS_STREAM", "shortn")
+	natsSubject := getEnvVarOrDefault("NATS_SUBJECT", "shortn.urls")
+	natsDurable := getEnvVarOrDefault("NATS_DURABLE", "shortn")
+	natsDeadLetterSubject := getEnvVarOrDefault("NATS_DLQ_SUBJECT", "shortn.dlq")
+	natsMaxDeliver := getEnvIntOrDefault("NATS_MAX_DELIVER", 5)
+	natsAckWait := getEnvDurationOrDefault("NATS_ACK_WAIT", 30*time.Second)
 
 	kafkaBootstrapServers := getEnvVarOrDefault("KAFKA_BOOTSTRAP_SERVERS", "localhost:9092")
 	kafkaTopic := getEnvVarOrDefault("KAFKA_TOPIC", "shortn")
 	kafkaGroupId := getEnvVarOrDefault("KAFKA_GROUP_ID", "shortn")
 	kafkaOffset := getEnvVarOrDefault("KAFKA_OFFSET", "earliest")
+	kafkaDeadLetterTopic := getEnvVarOrDefault("KAFKA_DLQ_TOPIC", "shortn-dlq")
+	consumerMaxAttempts := getEnvIntOrDefault("KAFKA_MAX_ATTEMPTS", 5)
+	consumerInitialBackoff := getEnvDurationOrDefault("KAFKA_INITIAL_BACKOFF", 100*time.Millisecond)
+	consumerMaxBackoff := getEnvDurationOrDefault("KAFKA_MAX_BACKOFF", 5*time.Second)
+	consumerBatchSize := getEnvIntOrDefault("KAFKA_BATCH_SIZE", 100)
+	consumerBatchTimeout := getEnvDurationOrDefault("KAFKA_BATCH_TIMEOUT", 50*time.Millisecond)
+	kafkaCommitInterval := getEnvDurationOrDefault("KAFKA_COMMIT_INTERVAL", time.Second)
+	kafkaClicksTopic := getEnvVarOrDefault("KAFKA_CLICKS_TOPIC", "shortn-clicks")
+
+	metricsTopLinks := getEnvIntOrDefault("METRICS_TOP_LINKS", 0)
+	tracesExporter := getEnvVarOrDefault("OTEL_TRACES_EXPORTER", instrumentation.TracesExporterNone)
+
+	clickBufferSize := getEnvIntOrDefault("CLICK_BUFFER_SIZE", 10000)
+	clickIpSalt := getEnvVarOrDefault("CLICK_IP_HASH_SALT", "")
+	clickCountryHeader := getEnvVarOrDefault("CLICK_COUNTRY_HEADER", "CF-IPCountry")
+	clickTrustedProxies := getEnvVarOrDefault("CLICK_TRUSTED_PROXIES", "")
+	clickCounterBufferSize := getEnvIntOrDefault("CLICK_COUNTER_BUFFER_SIZE", 10000)
+	clickCounterBatchSize := getEnvIntOrDefault("CLICK_COUNTER_BATCH_SIZE", 500)
+	clickCounterFlushInterval := getEnvDurationOrDefault("CLICK_COUNTER_FLUSH_INTERVAL", time.Second)
+	clickTopLinks := getEnvIntOrDefault("CLICK_TOP_LINKS", 0)
+	clickTopLinksInterval := getEnvDurationOrDefault("CLICK_TOP_LINKS_INTERVAL", time.Minute)
+	clickExcludeBots := getEnvBoolOrDefault("CLICK_EXCLUDE_BOTS", false)
+	botPatternsFile := getEnvVarOrDefault("BOT_PATTERNS_FILE", "")
+	botPatternsReloadInterval := getEnvDurationOrDefault("BOT_PATTERNS_RELOAD_INTERVAL", time.Minute)
+	openApiValidateResponses := getEnvBoolOrDefault("OPENAPI_VALIDATE_RESPONSES", false)
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
 
-	metrics := instrumentation.NewMetrics()
+	shutdownTracing, err := instrumentation.SetupTracing(context.Background(), tracesExporter, appName)
+	if err != nil {
+		log.Fatal("Failed to set up tracing: ", err)
+		return 1
+	}
+
+	metrics := instrumentation.NewMetrics(metricsTopLinks, logger)
 	metricsHooks := metrics.GetHooks()
 
-	tokenGen := token.NewSnowflakeTokenGenerator(defaultEpoch, logger)
+	tokenGen, err := token.NewSnowflakeTokenGenerator(defaultEpoch, logger)
+	if err != nil {
+		log.Fatal("Failed to create the token generator: ", err)
+		return 1
+	}
 
 	urlTokenHasher := hash.NewUrlTokenHash(logger)
 
 	urlStore := storage.NewRedisStore(redisAddr, redisPassword, logger)
 
-	kafkaConfigs := event.KafkaConfigs{
-		BootstrapServers: kafkaBootstrapServers,
-		Topic:            kafkaTopic,
-		GroupId:          kafkaGroupId,
-		Offset:           kafkaOffset,
+	busConfigs := event.BusConfigs{
+		Transport: eventBusTransport,
+		Kafka: event.KafkaConfigs{
+			BootstrapServers: kafkaBootstrapServers,
+			Topic:            kafkaTopic,
+			GroupId:          kafkaGroupId,
+			Offset:           kafkaOffset,
+			DeadLetterTopic:  kafkaDeadLetterTopic,
+			CommitInterval:   kafkaCommitInterval,
+		},
+		Memory: event.MemoryConfigs{
+			Topic:      kafkaTopic,
+			BufferSize: memoryBusBufferSize,
+		},
+		Redis: event.RedisStreamConfigs{
+			Addr:             redisAddr,
+			Password:         redisPassword,
+			Stream:           redisStream,
+			Group:            redisStreamGroup,
+			Consumer:         redisStreamConsumer,
+			DeadLetterStream: redisStreamDeadLetter,
+			MinIdle:          redisStreamMinIdle,
+			MaxLen:           int64(redisStreamMaxLen),
+		},
+		Nats: event.NatsConfigs{
+			Url:               natsUrl,
+			Stream:            natsStream,
+			Subject:           natsSubject,
+			Durable:           natsDurable,
+			DeadLetterSubject: natsDeadLetterSubject,
+			MaxDeliver:        natsMaxDeliver,
+			AckWait:           natsAckWait,
+		},
+	}
+	consumerConfigs := event.ConsumerConfigs{
+		Retry: event.RetryPolicy{
+			MaxAttempts:    consumerMaxAttempts,
+			InitialBackoff: consumerInitialBackoff,
+			MaxBackoff:     consumerMaxBackoff,
+		},
+		BatchSize:    consumerBatchSize,
+		BatchTimeout: consumerBatchTimeout,
 	}
-	shortUrlEventProducer, err := event.NewShortUrlProducer(kafkaConfigs, logger)
+	eventBus, err := event.NewBus(busConfigs, metricsHooks, logger)
 	if err != nil {
-		log.Fatal("Failed to create short url event producer: ", err)
+		log.Fatal("Failed to create event bus: ", err)
 		return 1
 	}
 
-	shortUrlEventConsumer, err := event.NewShortUrlConsumer(kafkaConfigs, urlStore, logger)
+	subscription, err := eventBus.Subscribe()
 	if err != nil {
-		log.Fatal("Failed to create short url event consumer: ", err)
+		log.Fatal("Failed to subscribe to the event bus: ", err)
 		return 1
 	}
+	shortUrlEventConsumer := event.NewShortUrlConsumer(subscription, urlStore, consumerConfigs, metricsHooks, logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// start the consumer
+	var consumerDone sync.WaitGroup
+	consumerDone.Add(1)
 	go func(consumer *event.ShortUrlEventConsumer) {
-		consumer.Start()
+		defer consumerDone.Done()
+		consumer.Start(ctx)
 	}(shortUrlEventConsumer)
 
-	urlHandler := api.NewUrlHandler(tokenGen, urlTokenHasher, urlStore, shortUrlEventProducer, metricsHooks, logger)
-
-	http.HandleFunc("/shortn", func(w http.ResponseWriter, r *http.Request) {
-		urlHandler.ShortenUrl(w, r)
-	})
-	http.HandleFunc("/shortn/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			urlHandler.GetLongUrl(w, r)
-		case http.MethodDelete:
-			urlHandler.DeleteShortenUrl(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	var outbox storage.Outbox
+	var redisOutbox *storage.RedisOutbox
+	switch storageWriteMode {
+	case writeModeAsync:
+	case writeModeSync:
+		redisOutbox = storage.NewRedisOutbox(redisAddr, redisPassword, logger)
+		outbox = redisOutbox
+		relay := event.NewOutboxRelay(redisOutbox, eventBus, event.OutboxConfigs{
+			Interval:   outboxRelayInterval,
+			BatchSize:  outboxBatchSize,
+			MaxBackoff: outboxMaxBackoff,
+			LeaseTTL:   outboxLeaseTTL,
+		}, metricsHooks, logger)
+		// the relay produces events too, so it has to stop before the bus is closed
+		consumerDone.Add(1)
+		go func() {
+			defer consumerDone.Done()
+			relay.Start(ctx)
+		}()
+	default:
+		log.Fatalf("Unknown storage write mode %q", storageWriteMode)
+		return 1
+	}
+
+	// clicks are always counted for the stats endpoint
+	clickStore := storage.NewRedisClickStore(redisAddr, redisPassword, logger)
+	clickCounter := event.NewClickCounter(clickStore, event.ClickCounterConfigs{
+		BufferSize:       clickCounterBufferSize,
+		BatchSize:        clickCounterBatchSize,
+		FlushInterval:    clickCounterFlushInterval,
+		TopLinks:         clickTopLinks,
+		TopLinksInterval: clickTopLinksInterval,
+		ExcludeBots:      clickExcludeBots,
+	}, metricsHooks, logger)
+	clickPublishers := []api.ClickPublisher{clickCounter}
+
+	// click events go to their own kafka topic, so they are only published when kafka is available
+	var clickProducer *event.ShortUrlEventProducer
+	var clickPublisher *event.ClickEventPublisher
+	if eventBusTransport == event.TransportKafka {
+		clickProducer, err = event.NewShortUrlProducer(event.KafkaConfigs{
+			BootstrapServers: kafkaBootstrapServers,
+			Topic:            kafkaClicksTopic,
+		}, metricsHooks, logger)
+		if err != nil {
+			log.Fatal("Failed to create click producer: ", err)
+			return 1
 		}
-	})
-	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", port), nil); err != nil {
+		clickPublisher = event.NewClickEventPublisher(clickProducer, clickBufferSize, metricsHooks, logger)
+		clickPublishers = append(clickPublishers, clickPublisher)
+	}
+	botClassifier, err := bot.NewClassifier(botPatternsFile, logger)
+	if err != nil {
+		log.Fatal("Failed to load the bot patterns: ", err)
+		return 1
+	}
+	go botClassifier.Watch(ctx, botPatternsReloadInterval)
+	trustedProxies, err := api.ParseTrustedProxies(clickTrustedProxies)
+	if err != nil {
+		log.Fatal("Invalid CLICK_TRUSTED_PROXIES: ", err)
+		return 1
+	}
+	if clickIpSalt == "" {
+		clickIpSalt = rand.Text()
+		logger.Warn("CLICK_IP_HASH_SALT is not set, using a random salt: ip hashes won't match across restarts or replicas")
+	}
+	clicks := api.NewClickRecorder(clickIpSalt, clickCountryHeader, trustedProxies, botClassifier, clickStore, metricsHooks, logger, clickPublishers...)
+
+	if err := validatePublicBaseUrl(publicBaseUrl); err != nil {
+		log.Fatal("Invalid PUBLIC_BASE_URL: ", err)
+		return 1
+	}
+	domainStore := storage.NewRedisDomainStore(redisAddr, redisPassword, logger)
+	urlHandler := api.NewUrlHandler(api.UrlHandlerConfigs{
+		TokenGen:              tokenGen,
+		TokenHasher:           urlTokenHasher,
+		UrlStore:              urlStore,
+		ShortUrlEventProducer: eventBus,
+		EventContentType:      eventContentType,
+		Outbox:                outbox,
+		Clicks:                clicks,
+		ClickStore:            clickStore,
+		PublicBaseUrl:         publicBaseUrl,
+		Domains:               domainStore,
+		UnknownHostFallback:   unknownHostFallback,
+		MaxBatchItems:         batchMaxItems,
+		StoreTimeout:          storeTimeout,
+	}, metricsHooks, logger)
+	if err := validateUnknownHostFallback(unknownHostFallback); err != nil {
+		log.Fatal("Invalid UNKNOWN_HOST_FALLBACK: ", err)
+		return 1
+	}
+	if batchMaxItems <= 0 {
+		log.Fatal("Invalid BATCH_MAX_ITEMS: must be positive, got ", batchMaxItems)
+		return 1
+	}
+	specValidator, err := api.NewSpecValidator(openApiValidateResponses, metricsHooks, logger)
+	if err != nil {
+		log.Fatal("Failed to load the openapi spec: ", err)
+		return 1
+	}
+	mux := newRouter(&urlHandler, specValidator)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
 		log.Fatal(err)
 		return 1
 	}
+	logger.Info("Starting http server", "port", port)
+	exitCode := 0
+	if err := serve(ctx, &http.Server{Handler: otelhttp.NewHandler(api.WithRequestId(metrics.Middleware(mux)), appName)}, listener, shutdownTimeout); err != nil {
+		logger.Error("Http server stopped with error", "error", err)
+		exitCode = 1
+	}
 
-	return 0
+	// the http server no longer produces events, so the rest can be stopped in order
+	stop()
+	consumerDone.Wait()
+	eventBus.Close(shutdownTimeout)
+	if clickPublisher != nil {
+		clickPublisher.Close(shutdownTimeout)
+		clickProducer.Close(shutdownTimeout)
+	}
+	clickCounter.Close(shutdownTimeout)
+	if err := clickStore.Close(); err != nil {
+		logger.Error("Error closing redis click store client", "error", err)
+	}
+	if err := urlStore.Close(); err != nil {
+		logger.Error("Error closing redis client", "error", err)
+	}
+	if err := domainStore.Close(); err != nil {
+		logger.Error("Error closing redis domain store client", "error", err)
+	}
+	if redisOutbox != nil {
+		if err := redisOutbox.Close(); err != nil {
+			logger.Error("Error closing redis outbox client", "error", err)
+		}
+	}
+	tracingCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		logger.Error("Error flushing traces", "error", err)
+	}
+	logger.Info("Shutdown complete")
+
+	return exitCode
+}
+
+// newRouter serves the management api under /api/v1 and the short urls themselves at /{code}, on
+// the default domain as well as the branded ones. The /shortn routes are aliases kept for the
+// clients of the first version of the api.
+func newRouter(urlHandler *api.UrlHandler, specValidator *api.SpecValidator) *http.ServeMux {
+	mux := http.NewServeMux()
+	// the validator wraps each route rather than the mux, which has to see the request the metrics
+	// middleware labels by its pattern
+	route := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, specValidator.Middleware(handler))
+	}
+	route("POST /api/v1/links", urlHandler.ShortenUrl)
+	route("POST /api/v1/links/batch", urlHandler.ShortenUrls)
+	route("GET /api/v1/links/{code}", urlHandler.GetLink)
+	route("DELETE /api/v1/links/{code}", urlHandler.DeleteShortenUrl)
+	route("GET /api/v1/links/{code}/stats", urlHandler.GetClickStats)
+	route("POST /api/v1/domains", urlHandler.RegisterDomain)
+	route("GET /api/v1/domains", urlHandler.GetDomains)
+	route("DELETE /api/v1/domains/{domain}", urlHandler.DeleteDomain)
+	route("GET /{code}", urlHandler.GetLongUrl)
+
+	route("POST /shortn", urlHandler.ShortenUrl)
+	route("POST /shortn/batch", urlHandler.ShortenUrls)
+	route("GET /shortn/{code}", urlHandler.GetLongUrl)
+	route("DELETE /shortn/{code}", urlHandler.DeleteShortenUrl)
+	route("GET /shortn/{code}/stats", urlHandler.GetClickStats)
+
+	mux.Handle("GET /openapi.json", api.OpenApiHandler())
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return mux
+}
+
+// validatePublicBaseUrl checks that the short urls built on baseUrl are absolute urls. The codes are
+// routed at the root, so baseUrl can't have a path, not even one a proxy strips, as branded domains
+// are served without it.
+func validatePublicBaseUrl(baseUrl string) error {
+	parsed, err := url.Parse(baseUrl)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, got %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return errors.New("host is missing")
+	}
+	if strings.TrimSuffix(parsed.Path, "/") != "" {
+		return fmt.Errorf("path is not allowed, got %q", parsed.Path)
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" || parsed.ForceQuery {
+		return errors.New("query and fragment are not allowed")
+	}
+	return nil
+}
+
+// validateUnknownHostFallback checks that fallback is one of the api.UnknownHost values or an
+// absolute url to redirect to
+func validateUnknownHostFallback(fallback string) error {
+	if fallback == api.UnknownHostDefault || fallback == api.UnknownHostNotFound {
+		return nil
+	}
+	parsed, err := url.Parse(fallback)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("must be %s, %s or an absolute http url, got %q", api.UnknownHostDefault, api.UnknownHostNotFound, fallback)
+	}
+	return nil
 }
 
 func getEnvVarOrDefault(key string, defaultValue string) string {
@@ -103,3 +427,27 @@ func getEnvVarOrDefault(key string, defaultValue string) string {
 	}
 	return value
 }
+
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvBoolOrDefault(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
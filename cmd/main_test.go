@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_validatePublicBaseUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseUrl string
+		wantErr bool
+	}{
+		{
+			name:    "when the url is a scheme and host, return nil",
+			baseUrl: "https://x.io",
+			wantErr: false,
+		},
+		{
+			name:    "when the url has a port and a trailing slash, return nil",
+			baseUrl: "http://localhost:8080/",
+			wantErr: false,
+		},
+		{
+			name:    "when the url has a path, return error",
+			baseUrl: "https://x.io/s",
+			wantErr: true,
+		},
+		{
+			name:    "when the url has a query, return error",
+			baseUrl: "https://x.io?a=b",
+			wantErr: true,
+		},
+		{
+			name:    "when the url has an empty query, return error",
+			baseUrl: "https://x.io?",
+			wantErr: true,
+		},
+		{
+			name:    "when the url has a fragment, return error",
+			baseUrl: "https://x.io#s",
+			wantErr: true,
+		},
+		{
+			name:    "when the scheme is not http, return error",
+			baseUrl: "ftp://x.io",
+			wantErr: true,
+		},
+		{
+			name:    "when the host is missing, return error",
+			baseUrl: "https://",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePublicBaseUrl(tt.baseUrl); (err != nil) != tt.wantErr {
+				t.Errorf("validatePublicBaseUrl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
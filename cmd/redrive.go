@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"time"
+	"urlshortn/pkg/event"
+)
+
+const redriveCommand = "redrive-dlq"
+
+// runRedrive moves messages from the dead-letter topic back to the main topic, e.g.
+//
+//	shortn redrive-dlq -max 100 -idle-timeout 5s
+func runRedrive(name string, args ...string) int {
+	flags := flag.NewFlagSet(name+" "+redriveCommand, flag.ContinueOnError)
+	maxMessages := flags.Int("max", 0, "maximum number of messages to redrive (0 means all)")
+	idleTimeout := flags.Duration("idle-timeout", 10*time.Second, "stop after the dead letter topic has been idle for this long")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	kafkaConfigs := event.KafkaConfigs{
+		BootstrapServers: getEnvVarOrDefault("KAFKA_BOOTSTRAP_SERVERS", "localhost:9092"),
+		Topic:            getEnvVarOrDefault("KAFKA_TOPIC", "shortn"),
+		GroupId:          getEnvVarOrDefault("KAFKA_GROUP_ID", "shortn"),
+		DeadLetterTopic:  getEnvVarOrDefault("KAFKA_DLQ_TOPIC", "shortn-dlq"),
+	}
+	redriver, err := event.NewDeadLetterRedriver(kafkaConfigs, logger)
+	if err != nil {
+		logger.Error("Failed to create dead letter redriver", "error", err)
+		return 1
+	}
+	defer redriver.Close(getEnvDurationOrDefault("SHUTDOWN_TIMEOUT", 15*time.Second))
+
+	redriven, err := redriver.Redrive(*maxMessages, *idleTimeout)
+	if err != nil {
+		logger.Error("Failed to redrive dead letter messages", "error", err, "redriven", redriven)
+		return 1
+	}
+	logger.Info("Redrove dead letter messages", "redriven", redriven, "from", kafkaConfigs.DeadLetterTopic, "to", kafkaConfigs.Topic)
+	return 0
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServe_drainsInFlightRequestsOnSignal(t *testing.T) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("done"))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, &http.Server{Handler: mux}, listener, 5*time.Second)
+	}()
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	response := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			response <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		response <- result{code: resp.StatusCode, body: string(body), err: err}
+	}()
+
+	<-started
+	assert.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGTERM))
+
+	got := <-response
+	assert.Nil(t, got.err, "in-flight request should complete")
+	assert.Equal(t, http.StatusOK, got.code)
+	assert.Equal(t, "done", got.body)
+
+	select {
+	case err := <-served:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after SIGTERM")
+	}
+
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err, "server should not accept new connections after shutdown")
+}
+
+func TestServe_returnsWhenShutdownDeadlineIsExceeded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, &http.Server{Handler: mux}, listener, 50*time.Millisecond)
+	}()
+	go http.Get("http://" + listener.Addr().String() + "/stuck")
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-served:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not give up after the shutdown deadline")
+	}
+}
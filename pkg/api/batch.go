@@ -0,0 +1,424 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"mime"
+	"net/http"
+	"slices"
+	"time"
+	"urlshortn/pkg/event"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+)
+
+const (
+	contentTypeNdjson = "application/x-ndjson"
+
+	// batchChunkSize is how many items of a batch are shortened together: their tokens are generated
+	// at once and they are stored in a single round trip
+	batchChunkSize = 100
+	// maxBatchLineSize bounds the lines of an ndjson batch
+	maxBatchLineSize = 64 * 1024
+
+	// batchSizeAttribute is the span attribute holding how many items a batch has
+	batchSizeAttribute = "shortn.batch_size"
+)
+
+// BatchItemResult is the outcome of shortening the item of a batch at Index, which has the fields of
+// a ShortenUrlResponse when Status is 200 and the problem that kept it from being shortened otherwise.
+type BatchItemResult struct {
+	Index  int `json:"index"`
+	Status int `json:"status"`
+	*ShortenUrlResponse
+	Error *Problem `json:"error,omitempty"`
+}
+
+// BatchResponse has the result of every item of a json batch, in the order of the items.
+type BatchResponse struct {
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// batch is the state shared by the chunks of a batch
+type batch struct {
+	receivedAt time.Time
+	// claimed has the long url of every alias claimed in the batch so far, so that two items can't
+	// claim the same alias for different urls
+	claimed map[string]string
+	// domains has the domain, or the problem, of every domain requested in the batch so far
+	domains map[string]batchDomain
+}
+
+type batchDomain struct {
+	domain  string
+	problem *Problem
+}
+
+// batchLink is an item of a chunk on its way to be stored
+type batchLink struct {
+	index  int
+	req    ShortenUrlRequest
+	domain string
+	code   string
+	// key is the code on its domain, as stored
+	key string
+}
+
+// ShortenUrls shortens up to MaxBatchItems urls in a single request, each item being shortened as
+// ShortenUrl does with one. The items are a json array of ShortenUrlRequest, answered with a
+// BatchResponse, or one ShortenUrlRequest per line when the content type is ndjson, answered with
+// one BatchItemResult per line as the items are shortened. An invalid item fails alone, with the
+// problem it would have got from ShortenUrl in its result.
+func (h *UrlHandler) ShortenUrls(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.ShortenUrls")
+	defer span.End()
+	b := &batch{
+		receivedAt: time.Now(),
+		claimed:    map[string]string{},
+		domains:    map[string]batchDomain{},
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == contentTypeNdjson {
+		h.shortenNdjson(ctx, w, r, span, b)
+		return
+	}
+	h.shortenJson(ctx, w, r, span, b)
+}
+
+// shortenJson shortens the json array of items of r, which are all read before any is shortened.
+func (h *UrlHandler) shortenJson(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span, b *batch) {
+	decoder := json.NewDecoder(r.Body)
+	var items []json.RawMessage
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		h.logger.Error("Error decoding the batch", "error", err)
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "the batch must be a json array"))
+		return
+	}
+	for decoder.More() {
+		if len(items) == h.MaxBatchItems {
+			h.fail(ctx, w, h.batchTooLargeProblem())
+			return
+		}
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			h.logger.Error("Error decoding the batch", "error", err)
+			h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "the batch must be a json array"))
+			return
+		}
+		items = append(items, item)
+	}
+	if _, err := decoder.Token(); err != nil {
+		h.logger.Error("Error decoding the batch", "error", err)
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "the batch must be a json array"))
+		return
+	}
+	h.logger.Debug("Shortening batch", "size", len(items))
+	span.SetAttributes(attribute.Int(batchSizeAttribute, len(items)))
+
+	response := BatchResponse{Results: make([]BatchItemResult, 0, len(items))}
+	for start := 0; start < len(items); start += batchChunkSize {
+		end := min(start+batchChunkSize, len(items))
+		response.Results = append(response.Results, h.shortenChunk(ctx, span, b, start, items[start:end])...)
+		if ctx.Err() != nil {
+			h.batchInterrupted(ctx, w, span)
+			return
+		}
+	}
+	for _, result := range response.Results {
+		if result.Error == nil {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+	h.writeJson(ctx, w, span, response)
+}
+
+// shortenNdjson shortens the items of r as they are read, one per line, writing the results of every
+// chunk as soon as it is done. Once the response started, a batch with too many items or a line that
+// can't be read gets a result for that item instead of a problem, and nothing after it is read.
+func (h *UrlHandler) shortenNdjson(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span, b *batch) {
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 4096), maxBatchLineSize)
+	w.Header().Set("Content-Type", contentTypeNdjson)
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	controller := http.NewResponseController(w)
+	write := func(results ...BatchItemResult) {
+		for _, result := range results {
+			if err := encoder.Encode(result); err != nil {
+				h.logger.Debug("Error writing a batch result", "error", err)
+			}
+		}
+		if err := controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			h.logger.Debug("Error flushing the batch results", "error", err)
+		}
+	}
+
+	var chunk []json.RawMessage
+	next := 0
+	shorten := func() {
+		write(h.shortenChunk(ctx, span, b, next-len(chunk), chunk)...)
+		chunk = nil
+	}
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if next == h.MaxBatchItems {
+			shorten()
+			problem := h.batchTooLargeProblem()
+			write(BatchItemResult{Index: next, Status: problem.Status, Error: &problem})
+			return
+		}
+		chunk = append(chunk, bytes.Clone(line))
+		next++
+		if len(chunk) == batchChunkSize {
+			shorten()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+	shorten()
+	span.SetAttributes(attribute.Int(batchSizeAttribute, next))
+	if err := scanner.Err(); err != nil {
+		h.logger.Error("Error reading the batch", "error", err)
+		reason := "could not be read"
+		if errors.Is(err, bufio.ErrTooLong) {
+			reason = fmt.Sprintf("is longer than %d bytes", maxBatchLineSize)
+		}
+		problem := newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid item")
+		problem.Details = []ProblemDetail{{Field: "body", Reason: "the line " + reason}}
+		write(BatchItemResult{Index: next, Status: problem.Status, Error: &problem})
+	}
+}
+
+func (h *UrlHandler) batchTooLargeProblem() Problem {
+	return newProblem(http.StatusRequestEntityTooLarge, metrics.ErrorKindTooLarge, fmt.Sprintf("a batch can't have more than %d items", h.MaxBatchItems))
+}
+
+// batchInterrupted records that the client went away before its batch was shortened. The items
+// stored so far are kept.
+func (h *UrlHandler) batchInterrupted(ctx context.Context, w http.ResponseWriter, span trace.Span) {
+	failSpan(span, ctx.Err())
+	h.logger.Debug("Client went away while shortening a batch", "error", ctx.Err())
+	w.WriteHeader(statusClientClosedRequest)
+	h.MetricsHooks.OnRequestFailed(metrics.ErrorKindCanceled)
+}
+
+// shortenChunk shortens items, the first of which is the item at first in the batch, and returns
+// their results in the same order.
+func (h *UrlHandler) shortenChunk(ctx context.Context, span trace.Span, b *batch, first int, items []json.RawMessage) []BatchItemResult {
+	results := make([]BatchItemResult, len(items))
+	fail := func(i int, problem Problem) {
+		results[i] = BatchItemResult{Index: first + i, Status: problem.Status, Error: &problem}
+	}
+	failed := func(i int) bool {
+		return results[i].Error != nil
+	}
+
+	var links []batchLink
+	var generated []int
+	for i, item := range items {
+		var req ShortenUrlRequest
+		if err := json.Unmarshal(item, &req); err != nil {
+			h.logger.Debug("Error decoding a batch item", "index", first+i, "error", err)
+			fail(i, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid item"))
+			continue
+		}
+		link, problem := h.prepareLink(ctx, span, b, req)
+		if problem != nil {
+			fail(i, *problem)
+			continue
+		}
+		link.index = i
+		if link.code == "" {
+			generated = append(generated, len(links))
+		}
+		links = append(links, link)
+	}
+
+	if len(generated) > 0 {
+		tokens, err := h.TokenGen.GenerateTokens(len(generated))
+		if err != nil {
+			h.logger.Error("Error generating the tokens of a batch", "error", err)
+			failSpan(span, err)
+		}
+		for j, l := range generated {
+			if err != nil {
+				fail(links[l].index, newProblem(http.StatusInternalServerError, metrics.ErrorKindToken, "internal error generating a token"))
+				continue
+			}
+			code, err := h.TokenHasher.Hash(int64(tokens[j]))
+			if err != nil {
+				h.logger.Error("Error generating a hash for the token", "error", err)
+				failSpan(span, err)
+				fail(links[l].index, newProblem(http.StatusInternalServerError, metrics.ErrorKindToken, "internal error generating a hash for the token"))
+				continue
+			}
+			links[l].code = code
+		}
+	}
+
+	stored := map[string]storage.Link{}
+	entries := map[string]storage.OutboxEntry{}
+	var pending []batchLink
+	for _, link := range links {
+		if failed(link.index) {
+			continue
+		}
+		link.key = storage.DomainKey(link.domain, link.code)
+		shortUrlEvent := newShortUrlEvent(link.key, link.req, b.receivedAt)
+		content, headers, err := event.EncodeShortUrlEvent(shortUrlEvent, h.EventContentType)
+		if err != nil {
+			h.logger.Error("Error encoding the event", "error", err)
+			failSpan(span, err)
+			fail(link.index, newProblem(http.StatusInternalServerError, metrics.ErrorKindEncode, "internal error encoding the event"))
+			continue
+		}
+		otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+		stored[link.key] = newLink(link.req)
+		entries[link.key] = storage.OutboxEntry{Value: content, Headers: headers}
+		pending = append(pending, link)
+	}
+	if len(pending) == 0 {
+		return results
+	}
+
+	if h.Outbox != nil {
+		storeCtx, cancel := h.storeContext(ctx)
+		defer cancel()
+		err := h.Outbox.StoreBatchWithOutbox(storeCtx, stored, entries)
+		var conflict *storage.ConflictError
+		switch {
+		case errors.As(err, &conflict):
+			// the other links were stored, only the ones whose key was taken meanwhile fail
+			taken := h.storeProblem(storeCtx, span, err, "storing the short urls")
+			for _, link := range pending {
+				switch {
+				case !slices.Contains(conflict.Keys, link.key):
+				case link.req.Alias != "":
+					fail(link.index, aliasTakenProblem())
+				default:
+					fail(link.index, taken)
+				}
+			}
+		case err != nil:
+			problem := h.storeProblem(storeCtx, span, err, "storing the short urls")
+			for _, link := range pending {
+				fail(link.index, problem)
+			}
+			return results
+		}
+	} else {
+		// the events of the chunk are produced at once, and only once for items of the same key
+		produced := map[string]error{}
+		var keys []string
+		var events []event.OutgoingEvent
+		for _, link := range pending {
+			if _, ok := produced[link.key]; !ok {
+				produced[link.key] = nil
+				keys = append(keys, link.key)
+				events = append(events, event.OutgoingEvent{Value: entries[link.key].Value, Headers: entries[link.key].Headers})
+			}
+		}
+		for i, err := range h.ShortUrlEventProducer.ProduceBatch(events) {
+			produced[keys[i]] = err
+			if err != nil {
+				h.logger.Error("Error producing the event", "error", err)
+				failSpan(span, err)
+			}
+		}
+		for _, link := range pending {
+			if produced[link.key] != nil {
+				fail(link.index, producerProblem())
+			}
+		}
+	}
+	for _, link := range pending {
+		if failed(link.index) {
+			continue
+		}
+		response := h.shortenUrlResponse(link.domain, link.code, link.req)
+		results[link.index] = BatchItemResult{Index: first + link.index, Status: http.StatusOK, ShortenUrlResponse: &response}
+	}
+	return results
+}
+
+// prepareLink checks an item of a batch as ShortenUrl checks its request, and returns it along with
+// the domain it is stored on and, when it has an alias, its code. Its alias is claimed in the batch
+// right away, so a later item can't claim it for another url, and without an outbox it is claimed in
+// the store too, as claimAlias does.
+func (h *UrlHandler) prepareLink(ctx context.Context, span trace.Span, b *batch, req ShortenUrlRequest) (batchLink, *Problem) {
+	if req.URL == "" {
+		problem := newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid item")
+		problem.Details = []ProblemDetail{{Field: "url", Reason: "is required"}}
+		return batchLink{}, &problem
+	}
+	if problem := expiryProblem(req.ExpiresAt, b.receivedAt); problem != nil {
+		return batchLink{}, problem
+	}
+	domain := h.batchLinkDomain(ctx, span, b, req.Domain)
+	if domain.problem != nil {
+		return batchLink{}, domain.problem
+	}
+	link := batchLink{req: req, domain: domain.domain}
+	if req.Alias == "" {
+		return link, nil
+	}
+
+	if problem := aliasProblem(req.Alias); problem != nil {
+		return batchLink{}, problem
+	}
+	key := storage.DomainKey(link.domain, req.Alias)
+	existing, claimed := b.claimed[key]
+	if !claimed && h.Outbox == nil {
+		storeCtx, cancel := h.storeContext(ctx)
+		defer cancel()
+		err := h.UrlStore.Store(storeCtx, key, newLink(req))
+		switch {
+		case errors.Is(err, storage.ErrConflict):
+			problem := aliasTakenProblem()
+			return batchLink{}, &problem
+		case err != nil:
+			problem := h.storeProblem(storeCtx, span, err, "claiming the alias")
+			return batchLink{}, &problem
+		}
+	}
+	if claimed && existing != req.URL {
+		problem := aliasTakenProblem()
+		return batchLink{}, &problem
+	}
+	b.claimed[key] = req.URL
+	link.code = req.Alias
+	return link, nil
+}
+
+// batchLinkDomain returns the domain the items of a batch requested on requested are stored on, which
+// is checked once per batch unless the domains couldn't be checked.
+func (h *UrlHandler) batchLinkDomain(ctx context.Context, span trace.Span, b *batch, requested string) batchDomain {
+	if domain, ok := b.domains[requested]; ok {
+		return domain
+	}
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	name, problem, err := h.newLinkDomain(storeCtx, requested)
+	if err != nil {
+		problem := h.storeProblem(storeCtx, span, err, "checking the domain")
+		return batchDomain{problem: &problem}
+	}
+	domain := batchDomain{domain: name, problem: problem}
+	b.domains[requested] = domain
+	return domain
+}
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/snowflake"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"urlshortn/pkg/hash"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+	"urlshortn/pkg/token"
+)
+
+// sequentialTokens generates the tokens 1, 2, 3... across calls
+func sequentialTokens() *token.FakeTokenGenerator {
+	next := snowflake.ID(0)
+	return &token.FakeTokenGenerator{
+		GenerateTokensFn: func(n int) ([]snowflake.ID, error) {
+			tokens := make([]snowflake.ID, n)
+			for i := range tokens {
+				next++
+				tokens[i] = next
+			}
+			return tokens, nil
+		},
+	}
+}
+
+// newBatchHandler returns a handler with the alias "taken" given to http://mercadolibre.com.ar, which
+// stores its batches with storeErr and records the keys stored without error
+func newBatchHandler(tokenGen token.TokenGenerator, storeErr error, maxItems int, stored *[]string) *UrlHandler {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	return &UrlHandler{
+		TokenGen:    tokenGen,
+		TokenHasher: &hash.FakeTokenHasher{HashFn: func(n int64) (string, error) { return fmt.Sprint(n), nil }},
+		Outbox: &storage.FakeOutbox{
+			StoreBatchWithOutboxFn: func(ctx context.Context, links map[string]storage.Link, entries map[string]storage.OutboxEntry) error {
+				if len(entries) < len(links) {
+					return errors.New("every link should have its event")
+				}
+				if storeErr != nil {
+					return storeErr
+				}
+				var taken []string
+				for key, link := range links {
+					if key == "taken" && link.LongUrl != "http://mercadolibre.com.ar" {
+						taken = append(taken, key)
+						continue
+					}
+					*stored = append(*stored, key)
+				}
+				if len(taken) > 0 {
+					return &storage.ConflictError{Keys: taken}
+				}
+				return nil
+			},
+		},
+		PublicBaseUrl: "https://sho.rt",
+		Domains:       registeredDomains("go.brand-a.com"),
+		MaxBatchItems: maxItems,
+		logger:        logger,
+	}
+}
+
+func TestUrlHandler_ShortenUrls(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		tokenErr     error
+		storeErr     error
+		maxItems     int
+		wantCode     int
+		wantStatuses []int
+		wantStored   []string
+	}{
+		{
+			name:         "when every item is valid, each one is shortened",
+			body:         `[{"url":"http://google.com"},{"url":"http://google.com","alias":"my-link"},{"url":"http://google.com","domain":"go.brand-a.com"}]`,
+			wantCode:     http.StatusOK,
+			wantStatuses: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+			wantStored:   []string{"1", "go.brand-a.com/2", "my-link"},
+		},
+		{
+			name: "when some items are invalid, only they fail",
+			body: `[{"url":"http://google.com"},42,{"url":""},{"url":"http://google.com","alias":"taken"},` +
+				`{"url":"http://google.com","domain":"unknown.com"},{"url":"http://google.com","expires_at":"2001-01-01T00:00:00Z"},{"url":"http://google.com","alias":"api"}]`,
+			wantCode:     http.StatusOK,
+			wantStatuses: []int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest, http.StatusConflict, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest},
+			wantStored:   []string{"1"},
+		},
+		{
+			name:         "when two items claim the same alias for different urls, the later one conflicts",
+			body:         `[{"url":"http://google.com","alias":"my-link"},{"url":"http://mercadolibre.com.ar","alias":"my-link"},{"url":"http://google.com","alias":"my-link"}]`,
+			wantCode:     http.StatusOK,
+			wantStatuses: []int{http.StatusOK, http.StatusConflict, http.StatusOK},
+			wantStored:   []string{"my-link"},
+		},
+		{
+			name:         "when the tokens can't be generated, only the items without an alias fail",
+			body:         `[{"url":"http://google.com"},{"url":"http://google.com","alias":"my-link"}]`,
+			tokenErr:     errors.New("expected error"),
+			wantCode:     http.StatusOK,
+			wantStatuses: []int{http.StatusInternalServerError, http.StatusOK},
+			wantStored:   []string{"my-link"},
+		},
+		{
+			name:         "when the storage is unavailable, the items to store fail with it",
+			body:         `[{"url":"http://google.com"},{"url":""}]`,
+			storeErr:     storage.ErrUnavailable,
+			wantCode:     http.StatusOK,
+			wantStatuses: []int{http.StatusServiceUnavailable, http.StatusBadRequest},
+		},
+		{
+			name:     "when the body is not an array, response is bad request",
+			body:     `{"url":"http://google.com"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "when the batch has more items than allowed, response is request entity too large",
+			body:     `[{"url":"http://google.com"},{"url":"http://google.com"},{"url":"http://google.com"}]`,
+			maxItems: 2,
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenGen := sequentialTokens()
+			if tt.tokenErr != nil {
+				tokenGen.GenerateTokensFn = func(n int) ([]snowflake.ID, error) {
+					return nil, tt.tokenErr
+				}
+			}
+			maxItems := tt.maxItems
+			if maxItems == 0 {
+				maxItems = 10
+			}
+			var stored []string
+			h := newBatchHandler(tokenGen, tt.storeErr, maxItems, &stored)
+			rr := httptest.NewRecorder()
+
+			h.ShortenUrls(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+			if tt.wantCode != http.StatusOK {
+				assert.Equal(t, contentTypeProblem, rr.Header().Get("Content-Type"))
+				return
+			}
+			assert.Equal(t, contentTypeJson, rr.Header().Get("Content-Type"))
+			var got BatchResponse
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+			var statuses []int
+			succeeded := 0
+			for i, result := range got.Results {
+				assert.Equal(t, i, result.Index, "results should be in the order of the items")
+				assert.Equal(t, result.Status == http.StatusOK, result.ShortenUrlResponse != nil, "only the shortened items have a short url")
+				assert.Equal(t, result.Status != http.StatusOK, result.Error != nil, "only the failed items have a problem")
+				if result.Status == http.StatusOK {
+					succeeded++
+				}
+				statuses = append(statuses, result.Status)
+			}
+			assert.Equal(t, tt.wantStatuses, statuses)
+			assert.Equal(t, succeeded, got.Succeeded)
+			assert.Equal(t, len(got.Results)-succeeded, got.Failed)
+			slices.Sort(stored)
+			assert.Equal(t, tt.wantStored, stored)
+		})
+	}
+}
+
+func TestUrlHandler_ShortenUrls_inChunks(t *testing.T) {
+	var sizes []int
+	tokenGen := sequentialTokens()
+	generate := tokenGen.GenerateTokensFn
+	tokenGen.GenerateTokensFn = func(n int) ([]snowflake.ID, error) {
+		sizes = append(sizes, n)
+		return generate(n)
+	}
+	var stored []string
+	h := newBatchHandler(tokenGen, nil, 1000, &stored)
+	items := make([]string, 250)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"url":"http://google.com/%d"}`, i)
+	}
+	rr := httptest.NewRecorder()
+
+	h.ShortenUrls(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("["+strings.Join(items, ",")+"]")))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []int{100, 100, 50}, sizes, "tokens should be generated once per chunk")
+	assert.Len(t, stored, 250)
+	var got BatchResponse
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Equal(t, 250, got.Succeeded)
+	assert.Equal(t, 249, got.Results[249].Index)
+	assert.Equal(t, "https://sho.rt/250", got.Results[249].ShortUrl)
+}
+
+func TestUrlHandler_ShortenUrls_uniqueCodes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+	tokenGen, err := token.NewSnowflakeTokenGenerator("2010-11-04T00:00:00Z", logger)
+	assert.Nil(t, err)
+	var stored []string
+	h := newBatchHandler(tokenGen, nil, 1000, &stored)
+	h.TokenHasher = hash.NewUrlTokenHash(logger)
+	items := make([]string, 3*batchChunkSize)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"url":"http://google.com/%d"}`, i)
+	}
+	rr := httptest.NewRecorder()
+
+	h.ShortenUrls(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("["+strings.Join(items, ",")+"]")))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var got BatchResponse
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	codes := map[string]bool{}
+	for _, result := range got.Results {
+		assert.NotNil(t, result.ShortenUrlResponse)
+		codes[result.Code] = true
+	}
+	assert.Len(t, codes, len(items), "every item should get a code of its own, across chunks too")
+	assert.Len(t, stored, len(items))
+}
+
+func TestUrlHandler_ShortenUrls_produceFails(t *testing.T) {
+	var stored []string
+	h := newBatchHandler(sequentialTokens(), nil, 10, &stored)
+	h.Outbox = nil
+	producer := &FakeShortUrlEventProducer{
+		ProduceFn: func(value []byte, headers map[string]string) error {
+			if bytes.Contains(value, []byte("mercadolibre")) {
+				return errors.New("queue full")
+			}
+			return nil
+		},
+	}
+	h.ShortUrlEventProducer = producer
+	rr := httptest.NewRecorder()
+
+	h.ShortenUrls(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[{"url":"http://google.com"},{"url":"http://mercadolibre.com.ar"}]`)))
+
+	var got BatchResponse
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Equal(t, 1, got.Succeeded)
+	assert.Equal(t, http.StatusOK, got.Results[0].Status)
+	assert.Equal(t, http.StatusServiceUnavailable, got.Results[1].Status)
+	assert.Equal(t, metrics.ErrorKindUnavailable, got.Results[1].Error.Code)
+	assert.Equal(t, []int{2}, producer.Batches, "the events of a chunk should be produced at once")
+}
+
+func TestUrlHandler_ShortenUrls_ndjson(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		maxItems     int
+		wantStatuses []int
+		wantStored   []string
+	}{
+		{
+			name:         "when items are streamed, there is a result line per item, blank lines aside",
+			body:         "{\"url\":\"http://google.com\"}\n\n{\"url\":\"\"}\n{\"url\":\"http://google.com\",\"alias\":\"my-link\"}",
+			wantStatuses: []int{http.StatusOK, http.StatusBadRequest, http.StatusOK},
+			wantStored:   []string{"1", "my-link"},
+		},
+		{
+			name:         "when the batch has more items than allowed, it ends with a too large result",
+			body:         "{\"url\":\"http://google.com\"}\n{\"url\":\"http://google.com\"}\n{\"url\":\"http://google.com\"}\n",
+			maxItems:     2,
+			wantStatuses: []int{http.StatusOK, http.StatusOK, http.StatusRequestEntityTooLarge},
+			wantStored:   []string{"1", "2"},
+		},
+		{
+			name:         "when a line is too long, the batch ends with a bad request result",
+			body:         "{\"url\":\"http://google.com\"}\n{\"url\":\"http://google.com/" + strings.Repeat("a", maxBatchLineSize) + "\"}\n{\"url\":\"http://google.com\"}\n",
+			wantStatuses: []int{http.StatusOK, http.StatusBadRequest},
+			wantStored:   []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxItems := tt.maxItems
+			if maxItems == 0 {
+				maxItems = 10
+			}
+			var stored []string
+			h := newBatchHandler(sequentialTokens(), nil, maxItems, &stored)
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", contentTypeNdjson)
+			rr := httptest.NewRecorder()
+
+			h.ShortenUrls(rr, r)
+
+			assert.Equal(t, http.StatusOK, rr.Code, "http status code does not match")
+			assert.Equal(t, contentTypeNdjson, rr.Header().Get("Content-Type"))
+			assert.True(t, rr.Flushed, "results should be flushed as they are written")
+			var statuses []int
+			scanner := bufio.NewScanner(bytes.NewReader(rr.Body.Bytes()))
+			for scanner.Scan() {
+				var result BatchItemResult
+				assert.Nil(t, json.Unmarshal(scanner.Bytes(), &result))
+				assert.Equal(t, len(statuses), result.Index, "results should be in the order of the items")
+				statuses = append(statuses, result.Status)
+			}
+			assert.Equal(t, tt.wantStatuses, statuses)
+			slices.Sort(stored)
+			assert.Equal(t, tt.wantStored, stored)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+	"urlshortn/pkg/bot"
+	"urlshortn/pkg/event"
+	"urlshortn/pkg/metrics"
+)
+
+const (
+	// visitorSaltTimeout bounds the wait of the redirect that asks for the salt of a new day
+	visitorSaltTimeout = 500 * time.Millisecond
+	// visitorSaltRetry is how long visitor ids are left out after the salt of the day couldn't be had
+	visitorSaltRetry = time.Minute
+)
+
+type ClickPublisher interface {
+	Publish(click event.ClickEvent)
+}
+
+// ClickRecorder turns redirects into click events handed to every publisher, e.g. the click topic
+// and the click counter. A nil *ClickRecorder records nothing.
+type ClickRecorder struct {
+	Publishers []ClickPublisher
+	// IpSalt is mixed into the client ip before hashing it, so the hash can't be reversed by
+	// hashing every address
+	IpSalt string
+	// VisitorSalts hands out the salt visitor ids are hashed with, a random one for every UTC day
+	// that every replica shares and that is destroyed soon after the day, so nothing left can link
+	// the ids of a client across days. Nil leaves visitor ids out.
+	VisitorSalts interface {
+		VisitorSalt(ctx context.Context, day time.Time) (string, error)
+	}
+	// CountryHeader is the request header a proxy or CDN in front of the service puts the client's
+	// country in, e.g. CF-IPCountry
+	CountryHeader string
+	// TrustedProxies are the addresses of the proxies in front of the service, whose X-Forwarded-For
+	// is honoured. It is ignored from anyone else, who could put any address in it.
+	TrustedProxies []netip.Prefix
+	// Classifier tags clicks made by bots, nil tags none
+	Classifier interface {
+		IsBot(r *http.Request) bool
+	}
+	MetricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+
+	// mu guards the salt of saltDay, the day visitor ids are hashed for, and saltRetryAt, when to
+	// ask for it again after it couldn't be had
+	mu          sync.Mutex
+	saltDay     string
+	salt        string
+	saltRetryAt time.Time
+}
+
+func NewClickRecorder(ipSalt string, countryHeader string, trustedProxies []netip.Prefix, classifier *bot.Classifier, visitorSalts interface {
+	VisitorSalt(ctx context.Context, day time.Time) (string, error)
+}, metricsHooks *metrics.MetricsHooks, logger *slog.Logger, publishers ...ClickPublisher) *ClickRecorder {
+	return &ClickRecorder{
+		Publishers:     publishers,
+		IpSalt:         ipSalt,
+		VisitorSalts:   visitorSalts,
+		CountryHeader:  countryHeader,
+		TrustedProxies: trustedProxies,
+		Classifier:     classifier,
+		MetricsHooks:   metricsHooks,
+		logger:         logger,
+	}
+}
+
+// ParseTrustedProxies parses a comma separated list of addresses and CIDR ranges, e.g.
+// "10.0.0.0/8, 192.168.1.10".
+func ParseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, proxy := range strings.Split(value, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// Record publishes a click on shortUrl made with r.
+func (c *ClickRecorder) Record(r *http.Request, shortUrl string) {
+	if c == nil || len(c.Publishers) == 0 {
+		return
+	}
+	now := time.Now()
+	ip := c.clientIp(r)
+	click := event.ClickEvent{
+		ShortUrl:       shortUrl,
+		Timestamp:      now,
+		Referrer:       r.Referer(),
+		UserAgent:      r.UserAgent(),
+		IpHash:         c.hashIp(ip),
+		VisitorId:      c.visitorId(c.dailySalt(r.Context(), now), ip, r.UserAgent()),
+		AcceptLanguage: r.Header.Get("Accept-Language"),
+		IsBot:          c.Classifier != nil && c.Classifier.IsBot(r),
+	}
+	if c.CountryHeader != "" {
+		click.Country = r.Header.Get(c.CountryHeader)
+	}
+	c.MetricsHooks.OnClickRecorded(shortUrl, click.IsBot)
+	for _, publisher := range c.Publishers {
+		publisher.Publish(click)
+	}
+}
+
+func (c *ClickRecorder) hashIp(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(c.IpSalt + ip))
+	return hex.EncodeToString(sum[:])
+}
+
+// visitorId fingerprints the client for unique visitor counts, hashing its ip and user agent with
+// the salt of the day. As the salt changes every day, the same client gets a new id each day and
+// can't be followed across days. There is no id without a salt.
+func (c *ClickRecorder) visitorId(salt string, ip string, userAgent string) string {
+	if salt == "" || (ip == "" && userAgent == "") {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(salt + ip + "\x00" + userAgent))
+	return hex.EncodeToString(sum[:])
+}
+
+// dailySalt returns the salt of the UTC day of at, asking VisitorSalts for it on the first click of
+// the day. When it can't be had, it returns none and isn't asked for again for visitorSaltRetry.
+func (c *ClickRecorder) dailySalt(ctx context.Context, at time.Time) string {
+	if c.VisitorSalts == nil {
+		return ""
+	}
+	day := at.UTC().Format(time.DateOnly)
+	// held while asking, so the clicks waiting on the salt of a new day don't all ask for it
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.saltDay == day {
+		return c.salt
+	}
+	if at.Before(c.saltRetryAt) {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, visitorSaltTimeout)
+	defer cancel()
+	salt, err := c.VisitorSalts.VisitorSalt(ctx, at)
+	if err != nil {
+		c.logger.Error("Error getting the visitor salt of the day, visitor ids are left out", "error", err, "day", day)
+		c.saltRetryAt = at.Add(visitorSaltRetry)
+		return ""
+	}
+	c.saltDay, c.salt = day, salt
+	return salt
+}
+
+// clientIp returns the address of the connection, unless it comes from a trusted proxy. Every proxy
+// appends the address it got the request from to X-Forwarded-For, so the client is then the last
+// forwarded address that isn't a trusted proxy, whatever the client put before it.
+func (c *ClickRecorder) clientIp(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && c.trustedProxy(ip); i-- {
+		if hop := strings.TrimSpace(forwarded[i]); hop != "" {
+			ip = hop
+		}
+	}
+	return ip
+}
+
+func (c *ClickRecorder) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, proxy := range c.TrustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
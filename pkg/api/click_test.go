@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+	"urlshortn/pkg/bot"
+	"urlshortn/pkg/event"
+	"urlshortn/pkg/metrics"
+)
+
+func TestClickRecorder_Record(t *testing.T) {
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		remoteAddr  string
+		wantIp      string
+		wantCountry string
+		wantBot     bool
+	}{
+		{
+			name:       "when the request comes straight from the client, hash the connection address",
+			remoteAddr: "10.0.0.1:1234",
+			wantIp:     "10.0.0.1",
+		},
+		{
+			name:       "when the request went through trusted proxies, hash the address they got it from",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.2"},
+			remoteAddr: "10.0.0.1:1234",
+			wantIp:     "203.0.113.7",
+		},
+		{
+			name:       "when the client forged X-Forwarded-For, hash the address the trusted proxy got it from",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7"},
+			remoteAddr: "10.0.0.1:1234",
+			wantIp:     "203.0.113.7",
+		},
+		{
+			name:       "when X-Forwarded-For comes from an untrusted address, hash the connection address",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			remoteAddr: "203.0.113.7:1234",
+			wantIp:     "203.0.113.7",
+		},
+		{
+			name:        "when the country is known, include it",
+			headers:     map[string]string{"CF-IPCountry": "AR"},
+			remoteAddr:  "10.0.0.1:1234",
+			wantIp:      "10.0.0.1",
+			wantCountry: "AR",
+		},
+		{
+			name:       "when the browser prefetches the link, tag the click as made by a bot",
+			headers:    map[string]string{"Sec-Purpose": "prefetch"},
+			remoteAddr: "10.0.0.1:1234",
+			wantIp:     "10.0.0.1",
+			wantBot:    true,
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	classifier, err := bot.NewClassifier("", logger)
+	assert.Nil(t, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/shortn/abc", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("Referer", "http://example.com")
+			r.Header.Set("User-Agent", "test-agent")
+			r.Header.Set("Accept-Language", "es-AR")
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			publisher := &FakeClickPublisher{}
+			other := &FakeClickPublisher{}
+			var recorded []bool
+			c := NewClickRecorder("salt", "CF-IPCountry", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, classifier, daySalts(), &metrics.MetricsHooks{
+				OnClickRecordedFn: func(shortUrl string, isBot bool) {
+					recorded = append(recorded, isBot)
+				},
+			}, logger, publisher, other)
+
+			c.Record(r, "abc")
+
+			assert.Len(t, publisher.clicks, 1)
+			assert.Equal(t, publisher.clicks, other.clicks, "every publisher should get the click")
+			click := publisher.clicks[0]
+			assert.Equal(t, "abc", click.ShortUrl)
+			assert.False(t, click.Timestamp.IsZero(), "timestamp should be set")
+			assert.Equal(t, "http://example.com", click.Referrer)
+			assert.Equal(t, "test-agent", click.UserAgent)
+			assert.Equal(t, "es-AR", click.AcceptLanguage)
+			assert.Equal(t, tt.wantCountry, click.Country)
+			assert.Equal(t, c.hashIp(tt.wantIp), click.IpHash)
+			assert.NotContains(t, click.IpHash, tt.wantIp, "the ip should not be published")
+			assert.Equal(t, c.visitorId("salt of "+click.Timestamp.UTC().Format(time.DateOnly), tt.wantIp, "test-agent"), click.VisitorId)
+			assert.Equal(t, tt.wantBot, click.IsBot)
+			assert.Equal(t, []bool{tt.wantBot}, recorded, "the click should be counted in the metrics")
+		})
+	}
+}
+
+func TestClickRecorder_hashIp(t *testing.T) {
+	a := &ClickRecorder{IpSalt: "a"}
+	b := &ClickRecorder{IpSalt: "b"}
+	assert.Equal(t, a.hashIp("10.0.0.1"), a.hashIp("10.0.0.1"), "the same ip should hash the same")
+	assert.NotEqual(t, a.hashIp("10.0.0.1"), b.hashIp("10.0.0.1"), "the salt should change the hash")
+	assert.Equal(t, "", a.hashIp(""))
+}
+
+func TestClickRecorder_visitorId(t *testing.T) {
+	c := &ClickRecorder{IpSalt: "a"}
+	id := c.visitorId("monday", "10.0.0.1", "agent")
+	assert.Equal(t, id, c.visitorId("monday", "10.0.0.1", "agent"), "the same client should get the same id with the same salt")
+	assert.NotEqual(t, id, c.visitorId("tuesday", "10.0.0.1", "agent"), "the id should change with the salt")
+	assert.NotEqual(t, id, c.visitorId("monday", "10.0.0.1", "other agent"), "clients behind the same ip should get different ids")
+	assert.NotEqual(t, id, c.visitorId("monday", "10.0.0.2", "agent"))
+	assert.Equal(t, id, (&ClickRecorder{IpSalt: "b"}).visitorId("monday", "10.0.0.1", "agent"), "the id should not depend on the configured secret")
+	assert.Equal(t, "", c.visitorId("monday", "", ""))
+	assert.Equal(t, "", c.visitorId("", "10.0.0.1", "agent"), "there should be no id without a salt")
+}
+
+func TestClickRecorder_dailySalt(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	var asked []time.Time
+	var saltErr error
+	c := NewClickRecorder("secret", "", nil, nil, &FakeVisitorSalts{
+		VisitorSaltFn: func(ctx context.Context, day time.Time) (string, error) {
+			asked = append(asked, day)
+			if saltErr != nil {
+				return "", saltErr
+			}
+			return rand.Text(), nil
+		},
+	}, nil, logger)
+	day := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	salt := c.dailySalt(context.Background(), day)
+	assert.NotEmpty(t, salt)
+	assert.Equal(t, salt, c.dailySalt(context.Background(), day.Add(20*time.Hour)), "the salt should be the same all day")
+	assert.Len(t, asked, 1, "the salt should be asked for once a day")
+	next := c.dailySalt(context.Background(), day.Add(21*time.Hour))
+	assert.NotEqual(t, salt, next, "the salt should change the next day")
+	assert.Len(t, asked, 2)
+
+	other := NewClickRecorder("secret", "", nil, nil, &FakeVisitorSalts{
+		VisitorSaltFn: func(ctx context.Context, day time.Time) (string, error) {
+			return rand.Text(), nil
+		},
+	}, nil, logger)
+	assert.NotEqual(t, salt, other.dailySalt(context.Background(), day), "the salt of a day should not be derived from the configuration")
+
+	saltErr = errors.New("redis down")
+	dayAfter := day.Add(45 * time.Hour)
+	assert.Equal(t, "", c.dailySalt(context.Background(), dayAfter), "without a salt, there should be no visitor ids")
+	assert.Equal(t, "", c.dailySalt(context.Background(), dayAfter.Add(time.Second)))
+	assert.Len(t, asked, 3, "a salt that couldn't be had should not be asked for again right away")
+	saltErr = nil
+	assert.NotEmpty(t, c.dailySalt(context.Background(), dayAfter.Add(visitorSaltRetry)))
+	assert.Len(t, asked, 4)
+}
+
+func TestClickRecorder_Record_nil(t *testing.T) {
+	var c *ClickRecorder
+	c.Record(httptest.NewRequest(http.MethodGet, "/shortn/abc", nil), "abc")
+}
+
+// daySalts returns visitor salts named after their day
+func daySalts() *FakeVisitorSalts {
+	return &FakeVisitorSalts{
+		VisitorSaltFn: func(ctx context.Context, day time.Time) (string, error) {
+			return "salt of " + day.UTC().Format(time.DateOnly), nil
+		},
+	}
+}
+
+type FakeVisitorSalts struct {
+	VisitorSaltFn func(ctx context.Context, day time.Time) (string, error)
+}
+
+func (f *FakeVisitorSalts) VisitorSalt(ctx context.Context, day time.Time) (string, error) {
+	return f.VisitorSaltFn(ctx, day)
+}
+
+type FakeClickPublisher struct {
+	clicks []event.ClickEvent
+}
+
+func (f *FakeClickPublisher) Publish(click event.ClickEvent) {
+	f.clicks = append(f.clicks, click)
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []netip.Prefix
+		wantErr bool
+	}{
+		{
+			name:  "when nothing is set, no proxy is trusted",
+			value: "",
+		},
+		{
+			name:  "when addresses and ranges are set, parse them as ranges",
+			value: "10.0.0.0/8, 192.168.1.10,,2001:db8::/32",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("192.168.1.10/32"),
+				netip.MustParsePrefix("2001:db8::/32"),
+			},
+		},
+		{
+			name:    "when an address is invalid, return an error",
+			value:   "10.0.0.0/8, proxy.internal",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrustedProxies(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseTrustedProxies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
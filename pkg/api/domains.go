@@ -0,0 +1,269 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+)
+
+const (
+	// UnknownHostDefault makes GetLongUrl serve hosts that are not a registered domain as the
+	// default one, as it did before branded domains existed
+	UnknownHostDefault = "default"
+	// UnknownHostNotFound makes GetLongUrl answer hosts that are not a registered domain with a 404.
+	// Any other fallback but these two is an absolute url they are redirected to.
+	UnknownHostNotFound = "not_found"
+)
+
+// domainPathValue is the wildcard of the route patterns that holds a domain, as in /{domain}
+const domainPathValue = "domain"
+
+// validDomain accepts lowercase host names of two labels or more, without a port
+var validDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// DomainRequest is the branded domain to register
+type DomainRequest struct {
+	Domain string `json:"domain"`
+}
+
+// DomainResponse is a registered domain
+type DomainResponse struct {
+	Domain string `json:"domain"`
+}
+
+// DomainsResponse has every registered domain, sorted
+type DomainsResponse struct {
+	Domains []string `json:"domains"`
+}
+
+// normalizeHost returns host, as in the Host header, lowercase and without its port or trailing dot.
+func normalizeHost(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// defaultHost returns the domain of PublicBaseUrl, which the short urls without a domain are
+// served at.
+func (h *UrlHandler) defaultHost() string {
+	base, err := url.Parse(h.PublicBaseUrl)
+	if err != nil {
+		return ""
+	}
+	return normalizeHost(base.Host)
+}
+
+// domainName returns the name of domain as shown in responses, the default one being "".
+func (h *UrlHandler) domainName(domain string) string {
+	if domain == "" {
+		return h.defaultHost()
+	}
+	return domain
+}
+
+// absoluteShortUrl returns the url the short url code on domain is followed at. Branded domains are
+// served over the same scheme as the default one.
+func (h *UrlHandler) absoluteShortUrl(domain string, code string) string {
+	if domain == "" {
+		return h.PublicBaseUrl + "/" + code
+	}
+	scheme := "https"
+	if base, err := url.Parse(h.PublicBaseUrl); err == nil && base.Scheme != "" {
+		scheme = base.Scheme
+	}
+	return scheme + "://" + domain + "/" + code
+}
+
+// queryDomain returns the domain a link operation is about, as set by the domain query parameter.
+// It needs not be registered anymore, so the links of a removed domain can still be managed.
+func (h *UrlHandler) queryDomain(r *http.Request) string {
+	domain := normalizeHost(r.URL.Query().Get("domain"))
+	if domain == h.defaultHost() {
+		return ""
+	}
+	return domain
+}
+
+// requestDomain checks that the domain requested for a new short url is registered, and returns it
+// as the domain to store it on if so.
+func (h *UrlHandler) requestDomain(ctx context.Context, w http.ResponseWriter, span trace.Span, requested string) (string, bool) {
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	domain, problem, err := h.newLinkDomain(storeCtx, requested)
+	if err != nil {
+		h.storeFailed(storeCtx, w, span, err, "checking the domain")
+		return "", false
+	}
+	if problem != nil {
+		h.fail(ctx, w, *problem)
+		return "", false
+	}
+	return domain, true
+}
+
+// newLinkDomain returns the domain a new short url requested on requested is stored on, or the
+// problem keeping it from being created there. err is set when the domains couldn't be checked.
+func (h *UrlHandler) newLinkDomain(ctx context.Context, requested string) (string, *Problem, error) {
+	domain := normalizeHost(requested)
+	if domain == "" || domain == h.defaultHost() {
+		return "", nil, nil
+	}
+	registered := false
+	if h.Domains != nil {
+		var err error
+		if registered, err = h.Domains.IsRegistered(ctx, domain); err != nil {
+			return "", nil, err
+		}
+	}
+	if !registered {
+		problem := newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid domain")
+		problem.Details = []ProblemDetail{{Field: "domain", Reason: "is not registered"}}
+		return "", &problem, nil
+	}
+	return domain, nil, nil
+}
+
+// hostDomain returns the domain a redirect is looked up on, the one of its Host header when it is
+// registered. Other hosts are answered as set by UnknownHostFallback, which may respond to them.
+func (h *UrlHandler) hostDomain(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span) (string, bool) {
+	host := normalizeHost(r.Host)
+	if host == "" || host == h.defaultHost() {
+		return "", true
+	}
+	if h.Domains != nil {
+		storeCtx, cancel := h.storeContext(ctx)
+		defer cancel()
+		registered, err := h.Domains.IsRegistered(storeCtx, host)
+		if err != nil {
+			h.storeFailed(storeCtx, w, span, err, "checking the domain")
+			return "", false
+		}
+		if registered {
+			return host, true
+		}
+	}
+	h.logger.Debug("Request for an unknown host", "host", host, "fallback", h.UnknownHostFallback)
+	switch h.UnknownHostFallback {
+	case "", UnknownHostDefault:
+		return "", true
+	case UnknownHostNotFound:
+		h.fail(ctx, w, newProblem(http.StatusNotFound, metrics.ErrorKindUnknownHost, "the host is not a known domain"))
+	default:
+		h.MetricsHooks.OnRequestFailed(metrics.ErrorKindUnknownHost)
+		http.Redirect(w, r, h.UnknownHostFallback, http.StatusFound)
+	}
+	return "", false
+}
+
+// RegisterDomain registers the branded domain of the request, so short urls can be created on it
+// and followed at it. Registering a domain twice is not an error.
+func (h *UrlHandler) RegisterDomain(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.RegisterDomain")
+	defer span.End()
+	if h.Domains == nil {
+		h.notEnabled(ctx, w, "branded domains")
+		return
+	}
+	var req DomainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Error("Error decoding the request to a known struct", "error", err)
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid request"))
+		return
+	}
+	domain := strings.TrimSuffix(strings.ToLower(req.Domain), ".")
+	h.logger.Debug("RegisterDomain", "domain", domain)
+	var reason string
+	switch {
+	case !validDomain.MatchString(domain):
+		reason = "must be a host name without a port"
+	case domain == h.defaultHost():
+		reason = "is the default domain"
+	}
+	if reason != "" {
+		problem := newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid domain")
+		problem.Details = []ProblemDetail{{Field: "domain", Reason: reason}}
+		h.fail(ctx, w, problem)
+		return
+	}
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	if err := h.Domains.Register(storeCtx, domain); err != nil {
+		h.storeFailed(storeCtx, w, span, err, "registering the domain")
+		return
+	}
+	h.writeJson(ctx, w, span, DomainResponse{Domain: domain})
+}
+
+// GetDomains returns the registered domains, which don't include the default one.
+func (h *UrlHandler) GetDomains(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.GetDomains")
+	defer span.End()
+	if h.Domains == nil {
+		h.notEnabled(ctx, w, "branded domains")
+		return
+	}
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	domains, err := h.Domains.Domains(storeCtx)
+	if err != nil {
+		h.storeFailed(storeCtx, w, span, err, "getting the domains")
+		return
+	}
+	if domains == nil {
+		domains = []string{}
+	}
+	slices.Sort(domains)
+	h.writeJson(ctx, w, span, DomainsResponse{Domains: domains})
+}
+
+// DeleteDomain unregisters a domain. Its short urls are kept, but are not followed at it anymore.
+func (h *UrlHandler) DeleteDomain(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.DeleteDomain")
+	defer span.End()
+	if h.Domains == nil {
+		h.notEnabled(ctx, w, "branded domains")
+		return
+	}
+	domain := normalizeHost(r.PathValue(domainPathValue))
+	if domain == "" {
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "no domain provided"))
+		return
+	}
+	h.logger.Debug("DeleteDomain", "domain", domain)
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	err := h.Domains.Remove(storeCtx, domain)
+	if errors.Is(err, storage.ErrNotFound) {
+		h.fail(ctx, w, newProblem(http.StatusNotFound, metrics.ErrorKindNotFound, "the domain is not registered"))
+		return
+	}
+	if err != nil {
+		h.storeFailed(storeCtx, w, span, err, "deleting the domain")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeJson responds with value as json.
+func (h *UrlHandler) writeJson(ctx context.Context, w http.ResponseWriter, span trace.Span, value any) {
+	response, err := json.Marshal(value)
+	if err != nil {
+		h.logger.Error("Error marshalling the response", "error", err)
+		failSpan(span, err)
+		h.fail(ctx, w, newProblem(http.StatusInternalServerError, metrics.ErrorKindEncode, "internal error generating the response"))
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJson)
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
@@ -0,0 +1,355 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+)
+
+// registeredDomains returns a domain store where only domains are registered
+func registeredDomains(domains ...string) *storage.FakeDomainStore {
+	return &storage.FakeDomainStore{
+		IsRegisteredFn: func(ctx context.Context, domain string) (bool, error) {
+			for _, registered := range domains {
+				if domain == registered {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+	}
+}
+
+func TestUrlHandler_GetLongUrl_byHost(t *testing.T) {
+	tests := []struct {
+		name         string
+		host         string
+		domains      storage.DomainStore
+		fallback     string
+		wantCode     int
+		wantKey      string
+		wantLocation string
+		wantFailure  string
+	}{
+		{
+			name:         "when the host is the default domain, the code is looked up on it",
+			host:         "sho.rt:443",
+			wantCode:     http.StatusFound,
+			wantKey:      "1234",
+			wantLocation: "http://google.com",
+		},
+		{
+			name:         "when the host is a registered domain, the code is looked up on it",
+			host:         "Go.Brand-A.com",
+			domains:      registeredDomains("go.brand-a.com"),
+			wantCode:     http.StatusFound,
+			wantKey:      "go.brand-a.com/1234",
+			wantLocation: "http://google.com",
+		},
+		{
+			name:         "when the host is unknown and falls back to the default domain, the code is looked up on it",
+			host:         "lnk.brand-b.io",
+			domains:      registeredDomains("go.brand-a.com"),
+			fallback:     UnknownHostDefault,
+			wantCode:     http.StatusFound,
+			wantKey:      "1234",
+			wantLocation: "http://google.com",
+		},
+		{
+			name:        "when the host is unknown and falls back to not found, response is not found",
+			host:        "lnk.brand-b.io",
+			domains:     registeredDomains("go.brand-a.com"),
+			fallback:    UnknownHostNotFound,
+			wantCode:    http.StatusNotFound,
+			wantFailure: metrics.ErrorKindUnknownHost,
+		},
+		{
+			name:         "when the host is unknown and falls back to a url, it is redirected there",
+			host:         "lnk.brand-b.io",
+			domains:      registeredDomains("go.brand-a.com"),
+			fallback:     "https://www.brand-b.io",
+			wantCode:     http.StatusFound,
+			wantLocation: "https://www.brand-b.io",
+			wantFailure:  metrics.ErrorKindUnknownHost,
+		},
+		{
+			name: "when the domains are unavailable, response is service unavailable",
+			host: "go.brand-a.com",
+			domains: &storage.FakeDomainStore{
+				IsRegisteredFn: func(ctx context.Context, domain string) (bool, error) {
+					return false, storage.ErrUnavailable
+				},
+			},
+			wantCode:    http.StatusServiceUnavailable,
+			wantFailure: metrics.ErrorKindUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var fetched, failedWith string
+			publisher := &FakeClickPublisher{}
+			h := &UrlHandler{
+				UrlStore: &storage.FakeUrlStore{
+					FetchFn: func(ctx context.Context, key string) (string, error) {
+						fetched = key
+						return "http://google.com", nil
+					},
+				},
+				Clicks:              NewClickRecorder("", "", nil, nil, nil, nil, logger, publisher),
+				PublicBaseUrl:       "https://sho.rt",
+				Domains:             tt.domains,
+				UnknownHostFallback: tt.fallback,
+				MetricsHooks: &metrics.MetricsHooks{
+					OnRequestFailedFn: func(errorKind string) {
+						failedWith = errorKind
+					},
+				},
+				logger: logger,
+			}
+			r := newCodeRequest(http.MethodGet, "/1234", "1234")
+			r.Host = tt.host
+			rr := httptest.NewRecorder()
+
+			h.GetLongUrl(rr, r)
+
+			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+			assert.Equal(t, tt.wantKey, fetched)
+			assert.Equal(t, tt.wantLocation, rr.Header().Get("Location"))
+			assert.Equal(t, tt.wantFailure, failedWith)
+			if tt.wantKey != "" {
+				assert.Len(t, publisher.clicks, 1)
+				assert.Equal(t, tt.wantKey, publisher.clicks[0].ShortUrl, "clicks should be counted on the domain")
+			} else {
+				assert.Empty(t, publisher.clicks)
+			}
+		})
+	}
+}
+
+func TestUrlHandler_ShortenUrl_onDomain(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantKey  string
+		wantBody *ShortenUrlResponse
+	}{
+		{
+			name:     "when the domain is registered, the short url is stored and served on it",
+			body:     `{"url":"http://google.com","alias":"my-link","domain":"go.brand-a.com"}`,
+			wantCode: http.StatusOK,
+			wantKey:  "go.brand-a.com/my-link",
+			wantBody: &ShortenUrlResponse{ShortUrl: "https://go.brand-a.com/my-link", Code: "my-link", Domain: "go.brand-a.com"},
+		},
+		{
+			name:     "when the domain is the default one, the short url is stored without a domain",
+			body:     `{"url":"http://google.com","alias":"my-link","domain":"SHO.RT"}`,
+			wantCode: http.StatusOK,
+			wantKey:  "my-link",
+			wantBody: &ShortenUrlResponse{ShortUrl: "https://sho.rt/my-link", Code: "my-link", Domain: "sho.rt"},
+		},
+		{
+			name:     "when the domain is not registered, response is bad request",
+			body:     `{"url":"http://google.com","alias":"my-link","domain":"lnk.brand-b.io"}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var stored string
+			h := &UrlHandler{
+				UrlStore: &storage.FakeUrlStore{
+					FetchFn: func(ctx context.Context, key string) (string, error) {
+						return "", storage.ErrNotFound
+					},
+				},
+				Outbox: &storage.FakeOutbox{
+					StoreWithOutboxFn: func(ctx context.Context, key string, link storage.Link, entry storage.OutboxEntry) error {
+						stored = key
+						return nil
+					},
+				},
+				PublicBaseUrl: "https://sho.rt",
+				Domains:       registeredDomains("go.brand-a.com"),
+				logger:        logger,
+			}
+			rr := httptest.NewRecorder()
+
+			h.ShortenUrl(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(tt.body))))
+
+			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+			assert.Equal(t, tt.wantKey, stored)
+			if tt.wantBody != nil {
+				var got ShortenUrlResponse
+				assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+				assert.Equal(t, *tt.wantBody, got)
+			}
+		})
+	}
+}
+
+func TestUrlHandler_RegisterDomain(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		registerErr  error
+		wantCode     int
+		wantRegister string
+		wantDetails  []ProblemDetail
+	}{
+		{
+			name:         "when the domain is valid, it is registered lowercase",
+			body:         `{"domain":"Go.Brand-A.com"}`,
+			wantCode:     http.StatusOK,
+			wantRegister: "go.brand-a.com",
+		},
+		{
+			name:        "when the domain has a port, response is bad request",
+			body:        `{"domain":"go.brand-a.com:8080"}`,
+			wantCode:    http.StatusBadRequest,
+			wantDetails: []ProblemDetail{{Field: "domain", Reason: "must be a host name without a port"}},
+		},
+		{
+			name:        "when the domain is the default one, response is bad request",
+			body:        `{"domain":"sho.rt"}`,
+			wantCode:    http.StatusBadRequest,
+			wantDetails: []ProblemDetail{{Field: "domain", Reason: "is the default domain"}},
+		},
+		{
+			name:         "when the domains are unavailable, response is service unavailable",
+			body:         `{"domain":"go.brand-a.com"}`,
+			registerErr:  storage.ErrUnavailable,
+			wantCode:     http.StatusServiceUnavailable,
+			wantRegister: "go.brand-a.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var registered string
+			h := &UrlHandler{
+				PublicBaseUrl: "https://sho.rt",
+				Domains: &storage.FakeDomainStore{
+					RegisterFn: func(ctx context.Context, domain string) error {
+						registered = domain
+						return tt.registerErr
+					},
+				},
+				logger: logger,
+			}
+			rr := httptest.NewRecorder()
+
+			h.RegisterDomain(rr, httptest.NewRequest(http.MethodPost, "/api/v1/domains", bytes.NewReader([]byte(tt.body))))
+
+			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+			assert.Equal(t, tt.wantRegister, registered)
+			if tt.wantCode == http.StatusOK {
+				var got DomainResponse
+				assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+				assert.Equal(t, DomainResponse{Domain: tt.wantRegister}, got)
+			}
+			if tt.wantDetails != nil {
+				var problem Problem
+				assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+				assert.Equal(t, tt.wantDetails, problem.Details)
+			}
+		})
+	}
+}
+
+func TestUrlHandler_GetDomains(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	var domains []string
+	h := &UrlHandler{
+		Domains: &storage.FakeDomainStore{
+			DomainsFn: func(ctx context.Context) ([]string, error) {
+				return domains, nil
+			},
+		},
+		logger: logger,
+	}
+
+	rr := httptest.NewRecorder()
+	h.GetDomains(rr, httptest.NewRequest(http.MethodGet, "/api/v1/domains", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"domains":[]}`, rr.Body.String(), "no domains should be an empty list")
+
+	domains = []string{"lnk.brand-b.io", "go.brand-a.com"}
+	rr = httptest.NewRecorder()
+	h.GetDomains(rr, httptest.NewRequest(http.MethodGet, "/api/v1/domains", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"domains":["go.brand-a.com","lnk.brand-b.io"]}`, rr.Body.String())
+}
+
+func TestUrlHandler_DeleteDomain(t *testing.T) {
+	tests := []struct {
+		name      string
+		domain    string
+		removeErr error
+		wantCode  int
+	}{
+		{
+			name:     "when the domain is registered, it is removed",
+			domain:   "go.brand-a.com",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:      "when the domain is not registered, response is not found",
+			domain:    "go.brand-a.com",
+			removeErr: storage.ErrNotFound,
+			wantCode:  http.StatusNotFound,
+		},
+		{
+			name:      "when removing the domain fails, response is internal server error",
+			domain:    "go.brand-a.com",
+			removeErr: errors.New("expected error"),
+			wantCode:  http.StatusInternalServerError,
+		},
+		{
+			name:     "when no domain is provided, response is bad request",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			h := &UrlHandler{
+				Domains: &storage.FakeDomainStore{
+					RemoveFn: func(ctx context.Context, domain string) error {
+						assert.Equal(t, tt.domain, domain)
+						return tt.removeErr
+					},
+				},
+				logger: logger,
+			}
+			r := httptest.NewRequest(http.MethodDelete, "/api/v1/domains/"+tt.domain, nil)
+			r.SetPathValue(domainPathValue, tt.domain)
+			rr := httptest.NewRecorder()
+
+			h.DeleteDomain(rr, r)
+
+			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+		})
+	}
+}
@@ -0,0 +1,494 @@
+package api
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"urlshortn/pkg/metrics"
+)
+
+// openApiSpec is the OpenAPI 3.1 description of the api
+//
+//go:embed openapi.json
+var openApiSpec []byte
+
+// openApiUrl is the location the spec is compiled from, its schemas are referred to by json pointers
+// into it
+const openApiUrl = "mem://shortn/openapi.json"
+
+const (
+	// maxRequestBodySize bounds the json request bodies read to validate them
+	maxRequestBodySize = 4 << 20
+	// maxRecordedResponseSize bounds the copy of a response kept to validate it, larger responses are
+	// only streamed to the client
+	maxRecordedResponseSize = 4 << 20
+)
+
+// OpenApiHandler serves the OpenAPI description of the api.
+func OpenApiHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJson)
+		w.Write(openApiSpec)
+	})
+}
+
+// openApiDoc holds the parts of the spec the validator needs, schemas are compiled straight from
+// the document instead
+type openApiDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters map[string]openApiParameter `json:"parameters"`
+		Responses  map[string]openApiResponse  `json:"responses"`
+	} `json:"components"`
+}
+
+type openApiOperation struct {
+	OperationId string             `json:"operationId"`
+	Parameters  []openApiParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool                       `json:"required"`
+		Content  map[string]json.RawMessage `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]openApiResponse `json:"responses"`
+}
+
+type openApiParameter struct {
+	Ref      string `json:"$ref"`
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+}
+
+type openApiResponse struct {
+	Ref     string `json:"$ref"`
+	Headers map[string]struct {
+		Required bool `json:"required"`
+	} `json:"headers"`
+	Content map[string]struct {
+		Schema json.RawMessage `json:"schema"`
+	} `json:"content"`
+}
+
+// operation is an operation of the spec with its schemas compiled
+type operation struct {
+	id         string
+	path       string
+	parameters []parameter
+	// body is the schema of the json request body, nil when the operation takes none
+	body         *jsonschema.Schema
+	bodyRequired bool
+	// streamed are the other media types of the request body, which are left for the handler to read
+	// as it goes
+	streamed  []string
+	responses map[string]response
+}
+
+type parameter struct {
+	name     string
+	in       string
+	required bool
+	schema   *jsonschema.Schema
+}
+
+type response struct {
+	headers []string
+	// content has the schema of every media type of the response, nil for the ones not validated
+	content map[string]*jsonschema.Schema
+}
+
+// SpecValidator checks requests, and optionally responses, against the OpenAPI description of the
+// api. Requests of operations the spec does not describe are let through untouched.
+type SpecValidator struct {
+	// operations by the pattern of their method and path, as registered in mux
+	operations map[string]*operation
+	// mux only finds the operation of a request, its handlers are never called
+	mux               *http.ServeMux
+	validateResponses bool
+	metricsHooks      *metrics.MetricsHooks
+	logger            *slog.Logger
+}
+
+// NewSpecValidator compiles the spec into a validator, which also checks the responses when
+// validateResponses is set. The responses that do not match the spec are logged, not changed.
+func NewSpecValidator(validateResponses bool, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) (*SpecValidator, error) {
+	var doc openApiDoc
+	if err := json.Unmarshal(openApiSpec, &doc); err != nil {
+		return nil, fmt.Errorf("decoding the openapi spec: %w", err)
+	}
+	schemaDoc, err := jsonschema.UnmarshalJSON(bytes.NewReader(openApiSpec))
+	if err != nil {
+		return nil, fmt.Errorf("decoding the openapi spec: %w", err)
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.DefaultDraft(jsonschema.Draft2020)
+	compiler.AssertFormat()
+	if err := compiler.AddResource(openApiUrl, schemaDoc); err != nil {
+		return nil, fmt.Errorf("loading the openapi spec: %w", err)
+	}
+
+	v := &SpecValidator{
+		operations:        map[string]*operation{},
+		mux:               http.NewServeMux(),
+		validateResponses: validateResponses,
+		metricsHooks:      metricsHooks,
+		logger:            logger,
+	}
+	for path, item := range doc.Paths {
+		for method, raw := range item {
+			if !isHttpMethod(method) {
+				continue
+			}
+			var spec openApiOperation
+			if err := json.Unmarshal(raw, &spec); err != nil {
+				return nil, fmt.Errorf("decoding %s %s: %w", method, path, err)
+			}
+			op, err := compileOperation(compiler, &doc, path, method, spec)
+			if err != nil {
+				return nil, fmt.Errorf("compiling %s %s: %w", method, path, err)
+			}
+			pattern := strings.ToUpper(method) + " " + path
+			v.operations[pattern] = op
+			v.mux.Handle(pattern, http.NotFoundHandler())
+		}
+	}
+	return v, nil
+}
+
+func isHttpMethod(method string) bool {
+	switch method {
+	case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+		return true
+	}
+	return false
+}
+
+func compileOperation(compiler *jsonschema.Compiler, doc *openApiDoc, path string, method string, spec openApiOperation) (*operation, error) {
+	op := &operation{id: spec.OperationId, path: path, responses: map[string]response{}}
+	at := []string{"paths", path, method}
+	for i, param := range spec.Parameters {
+		paramAt := append(at, "parameters", strconv.Itoa(i))
+		if param.Ref != "" {
+			name, ok := strings.CutPrefix(param.Ref, "#/components/parameters/")
+			if !ok || doc.Components.Parameters[name].Name == "" {
+				return nil, fmt.Errorf("unknown parameter %s", param.Ref)
+			}
+			param = doc.Components.Parameters[name]
+			paramAt = []string{"components", "parameters", name}
+		}
+		schema, err := compiler.Compile(schemaUrl(append(paramAt, "schema")...))
+		if err != nil {
+			return nil, err
+		}
+		op.parameters = append(op.parameters, parameter{name: param.Name, in: param.In, required: param.Required, schema: schema})
+	}
+	if spec.RequestBody != nil {
+		if _, ok := spec.RequestBody.Content[contentTypeJson]; !ok {
+			return nil, errors.New("request bodies must have a json media type")
+		}
+		for mediaType := range spec.RequestBody.Content {
+			if mediaType != contentTypeJson {
+				op.streamed = append(op.streamed, mediaType)
+			}
+		}
+		schema, err := compiler.Compile(schemaUrl(append(at, "requestBody", "content", contentTypeJson, "schema")...))
+		if err != nil {
+			return nil, err
+		}
+		op.body = schema
+		op.bodyRequired = spec.RequestBody.Required
+	}
+	for status, resp := range spec.Responses {
+		respAt := append(at, "responses", status)
+		if resp.Ref != "" {
+			name, ok := strings.CutPrefix(resp.Ref, "#/components/responses/")
+			if !ok || doc.Components.Responses[name].Content == nil {
+				return nil, fmt.Errorf("unknown response %s", resp.Ref)
+			}
+			resp = doc.Components.Responses[name]
+			respAt = []string{"components", "responses", name}
+		}
+		compiled := response{content: map[string]*jsonschema.Schema{}}
+		for header, spec := range resp.Headers {
+			if spec.Required {
+				compiled.headers = append(compiled.headers, header)
+			}
+		}
+		for mediaType, content := range resp.Content {
+			compiled.content[mediaType] = nil
+			if content.Schema == nil || !isJson(mediaType) {
+				continue
+			}
+			schema, err := compiler.Compile(schemaUrl(append(respAt, "content", mediaType, "schema")...))
+			if err != nil {
+				return nil, err
+			}
+			compiled.content[mediaType] = schema
+		}
+		op.responses[status] = compiled
+	}
+	return op, nil
+}
+
+// schemaUrl returns the url of the schema at the json pointer made of tokens
+func schemaUrl(tokens ...string) string {
+	var sb strings.Builder
+	sb.WriteString(openApiUrl + "#")
+	for _, token := range tokens {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+		sb.WriteString("/" + url.PathEscape(token))
+	}
+	return sb.String()
+}
+
+func isJson(mediaType string) bool {
+	return mediaType == contentTypeJson || strings.HasSuffix(mediaType, "+json")
+}
+
+// operation returns the operation of r along with its path parameters, nil if the spec has none
+func (v *SpecValidator) operation(r *http.Request) (*operation, map[string]string) {
+	_, pattern := v.mux.Handler(r)
+	op := v.operations[pattern]
+	if op == nil {
+		return nil, nil
+	}
+	params := map[string]string{}
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range strings.Split(op.path, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok && i < len(segments) {
+			params[strings.TrimSuffix(name, "}")] = segments[i]
+		}
+	}
+	return op, params
+}
+
+// Middleware rejects the requests that do not match the spec with a 400 problem listing every
+// invalid field, and the json bodies larger than maxRequestBodySize with a 413 one. Path and query
+// parameters are validated as strings, and bodies as json whatever their content type, as the
+// handlers decode them, but for the streamed media types of the spec which are not validated.
+// Responses are handed to next's writer as they are written, and only copied when they are validated.
+func (v *SpecValidator) Middleware(next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, params := v.operation(r)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		details, err := v.checkRequest(w, r, op, params)
+		if err != nil {
+			v.logger.Debug("Request body is too large", "operation", op.id, "error", err)
+			v.reject(w, r, newProblem(http.StatusRequestEntityTooLarge, metrics.ErrorKindTooLarge, fmt.Sprintf("the request body can't be larger than %d bytes", maxRequestBodySize)))
+			return
+		}
+		if len(details) > 0 {
+			v.logger.Debug("Request does not match the spec", "operation", op.id, "details", details)
+			problem := newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid request")
+			problem.Details = details
+			v.reject(w, r, problem)
+			return
+		}
+		if !v.validateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.truncated {
+			v.logger.Debug("Response is too large to be validated", "operation", op.id, "status", recorder.status)
+			return
+		}
+		if err := checkResponse(r, op, recorder.status, w.Header(), recorder.body.Bytes()); err != nil {
+			v.logger.Warn("Response does not match the spec", "operation", op.id, "status", recorder.status, "error", err)
+		}
+	})
+}
+
+func (v *SpecValidator) reject(w http.ResponseWriter, r *http.Request, problem Problem) {
+	v.metricsHooks.OnRequestFailed(problem.Code)
+	writeProblem(r.Context(), w, problem, v.logger)
+}
+
+// checkRequest returns the problem of every invalid parameter and body field of r. The body is read
+// and put back for the handler, unless it has a streamed media type. It fails with the
+// *http.MaxBytesError of a body larger than maxRequestBodySize.
+func (v *SpecValidator) checkRequest(w http.ResponseWriter, r *http.Request, op *operation, pathParams map[string]string) ([]ProblemDetail, error) {
+	var details []ProblemDetail
+	query := r.URL.Query()
+	for _, param := range op.parameters {
+		value, ok := pathParams[param.name], param.in == "path"
+		if param.in == "query" {
+			// the handlers take empty query parameters as missing ones
+			value = query.Get(param.name)
+			ok = value != ""
+		}
+		if !ok {
+			if param.required {
+				details = append(details, ProblemDetail{Field: param.name, Reason: "is required"})
+			}
+			continue
+		}
+		details = append(details, schemaDetails(param.schema.Validate(value), param.name)...)
+	}
+	if op.body == nil {
+		return details, nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); slices.Contains(op.streamed, mediaType) {
+		return details, nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return details, err
+	}
+	if err != nil {
+		return append(details, ProblemDetail{Field: "body", Reason: "could not be read"}), nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.bodyRequired {
+			details = append(details, ProblemDetail{Field: "body", Reason: "is required"})
+		}
+		return details, nil
+	}
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return append(details, ProblemDetail{Field: "body", Reason: "is not valid json"}), nil
+	}
+	return append(details, schemaDetails(op.body.Validate(instance), "")...), nil
+}
+
+var schemaMessages = message.NewPrinter(language.English)
+
+// schemaDetails turns the innermost causes of a schema validation error into problem details. The
+// fields are named after the parameter, or after their path in the body when param is empty.
+func schemaDetails(err error, param string) []ProblemDetail {
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		if err != nil {
+			return []ProblemDetail{{Field: param, Reason: err.Error()}}
+		}
+		return nil
+	}
+	if len(validationErr.Causes) > 0 {
+		var details []ProblemDetail
+		for _, cause := range validationErr.Causes {
+			details = append(details, schemaDetails(cause, param)...)
+		}
+		return details
+	}
+	field := func(location ...string) string {
+		if param != "" {
+			return param
+		}
+		if len(location) == 0 {
+			return "body"
+		}
+		return strings.Join(location, ".")
+	}
+	if required, ok := validationErr.ErrorKind.(*kind.Required); ok {
+		details := make([]ProblemDetail, 0, len(required.Missing))
+		for _, missing := range required.Missing {
+			details = append(details, ProblemDetail{Field: field(append(slices.Clone(validationErr.InstanceLocation), missing)...), Reason: "is required"})
+		}
+		return details
+	}
+	return []ProblemDetail{{
+		Field:  field(validationErr.InstanceLocation...),
+		Reason: validationErr.ErrorKind.LocalizedString(schemaMessages),
+	}}
+}
+
+// CheckResponse returns why a response with status, header and body is not one the spec allows for
+// r, nil if it is.
+func (v *SpecValidator) CheckResponse(r *http.Request, status int, header http.Header, body []byte) error {
+	op, _ := v.operation(r)
+	if op == nil {
+		return fmt.Errorf("the spec has no operation for %s %s", r.Method, r.URL.Path)
+	}
+	return checkResponse(r, op, status, header, body)
+}
+
+func checkResponse(r *http.Request, op *operation, status int, header http.Header, body []byte) error {
+	resp, ok := op.responses[strconv.Itoa(status)]
+	if !ok {
+		if resp, ok = op.responses["default"]; !ok {
+			return fmt.Errorf("status %d is not documented for %s", status, op.id)
+		}
+	}
+	for _, name := range resp.headers {
+		if header.Get(name) == "" {
+			return fmt.Errorf("header %s is missing", name)
+		}
+	}
+	if len(resp.content) == 0 {
+		if len(body) > 0 {
+			return fmt.Errorf("status %d of %s has no content, got %d bytes", status, op.id, len(body))
+		}
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("invalid content type %q: %w", header.Get("Content-Type"), err)
+	}
+	schema, ok := resp.content[mediaType]
+	if !ok {
+		return fmt.Errorf("content type %s is not documented for status %d of %s", mediaType, status, op.id)
+	}
+	// HEAD responses have the headers of GET ones without their body
+	if schema == nil || r.Method == http.MethodHead {
+		return nil
+	}
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("body is not valid json: %w", err)
+	}
+	return schema.Validate(instance)
+}
+
+// bodyRecorder keeps a copy of the status and body written through it, up to maxRecordedResponseSize
+// bytes of body
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// truncated is set once the body outgrew the copy, which is then dropped
+	truncated bool
+}
+
+func (r *bodyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	switch {
+	case r.truncated:
+	case r.body.Len()+len(b) > maxRecordedResponseSize:
+		r.truncated = true
+		r.body = bytes.Buffer{}
+	default:
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *bodyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
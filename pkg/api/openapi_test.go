@@ -0,0 +1,287 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"urlshortn/pkg/metrics"
+)
+
+func TestSpecValidator_Middleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		body        string
+		wantCalled  bool
+		wantBody    string
+		wantDetails []ProblemDetail
+	}{
+		{
+			name:       "when the body matches the spec, the request reaches the handler with its body",
+			method:     http.MethodPost,
+			target:     "/shortn",
+			body:       `{"url":"http://mercadolibre.com.ar"}`,
+			wantCalled: true,
+			wantBody:   `{"url":"http://mercadolibre.com.ar"}`,
+		},
+		{
+			name:        "when the url is missing, it is reported as required",
+			method:      http.MethodPost,
+			target:      "/shortn",
+			body:        `{}`,
+			wantDetails: []ProblemDetail{{Field: "url", Reason: "is required"}},
+		},
+		{
+			name:        "when the url is not a string, its type is reported",
+			method:      http.MethodPost,
+			target:      "/shortn",
+			body:        `{"url":1}`,
+			wantDetails: []ProblemDetail{{Field: "url", Reason: "got number, want string"}},
+		},
+		{
+			name:        "when the body is not json, the body is reported",
+			method:      http.MethodPost,
+			target:      "/shortn",
+			body:        `url=http://mercadolibre.com.ar`,
+			wantDetails: []ProblemDetail{{Field: "body", Reason: "is not valid json"}},
+		},
+		{
+			name:        "when the body is missing, it is reported as required",
+			method:      http.MethodPost,
+			target:      "/shortn",
+			wantDetails: []ProblemDetail{{Field: "body", Reason: "is required"}},
+		},
+		{
+			name:        "when query parameters are invalid, every one of them is reported",
+			method:      http.MethodGet,
+			target:      "/shortn/1234/stats?granularity=minute&from=yesterday&to=2024-01-01",
+			wantDetails: []ProblemDetail{{Field: "granularity", Reason: "value must be one of 'hour', 'day'"}, {Field: "from", Reason: "'yesterday' does not match pattern '^[0-9]{4}-[0-9]{2}-[0-9]{2}(T.+)?$'"}},
+		},
+		{
+			name:       "when query parameters are empty, they are taken as missing",
+			method:     http.MethodGet,
+			target:     "/shortn/1234/stats?granularity=",
+			wantCalled: true,
+		},
+		{
+			name:       "when the spec has no operation for the request, it reaches the handler",
+			method:     http.MethodPut,
+			target:     "/shortn/1234",
+			body:       `not json`,
+			wantCalled: true,
+			wantBody:   `not json`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var failedWith string
+			v, err := NewSpecValidator(false, &metrics.MetricsHooks{
+				OnRequestFailedFn: func(errorKind string) {
+					failedWith = errorKind
+				},
+			}, logger)
+			assert.Nil(t, err)
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				body, _ := io.ReadAll(r.Body)
+				assert.Equal(t, tt.wantBody, string(body))
+			})
+			rr := httptest.NewRecorder()
+
+			v.Middleware(next).ServeHTTP(rr, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.wantCalled, called)
+			if tt.wantCalled {
+				assert.Equal(t, http.StatusOK, rr.Code)
+				return
+			}
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			assert.Equal(t, contentTypeProblem, rr.Header().Get("Content-Type"))
+			assert.Equal(t, metrics.ErrorKindInvalidRequest, failedWith)
+			var problem Problem
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+			assert.Equal(t, metrics.ErrorKindInvalidRequest, problem.Code)
+			assert.ElementsMatch(t, tt.wantDetails, problem.Details)
+		})
+	}
+}
+
+func TestSpecValidator_Middleware_tooLarge(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	var failedWith string
+	v, err := NewSpecValidator(false, &metrics.MetricsHooks{
+		OnRequestFailedFn: func(errorKind string) {
+			failedWith = errorKind
+		},
+	}, logger)
+	assert.Nil(t, err)
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	rr := httptest.NewRecorder()
+	body := `{"url":"http://mercadolibre.com.ar/` + strings.Repeat("a", maxRequestBodySize) + `"}`
+
+	v.Middleware(next).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/shortn", strings.NewReader(body)))
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Equal(t, metrics.ErrorKindTooLarge, failedWith)
+	var problem Problem
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+	assert.Equal(t, metrics.ErrorKindTooLarge, problem.Code)
+}
+
+func TestSpecValidator_Middleware_responses(t *testing.T) {
+	tests := []struct {
+		name              string
+		validateResponses bool
+		size              int
+		wantRecorded      bool
+	}{
+		{
+			name:              "when responses aren't validated, the handler writes straight to the client",
+			validateResponses: false,
+			size:              10,
+		},
+		{
+			name:              "when responses are validated, a copy of the response is kept",
+			validateResponses: true,
+			size:              10,
+			wantRecorded:      true,
+		},
+		{
+			name:              "when a validated response is too large, it is only written to the client",
+			validateResponses: true,
+			size:              maxRecordedResponseSize + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			v, err := NewSpecValidator(tt.validateResponses, nil, logger)
+			assert.Nil(t, err)
+			rr := httptest.NewRecorder()
+			var recorder *bodyRecorder
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				recorder, _ = w.(*bodyRecorder)
+				assert.Equal(t, !tt.validateResponses, w == http.ResponseWriter(rr))
+				w.Header().Set("Content-Type", contentTypeJson)
+				w.Write([]byte(strings.Repeat(" ", tt.size/2)))
+				w.Write([]byte(strings.Repeat(" ", tt.size-tt.size/2)))
+			})
+
+			v.Middleware(next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/shortn/1234", nil))
+
+			assert.Equal(t, tt.size, rr.Body.Len(), "the whole response should reach the client")
+			assert.Equal(t, tt.wantRecorded, recorder != nil && recorder.body.Len() == tt.size)
+		})
+	}
+}
+
+func TestSpecValidator_CheckResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		status      int
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{
+			name:        "when the response matches the spec, there is no error",
+			method:      http.MethodPost,
+			target:      "/shortn",
+			status:      http.StatusOK,
+			contentType: contentTypeJson,
+			body:        `{"short_url":"https://sho.rt/1234","code":"1234","domain":"sho.rt"}`,
+		},
+		{
+			name:        "when the body misses a required property, it fails",
+			method:      http.MethodPost,
+			target:      "/shortn",
+			status:      http.StatusOK,
+			contentType: contentTypeJson,
+			body:        `{"shortUrl":"https://sho.rt/1234","code":"1234","domain":"sho.rt"}`,
+			wantErr:     true,
+		},
+		{
+			name:        "when the status is not documented, it fails",
+			method:      http.MethodPost,
+			target:      "/shortn",
+			status:      http.StatusTeapot,
+			contentType: contentTypeProblem,
+			body:        `{"type":"about:blank","title":"I'm a teapot","status":418,"code":"teapot"}`,
+			wantErr:     true,
+		},
+		{
+			name:        "when the content type is not documented, it fails",
+			method:      http.MethodPost,
+			target:      "/shortn",
+			status:      http.StatusBadRequest,
+			contentType: "text/plain",
+			body:        `invalid request`,
+			wantErr:     true,
+		},
+		{
+			name:    "when a response without content has a body, it fails",
+			method:  http.MethodDelete,
+			target:  "/shortn/1234",
+			status:  http.StatusOK,
+			body:    `deleted`,
+			wantErr: true,
+		},
+		{
+			name:    "when the spec has no operation for the request, it fails",
+			method:  http.MethodGet,
+			target:  "/metrics",
+			status:  http.StatusOK,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			v, err := NewSpecValidator(false, nil, logger)
+			assert.Nil(t, err)
+			header := http.Header{}
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+
+			err = v.CheckResponse(httptest.NewRequest(tt.method, tt.target, nil), tt.status, header, []byte(tt.body))
+
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
+
+func TestOpenApiHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+
+	OpenApiHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, contentTypeJson, rr.Header().Get("Content-Type"))
+	var spec map[string]any
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &spec))
+	assert.Equal(t, "3.1.0", spec["openapi"])
+}
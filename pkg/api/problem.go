@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	contentTypeJson    = "application/json"
+	contentTypeProblem = "application/problem+json"
+	contentTypeHtml    = "text/html; charset=utf-8"
+
+	// RequestIdHeader carries the id of a request, taken from the client when it sends a valid one
+	RequestIdHeader = "X-Request-Id"
+)
+
+// Problem is the body of every error response, an RFC 9457 problem details object. Detail is the
+// message for humans, while the extension members Code, a stable identifier of the error meant for
+// programs, Details, the problem of every invalid field, and RequestId, the id the request was
+// logged with, are specific to this API.
+type Problem struct {
+	Type      string          `json:"type"`
+	Title     string          `json:"title"`
+	Status    int             `json:"status"`
+	Detail    string          `json:"detail,omitempty"`
+	Code      string          `json:"code"`
+	Details   []ProblemDetail `json:"details,omitempty"`
+	RequestId string          `json:"request_id,omitempty"`
+}
+
+// ProblemDetail is the reason a field of a request is invalid.
+type ProblemDetail struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// newProblem returns a problem without a type of its own, as RFC 9457 suggests when the status
+// says it all, so its title is the status text.
+func newProblem(status int, code string, detail string) Problem {
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// htmlErrorsKey marks the context of the requests whose errors are shown as an HTML page
+type htmlErrorsKey struct{}
+
+// withHtmlErrors marks ctx so that errors are shown as an HTML page when r comes from a browser,
+// which sends text/html first in its Accept header.
+func withHtmlErrors(ctx context.Context, r *http.Request) context.Context {
+	accept, _, _ := strings.Cut(r.Header.Get("Accept"), ",")
+	if mediaType, _, err := mime.ParseMediaType(accept); err != nil || mediaType != "text/html" {
+		return ctx
+	}
+	return context.WithValue(ctx, htmlErrorsKey{}, true)
+}
+
+var problemPage = template.Must(template.New("problem").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+{{if .RequestId}}<p><small>Request id: {{.RequestId}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+// fail responds with problem and reports its code as the reason the request failed.
+func (h *UrlHandler) fail(ctx context.Context, w http.ResponseWriter, problem Problem) {
+	h.MetricsHooks.OnRequestFailed(problem.Code)
+	writeProblem(ctx, w, problem, h.logger)
+}
+
+// writeProblem responds with problem, tagged with the id of the request, as an HTML page when ctx
+// asks for one and as json otherwise.
+func writeProblem(ctx context.Context, w http.ResponseWriter, problem Problem, logger *slog.Logger) {
+	problem.RequestId = RequestIdFrom(ctx)
+	if html, _ := ctx.Value(htmlErrorsKey{}).(bool); html {
+		w.Header().Set("Content-Type", contentTypeHtml)
+		w.WriteHeader(problem.Status)
+		if err := problemPage.Execute(w, problem); err != nil {
+			logger.Error("Error rendering the error page", "error", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeProblem)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// requestIdKey is the context key of the request id
+type requestIdKey struct{}
+
+// validRequestId limits the request ids taken from clients to ones safe to log and send back
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// WithRequestId gives every request an id, the one in its X-Request-Id header when valid or a random
+// one otherwise. The id is sent back in the same header and is available through RequestIdFrom.
+func WithRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if !validRequestId.MatchString(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+// RequestIdFrom returns the id WithRequestId gave to the request of ctx, empty if it has none.
+func RequestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"urlshortn/pkg/metrics"
+)
+
+func TestUrlHandler_fail(t *testing.T) {
+	tests := []struct {
+		name            string
+		accept          string
+		wantContentType string
+	}{
+		{
+			name:            "when the client doesn't ask for html, the problem is json",
+			accept:          "application/json",
+			wantContentType: contentTypeProblem,
+		},
+		{
+			name:            "when a browser asks for html, the problem is a page",
+			accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			wantContentType: contentTypeHtml,
+		},
+		{
+			name:            "when html is not the preferred type, the problem is json",
+			accept:          "application/json, text/html",
+			wantContentType: contentTypeProblem,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var failedWith string
+			h := &UrlHandler{
+				MetricsHooks: &metrics.MetricsHooks{
+					OnRequestFailedFn: func(errorKind string) {
+						failedWith = errorKind
+					},
+				},
+				logger: logger,
+			}
+			r := httptest.NewRequest(http.MethodGet, "/shortn/1234", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set(RequestIdHeader, "request-1")
+			rr := httptest.NewRecorder()
+
+			WithRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.fail(withHtmlErrors(r.Context(), r), w, newProblem(http.StatusNotFound, metrics.ErrorKindNotFound, "the provided short url is not available"))
+			})).ServeHTTP(rr, r)
+
+			assert.Equal(t, http.StatusNotFound, rr.Code)
+			assert.Equal(t, tt.wantContentType, rr.Header().Get("Content-Type"))
+			assert.Equal(t, metrics.ErrorKindNotFound, failedWith)
+			if tt.wantContentType == contentTypeHtml {
+				assert.Contains(t, rr.Body.String(), "<h1>Not Found</h1>")
+				assert.Contains(t, rr.Body.String(), "request-1")
+				return
+			}
+			var problem Problem
+			assert.Nil(t, json.NewDecoder(rr.Body).Decode(&problem))
+			assert.Equal(t, Problem{
+				Type:      "about:blank",
+				Title:     "Not Found",
+				Status:    http.StatusNotFound,
+				Detail:    "the provided short url is not available",
+				Code:      metrics.ErrorKindNotFound,
+				RequestId: "request-1",
+			}, problem)
+		})
+	}
+}
+
+func TestWithRequestId(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		wantKept bool
+	}{
+		{
+			name:     "when the client sends a valid id, it is kept",
+			header:   "4bf92f3577b34da6",
+			wantKept: true,
+		},
+		{
+			name:   "when the client sends no id, a new one is made",
+			header: "",
+		},
+		{
+			name:   "when the client sends an id that is not safe to log, a new one is made",
+			header: "id\nwith a new line",
+		},
+		{
+			name:   "when the client sends an id that is too long, a new one is made",
+			header: strings.Repeat("a", 65),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := WithRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = RequestIdFrom(r.Context())
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(RequestIdHeader, tt.header)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, r)
+
+			assert.NotEmpty(t, got)
+			assert.Equal(t, got, rr.Header().Get(RequestIdHeader), "the id should be sent back")
+			if tt.wantKept {
+				assert.Equal(t, tt.header, got)
+			} else {
+				assert.NotEqual(t, tt.header, got)
+			}
+		})
+	}
+}
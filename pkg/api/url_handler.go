@@ -4,10 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"github.com/redis/go-redis/v9"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
 	"net/http"
+	"regexp"
 	"strings"
+	"time"
 	"urlshortn/pkg/event"
 	"urlshortn/pkg/hash"
 	"urlshortn/pkg/metrics"
@@ -15,10 +22,24 @@ import (
 	"urlshortn/pkg/token"
 )
 
+// shortUrlAttribute is the span attribute holding the short url a request is about
+const shortUrlAttribute = "shortn.short_url"
+
+// codePathValue is the wildcard of the route patterns that holds the short url, as in /{code}
+const codePathValue = "code"
+
+var tracer = otel.Tracer("urlshortn/pkg/api")
+
 type HttpUrlHandler interface {
 	ShortenUrl(http.ResponseWriter, *http.Request)
+	ShortenUrls(http.ResponseWriter, *http.Request)
 	GetLongUrl(http.ResponseWriter, *http.Request)
+	GetLink(http.ResponseWriter, *http.Request)
 	DeleteShortenUrl(http.ResponseWriter, *http.Request)
+	GetClickStats(http.ResponseWriter, *http.Request)
+	RegisterDomain(http.ResponseWriter, *http.Request)
+	GetDomains(http.ResponseWriter, *http.Request)
+	DeleteDomain(http.ResponseWriter, *http.Request)
 }
 
 type UrlHandler struct {
@@ -26,178 +47,626 @@ type UrlHandler struct {
 	TokenHasher           hash.TokenHasher
 	UrlStore              storage.Store
 	ShortUrlEventProducer interface {
-		Produce(content string) error
+		Produce(value []byte, headers map[string]string) error
+		ProduceBatch(events []event.OutgoingEvent) []error
+	}
+	// EventContentType is the format events are produced in, see event.EncodeShortUrlEvent
+	EventContentType string
+	// Outbox, when set, makes ShortenUrl store the url synchronously along with its event, which is
+	// then published by an event.OutboxRelay instead of ShortUrlEventProducer
+	Outbox interface {
+		StoreWithOutbox(ctx context.Context, key string, link storage.Link, entry storage.OutboxEntry) error
+		StoreBatchWithOutbox(ctx context.Context, links map[string]storage.Link, entries map[string]storage.OutboxEntry) error
+	}
+	// Clicks records successful redirects, nil disables click events
+	Clicks     *ClickRecorder
+	ClickStore interface {
+		ClickStats(ctx context.Context, shortUrl string, from time.Time, to time.Time, granularity string, top int) (storage.ClickStats, error)
 	}
+	// PublicBaseUrl is what the absolute short urls start with, the scheme and host they are
+	// served at without a trailing slash. Its host is the default domain.
+	PublicBaseUrl string
+	// Domains are the branded domains short urls can also be served at
+	Domains storage.DomainStore
+	// UnknownHostFallback is how GetLongUrl answers hosts that are neither the default domain nor
+	// a registered one, see UnknownHostDefault
+	UnknownHostFallback string
+	// MaxBatchItems is how many urls ShortenUrls takes at most in a single request
+	MaxBatchItems int
+	// StoreTimeout bounds every storage call made while serving a request, 0 means no bound other
+	// than the client going away
+	StoreTimeout time.Duration
 	MetricsHooks *metrics.MetricsHooks
 	logger       *slog.Logger
 }
 
-func NewUrlHandler(tokenGen token.TokenGenerator, urlTokenHasher hash.TokenHasher, urlStore storage.Store, shortUrlEventProducer event.Producer, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) UrlHandler {
+// UrlHandlerConfigs has what a UrlHandler is made of, see the UrlHandler fields of the same names.
+// Outbox, Clicks, ClickStore and Domains are optional. Without ClickStore or Domains, the click stats
+// and domains routes answer 501 Not Implemented.
+type UrlHandlerConfigs struct {
+	TokenGen              token.TokenGenerator
+	TokenHasher           hash.TokenHasher
+	UrlStore              storage.Store
+	ShortUrlEventProducer event.Producer
+	EventContentType      string
+	Outbox                storage.Outbox
+	Clicks                *ClickRecorder
+	ClickStore            storage.ClickStore
+	PublicBaseUrl         string
+	Domains               storage.DomainStore
+	UnknownHostFallback   string
+	MaxBatchItems         int
+	StoreTimeout          time.Duration
+}
+
+func NewUrlHandler(configs UrlHandlerConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) UrlHandler {
 	return UrlHandler{
-		TokenGen:              tokenGen,
-		TokenHasher:           urlTokenHasher,
-		UrlStore:              urlStore,
-		ShortUrlEventProducer: shortUrlEventProducer,
+		TokenGen:              configs.TokenGen,
+		TokenHasher:           configs.TokenHasher,
+		UrlStore:              configs.UrlStore,
+		ShortUrlEventProducer: configs.ShortUrlEventProducer,
+		EventContentType:      configs.EventContentType,
+		Outbox:                configs.Outbox,
+		Clicks:                configs.Clicks,
+		ClickStore:            configs.ClickStore,
+		PublicBaseUrl:         strings.TrimSuffix(configs.PublicBaseUrl, "/"),
+		Domains:               configs.Domains,
+		UnknownHostFallback:   configs.UnknownHostFallback,
+		MaxBatchItems:         configs.MaxBatchItems,
+		StoreTimeout:          configs.StoreTimeout,
 		MetricsHooks:          metricsHooks,
 		logger:                logger,
 	}
 }
 
+// ShortenUrlRequest is the url to shorten, and the code to shorten it to when Alias is set instead of
+// a generated one. Domain is the registered domain to serve the short url at, the default one when
+// empty, and ExpiresAt is when the short url stops redirecting, after the default TTL when unset.
 type ShortenUrlRequest struct {
-	URL string `json:"url"`
+	URL       string     `json:"url"`
+	Alias     string     `json:"alias,omitempty"`
+	Domain    string     `json:"domain,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
+// ShortenUrlResponse has the absolute short url, on its domain, along with its code and domain alone
+// and the expiry that was requested for it
 type ShortenUrlResponse struct {
-	ShortUrl string `json:"short_url"`
+	ShortUrl  string     `json:"short_url"`
+	Code      string     `json:"code"`
+	Domain    string     `json:"domain"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// validAlias limits aliases to what fits in a single path segment without escaping
+var validAlias = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+// reservedAliases are the first path segments of the routes served next to the short urls, which
+// can't be claimed as aliases whatever their case
+var reservedAliases = map[string]bool{
+	"api":          true,
+	"healthz":      true,
+	"metrics":      true,
+	"openapi.json": true,
+	"shortn":       true,
 }
 
 func (h *UrlHandler) ShortenUrl(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.ShortenUrl")
+	defer span.End()
+	receivedAt := time.Now()
 	var req ShortenUrlRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		h.logger.Error("Error decoding the request to a known struct", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"invalid request"})
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid request"))
 		return
 	}
-	h.logger.Debug("Shortening url", "url", req.URL)
-
-	ctx = h.MetricsHooks.OnShortenUrlCalled(ctx, req.URL)
+	h.logger.Debug("Shortening url", "url", req.URL, "alias", req.Alias, "domain", req.Domain)
 
-	token, err := h.TokenGen.GenerateToken()
-	if err != nil {
-		h.logger.Error("Error generating a token based on the url", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"internal error generating a token"})
-		h.MetricsHooks.OnShortenUrlFinished(ctx, req.URL, err)
+	if problem := expiryProblem(req.ExpiresAt, receivedAt); problem != nil {
+		h.fail(ctx, w, *problem)
 		return
 	}
-	h.logger.Debug("Generated token", "token", token)
-
-	shortenUrl, err := h.TokenHasher.Hash(int64(token))
-	if err != nil {
-		h.logger.Error("Error generating a hash for the token", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"internal error generating a hash for the token"})
-		h.MetricsHooks.OnShortenUrlFinished(ctx, req.URL, err)
+	domain, ok := h.requestDomain(ctx, w, span, req.Domain)
+	if !ok {
 		return
 	}
-	h.logger.Debug("Generated shorten url", "url", shortenUrl)
+	var shortenUrl string
+	if req.Alias != "" {
+		if shortenUrl, ok = h.claimAlias(ctx, w, span, req, domain); !ok {
+			return
+		}
+	} else {
+		token, err := h.TokenGen.GenerateToken()
+		if err != nil {
+			h.logger.Error("Error generating a token based on the url", "error", err)
+			failSpan(span, err)
+			h.fail(ctx, w, newProblem(http.StatusInternalServerError, metrics.ErrorKindToken, "internal error generating a token"))
+			return
+		}
+		h.logger.Debug("Generated token", "token", token)
 
-	event := event.ShortUrlEvent{
-		ShortUrl: shortenUrl,
-		LongUrl:  req.URL,
+		shortenUrl, err = h.TokenHasher.Hash(int64(token))
+		if err != nil {
+			h.logger.Error("Error generating a hash for the token", "error", err)
+			failSpan(span, err)
+			h.fail(ctx, w, newProblem(http.StatusInternalServerError, metrics.ErrorKindToken, "internal error generating a hash for the token"))
+			return
+		}
+		h.logger.Debug("Generated shorten url", "url", shortenUrl)
 	}
-	content, err := json.Marshal(event)
+	key := storage.DomainKey(domain, shortenUrl)
+	span.SetAttributes(attribute.String(shortUrlAttribute, key))
+
+	shortUrlEvent := newShortUrlEvent(key, req, receivedAt)
+	content, headers, err := event.EncodeShortUrlEvent(shortUrlEvent, h.EventContentType)
 	if err != nil {
 		h.logger.Error("Error encoding the event", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"internal error encoding the event"})
-		h.MetricsHooks.OnShortenUrlFinished(ctx, req.URL, err)
+		failSpan(span, err)
+		h.fail(ctx, w, newProblem(http.StatusInternalServerError, metrics.ErrorKindEncode, "internal error encoding the event"))
 		return
 	}
-	h.ShortUrlEventProducer.Produce(string(content))
-
-	result := ShortenUrlResponse{
-		ShortUrl: shortenUrl,
+	// the event carries the trace along, so that storing it in the consumer joins this request's trace
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	if h.Outbox != nil {
+		storeCtx, cancel := h.storeContext(ctx)
+		defer cancel()
+		err = h.Outbox.StoreWithOutbox(storeCtx, key, newLink(req), storage.OutboxEntry{Value: content, Headers: headers})
+		switch {
+		case req.Alias != "" && errors.Is(err, storage.ErrConflict):
+			h.fail(ctx, w, aliasTakenProblem())
+			return
+		case err != nil:
+			h.storeFailed(storeCtx, w, span, err, "storing the short url")
+			return
+		}
+	} else if err = h.ShortUrlEventProducer.Produce(content, headers); err != nil {
+		h.logger.Error("Error producing the event", "error", err)
+		failSpan(span, err)
+		h.fail(ctx, w, producerProblem())
+		return
 	}
 
-	response, err := json.Marshal(result)
+	response, err := json.Marshal(h.shortenUrlResponse(domain, shortenUrl, req))
 	if err != nil {
 		h.logger.Error("Error marshalling the response", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(struct {
-			Error string
-		}{"internal error generating the response"})
-		h.MetricsHooks.OnShortenUrlFinished(ctx, req.URL, err)
+		failSpan(span, err)
+		h.fail(ctx, w, newProblem(http.StatusInternalServerError, metrics.ErrorKindEncode, "internal error generating the response"))
 		return
 	}
 
-	h.MetricsHooks.OnShortenUrlFinished(ctx, req.URL, err)
+	w.Header().Set("Content-Type", contentTypeJson)
 	w.WriteHeader(http.StatusOK)
 	w.Write(response)
+}
+
+// claimAlias claims the alias of req for its url on domain, and returns it as the short url if so. An
+// alias already given to the same url is claimed again, as storing the url is idempotent.
+// Without an outbox the url is stored right away rather than by the consumer, so that of two requests
+// racing for the same alias only one gets it. With one, the alias is claimed along with storing the
+// url.
+func (h *UrlHandler) claimAlias(ctx context.Context, w http.ResponseWriter, span trace.Span, req ShortenUrlRequest, domain string) (string, bool) {
+	if problem := aliasProblem(req.Alias); problem != nil {
+		h.fail(ctx, w, *problem)
+		return "", false
+	}
+	if h.Outbox != nil {
+		return req.Alias, true
+	}
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	err := h.UrlStore.Store(storeCtx, storage.DomainKey(domain, req.Alias), newLink(req))
+	switch {
+	case errors.Is(err, storage.ErrConflict):
+		h.fail(ctx, w, aliasTakenProblem())
+		return "", false
+	case err != nil:
+		h.storeFailed(storeCtx, w, span, err, "claiming the alias")
+		return "", false
+	}
+	return req.Alias, true
+}
+
+// aliasProblem returns the problem of an alias that can't be claimed whoever holds it, nil if there
+// is none.
+func aliasProblem(alias string) *Problem {
+	var reason string
+	switch {
+	case !validAlias.MatchString(alias):
+		reason = "must be 3 to 64 letters, digits, _ or -"
+	case reservedAliases[strings.ToLower(alias)]:
+		reason = "is reserved"
+	default:
+		return nil
+	}
+	problem := newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid alias")
+	problem.Details = []ProblemDetail{{Field: "alias", Reason: reason}}
+	return &problem
+}
+
+// producerProblem is the problem of an event that couldn't be produced, which the client may retry.
+func producerProblem() Problem {
+	return newProblem(http.StatusServiceUnavailable, metrics.ErrorKindUnavailable, "the event bus is unavailable, try again later")
+}
+
+func aliasTakenProblem() Problem {
+	return newProblem(http.StatusConflict, metrics.ErrorKindConflict, "the alias is already taken")
+}
 
+// expiryProblem returns the problem of an expiry requested at now, nil if there is none.
+func expiryProblem(expiresAt *time.Time, now time.Time) *Problem {
+	if expiresAt == nil || expiresAt.After(now) {
+		return nil
+	}
+	problem := newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "invalid expiry")
+	problem.Details = []ProblemDetail{{Field: "expires_at", Reason: "must be in the future"}}
+	return &problem
+}
+
+// newShortUrlEvent returns the event announcing that key was shortened from req, received at
+// receivedAt.
+func newShortUrlEvent(key string, req ShortenUrlRequest, receivedAt time.Time) event.ShortUrlEvent {
+	shortUrlEvent := event.ShortUrlEvent{
+		ShortUrl:  key,
+		LongUrl:   req.URL,
+		CreatedAt: receivedAt,
+	}
+	if req.ExpiresAt != nil {
+		shortUrlEvent.ExpiresAt = req.ExpiresAt.UTC()
+	}
+	return shortUrlEvent
+}
+
+// newLink returns the link stored for req.
+func newLink(req ShortenUrlRequest) storage.Link {
+	link := storage.Link{LongUrl: req.URL}
+	if req.ExpiresAt != nil {
+		link.ExpiresAt = req.ExpiresAt.UTC()
+	}
+	return link
+}
+
+func (h *UrlHandler) shortenUrlResponse(domain string, code string, req ShortenUrlRequest) ShortenUrlResponse {
+	return ShortenUrlResponse{
+		ShortUrl:  h.absoluteShortUrl(domain, code),
+		Code:      code,
+		Domain:    h.domainName(domain),
+		ExpiresAt: req.ExpiresAt,
+	}
 }
 
 func (h *UrlHandler) GetLongUrl(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	shortenUrl := strings.TrimPrefix(r.URL.Path, "/shortn/")
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.GetLongUrl")
+	defer span.End()
+	// people follow short urls in their browser, so they get a page rather than json when it fails
+	ctx = withHtmlErrors(ctx, r)
+	shortenUrl := r.PathValue(codePathValue)
 	if shortenUrl == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(struct {
-			Error string `json:"error"`
-		}{Error: "no shortenUrl provided"})
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "no shortenUrl provided"))
+		return
+	}
+	h.logger.Debug("GetLongURl", "url", shortenUrl, "host", r.Host)
+	domain, ok := h.hostDomain(ctx, w, r, span)
+	if !ok {
 		return
 	}
-	h.logger.Debug("GetLongURl", "url", shortenUrl)
-	ctx = h.MetricsHooks.OnGetLongUrlCalled(ctx, shortenUrl)
-	longUrl, err := h.UrlStore.Fetch(shortenUrl)
+	key := storage.DomainKey(domain, shortenUrl)
+	span.SetAttributes(attribute.String(shortUrlAttribute, key))
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	longUrl, err := h.UrlStore.Fetch(storeCtx, key)
 	if err != nil {
-		switch {
-		case errors.Is(err, redis.Nil):
-			h.logger.Error("Provided short url not found in redis", "error", err)
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(struct {
-				Error string
-			}{"the provided short url is not available"})
-			h.MetricsHooks.OnGetLongUrlFinished(ctx, shortenUrl, err)
-			return
-		default:
-			h.logger.Error("Error fetching long url from storage", "error", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(struct {
-				Error string
-			}{"internal error getting the long url"})
-			h.MetricsHooks.OnGetLongUrlFinished(ctx, shortenUrl, err)
-			return
-		}
+		h.storeFailed(storeCtx, w, span, err, "getting the long url")
+		return
 	}
-	h.MetricsHooks.OnGetLongUrlFinished(ctx, shortenUrl, err)
+	h.Clicks.Record(r, key)
 	http.Redirect(w, r, longUrl, http.StatusFound)
 }
 
+// LinkResponse is a short url, absolute and as a code on its domain, along with the long url it
+// redirects to
+type LinkResponse struct {
+	ShortUrl string `json:"short_url"`
+	Code     string `json:"code"`
+	Domain   string `json:"domain"`
+	URL      string `json:"url"`
+}
+
+// GetLink returns the long url of a short url as json, for clients that manage links rather than
+// follow them. Unlike GetLongUrl, it does not count as a click. The short url is looked up on the
+// domain query parameter, the default domain when missing, and so are the other link operations.
+func (h *UrlHandler) GetLink(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.GetLink")
+	defer span.End()
+	shortenUrl := r.PathValue(codePathValue)
+	if shortenUrl == "" {
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "no shortenUrl provided"))
+		return
+	}
+	domain := h.queryDomain(r)
+	h.logger.Debug("GetLink", "url", shortenUrl, "domain", domain)
+	key := storage.DomainKey(domain, shortenUrl)
+	span.SetAttributes(attribute.String(shortUrlAttribute, key))
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	longUrl, err := h.UrlStore.Fetch(storeCtx, key)
+	if err != nil {
+		h.storeFailed(storeCtx, w, span, err, "getting the long url")
+		return
+	}
+
+	response, err := json.Marshal(LinkResponse{
+		ShortUrl: h.absoluteShortUrl(domain, shortenUrl),
+		Code:     shortenUrl,
+		Domain:   h.domainName(domain),
+		URL:      longUrl,
+	})
+	if err != nil {
+		h.logger.Error("Error marshalling the response", "error", err)
+		failSpan(span, err)
+		h.fail(ctx, w, newProblem(http.StatusInternalServerError, metrics.ErrorKindEncode, "internal error generating the response"))
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJson)
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
 func (h *UrlHandler) DeleteShortenUrl(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	shortenUrl := strings.TrimPrefix(r.URL.Path, "/shortn/")
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.DeleteShortenUrl")
+	defer span.End()
+	shortenUrl := r.PathValue(codePathValue)
 	if shortenUrl == "" {
 		h.logger.Error("No shortenUrl provided")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(struct {
-			Error string `json:"error"`
-		}{Error: "no shortenUrl provided"})
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "no shortenUrl provided"))
 		return
 	}
-	h.logger.Debug("DeleteShortenUrl", "url", shortenUrl)
-	ctx = h.MetricsHooks.OnDeleteShortenUrlCalled(ctx, shortenUrl)
-	err := h.UrlStore.Remove(shortenUrl)
+	domain := h.queryDomain(r)
+	h.logger.Debug("DeleteShortenUrl", "url", shortenUrl, "domain", domain)
+	key := storage.DomainKey(domain, shortenUrl)
+	span.SetAttributes(attribute.String(shortUrlAttribute, key))
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	err := h.UrlStore.Remove(storeCtx, key)
 	if err != nil {
-		switch {
-		case errors.Is(err, redis.Nil):
-			h.logger.Error("Provided short url not found in redis", "error", err)
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(struct {
-				Error string
-			}{"the provided short url is not available"})
-			h.MetricsHooks.OnDeleteShortenUrlFinished(ctx, shortenUrl, err)
-			return
-		default:
-			h.logger.Error("Error deleting short url from storage", "error", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(struct {
-				Error string
-			}{"internal error deleting the short url"})
-			h.MetricsHooks.OnDeleteShortenUrlFinished(ctx, shortenUrl, err)
-			return
+		h.storeFailed(storeCtx, w, span, err, "deleting the short url")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+const (
+	// topClickStatsSize is how many values are returned in each top list of the click stats
+	topClickStatsSize = 10
+	// maxClickStatsBuckets caps the length of the click stats time series
+	maxClickStatsBuckets = 1000
+)
+
+// ClickStatsResponse has the click stats of a short url, absolute and as a code on its domain. UniqueVisitors is estimated over whole UTC
+// days, and DailyVisitors holds the estimate of each of those days.
+type ClickStatsResponse struct {
+	ShortUrl       string                `json:"short_url"`
+	Code           string                `json:"code"`
+	Domain         string                `json:"domain"`
+	Total          int64                 `json:"total"`
+	Bots           int64                 `json:"bot_clicks"`
+	From           time.Time             `json:"from"`
+	To             time.Time             `json:"to"`
+	Granularity    string                `json:"granularity"`
+	Series         []storage.ClickBucket `json:"series"`
+	UniqueVisitors int64                 `json:"unique_visitors"`
+	DailyVisitors  []storage.ClickBucket `json:"daily_unique_visitors"`
+	TopReferrers   []storage.ClickCount  `json:"top_referrers"`
+	TopBrowsers    []storage.ClickCount  `json:"top_browsers"`
+	TopCountries   []storage.ClickCount  `json:"top_countries"`
+}
+
+// GetClickStats returns the clicks on a short url between the from and to query parameters (RFC 3339
+// times or dates, the last day by default) by hour or day, as set by the granularity parameter.
+func (h *UrlHandler) GetClickStats(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "UrlHandler.GetClickStats")
+	defer span.End()
+	if h.ClickStore == nil {
+		h.notEnabled(ctx, w, "click stats")
+		return
+	}
+	shortenUrl := r.PathValue(codePathValue)
+	if shortenUrl == "" {
+		h.fail(ctx, w, newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, "no shortenUrl provided"))
+		return
+	}
+	domain := h.queryDomain(r)
+	h.logger.Debug("GetClickStats", "url", shortenUrl, "domain", domain)
+	key := storage.DomainKey(domain, shortenUrl)
+	span.SetAttributes(attribute.String(shortUrlAttribute, key))
+
+	from, to, granularity, err := parseClickStatsQuery(r, time.Now())
+	if err != nil {
+		h.logger.Error("Invalid click stats query", "error", err)
+		problem := newProblem(http.StatusBadRequest, metrics.ErrorKindInvalidRequest, err.Error())
+		var paramErr *queryParamError
+		if errors.As(err, &paramErr) {
+			problem.Details = []ProblemDetail{{Field: paramErr.param, Reason: paramErr.reason}}
 		}
+		h.fail(ctx, w, problem)
+		return
 	}
-	h.MetricsHooks.OnDeleteShortenUrlFinished(ctx, shortenUrl, err)
+
+	storeCtx, cancel := h.storeContext(ctx)
+	defer cancel()
+	if _, err := h.UrlStore.Fetch(storeCtx, key); err != nil {
+		h.storeFailed(storeCtx, w, span, err, "getting the long url")
+		return
+	}
+
+	statsCtx, cancelStats := h.storeContext(ctx)
+	defer cancelStats()
+	stats, err := h.ClickStore.ClickStats(statsCtx, key, from, to, granularity, topClickStatsSize)
+	if err != nil {
+		h.storeFailed(statsCtx, w, span, err, "getting the click stats")
+		return
+	}
+
+	response, err := json.Marshal(ClickStatsResponse{
+		ShortUrl:       h.absoluteShortUrl(domain, shortenUrl),
+		Code:           shortenUrl,
+		Domain:         h.domainName(domain),
+		Total:          stats.Total,
+		Bots:           stats.Bots,
+		From:           from,
+		To:             to,
+		Granularity:    granularity,
+		Series:         stats.Series,
+		UniqueVisitors: stats.UniqueVisitors,
+		DailyVisitors:  stats.DailyVisitors,
+		TopReferrers:   stats.TopReferrers,
+		TopBrowsers:    stats.TopBrowsers,
+		TopCountries:   stats.TopCountries,
+	})
+	if err != nil {
+		h.logger.Error("Error marshalling the response", "error", err)
+		failSpan(span, err)
+		h.fail(ctx, w, newProblem(http.StatusInternalServerError, metrics.ErrorKindEncode, "internal error generating the response"))
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJson)
 	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// queryParamError is the reason a query parameter is invalid
+type queryParamError struct {
+	param  string
+	reason string
+}
+
+func (e *queryParamError) Error() string {
+	return "invalid " + e.param + ": " + e.reason
+}
+
+func parseClickStatsQuery(r *http.Request, now time.Time) (from time.Time, to time.Time, granularity string, err error) {
+	query := r.URL.Query()
+	granularity = query.Get("granularity")
+	var step, defaultRange time.Duration
+	switch granularity {
+	case "", storage.GranularityHour:
+		granularity = storage.GranularityHour
+		step, defaultRange = time.Hour, 24*time.Hour
+	case storage.GranularityDay:
+		step, defaultRange = 24*time.Hour, 30*24*time.Hour
+	default:
+		return from, to, granularity, &queryParamError{"granularity", fmt.Sprintf("must be %s or %s", storage.GranularityHour, storage.GranularityDay)}
+	}
+
+	to = now.UTC()
+	if value := query.Get("to"); value != "" {
+		if to, err = parseClickStatsTime(value); err != nil {
+			return from, to, granularity, &queryParamError{"to", err.Error()}
+		}
+	}
+	from = to.Add(-defaultRange)
+	if value := query.Get("from"); value != "" {
+		if from, err = parseClickStatsTime(value); err != nil {
+			return from, to, granularity, &queryParamError{"from", err.Error()}
+		}
+	}
+	if from.After(to) {
+		return from, to, granularity, &queryParamError{"from", "must not be after to"}
+	}
+	if to.Sub(from)/step >= maxClickStatsBuckets {
+		return from, to, granularity, &queryParamError{"from", fmt.Sprintf("the range can't span more than %d %ss", maxClickStatsBuckets, granularity)}
+	}
+	return from, to, granularity, nil
+}
+
+func parseClickStatsTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// statusClientClosedRequest is the non-standard status, borrowed from nginx, of the requests whose
+// client went away before they were served
+const statusClientClosedRequest = 499
+
+// storeContext bounds a storage call made while serving a request by StoreTimeout, on top of the
+// request being cancelled when the client goes away.
+func (h *UrlHandler) storeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.StoreTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, h.StoreTimeout)
+}
+
+// notEnabled answers a request to a route of feature, which needs a dependency the handler was built
+// without.
+func (h *UrlHandler) notEnabled(ctx context.Context, w http.ResponseWriter, feature string) {
+	h.fail(ctx, w, newProblem(http.StatusNotImplemented, metrics.ErrorKindNotEnabled, feature+" are not enabled"))
+}
+
+// storeFailed responds to a storage call made with ctx that failed with err, with the status matching
+// the storage error and 500 for any other. what describes the call, e.g. "getting the long url".
+func (h *UrlHandler) storeFailed(ctx context.Context, w http.ResponseWriter, span trace.Span, err error, what string) {
+	if ctx.Err() != nil {
+		h.storeInterrupted(ctx, w, span, ctx.Err(), err)
+		return
+	}
+	h.fail(ctx, w, h.storeProblem(ctx, span, err, what))
+}
+
+// storeProblem returns the problem of a storage call made with ctx that failed with err, as
+// storeFailed responds with it. A call whose context was done is a timeout.
+func (h *UrlHandler) storeProblem(ctx context.Context, span trace.Span, err error, what string) Problem {
+	var status int
+	var kind, message string
+	switch {
+	case ctx.Err() != nil:
+		return h.timeoutProblem(span, err)
+	case errors.Is(err, storage.ErrNotFound):
+		status, kind, message = http.StatusNotFound, metrics.ErrorKindNotFound, "the provided short url is not available"
+	case errors.Is(err, storage.ErrExpired):
+		status, kind, message = http.StatusGone, metrics.ErrorKindExpired, "the provided short url has expired"
+	case errors.Is(err, storage.ErrConflict):
+		status, kind, message = http.StatusConflict, metrics.ErrorKindConflict, "the short url is already taken"
+	case errors.Is(err, storage.ErrUnavailable):
+		status, kind, message = http.StatusServiceUnavailable, metrics.ErrorKindUnavailable, "the storage is unavailable, try again later"
+	default:
+		status, kind, message = http.StatusInternalServerError, metrics.ErrorKindStore, "internal error "+what
+	}
+	if status >= http.StatusInternalServerError {
+		h.logger.Error("Error "+what, "error", err)
+		failSpan(span, err)
+	} else {
+		h.logger.Debug("Failed "+what, "error", err)
+	}
+	return newProblem(status, kind, message)
+}
+
+// storeInterrupted responds to a storage call that failed with err because its context was done with
+// cause: a timeout is a 504, and a client that went away is only recorded since nobody reads the
+// response.
+func (h *UrlHandler) storeInterrupted(ctx context.Context, w http.ResponseWriter, span trace.Span, cause error, err error) {
+	if errors.Is(cause, context.DeadlineExceeded) {
+		h.fail(ctx, w, h.timeoutProblem(span, err))
+		return
+	}
+	failSpan(span, err)
+	h.logger.Debug("Client went away while waiting for the storage", "error", err)
+	w.WriteHeader(statusClientClosedRequest)
+	h.MetricsHooks.OnRequestFailed(metrics.ErrorKindCanceled)
+}
+
+// timeoutProblem returns the problem of a storage call that failed with err for taking longer than
+// StoreTimeout.
+func (h *UrlHandler) timeoutProblem(span trace.Span, err error) Problem {
+	failSpan(span, err)
+	h.logger.Error("Timed out waiting for the storage", "timeout", h.StoreTimeout, "error", err)
+	return newProblem(http.StatusGatewayTimeout, metrics.ErrorKindTimeout, "timed out waiting for the storage")
+}
+
+// failSpan marks span as failed with err.
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
 }
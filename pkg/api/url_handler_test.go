@@ -2,15 +2,27 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/bwmarrin/snowflake"
-	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"sync"
 	"testing"
+	"time"
+	"urlshortn/pkg/event"
 	"urlshortn/pkg/hash"
 	"urlshortn/pkg/metrics"
 	"urlshortn/pkg/storage"
@@ -18,12 +30,19 @@ import (
 )
 
 func TestUrlHandler_ShortenUrl(t *testing.T) {
+	expiresAt := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
 	type fields struct {
 		TokenGen              token.TokenGenerator
 		TokenHasher           hash.TokenHasher
 		UrlStore              storage.Store
 		ShortUrlEventProducer interface {
-			Produce(content string) error
+			Produce(value []byte, headers map[string]string) error
+			ProduceBatch(events []event.OutgoingEvent) []error
+		}
+		EventContentType string
+		Outbox           interface {
+			StoreWithOutbox(ctx context.Context, key string, link storage.Link, entry storage.OutboxEntry) error
+			StoreBatchWithOutbox(ctx context.Context, links map[string]storage.Link, entries map[string]storage.OutboxEntry) error
 		}
 		MetricsHooks *metrics.MetricsHooks
 	}
@@ -35,6 +54,7 @@ func TestUrlHandler_ShortenUrl(t *testing.T) {
 		fields   fields
 		args     args
 		wantCode int
+		wantBody *ShortenUrlResponse
 	}{
 		{
 			name:   "when the request body is not parseable, the response is bad request",
@@ -71,6 +91,90 @@ func TestUrlHandler_ShortenUrl(t *testing.T) {
 			},
 			wantCode: http.StatusInternalServerError,
 		},
+		{
+			name: "when the event cannot be encoded, response is internal server error",
+			fields: fields{
+				TokenGen: &token.FakeTokenGenerator{GenerateTokenFn: func() (snowflake.ID, error) {
+					return 1234, nil
+				}},
+				TokenHasher: &hash.FakeTokenHasher{HashFn: func(n int64) (string, error) {
+					return "1234", nil
+				}},
+				EventContentType: "text/plain",
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\"}"))),
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name: "when the short url can't be stored with its event, response is internal server error",
+			fields: fields{
+				TokenGen: &token.FakeTokenGenerator{GenerateTokenFn: func() (snowflake.ID, error) {
+					return 1234, nil
+				}},
+				TokenHasher: &hash.FakeTokenHasher{HashFn: func(n int64) (string, error) {
+					return "1234", nil
+				}},
+				Outbox: &storage.FakeOutbox{
+					StoreWithOutboxFn: func(ctx context.Context, key string, link storage.Link, entry storage.OutboxEntry) error {
+						return errors.New("expected error")
+					},
+				},
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\"}"))),
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name: "when the short url is stored with its event, return a status ok without producing",
+			fields: fields{
+				TokenGen: &token.FakeTokenGenerator{GenerateTokenFn: func() (snowflake.ID, error) {
+					return 1234, nil
+				}},
+				TokenHasher: &hash.FakeTokenHasher{HashFn: func(n int64) (string, error) {
+					return "1234", nil
+				}},
+				ShortUrlEventProducer: &FakeShortUrlEventProducer{
+					ProduceFn: func(value []byte, headers map[string]string) error {
+						panic("events should be published by the outbox relay")
+					},
+				},
+				Outbox: &storage.FakeOutbox{
+					StoreWithOutboxFn: func(ctx context.Context, key string, link storage.Link, entry storage.OutboxEntry) error {
+						if key != "1234" || link.LongUrl != "http://google.com" || !link.ExpiresAt.IsZero() || len(entry.Value) == 0 {
+							return errors.New("unexpected entry")
+						}
+						return nil
+					},
+				},
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\"}"))),
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "when the event can't be produced, response is service unavailable",
+			fields: fields{
+				TokenGen: &token.FakeTokenGenerator{GenerateTokenFn: func() (snowflake.ID, error) {
+					return 1234, nil
+				}},
+				TokenHasher: &hash.FakeTokenHasher{HashFn: func(n int64) (string, error) {
+					return "1234", nil
+				}},
+				ShortUrlEventProducer: &FakeShortUrlEventProducer{
+					ProduceFn: func(value []byte, headers map[string]string) error {
+						return errors.New("queue full")
+					},
+				},
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\"}"))),
+			},
+			wantCode: http.StatusServiceUnavailable,
+		},
 		{
 			name: "when the short url is generated, return a status ok",
 			fields: fields{
@@ -81,7 +185,7 @@ func TestUrlHandler_ShortenUrl(t *testing.T) {
 					return "1234", nil
 				}},
 				ShortUrlEventProducer: &FakeShortUrlEventProducer{
-					ProduceFn: func(content string) error {
+					ProduceFn: func(value []byte, headers map[string]string) error {
 						return nil
 					},
 				},
@@ -90,6 +194,123 @@ func TestUrlHandler_ShortenUrl(t *testing.T) {
 				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\"}"))),
 			},
 			wantCode: http.StatusOK,
+			wantBody: &ShortenUrlResponse{ShortUrl: "https://sho.rt/1234", Code: "1234", Domain: "sho.rt"},
+		},
+		{
+			name: "when the alias is free, the url is shortened to it without generating a token",
+			fields: fields{
+				UrlStore: &storage.FakeUrlStore{
+					StoreFn: func(ctx context.Context, key string, link storage.Link) error {
+						return nil
+					},
+				},
+				ShortUrlEventProducer: &FakeShortUrlEventProducer{
+					ProduceFn: func(value []byte, headers map[string]string) error {
+						return nil
+					},
+				},
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\",\"alias\":\"my-link\"}"))),
+			},
+			wantCode: http.StatusOK,
+			wantBody: &ShortenUrlResponse{ShortUrl: "https://sho.rt/my-link", Code: "my-link", Domain: "sho.rt"},
+		},
+		{
+			name: "when the alias was given to the same url, it is claimed again",
+			fields: fields{
+				UrlStore: &storage.FakeUrlStore{
+					StoreFn: func(ctx context.Context, key string, link storage.Link) error {
+						return nil
+					},
+				},
+				ShortUrlEventProducer: &FakeShortUrlEventProducer{
+					ProduceFn: func(value []byte, headers map[string]string) error {
+						return nil
+					},
+				},
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\",\"alias\":\"my-link\"}"))),
+			},
+			wantCode: http.StatusOK,
+			wantBody: &ShortenUrlResponse{ShortUrl: "https://sho.rt/my-link", Code: "my-link", Domain: "sho.rt"},
+		},
+		{
+			name: "when the alias was given to another url, response is conflict",
+			fields: fields{
+				UrlStore: &storage.FakeUrlStore{
+					StoreFn: func(ctx context.Context, key string, link storage.Link) error {
+						return storage.ErrConflict
+					},
+				},
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://mercadolibre.com.ar\",\"alias\":\"my-link\"}"))),
+			},
+			wantCode: http.StatusConflict,
+		},
+		{
+			name: "when the alias is taken while storing it with its event, response is conflict",
+			fields: fields{
+				Outbox: &storage.FakeOutbox{
+					StoreWithOutboxFn: func(ctx context.Context, key string, link storage.Link, entry storage.OutboxEntry) error {
+						return storage.ErrConflict
+					},
+				},
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://mercadolibre.com.ar\",\"alias\":\"my-link\"}"))),
+			},
+			wantCode: http.StatusConflict,
+		},
+		{
+			name: "when an expiry is requested, the short url is stored until then",
+			fields: fields{
+				TokenGen: &token.FakeTokenGenerator{GenerateTokenFn: func() (snowflake.ID, error) {
+					return 1234, nil
+				}},
+				TokenHasher: &hash.FakeTokenHasher{HashFn: func(n int64) (string, error) {
+					return "1234", nil
+				}},
+				Outbox: &storage.FakeOutbox{
+					StoreWithOutboxFn: func(ctx context.Context, key string, link storage.Link, entry storage.OutboxEntry) error {
+						if !link.ExpiresAt.Equal(time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)) {
+							return errors.New("unexpected expiry")
+						}
+						return nil
+					},
+				},
+			},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\",\"expires_at\":\"2099-01-01T00:00:00Z\"}"))),
+			},
+			wantCode: http.StatusOK,
+			wantBody: &ShortenUrlResponse{ShortUrl: "https://sho.rt/1234", Code: "1234", Domain: "sho.rt", ExpiresAt: &expiresAt},
+		},
+		{
+			name:   "when the expiry is in the past, response is bad request",
+			fields: fields{},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\",\"expires_at\":\"2001-01-01T00:00:00Z\"}"))),
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:   "when the alias is the path of another route, response is bad request",
+			fields: fields{},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\",\"alias\":\"Metrics\"}"))),
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:   "when the alias doesn't fit in a path segment, response is bad request",
+			fields: fields{},
+			args: args{
+				r: httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\",\"alias\":\"my link\"}"))),
+			},
+			wantCode: http.StatusBadRequest,
 		},
 	}
 	for _, tt := range tests {
@@ -102,40 +323,145 @@ func TestUrlHandler_ShortenUrl(t *testing.T) {
 				TokenHasher:           tt.fields.TokenHasher,
 				UrlStore:              tt.fields.UrlStore,
 				ShortUrlEventProducer: tt.fields.ShortUrlEventProducer,
+				EventContentType:      tt.fields.EventContentType,
+				Outbox:                tt.fields.Outbox,
+				PublicBaseUrl:         "https://sho.rt",
 				MetricsHooks:          tt.fields.MetricsHooks,
 				logger:                logger,
 			}
 			rr := httptest.NewRecorder()
 			h.ShortenUrl(rr, tt.args.r)
 			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+			wantContentType := contentTypeProblem
+			if tt.wantCode == http.StatusOK {
+				wantContentType = contentTypeJson
+			}
+			assert.Equal(t, wantContentType, rr.Header().Get("Content-Type"))
+			if tt.wantBody != nil {
+				var got ShortenUrlResponse
+				assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+				assert.Equal(t, *tt.wantBody, got)
+			}
 		})
 	}
 }
 
+func TestUrlHandler_ShortenUrl_concurrentAliasClaims(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	server := miniredis.RunT(t)
+	store := storage.NewRedisStore(server.Addr(), "", logger)
+	defer store.Close()
+	h := &UrlHandler{
+		UrlStore: store,
+		ShortUrlEventProducer: &FakeShortUrlEventProducer{
+			ProduceFn: func(value []byte, headers map[string]string) error {
+				return nil
+			},
+		},
+		PublicBaseUrl: "https://sho.rt",
+		logger:        logger,
+	}
+
+	urls := []string{"http://google.com", "http://mercadolibre.com.ar"}
+	codes := make([]int, len(urls))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"url":"`+url+`","alias":"my-link"}`)))
+			rr := httptest.NewRecorder()
+			<-start
+			h.ShortenUrl(rr, r)
+			codes[i] = rr.Code
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	assert.ElementsMatch(t, []int{http.StatusOK, http.StatusConflict}, codes)
+	winner := urls[slices.Index(codes, http.StatusOK)]
+	stored, err := server.Get("my-link")
+	assert.Nil(t, err)
+	assert.Equal(t, winner, stored)
+}
+
+func TestUrlHandler_ShortenUrl_propagatesTrace(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	var produced map[string]string
+	h := &UrlHandler{
+		TokenGen: &token.FakeTokenGenerator{GenerateTokenFn: func() (snowflake.ID, error) {
+			return 1234, nil
+		}},
+		TokenHasher: &hash.FakeTokenHasher{HashFn: func(n int64) (string, error) {
+			return "1234", nil
+		}},
+		ShortUrlEventProducer: &FakeShortUrlEventProducer{
+			ProduceFn: func(value []byte, headers map[string]string) error {
+				produced = headers
+				return nil
+			},
+		},
+		logger: logger,
+	}
+	rr := httptest.NewRecorder()
+	h.ShortenUrl(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{\"url\":\"http://google.com\"}"))))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	ended := spans.Ended()
+	assert.Len(t, ended, 1)
+	assert.Equal(t, "UrlHandler.ShortenUrl", ended[0].Name())
+	assert.Contains(t, produced["traceparent"], ended[0].SpanContext().TraceID().String(), "the event should carry the request's trace")
+}
+
 func TestUrlHandler_GetLongUrl(t *testing.T) {
 	type fields struct {
 		TokenGen              token.TokenGenerator
 		TokenHasher           hash.TokenHasher
 		UrlStore              storage.Store
 		ShortUrlEventProducer interface {
-			Produce(content string) error
+			Produce(value []byte, headers map[string]string) error
+			ProduceBatch(events []event.OutgoingEvent) []error
 		}
+		StoreTimeout time.Duration
 		MetricsHooks *metrics.MetricsHooks
 	}
 	type args struct {
 		r *http.Request
 	}
+	// the fetch only returns once its context is done
+	blockingStore := &storage.FakeUrlStore{
+		FetchFn: func(ctx context.Context, s string) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		},
+	}
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
 	tests := []struct {
-		name     string
-		fields   fields
-		args     args
-		wantCode int
+		name       string
+		fields     fields
+		args       args
+		wantCode   int
+		wantClicks int
 	}{
 		{
 			name:   "when the url is not correct, response is bad request",
 			fields: fields{},
 			args: args{
-				r: httptest.NewRequest(http.MethodGet, "/shortn/", nil),
+				r: newCodeRequest(http.MethodGet, "/", ""),
 			},
 			wantCode: http.StatusBadRequest,
 		},
@@ -143,43 +469,93 @@ func TestUrlHandler_GetLongUrl(t *testing.T) {
 			name: "when there is an error fetching the long url, response is internal server error",
 			fields: fields{
 				UrlStore: &storage.FakeUrlStore{
-					FetchFn: func(s string) (string, error) {
+					FetchFn: func(ctx context.Context, s string) (string, error) {
 						return "", errors.New("expected error")
 					},
 				},
 			},
 			args: args{
-				r: httptest.NewRequest(http.MethodGet, "/shortn/1234", nil),
+				r: newCodeRequest(http.MethodGet, "/1234", "1234"),
 			},
 			wantCode: http.StatusInternalServerError,
 		},
 		{
-			name: "when there is an error fetching the long url because the short url does not exist, response is bad request",
+			name: "when there is an error fetching the long url because the short url does not exist, response is not found",
 			fields: fields{
 				UrlStore: &storage.FakeUrlStore{
-					FetchFn: func(s string) (string, error) {
-						return "", redis.Nil
+					FetchFn: func(ctx context.Context, s string) (string, error) {
+						return "", storage.ErrNotFound
 					},
 				},
 			},
 			args: args{
-				r: httptest.NewRequest(http.MethodGet, "/shortn/1234", nil),
+				r: newCodeRequest(http.MethodGet, "/1234", "1234"),
 			},
-			wantCode: http.StatusBadRequest,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name: "when the short url expired, response is gone",
+			fields: fields{
+				UrlStore: &storage.FakeUrlStore{
+					FetchFn: func(ctx context.Context, s string) (string, error) {
+						return "", storage.ErrExpired
+					},
+				},
+			},
+			args: args{
+				r: newCodeRequest(http.MethodGet, "/1234", "1234"),
+			},
+			wantCode: http.StatusGone,
+		},
+		{
+			name: "when the storage is unavailable, response is service unavailable",
+			fields: fields{
+				UrlStore: &storage.FakeUrlStore{
+					FetchFn: func(ctx context.Context, s string) (string, error) {
+						return "", fmt.Errorf("%w: connection refused", storage.ErrUnavailable)
+					},
+				},
+			},
+			args: args{
+				r: newCodeRequest(http.MethodGet, "/1234", "1234"),
+			},
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			name: "when fetching the long url takes longer than the store timeout, response is gateway timeout",
+			fields: fields{
+				UrlStore:     blockingStore,
+				StoreTimeout: time.Millisecond,
+			},
+			args: args{
+				r: newCodeRequest(http.MethodGet, "/1234", "1234"),
+			},
+			wantCode: http.StatusGatewayTimeout,
+		},
+		{
+			name: "when the client goes away while fetching the long url, the fetch is given up",
+			fields: fields{
+				UrlStore: blockingStore,
+			},
+			args: args{
+				r: newCodeRequest(http.MethodGet, "/1234", "1234").WithContext(gone),
+			},
+			wantCode: statusClientClosedRequest,
 		},
 		{
 			name: "when the long url is found, response is moved temporarily",
 			fields: fields{
 				UrlStore: &storage.FakeUrlStore{
-					FetchFn: func(s string) (string, error) {
+					FetchFn: func(ctx context.Context, s string) (string, error) {
 						return "1234567890", nil
 					},
 				},
 			},
 			args: args{
-				r: httptest.NewRequest(http.MethodGet, "/shortn/1234", nil),
+				r: newCodeRequest(http.MethodGet, "/1234", "1234"),
 			},
-			wantCode: http.StatusFound,
+			wantCode:   http.StatusFound,
+			wantClicks: 1,
 		},
 	}
 	for _, tt := range tests {
@@ -187,17 +563,82 @@ func TestUrlHandler_GetLongUrl(t *testing.T) {
 			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 				Level: slog.LevelDebug,
 			}))
+			publisher := &FakeClickPublisher{}
 			h := &UrlHandler{
 				TokenGen:              tt.fields.TokenGen,
 				TokenHasher:           tt.fields.TokenHasher,
 				UrlStore:              tt.fields.UrlStore,
 				ShortUrlEventProducer: tt.fields.ShortUrlEventProducer,
+				Clicks:                NewClickRecorder("", "", nil, nil, nil, nil, logger, publisher),
+				StoreTimeout:          tt.fields.StoreTimeout,
 				MetricsHooks:          tt.fields.MetricsHooks,
 				logger:                logger,
 			}
 			rr := httptest.NewRecorder()
 			h.GetLongUrl(rr, tt.args.r)
 			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+			assert.Len(t, publisher.clicks, tt.wantClicks, "only redirects should be recorded as clicks")
+		})
+	}
+}
+
+func TestUrlHandler_GetLink(t *testing.T) {
+	tests := []struct {
+		name     string
+		urlStore storage.Store
+		r        *http.Request
+		wantCode int
+		wantBody *LinkResponse
+	}{
+		{
+			name:     "when the url is not correct, response is bad request",
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links/", ""),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "when the short url does not exist, response is not found",
+			urlStore: &storage.FakeUrlStore{
+				FetchFn: func(ctx context.Context, s string) (string, error) {
+					return "", storage.ErrNotFound
+				},
+			},
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links/1234", "1234"),
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name: "when the long url is found, response is OK with the link",
+			urlStore: &storage.FakeUrlStore{
+				FetchFn: func(ctx context.Context, s string) (string, error) {
+					return "http://google.com", nil
+				},
+			},
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links/1234", "1234"),
+			wantCode: http.StatusOK,
+			wantBody: &LinkResponse{ShortUrl: "https://sho.rt/1234", Code: "1234", Domain: "sho.rt", URL: "http://google.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			publisher := &FakeClickPublisher{}
+			h := &UrlHandler{
+				UrlStore:      tt.urlStore,
+				Clicks:        NewClickRecorder("", "", nil, nil, nil, nil, logger, publisher),
+				PublicBaseUrl: "https://sho.rt",
+				logger:        logger,
+			}
+			rr := httptest.NewRecorder()
+			h.GetLink(rr, tt.r)
+			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+			assert.Empty(t, publisher.clicks, "looking a link up is not a click")
+			if tt.wantBody != nil {
+				assert.Equal(t, contentTypeJson, rr.Header().Get("Content-Type"))
+				var got LinkResponse
+				assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+				assert.Equal(t, *tt.wantBody, got)
+			}
 		})
 	}
 }
@@ -208,7 +649,8 @@ func TestUrlHandler_DeleteShortenUrl(t *testing.T) {
 		TokenHasher           hash.TokenHasher
 		UrlStore              storage.Store
 		ShortUrlEventProducer interface {
-			Produce(content string) error
+			Produce(value []byte, headers map[string]string) error
+			ProduceBatch(events []event.OutgoingEvent) []error
 		}
 		MetricsHooks *metrics.MetricsHooks
 	}
@@ -225,7 +667,7 @@ func TestUrlHandler_DeleteShortenUrl(t *testing.T) {
 			name:   "when the url is not correct, response is bad request",
 			fields: fields{},
 			args: args{
-				r: httptest.NewRequest(http.MethodGet, "/shortn/", nil),
+				r: newCodeRequest(http.MethodDelete, "/api/v1/links/", ""),
 			},
 			wantCode: http.StatusBadRequest,
 		},
@@ -233,41 +675,41 @@ func TestUrlHandler_DeleteShortenUrl(t *testing.T) {
 			name: "when there is an error deleting the long url, response is internal server error",
 			fields: fields{
 				UrlStore: &storage.FakeUrlStore{
-					RemoveFn: func(s string) error {
+					RemoveFn: func(ctx context.Context, s string) error {
 						return errors.New("expected error")
 					},
 				},
 			},
 			args: args{
-				r: httptest.NewRequest(http.MethodGet, "/shortn/1234", nil),
+				r: newCodeRequest(http.MethodDelete, "/api/v1/links/1234", "1234"),
 			},
 			wantCode: http.StatusInternalServerError,
 		},
 		{
-			name: "when there is an error deleting the long url because the short url does not exist, response is bad request",
+			name: "when there is an error deleting the long url because the short url does not exist, response is not found",
 			fields: fields{
 				UrlStore: &storage.FakeUrlStore{
-					RemoveFn: func(s string) error {
-						return redis.Nil
+					RemoveFn: func(ctx context.Context, s string) error {
+						return storage.ErrNotFound
 					},
 				},
 			},
 			args: args{
-				r: httptest.NewRequest(http.MethodGet, "/shortn/1234", nil),
+				r: newCodeRequest(http.MethodDelete, "/api/v1/links/1234", "1234"),
 			},
-			wantCode: http.StatusBadRequest,
+			wantCode: http.StatusNotFound,
 		},
 		{
 			name: "when the short url is deleted, response is OK",
 			fields: fields{
 				UrlStore: &storage.FakeUrlStore{
-					RemoveFn: func(s string) error {
+					RemoveFn: func(ctx context.Context, s string) error {
 						return nil
 					},
 				},
 			},
 			args: args{
-				r: httptest.NewRequest(http.MethodGet, "/shortn/1234", nil),
+				r: newCodeRequest(http.MethodDelete, "/api/v1/links/1234", "1234"),
 			},
 			wantCode: http.StatusOK,
 		},
@@ -292,10 +734,202 @@ func TestUrlHandler_DeleteShortenUrl(t *testing.T) {
 	}
 }
 
+func TestUrlHandler_GetClickStats(t *testing.T) {
+	found := &storage.FakeUrlStore{
+		FetchFn: func(ctx context.Context, s string) (string, error) {
+			return "1234567890", nil
+		},
+	}
+	tests := []struct {
+		name            string
+		urlStore        storage.Store
+		clickStatsErr   error
+		r               *http.Request
+		wantCode        int
+		wantGranularity string
+		wantFrom        time.Time
+		wantTo          time.Time
+	}{
+		{
+			name:     "when the url is not correct, response is bad request",
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links//stats", ""),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "when the granularity is unknown, response is bad request",
+			urlStore: found,
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links/1234/stats?granularity=minute", "1234"),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "when from is not a time, response is bad request",
+			urlStore: found,
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links/1234/stats?from=yesterday", "1234"),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "when from is after to, response is bad request",
+			urlStore: found,
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links/1234/stats?from=2024-01-02&to=2024-01-01", "1234"),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "when the range has too many buckets, response is bad request",
+			urlStore: found,
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links/1234/stats?from=2020-01-01&to=2024-01-01", "1234"),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "when the short url does not exist, response is not found",
+			urlStore: &storage.FakeUrlStore{
+				FetchFn: func(ctx context.Context, s string) (string, error) {
+					return "", storage.ErrNotFound
+				},
+			},
+			r:        newCodeRequest(http.MethodGet, "/api/v1/links/1234/stats", "1234"),
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:          "when there is an error fetching the stats, response is internal server error",
+			urlStore:      found,
+			clickStatsErr: errors.New("expected error"),
+			r:             newCodeRequest(http.MethodGet, "/api/v1/links/1234/stats", "1234"),
+			wantCode:      http.StatusInternalServerError,
+		},
+		{
+			name:            "when the range is given, response is OK with the stats in the range",
+			urlStore:        found,
+			r:               newCodeRequest(http.MethodGet, "/api/v1/links/1234/stats?from=2024-01-01&to=2024-01-31T12:00:00Z&granularity=day", "1234"),
+			wantCode:        http.StatusOK,
+			wantGranularity: storage.GranularityDay,
+			wantFrom:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantTo:          time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var gotShortUrl, gotGranularity string
+			var gotFrom, gotTo time.Time
+			h := &UrlHandler{
+				UrlStore: tt.urlStore,
+				ClickStore: &storage.FakeClickStore{
+					ClickStatsFn: func(ctx context.Context, shortUrl string, from time.Time, to time.Time, granularity string, top int) (storage.ClickStats, error) {
+						gotShortUrl, gotFrom, gotTo, gotGranularity = shortUrl, from, to, granularity
+						return storage.ClickStats{Total: 3}, tt.clickStatsErr
+					},
+				},
+				PublicBaseUrl: "https://sho.rt",
+				logger:        logger,
+			}
+			rr := httptest.NewRecorder()
+			h.GetClickStats(rr, tt.r)
+			assert.Equal(t, tt.wantCode, rr.Code, "http status code does not match")
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, "1234", gotShortUrl)
+				assert.Equal(t, tt.wantGranularity, gotGranularity)
+				assert.Equal(t, tt.wantFrom, gotFrom)
+				assert.Equal(t, tt.wantTo, gotTo)
+				var response ClickStatsResponse
+				assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+				assert.Equal(t, "https://sho.rt/1234", response.ShortUrl)
+				assert.Equal(t, "1234", response.Code)
+				assert.Equal(t, int64(3), response.Total)
+			}
+		})
+	}
+}
+
+func Test_parseClickStatsQuery_defaults(t *testing.T) {
+	now := time.Date(2024, 1, 31, 12, 30, 0, 0, time.UTC)
+	from, to, granularity, err := parseClickStatsQuery(httptest.NewRequest(http.MethodGet, "/api/v1/links/1234/stats", nil), now)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.GranularityHour, granularity)
+	assert.Equal(t, now, to)
+	assert.Equal(t, now.Add(-24*time.Hour), from, "hourly stats should cover the last day by default")
+
+	from, _, _, err = parseClickStatsQuery(httptest.NewRequest(http.MethodGet, "/api/v1/links/1234/stats?granularity=day", nil), now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-30*24*time.Hour), from, "daily stats should cover the last month by default")
+}
+
 type FakeShortUrlEventProducer struct {
-	ProduceFn func(content string) error
+	ProduceFn func(value []byte, headers map[string]string) error
+	// Batches has the size of every batch produced with ProduceBatch, whose events go to ProduceFn
+	Batches []int
+}
+
+func (f *FakeShortUrlEventProducer) Produce(value []byte, headers map[string]string) error {
+	return f.ProduceFn(value, headers)
+}
+
+func (f *FakeShortUrlEventProducer) ProduceBatch(events []event.OutgoingEvent) []error {
+	f.Batches = append(f.Batches, len(events))
+	errs := make([]error, len(events))
+	for i, e := range events {
+		errs[i] = f.ProduceFn(e.Value, e.Headers)
+	}
+	return errs
+}
+
+// newCodeRequest returns a request with the short url in its code path value, as the router sets it
+func newCodeRequest(method string, target string, code string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.SetPathValue(codePathValue, code)
+	return r
 }
 
-func (f *FakeShortUrlEventProducer) Produce(content string) error {
-	return f.ProduceFn(content)
+func TestNewUrlHandler_withoutOptionalStores(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	h := NewUrlHandler(UrlHandlerConfigs{
+		UrlStore: &storage.FakeUrlStore{
+			FetchFn: func(ctx context.Context, key string) (string, error) {
+				return "https://example.com", nil
+			},
+		},
+		UnknownHostFallback: UnknownHostDefault,
+	}, nil, logger)
+
+	domainRequest := httptest.NewRequest(http.MethodDelete, "/api/v1/domains/go.brand.com", nil)
+	domainRequest.SetPathValue(domainPathValue, "go.brand.com")
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		request *http.Request
+	}{
+		{
+			name:    "when there is no click store, the click stats are not enabled",
+			handler: h.GetClickStats,
+			request: newCodeRequest(http.MethodGet, "/api/v1/links/abc/stats", "abc"),
+		},
+		{
+			name:    "when there is no domain store, registering a domain is not enabled",
+			handler: h.RegisterDomain,
+			request: httptest.NewRequest(http.MethodPost, "/api/v1/domains", bytes.NewBufferString(`{"domain":"go.brand.com"}`)),
+		},
+		{
+			name:    "when there is no domain store, listing the domains is not enabled",
+			handler: h.GetDomains,
+			request: httptest.NewRequest(http.MethodGet, "/api/v1/domains", nil),
+		},
+		{
+			name:    "when there is no domain store, deleting a domain is not enabled",
+			handler: h.DeleteDomain,
+			request: domainRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.handler(rr, tt.request)
+			assert.Equal(t, http.StatusNotImplemented, rr.Code)
+			var problem Problem
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+			assert.Equal(t, metrics.ErrorKindNotEnabled, problem.Code)
+		})
+	}
 }
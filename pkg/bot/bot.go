@@ -0,0 +1,140 @@
+package bot
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed user_agents.txt
+var defaultPatterns string
+
+// purposeHeaders are the headers browsers and link preview fetchers use to tell a request was not
+// made by someone following the link, e.g. Sec-Purpose: prefetch
+var purposeHeaders = []string{"Sec-Purpose", "Purpose", "X-Purpose", "X-Moz"}
+
+// Classifier tells bots apart from people following a link. A request is made by a bot when it is
+// a HEAD request, a prefetch or preview, or its user agent matches one of the patterns.
+type Classifier struct {
+	path   string
+	logger *slog.Logger
+
+	mu       sync.RWMutex
+	patterns *regexp.Regexp
+	modTime  time.Time
+}
+
+// NewClassifier loads the user agent patterns from the file at path, one regular expression per
+// line, or uses the built-in ones when path is empty.
+func NewClassifier(path string, logger *slog.Logger) (*Classifier, error) {
+	c := &Classifier{path: path, logger: logger}
+	if path == "" {
+		patterns, err := parsePatterns(defaultPatterns)
+		if err != nil {
+			return nil, err
+		}
+		c.patterns = patterns
+		return c, nil
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// IsBot classifies r. A nil *Classifier classifies every request as made by a person.
+func (c *Classifier) IsBot(r *http.Request) bool {
+	if c == nil {
+		return false
+	}
+	if r.Method == http.MethodHead {
+		return true
+	}
+	for _, header := range purposeHeaders {
+		purpose := strings.ToLower(r.Header.Get(header))
+		if strings.Contains(purpose, "prefetch") || strings.Contains(purpose, "preview") || strings.Contains(purpose, "prerender") {
+			return true
+		}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.patterns.MatchString(r.UserAgent())
+}
+
+// Watch reloads the patterns file every interval when it was modified, until ctx is done. A file
+// that fails to load is logged and the previous patterns are kept.
+func (c *Classifier) Watch(ctx context.Context, interval time.Duration) {
+	if c.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				c.logger.Error("Error reloading the bot patterns", "error", err, "path", c.path)
+				continue
+			}
+			if reloaded {
+				c.logger.Info("Reloaded the bot patterns", "path", c.path)
+			}
+		}
+	}
+}
+
+// reload loads the patterns file when it changed since the last load.
+func (c *Classifier) reload() (bool, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := info.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return false, err
+	}
+	patterns, err := parsePatterns(string(data))
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.patterns = patterns
+	c.modTime = info.ModTime()
+	c.mu.Unlock()
+	return true, nil
+}
+
+// parsePatterns compiles every pattern of text into a single case-insensitive regular expression.
+func parsePatterns(text string) (*regexp.Regexp, error) {
+	var patterns []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := regexp.Compile(line); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, "(?:"+line+")")
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New("no bot patterns found")
+	}
+	return regexp.Compile("(?i)" + strings.Join(patterns, "|"))
+}
@@ -0,0 +1,137 @@
+package bot
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClassifier_IsBot(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	c, err := NewClassifier("", logger)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name      string
+		method    string
+		userAgent string
+		headers   map[string]string
+		want      bool
+	}{
+		{
+			name:      "when a browser follows the link, it is not a bot",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+		},
+		{
+			name:      "when a phone model looks like a bot name, it is not a bot",
+			userAgent: "Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+		},
+		{
+			name:      "when a crawler follows the link, it is a bot",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want:      true,
+		},
+		{
+			name:      "when a chat app fetches a link preview, it is a bot",
+			userAgent: "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+			want:      true,
+		},
+		{
+			name:      "when a social network fetches a link preview, it is a bot",
+			userAgent: "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)",
+			want:      true,
+		},
+		{
+			name:      "when the link is requested with HEAD, it is a bot",
+			method:    http.MethodHead,
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0",
+			want:      true,
+		},
+		{
+			name:      "when the browser prefetches the link, it is a bot",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			headers:   map[string]string{"Sec-Purpose": "prefetch;prerender"},
+			want:      true,
+		},
+		{
+			name:      "when firefox prefetches the link, it is a bot",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0",
+			headers:   map[string]string{"X-Moz": "prefetch"},
+			want:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/shortn/abc", nil)
+			r.Header.Set("User-Agent", tt.userAgent)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			assert.Equal(t, tt.want, c.IsBot(r))
+		})
+	}
+}
+
+func TestClassifier_IsBot_nil(t *testing.T) {
+	var c *Classifier
+	assert.False(t, c.IsBot(httptest.NewRequest(http.MethodHead, "/shortn/abc", nil)))
+}
+
+func TestClassifier_Watch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	path := filepath.Join(t.TempDir(), "user_agents.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("# comment\n\nfirst-agent\n"), 0o644))
+	c, err := NewClassifier(path, logger)
+	assert.Nil(t, err)
+
+	request := func(userAgent string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/shortn/abc", nil)
+		r.Header.Set("User-Agent", userAgent)
+		return r
+	}
+	assert.True(t, c.IsBot(request("First-Agent/1.0")), "patterns should be case insensitive")
+	assert.False(t, c.IsBot(request("second-agent/1.0")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Watch(ctx, time.Millisecond)
+
+	assert.Nil(t, os.WriteFile(path, []byte("(invalid\n"), 0o644))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, c.IsBot(request("first-agent")), "an invalid file should keep the previous patterns")
+
+	assert.Nil(t, os.WriteFile(path, []byte("second-agent\n"), 0o644))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	assert.Eventually(t, func() bool {
+		return c.IsBot(request("second-agent/1.0"))
+	}, time.Second, time.Millisecond, "a modified file should be reloaded")
+	assert.False(t, c.IsBot(request("first-agent")))
+}
+
+func TestNewClassifier_invalidFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	_, err := NewClassifier(filepath.Join(t.TempDir(), "missing.txt"), logger)
+	assert.NotNil(t, err)
+
+	path := filepath.Join(t.TempDir(), "empty.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("# nothing\n"), 0o644))
+	_, err = NewClassifier(path, logger)
+	assert.NotNil(t, err)
+}
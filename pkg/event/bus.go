@@ -0,0 +1,72 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+const (
+	TransportKafka  = "kafka"
+	TransportMemory = "memory"
+	TransportRedis  = "redis"
+	TransportNats   = "nats"
+)
+
+// Bus carries short url events from the http handlers to the consumer that stores them.
+type Bus interface {
+	Producer
+	Subscribe() (Subscription, error)
+	Close(timeout time.Duration)
+}
+
+// Subscription is the transport side of ShortUrlEventConsumer: it hands out messages and takes
+// care of acknowledging, redelivering and dead-lettering them.
+type Subscription interface {
+	// Fetch returns up to max messages, waiting at most timeout for the batch to fill up once the
+	// first message arrived. It returns an empty batch when there is nothing to consume.
+	Fetch(ctx context.Context, max int, timeout time.Duration) ([]*Message, error)
+	// Ack marks msgs as processed so they are not delivered again.
+	Ack(msgs []*Message) error
+	// Nack makes msgs available again, keeping later messages of their partitions from being
+	// acknowledged before them.
+	Nack(msgs []*Message) error
+	DeadLetter(msg *Message, cause error, attempts int) error
+	Close() error
+}
+
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Value     []byte
+	// Headers describe how Value is encoded, see HeaderContentType and HeaderSchemaVersion
+	Headers map[string]string
+	// raw is the transport's own message, used to get back to it on Ack, Nack and DeadLetter
+	raw any
+}
+
+type BusConfigs struct {
+	Transport string
+	Kafka     KafkaConfigs
+	Memory    MemoryConfigs
+	Redis     RedisStreamConfigs
+	Nats      NatsConfigs
+}
+
+func NewBus(configs BusConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) (Bus, error) {
+	switch configs.Transport {
+	case TransportKafka:
+		return NewKafkaBus(configs.Kafka, metricsHooks, logger)
+	case TransportMemory:
+		return NewMemoryBus(configs.Memory, metricsHooks, logger), nil
+	case TransportRedis:
+		return NewRedisStreamBus(configs.Redis, metricsHooks, logger), nil
+	case TransportNats:
+		return NewNatsBus(configs.Nats, metricsHooks, logger)
+	default:
+		return nil, fmt.Errorf("unknown event bus transport %q", configs.Transport)
+	}
+}
@@ -0,0 +1,283 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+)
+
+// ClickEvent is published for every successful redirect. VisitorId identifies the client within a
+// day, see api.ClickRecorder, and IsBot tells clicks made by crawlers, link previews and prefetches.
+type ClickEvent struct {
+	ShortUrl       string    `json:"short_url"`
+	Timestamp      time.Time `json:"timestamp"`
+	Referrer       string    `json:"referrer,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	IpHash         string    `json:"ip_hash,omitempty"`
+	VisitorId      string    `json:"visitor_id,omitempty"`
+	AcceptLanguage string    `json:"accept_language,omitempty"`
+	Country        string    `json:"country,omitempty"`
+	IsBot          bool      `json:"is_bot"`
+}
+
+// ClickEventPublisher hands click events to a producer from a background goroutine, so that
+// redirects never wait on the transport. When its buffer is full, clicks are dropped and counted
+// rather than slowing redirects down.
+type ClickEventPublisher struct {
+	producer     Producer
+	clicks       chan ClickEvent
+	done         chan struct{}
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewClickEventPublisher(producer Producer, bufferSize int, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) *ClickEventPublisher {
+	p := &ClickEventPublisher{
+		producer:     producer,
+		clicks:       make(chan ClickEvent, bufferSize),
+		done:         make(chan struct{}),
+		metricsHooks: metricsHooks,
+		logger:       logger,
+	}
+	go p.run()
+	return p
+}
+
+// Publish queues click without blocking.
+func (p *ClickEventPublisher) Publish(click ClickEvent) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.metricsHooks.OnClickDropped(metrics.ClickBufferPublisher)
+		return
+	}
+	select {
+	case p.clicks <- click:
+	default:
+		p.metricsHooks.OnClickDropped(metrics.ClickBufferPublisher)
+	}
+}
+
+// Close stops accepting clicks and waits up to timeout for the queued ones to be handed to the
+// producer.
+func (p *ClickEventPublisher) Close(timeout time.Duration) {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.clicks)
+	}
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		p.logger.Error("Click publisher closed with queued clicks", "remaining", len(p.clicks))
+	}
+}
+
+func (p *ClickEventPublisher) run() {
+	defer close(p.done)
+	headers := map[string]string{HeaderContentType: ContentTypeJSON}
+	for click := range p.clicks {
+		value, err := json.Marshal(click)
+		if err != nil {
+			p.logger.Error("Error encoding click event", "error", err)
+			continue
+		}
+		if err := p.producer.Produce(value, headers); err != nil {
+			p.logger.Error("Error producing click event", "error", err)
+		}
+	}
+}
+
+type ClickCounterConfigs struct {
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+	// TopLinks is how many of the day's most clicked links get their unique visitors reported every
+	// TopLinksInterval, 0 disables the report
+	TopLinks         int
+	TopLinksInterval time.Duration
+	// ExcludeBots leaves the clicks made by bots out of the counts
+	ExcludeBots bool
+}
+
+// ClickCounter counts clicks in a storage.ClickStore from a background goroutine, in batches of up
+// to BatchSize clicks or every FlushInterval. Like ClickEventPublisher, it drops clicks when its
+// buffer is full instead of slowing redirects down.
+type ClickCounter struct {
+	store interface {
+		IncrementClicks(ctx context.Context, clicks []storage.Click) error
+		TopLinkVisitors(ctx context.Context, day time.Time, top int) (map[string]int64, error)
+	}
+	configs      ClickCounterConfigs
+	clicks       chan ClickEvent
+	done         chan struct{}
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewClickCounter(store storage.ClickStore, configs ClickCounterConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) *ClickCounter {
+	c := &ClickCounter{
+		store:        store,
+		configs:      configs,
+		clicks:       make(chan ClickEvent, configs.BufferSize),
+		done:         make(chan struct{}),
+		metricsHooks: metricsHooks,
+		logger:       logger,
+	}
+	if c.configs.FlushInterval <= 0 {
+		c.configs.FlushInterval = time.Second
+	}
+	if c.configs.TopLinksInterval <= 0 {
+		c.configs.TopLinksInterval = time.Minute
+	}
+	go c.run()
+	return c
+}
+
+// Publish queues click to be counted without blocking.
+func (c *ClickCounter) Publish(click ClickEvent) {
+	if click.IsBot && c.configs.ExcludeBots {
+		return
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		c.metricsHooks.OnClickDropped(metrics.ClickBufferCounter)
+		return
+	}
+	select {
+	case c.clicks <- click:
+	default:
+		c.metricsHooks.OnClickDropped(metrics.ClickBufferCounter)
+	}
+}
+
+// Close stops accepting clicks and waits up to timeout for the queued ones to be counted.
+func (c *ClickCounter) Close(timeout time.Duration) {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.clicks)
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.done:
+	case <-time.After(timeout):
+		c.logger.Error("Click counter closed with queued clicks", "remaining", len(c.clicks))
+	}
+}
+
+func (c *ClickCounter) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.configs.FlushInterval)
+	defer ticker.Stop()
+	var topLinks <-chan time.Time
+	if c.configs.TopLinks > 0 {
+		topLinksTicker := time.NewTicker(c.configs.TopLinksInterval)
+		defer topLinksTicker.Stop()
+		topLinks = topLinksTicker.C
+	}
+	var batch []storage.Click
+	for {
+		select {
+		case click, ok := <-c.clicks:
+			if !ok {
+				c.flush(batch)
+				return
+			}
+			batch = append(batch, toClick(click))
+			if len(batch) >= c.configs.BatchSize {
+				c.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			c.flush(batch)
+			batch = nil
+		case <-topLinks:
+			c.reportTopLinks()
+		}
+	}
+}
+
+func (c *ClickCounter) flush(batch []storage.Click) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	// counts are best effort, so a failed batch is not retried
+	if err := c.store.IncrementClicks(ctx, batch); err != nil {
+		c.logger.Error("Error counting clicks", "error", err, "size", len(batch))
+	}
+}
+
+func (c *ClickCounter) reportTopLinks() {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	visitors, err := c.store.TopLinkVisitors(ctx, time.Now(), c.configs.TopLinks)
+	if err != nil {
+		c.logger.Error("Error getting the unique visitors of the top links", "error", err)
+		return
+	}
+	c.metricsHooks.OnTopLinkVisitors(visitors)
+}
+
+func toClick(click ClickEvent) storage.Click {
+	return storage.Click{
+		ShortUrl: click.ShortUrl,
+		At:       click.Timestamp,
+		Referrer: referrerHost(click.Referrer),
+		Browser:  browserFamily(click.UserAgent),
+		Country:  click.Country,
+		Visitor:  click.VisitorId,
+		IsBot:    click.IsBot,
+	}
+}
+
+// referrerHost keeps the host of referrer, so the top referrers are sites rather than pages.
+func referrerHost(referrer string) string {
+	if referrer == "" {
+		return ""
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Host
+}
+
+// browserFamily returns the name of the browser sending userAgent. The order matters: most user
+// agents also claim to be the browsers their engine descends from.
+func browserFamily(userAgent string) string {
+	switch {
+	case userAgent == "":
+		return ""
+	case strings.Contains(userAgent, "Edg/"), strings.Contains(userAgent, "EdgiOS/"):
+		return "Edge"
+	case strings.Contains(userAgent, "OPR/"), strings.Contains(userAgent, "Opera"):
+		return "Opera"
+	case strings.Contains(userAgent, "SamsungBrowser/"):
+		return "Samsung Internet"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		return "Chrome"
+	case strings.Contains(userAgent, "Firefox/"), strings.Contains(userAgent, "FxiOS/"):
+		return "Firefox"
+	case strings.Contains(userAgent, "Safari/"):
+		return "Safari"
+	default:
+		return "Other"
+	}
+}
@@ -0,0 +1,217 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+)
+
+func TestClickEventPublisher_Publish(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	var mu sync.Mutex
+	var produced []ClickEvent
+	release := make(chan struct{})
+	dropped := 0
+	p := NewClickEventPublisher(&FakeEventProducer{
+		ProduceFn: func(value []byte, headers map[string]string) error {
+			<-release
+			var click ClickEvent
+			assert.Nil(t, json.Unmarshal(value, &click))
+			assert.Equal(t, ContentTypeJSON, headers[HeaderContentType])
+			mu.Lock()
+			produced = append(produced, click)
+			mu.Unlock()
+			return nil
+		},
+	}, 1, &metrics.MetricsHooks{
+		OnClickDroppedFn: func(buffer string) {
+			assert.Equal(t, metrics.ClickBufferPublisher, buffer)
+			dropped++
+		},
+	}, logger)
+
+	// the first click is taken by the producer, the second one waits in the buffer
+	p.Publish(ClickEvent{ShortUrl: "a"})
+	assert.Eventually(t, func() bool { return len(p.clicks) == 0 }, time.Second, time.Millisecond)
+	p.Publish(ClickEvent{ShortUrl: "b"})
+
+	done := make(chan struct{})
+	go func() {
+		p.Publish(ClickEvent{ShortUrl: "c"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing to a full buffer should not block")
+	}
+	assert.Equal(t, 1, dropped, "a click that doesn't fit in the buffer should be dropped")
+
+	close(release)
+	p.Close(time.Second)
+	p.Publish(ClickEvent{ShortUrl: "d"})
+
+	assert.Equal(t, 2, dropped, "a click published after closing should be dropped")
+	assert.Equal(t, []ClickEvent{{ShortUrl: "a"}, {ShortUrl: "b"}}, produced, "queued clicks should be produced on close")
+}
+
+func TestClickCounter_Publish(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	var mu sync.Mutex
+	var batches [][]storage.Click
+	c := NewClickCounter(&storage.FakeClickStore{
+		IncrementClicksFn: func(ctx context.Context, clicks []storage.Click) error {
+			_, ok := ctx.Deadline()
+			assert.True(t, ok, "counting should not wait on the store forever")
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, clicks)
+			return nil
+		},
+	}, ClickCounterConfigs{BufferSize: 10, BatchSize: 2, FlushInterval: time.Hour}, &metrics.MetricsHooks{}, logger)
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Publish(ClickEvent{ShortUrl: "a", Timestamp: at, Referrer: "https://google.com/search?q=a", UserAgent: "Mozilla/5.0 Firefox/120.0", Country: "AR"})
+	c.Publish(ClickEvent{ShortUrl: "b", Timestamp: at})
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches) == 1
+	}, time.Second, time.Millisecond, "a full batch should be counted without waiting for the flush interval")
+
+	c.Publish(ClickEvent{ShortUrl: "c", Timestamp: at})
+	c.Close(time.Second)
+
+	assert.Equal(t, [][]storage.Click{
+		{
+			{ShortUrl: "a", At: at, Referrer: "google.com", Browser: "Firefox", Country: "AR"},
+			{ShortUrl: "b", At: at},
+		},
+		{
+			{ShortUrl: "c", At: at},
+		},
+	}, batches, "the last partial batch should be counted on close")
+}
+
+func TestClickCounter_PublishExcludingBots(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	var counted []storage.Click
+	c := NewClickCounter(&storage.FakeClickStore{
+		IncrementClicksFn: func(ctx context.Context, clicks []storage.Click) error {
+			counted = append(counted, clicks...)
+			return nil
+		},
+	}, ClickCounterConfigs{BufferSize: 10, BatchSize: 10, ExcludeBots: true}, &metrics.MetricsHooks{
+		OnClickDroppedFn: func(buffer string) {
+			t.Error("excluded bots should not be counted as dropped")
+		},
+	}, logger)
+
+	c.Publish(ClickEvent{ShortUrl: "a", IsBot: true})
+	c.Publish(ClickEvent{ShortUrl: "b"})
+	c.Close(time.Second)
+
+	assert.Equal(t, []storage.Click{{ShortUrl: "b"}}, counted, "clicks made by bots should not be counted")
+}
+
+func TestClickCounter_PublishWhenFull(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	release := make(chan struct{})
+	dropped := 0
+	c := NewClickCounter(&storage.FakeClickStore{
+		IncrementClicksFn: func(ctx context.Context, clicks []storage.Click) error {
+			<-release
+			return errors.New("expected error")
+		},
+	}, ClickCounterConfigs{BufferSize: 1, BatchSize: 1}, &metrics.MetricsHooks{
+		OnClickDroppedFn: func(buffer string) {
+			assert.Equal(t, metrics.ClickBufferCounter, buffer)
+			dropped++
+		},
+	}, logger)
+
+	// the first click is being counted, the second one waits in the buffer
+	c.Publish(ClickEvent{ShortUrl: "a"})
+	assert.Eventually(t, func() bool { return len(c.clicks) == 0 }, time.Second, time.Millisecond)
+	c.Publish(ClickEvent{ShortUrl: "b"})
+	c.Publish(ClickEvent{ShortUrl: "c"})
+	assert.Equal(t, 1, dropped, "a click that doesn't fit in the buffer should be dropped")
+
+	close(release)
+	c.Close(time.Second)
+	c.Publish(ClickEvent{ShortUrl: "d"})
+	assert.Equal(t, 2, dropped, "a click published after closing should be dropped")
+}
+
+func TestClickCounter_reportTopLinks(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	reported := make(chan map[string]int64, 10)
+	c := NewClickCounter(&storage.FakeClickStore{
+		TopLinkVisitorsFn: func(ctx context.Context, day time.Time, top int) (map[string]int64, error) {
+			assert.Equal(t, 2, top)
+			_, ok := ctx.Deadline()
+			assert.True(t, ok, "the report should not wait on the store forever")
+			return map[string]int64{"a": 10, "b": 5}, nil
+		},
+	}, ClickCounterConfigs{BufferSize: 1, BatchSize: 1, TopLinks: 2, TopLinksInterval: time.Millisecond}, &metrics.MetricsHooks{
+		OnTopLinkVisitorsFn: func(visitors map[string]int64) {
+			select {
+			case reported <- visitors:
+			default:
+			}
+		},
+	}, logger)
+	defer c.Close(time.Second)
+
+	select {
+	case visitors := <-reported:
+		assert.Equal(t, map[string]int64{"a": 10, "b": 5}, visitors)
+	case <-time.After(time.Second):
+		t.Fatal("the top links should be reported every interval")
+	}
+}
+
+func Test_browserFamily(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"", ""},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", "Edge"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 OPR/105.0.0.0", "Opera"},
+		{"Mozilla/5.0 (Linux; Android 13) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36", "Samsung Internet"},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "Chrome"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", "Firefox"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15", "Safari"},
+		{"curl/8.4.0", "Other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, browserFamily(tt.userAgent))
+		})
+	}
+}
+
+func Test_referrerHost(t *testing.T) {
+	assert.Equal(t, "", referrerHost(""))
+	assert.Equal(t, "", referrerHost("not a url"))
+	assert.Equal(t, "news.ycombinator.com", referrerHost("https://news.ycombinator.com/item?id=1"))
+}
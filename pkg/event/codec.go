@@ -0,0 +1,106 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"strconv"
+	"urlshortn/pkg/event/eventpb"
+)
+
+const (
+	HeaderContentType   = "content-type"
+	HeaderSchemaVersion = "schema-version"
+
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+
+	// SchemaVersion is the version of eventpb.LinkEvent this service produces and the highest one
+	// it can consume
+	SchemaVersion = 1
+)
+
+// EncodeShortUrlEvent serializes event as contentType, which defaults to the legacy JSON format,
+// and returns the headers that tell consumers how to decode it.
+func EncodeShortUrlEvent(event ShortUrlEvent, contentType string) ([]byte, map[string]string, error) {
+	headers := map[string]string{
+		HeaderSchemaVersion: strconv.Itoa(SchemaVersion),
+	}
+	switch contentType {
+	case "", ContentTypeJSON:
+		headers[HeaderContentType] = ContentTypeJSON
+		value, err := json.Marshal(event)
+		return value, headers, err
+	case ContentTypeProtobuf:
+		headers[HeaderContentType] = ContentTypeProtobuf
+		value, err := proto.Marshal(toLinkEvent(event))
+		return value, headers, err
+	default:
+		return nil, nil, fmt.Errorf("unsupported event content type %q", contentType)
+	}
+}
+
+// DecodeShortUrlEvent reads the event carried by msg. Messages without a content type predate the
+// protobuf schema and are read as JSON.
+func DecodeShortUrlEvent(msg *Message) (ShortUrlEvent, error) {
+	if version, ok := msg.Headers[HeaderSchemaVersion]; ok {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return ShortUrlEvent{}, fmt.Errorf("invalid schema version %q", version)
+		}
+		if v > SchemaVersion {
+			return ShortUrlEvent{}, fmt.Errorf("unsupported schema version %d", v)
+		}
+	}
+	switch contentType := msg.Headers[HeaderContentType]; contentType {
+	case "", ContentTypeJSON:
+		var event ShortUrlEvent
+		err := json.Unmarshal(msg.Value, &event)
+		return event, err
+	case ContentTypeProtobuf:
+		var linkEvent eventpb.LinkEvent
+		if err := proto.Unmarshal(msg.Value, &linkEvent); err != nil {
+			return ShortUrlEvent{}, err
+		}
+		if linkEvent.GetSchemaVersion() > SchemaVersion {
+			return ShortUrlEvent{}, fmt.Errorf("unsupported schema version %d", linkEvent.GetSchemaVersion())
+		}
+		if linkEvent.GetType() != eventpb.LinkEventType_LINK_EVENT_TYPE_CREATED {
+			return ShortUrlEvent{}, fmt.Errorf("unsupported link event type %s", linkEvent.GetType())
+		}
+		return fromLinkEvent(&linkEvent), nil
+	default:
+		return ShortUrlEvent{}, fmt.Errorf("unsupported event content type %q", contentType)
+	}
+}
+
+func toLinkEvent(event ShortUrlEvent) *eventpb.LinkEvent {
+	linkEvent := &eventpb.LinkEvent{
+		SchemaVersion: SchemaVersion,
+		Type:          eventpb.LinkEventType_LINK_EVENT_TYPE_CREATED,
+		ShortUrl:      event.ShortUrl,
+		LongUrl:       event.LongUrl,
+	}
+	if !event.CreatedAt.IsZero() {
+		linkEvent.CreatedAt = timestamppb.New(event.CreatedAt)
+	}
+	if !event.ExpiresAt.IsZero() {
+		linkEvent.ExpiresAt = timestamppb.New(event.ExpiresAt)
+	}
+	return linkEvent
+}
+
+func fromLinkEvent(linkEvent *eventpb.LinkEvent) ShortUrlEvent {
+	event := ShortUrlEvent{
+		ShortUrl: linkEvent.GetShortUrl(),
+		LongUrl:  linkEvent.GetLongUrl(),
+	}
+	if linkEvent.CreatedAt != nil {
+		event.CreatedAt = linkEvent.CreatedAt.AsTime()
+	}
+	if linkEvent.ExpiresAt != nil {
+		event.ExpiresAt = linkEvent.ExpiresAt.AsTime()
+	}
+	return event
+}
@@ -0,0 +1,143 @@
+package event
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"testing"
+	"time"
+	"urlshortn/pkg/event/eventpb"
+)
+
+func TestEncodeShortUrlEvent(t *testing.T) {
+	event := ShortUrlEvent{
+		ShortUrl:  "abc",
+		LongUrl:   "http://google.com",
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		ExpiresAt: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name            string
+		contentType     string
+		wantContentType string
+		wantErr         bool
+	}{
+		{
+			name:            "when no content type is given, encode as json",
+			contentType:     "",
+			wantContentType: ContentTypeJSON,
+		},
+		{
+			name:            "when encoding as json, the event can be decoded back",
+			contentType:     ContentTypeJSON,
+			wantContentType: ContentTypeJSON,
+		},
+		{
+			name:            "when encoding as protobuf, the event can be decoded back",
+			contentType:     ContentTypeProtobuf,
+			wantContentType: ContentTypeProtobuf,
+		},
+		{
+			name:        "when the content type is unknown, return error",
+			contentType: "text/plain",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, headers, err := EncodeShortUrlEvent(event, tt.contentType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncodeShortUrlEvent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assert.Equal(t, tt.wantContentType, headers[HeaderContentType])
+			assert.Equal(t, "1", headers[HeaderSchemaVersion])
+
+			got, err := DecodeShortUrlEvent(&Message{Value: value, Headers: headers})
+			assert.Nil(t, err)
+			assert.Equal(t, event.ShortUrl, got.ShortUrl)
+			assert.Equal(t, event.LongUrl, got.LongUrl)
+			assert.True(t, event.CreatedAt.Equal(got.CreatedAt), "created at does not match")
+			assert.True(t, event.ExpiresAt.Equal(got.ExpiresAt), "expires at does not match")
+		})
+	}
+}
+
+func TestEncodeShortUrlEvent_zeroTimes(t *testing.T) {
+	value, _, err := EncodeShortUrlEvent(ShortUrlEvent{ShortUrl: "abc", LongUrl: "http://google.com"}, ContentTypeJSON)
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"short_url":"abc","long_url":"http://google.com"}`, string(value), "zero times should be left out")
+}
+
+func TestDecodeShortUrlEvent(t *testing.T) {
+	deleted, _ := proto.Marshal(&eventpb.LinkEvent{
+		SchemaVersion: 1,
+		Type:          eventpb.LinkEventType_LINK_EVENT_TYPE_DELETED,
+		ShortUrl:      "abc",
+	})
+	newer, _ := proto.Marshal(&eventpb.LinkEvent{
+		SchemaVersion: 2,
+		Type:          eventpb.LinkEventType_LINK_EVENT_TYPE_CREATED,
+		ShortUrl:      "abc",
+	})
+	tests := []struct {
+		name    string
+		msg     *Message
+		want    ShortUrlEvent
+		wantErr bool
+	}{
+		{
+			name: "when the message has no headers, decode it as legacy json",
+			msg:  &Message{Value: []byte(`{"short_url":"abc","long_url":"http://google.com"}`)},
+			want: ShortUrlEvent{ShortUrl: "abc", LongUrl: "http://google.com"},
+		},
+		{
+			name:    "when the json is malformed, return error",
+			msg:     &Message{Value: []byte("not json")},
+			wantErr: true,
+		},
+		{
+			name: "when the schema version header is newer than supported, return error",
+			msg: &Message{
+				Value:   []byte(`{"short_url":"abc"}`),
+				Headers: map[string]string{HeaderContentType: ContentTypeJSON, HeaderSchemaVersion: "2"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "when the protobuf schema version is newer than supported, return error",
+			msg: &Message{
+				Value:   newer,
+				Headers: map[string]string{HeaderContentType: ContentTypeProtobuf},
+			},
+			wantErr: true,
+		},
+		{
+			name: "when the protobuf event is not a creation, return error",
+			msg: &Message{
+				Value:   deleted,
+				Headers: map[string]string{HeaderContentType: ContentTypeProtobuf, HeaderSchemaVersion: "1"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "when the content type is unknown, return error",
+			msg: &Message{
+				Value:   []byte("abc"),
+				Headers: map[string]string{HeaderContentType: "text/plain"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeShortUrlEvent(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DecodeShortUrlEvent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -1,63 +1,216 @@
 package event
 
 import (
-	"encoding/json"
-	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"log"
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
+	"net"
 	"time"
+	"urlshortn/pkg/metrics"
 	"urlshortn/pkg/storage"
 )
 
 type ShortUrlEventConsumer struct {
-	Consumer interface {
-		SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) (err error)
-		ReadMessage(timeout time.Duration) (*kafka.Message, error)
+	Subscription Subscription
+	UrlStore     storage.Store
+	Retry        RetryPolicy
+	BatchSize    int
+	BatchTimeout time.Duration
+	MetricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+func NewShortUrlConsumer(subscription Subscription, urlStore storage.Store, configs ConsumerConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) *ShortUrlEventConsumer {
+	return &ShortUrlEventConsumer{
+		Subscription: subscription,
+		UrlStore:     urlStore,
+		Retry:        configs.Retry,
+		BatchSize:    configs.BatchSize,
+		BatchTimeout: configs.BatchTimeout,
+		MetricsHooks: metricsHooks,
+		logger:       logger,
 	}
-	UrlStore storage.Store
-	logger   *slog.Logger
 }
 
-func NewShortUrlConsumer(configs KafkaConfigs, urlStore storage.Store, logger *slog.Logger) (*ShortUrlEventConsumer, error) {
-	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": configs.BootstrapServers,
-		"group.id":          configs.GroupId,
-		"auto.offset.reset": configs.Offset,
-	})
-	if err != nil {
-		log.Fatalf("Failed to create consumer: %s", err)
-		return nil, err
+// Start consumes events until ctx is cancelled and then closes the subscription.
+//
+// Events are read in batches of up to BatchSize messages or BatchTimeout, whichever comes first,
+// and written to the store with a single StoreBatch call. Delivery is at-least-once: messages are
+// only acknowledged once the whole batch has been stored (or handed to the dead-letter topic). A
+// crash between storing and acknowledging means the batch is consumed again, which is harmless
+// because storage.Store writes are idempotent.
+func (c *ShortUrlEventConsumer) Start(ctx context.Context) {
+	c.logger.Debug("starting event consumer")
+	for ctx.Err() == nil {
+		batch, err := c.Subscription.Fetch(ctx, c.BatchSize, c.BatchTimeout)
+		if err != nil {
+			c.logger.Error("Error fetching events", "error", err)
+			continue
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		c.flush(ctx, batch)
 	}
-	err = consumer.SubscribeTopics([]string{configs.Topic}, nil)
-	if err != nil {
-		log.Fatalf("Failed to subscribe: %s", err)
-		return nil, err
+	c.logger.Debug("stopping event consumer")
+	if err := c.Subscription.Close(); err != nil {
+		c.logger.Error("Error closing event subscription", "error", err)
 	}
-	return &ShortUrlEventConsumer{
-		Consumer: consumer,
-		UrlStore: urlStore,
-		logger:   logger,
-	}, nil
 }
 
-func (c *ShortUrlEventConsumer) Start() {
-	c.logger.Debug("starting kafka consumer")
-	for {
-		msg, err := c.Consumer.ReadMessage(-1)
+// flush stores the events in batch and acknowledges them. Once a message of a partition could be
+// neither stored nor dead-lettered, it and the rest of its partition are handed back instead, so
+// they are consumed again rather than skipped.
+func (c *ShortUrlEventConsumer) flush(ctx context.Context, batch []*Message) {
+	startedAt := time.Now()
+	spans := startProcessSpans(ctx, batch)
+	failed := c.process(ctx, batch)
+	endProcessSpans(spans, failed)
+	c.MetricsHooks.OnBatchFlushed(len(batch), time.Since(startedAt), errors.Join(failed...))
+
+	var acked, nacked []*Message
+	blocked := map[partitionKey]bool{}
+	for i, msg := range batch {
+		key := partitionKey{msg.Topic, msg.Partition}
+		if failed[i] != nil {
+			blocked[key] = true
+		}
+		if blocked[key] {
+			nacked = append(nacked, msg)
+			continue
+		}
+		acked = append(acked, msg)
+	}
+	if len(acked) > 0 {
+		if err := c.Subscription.Ack(acked); err != nil {
+			// a later batch on the same partitions acknowledges past these messages anyway
+			c.logger.Error("Error acknowledging events", "error", err)
+		}
+	}
+	if len(nacked) > 0 {
+		if err := c.Subscription.Nack(nacked); err != nil {
+			c.logger.Error("Error handing back events", "error", err)
+		}
+	}
+}
+
+// process stores the events carried by batch. The returned slice holds, for every message, the
+// error that kept it from being either stored or dead-lettered.
+func (c *ShortUrlEventConsumer) process(ctx context.Context, batch []*Message) []error {
+	failed := make([]error, len(batch))
+	entries := map[string]storage.Link{}
+	var stored []int
+	var createdAt []time.Time
+	for i, msg := range batch {
+		c.MetricsHooks.OnEventConsumed(msg.Topic)
+		event, err := DecodeShortUrlEvent(msg)
 		if err != nil {
-			c.logger.Error("Error reading from kafka", "error", err)
-		} else {
-			var event ShortUrlEvent
-			err = json.Unmarshal(msg.Value, &event)
-			if err != nil {
-				c.logger.Error("Error unmarshalling event", "error", err)
-				continue
+			// a malformed payload will never succeed, so it goes straight to the dead-letter topic
+			c.logger.Error("Error decoding event", "error", err)
+			c.MetricsHooks.OnEventFailed(metrics.FailureUnmarshal, err)
+			failed[i] = c.deadLetter(msg, err, 1)
+			continue
+		}
+		entries[event.ShortUrl] = storage.Link{LongUrl: event.LongUrl, ExpiresAt: event.ExpiresAt}
+		stored = append(stored, i)
+		if !event.CreatedAt.IsZero() {
+			createdAt = append(createdAt, event.CreatedAt)
+		}
+	}
+	if len(entries) == 0 {
+		return failed
+	}
+
+	var err error
+	attempts := 0
+	for attempts < c.maxAttempts() {
+		attempts++
+		// a write in flight when ctx is cancelled on shutdown is let finish, rather than failing the batch
+		if err = c.UrlStore.StoreBatch(context.WithoutCancel(ctx), entries); err == nil {
+			for _, t := range createdAt {
+				c.MetricsHooks.OnEventStored(t)
 			}
-			err = c.UrlStore.Store(event.ShortUrl, event.LongUrl)
-			if err != nil {
-				c.logger.Error("Error storing event", "error", err)
-				continue
+			return failed
+		}
+		c.logger.Error("Error storing batch", "error", err, "attempt", attempts, "size", len(entries))
+		c.MetricsHooks.OnEventFailed(metrics.FailureStore, err)
+		if !retryable(err) {
+			// retrying won't help, e.g. a key holding another type, so the batch is dead-lettered right away
+			break
+		}
+		if attempts < c.maxAttempts() {
+			select {
+			case <-time.After(c.Retry.backoff(attempts)):
+			case <-ctx.Done():
+				c.logger.Error("Stopped retrying batch on shutdown", "error", err, "attempt", attempts)
+				for _, i := range stored {
+					failed[i] = ctx.Err()
+				}
+				return failed
 			}
 		}
 	}
+	for _, i := range stored {
+		failed[i] = c.deadLetter(batch[i], err, attempts)
+	}
+	return failed
+}
+
+// startProcessSpans starts a consumer span for every message of batch, continuing the trace carried
+// in its headers.
+func startProcessSpans(ctx context.Context, batch []*Message) []trace.Span {
+	spans := make([]trace.Span, len(batch))
+	for i, msg := range batch {
+		msgCtx := otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Headers))
+		_, spans[i] = tracer.Start(msgCtx, msg.Topic+" process",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(semconv.MessagingDestinationName(msg.Topic)),
+		)
+	}
+	return spans
+}
+
+// endProcessSpans ends spans, marking as failed the ones of the messages that could be neither
+// stored nor dead-lettered.
+func endProcessSpans(spans []trace.Span, failed []error) {
+	for i, span := range spans {
+		if failed[i] != nil {
+			span.RecordError(failed[i])
+			span.SetStatus(codes.Error, failed[i].Error())
+		}
+		span.End()
+	}
+}
+
+// retryable tells whether a StoreBatch call that failed with err may succeed if tried again, that
+// is when the storage couldn't be reached or didn't answer in time.
+func retryable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, storage.ErrUnavailable) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func (c *ShortUrlEventConsumer) maxAttempts() int {
+	if c.Retry.MaxAttempts < 1 {
+		return 1
+	}
+	return c.Retry.MaxAttempts
+}
+
+func (c *ShortUrlEventConsumer) deadLetter(msg *Message, cause error, attempts int) error {
+	if err := c.Subscription.DeadLetter(msg, cause, attempts); err != nil {
+		c.logger.Error("Error publishing event to dead letter topic", "error", err)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,378 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+)
+
+func TestShortUrlEventConsumer_process(t *testing.T) {
+	type fields struct {
+		UrlStore storage.Store
+		Retry    RetryPolicy
+	}
+	type args struct {
+		batch []*Message
+	}
+	tests := []struct {
+		name             string
+		fields           fields
+		args             args
+		wantDeadLettered bool
+		wantAttempts     int
+	}{
+		{
+			name:   "when the event cannot be unmarshalled, it is sent to the dead letter topic without retrying",
+			fields: fields{Retry: RetryPolicy{MaxAttempts: 3}},
+			args: args{
+				batch: []*Message{{Value: []byte("not json")}},
+			},
+			wantDeadLettered: true,
+			wantAttempts:     1,
+		},
+		{
+			name: "when storing fails transiently, it is retried and not sent to the dead letter topic",
+			fields: fields{
+				UrlStore: failingStore(2, storage.ErrUnavailable),
+				Retry:    RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			},
+			args: args{
+				batch: []*Message{{Value: []byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\"}")}},
+			},
+			wantDeadLettered: false,
+		},
+		{
+			name: "when storing keeps failing, it is sent to the dead letter topic after max attempts",
+			fields: fields{
+				UrlStore: failingStore(10, storage.ErrUnavailable),
+				Retry:    RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			},
+			args: args{
+				batch: []*Message{{Value: []byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\"}")}},
+			},
+			wantDeadLettered: true,
+			wantAttempts:     3,
+		},
+		{
+			name: "when storing times out, it is retried",
+			fields: fields{
+				UrlStore: failingStore(1, context.DeadlineExceeded),
+				Retry:    RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			},
+			args: args{
+				batch: []*Message{{Value: []byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\"}")}},
+			},
+			wantDeadLettered: false,
+		},
+		{
+			name: "when storing fails with an error retrying won't fix, it is sent to the dead letter topic without retrying",
+			fields: fields{
+				UrlStore: failingStore(1, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")),
+				Retry:    RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			},
+			args: args{
+				batch: []*Message{{Value: []byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\"}")}},
+			},
+			wantDeadLettered: true,
+			wantAttempts:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			subscription := &FakeSubscription{}
+			c := &ShortUrlEventConsumer{
+				Subscription: subscription,
+				UrlStore:     tt.fields.UrlStore,
+				Retry:        tt.fields.Retry,
+				logger:       logger,
+			}
+			failed := c.process(context.Background(), tt.args.batch)
+			assert.Equal(t, tt.wantDeadLettered, len(subscription.DeadLettered) > 0, "dead letter publishing does not match")
+			assert.Equal(t, tt.wantAttempts, subscription.Attempts, "attempts do not match")
+			for _, err := range failed {
+				assert.Nil(t, err, "every message should be either stored or dead lettered")
+			}
+		})
+	}
+}
+
+func TestShortUrlEventConsumer_flush(t *testing.T) {
+	tests := []struct {
+		name          string
+		batch         []*Message
+		deadLetterErr error
+		wantAcked     []int64
+		wantNacked    []int64
+	}{
+		{
+			name: "when a batch is stored, every message is acknowledged",
+			batch: []*Message{
+				{Partition: 0, Offset: 7, Value: []byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\"}")},
+				{Partition: 0, Offset: 8, Value: []byte("{\"short_url\":\"def\",\"long_url\":\"http://google.com\"}")},
+			},
+			wantAcked: []int64{7, 8},
+		},
+		{
+			name: "when an event is dead lettered, it is acknowledged",
+			batch: []*Message{
+				{Partition: 1, Offset: 3, Value: []byte("not json")},
+			},
+			wantAcked: []int64{3},
+		},
+		{
+			name: "when an event can be neither stored nor dead lettered, it and the rest of its partition are handed back",
+			batch: []*Message{
+				{Partition: 0, Offset: 1, Value: []byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\"}")},
+				{Partition: 0, Offset: 2, Value: []byte("not json")},
+				{Partition: 0, Offset: 3, Value: []byte("{\"short_url\":\"def\",\"long_url\":\"http://google.com\"}")},
+				{Partition: 1, Offset: 9, Value: []byte("{\"short_url\":\"ghi\",\"long_url\":\"http://google.com\"}")},
+			},
+			deadLetterErr: errors.New("expected error"),
+			wantAcked:     []int64{1, 9},
+			wantNacked:    []int64{2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			subscription := &FakeSubscription{DeadLetterErr: tt.deadLetterErr}
+			var batchSizes []int
+			c := &ShortUrlEventConsumer{
+				Subscription: subscription,
+				UrlStore: &storage.FakeUrlStore{
+					StoreBatchFn: func(ctx context.Context, entries map[string]storage.Link) error {
+						return nil
+					},
+				},
+				MetricsHooks: &metrics.MetricsHooks{
+					OnBatchFlushedFn: func(size int, duration time.Duration, err error) {
+						batchSizes = append(batchSizes, size)
+					},
+				},
+				logger: logger,
+			}
+
+			c.flush(context.Background(), tt.batch)
+
+			assert.Equal(t, []int{len(tt.batch)}, batchSizes, "batch sizes do not match")
+			assert.Equal(t, tt.wantAcked, offsetsOf(subscription.Acked), "acknowledged messages do not match")
+			assert.Equal(t, tt.wantNacked, offsetsOf(subscription.Nacked), "handed back messages do not match")
+		})
+	}
+}
+
+func TestShortUrlEventConsumer_flushReportsMetrics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	createdAt := time.Now().Add(-time.Second)
+	consumed := 0
+	failures := map[string]int{}
+	var stored []time.Time
+	c := &ShortUrlEventConsumer{
+		Subscription: &FakeSubscription{},
+		UrlStore: &storage.FakeUrlStore{
+			StoreBatchFn: func(ctx context.Context, entries map[string]storage.Link) error {
+				return nil
+			},
+		},
+		MetricsHooks: &metrics.MetricsHooks{
+			OnEventConsumedFn: func(topic string) {
+				consumed++
+			},
+			OnEventFailedFn: func(reason string, err error) {
+				failures[reason]++
+			},
+			OnEventStoredFn: func(createdAt time.Time) {
+				stored = append(stored, createdAt)
+			},
+		},
+		logger: logger,
+	}
+
+	c.flush(context.Background(), []*Message{
+		{Value: []byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\",\"created_at\":\"" + createdAt.Format(time.RFC3339Nano) + "\"}")},
+		{Value: []byte("not json")},
+	})
+
+	assert.Equal(t, 2, consumed, "consumed events do not match")
+	assert.Equal(t, map[string]int{metrics.FailureUnmarshal: 1}, failures, "failures do not match")
+	assert.Len(t, stored, 1, "stored events do not match")
+	assert.True(t, createdAt.Equal(stored[0]), "stored event should carry its creation time")
+}
+
+func TestShortUrlEventConsumer_flushContinuesTrace(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	// the trace context of the request that shortened the url
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	headers := map[string]string{HeaderContentType: ContentTypeJSON, "traceparent": traceparent}
+	var produced *kafka.Message
+	p := &ShortUrlEventProducer{
+		producer: &FakeProducer{
+			ProduceFn: func(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+				produced = msg
+				return nil
+			},
+		},
+		topic:  "shortn",
+		logger: logger,
+	}
+	assert.Nil(t, p.Produce([]byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\"}"), headers))
+	assert.Equal(t, traceparent, headers["traceparent"], "the headers of the caller should not be modified")
+
+	c := &ShortUrlEventConsumer{
+		Subscription: &FakeSubscription{},
+		UrlStore: &storage.FakeUrlStore{
+			StoreBatchFn: func(ctx context.Context, entries map[string]storage.Link) error {
+				return nil
+			},
+		},
+		logger: logger,
+	}
+	c.flush(context.Background(), []*Message{fromKafkaMessage(produced)})
+
+	ended := spans.Ended()
+	assert.Len(t, ended, 2)
+	publish, process := ended[0], ended[1]
+	assert.Equal(t, "shortn publish", publish.Name())
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", publish.SpanContext().TraceID().String(), "the producer should continue the request trace")
+	assert.Equal(t, "shortn process", process.Name())
+	assert.Equal(t, publish.SpanContext().SpanID(), process.Parent().SpanID(), "the consumer should continue the producer span")
+	assert.Equal(t, publish.SpanContext().TraceID(), process.SpanContext().TraceID())
+}
+
+func TestShortUrlEventConsumer_Start(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	subscription := &FakeSubscription{
+		Batches: [][]*Message{
+			{{Offset: 1, Value: []byte("{\"short_url\":\"abc\",\"long_url\":\"http://google.com\"}")}},
+		},
+	}
+	c := &ShortUrlEventConsumer{
+		Subscription: subscription,
+		UrlStore: &storage.FakeUrlStore{
+			StoreBatchFn: func(ctx context.Context, entries map[string]storage.Link) error {
+				// stop once the only batch has been stored
+				cancel()
+				return nil
+			},
+		},
+		logger: logger,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.Start(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consumer did not stop after the context was cancelled")
+	}
+	assert.Equal(t, []int64{1}, offsetsOf(subscription.Acked), "acknowledged messages do not match")
+	assert.True(t, subscription.Closed, "subscription should be closed on shutdown")
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	assert.Equal(t, 400*time.Millisecond, policy.backoff(3))
+	assert.Equal(t, time.Second, policy.backoff(10))
+}
+
+// failingStore fails the first n calls to StoreBatch
+// failingStore fails the first n StoreBatch calls with err
+func failingStore(n int, err error) *storage.FakeUrlStore {
+	calls := 0
+	return &storage.FakeUrlStore{
+		StoreBatchFn: func(ctx context.Context, entries map[string]storage.Link) error {
+			calls++
+			if calls <= n {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+func offsetsOf(msgs []*Message) []int64 {
+	var offsets []int64
+	for _, msg := range msgs {
+		offsets = append(offsets, msg.Offset)
+	}
+	return offsets
+}
+
+// FakeSubscription hands out Batches in order and records what happens to every message
+type FakeSubscription struct {
+	Batches       [][]*Message
+	DeadLetterErr error
+
+	Acked        []*Message
+	Nacked       []*Message
+	DeadLettered []*Message
+	Attempts     int
+	Closed       bool
+}
+
+func (f *FakeSubscription) Fetch(ctx context.Context, max int, timeout time.Duration) ([]*Message, error) {
+	if len(f.Batches) == 0 {
+		time.Sleep(time.Millisecond)
+		return nil, nil
+	}
+	batch := f.Batches[0]
+	f.Batches = f.Batches[1:]
+	return batch, nil
+}
+
+func (f *FakeSubscription) Ack(msgs []*Message) error {
+	f.Acked = append(f.Acked, msgs...)
+	return nil
+}
+
+func (f *FakeSubscription) Nack(msgs []*Message) error {
+	f.Nacked = append(f.Nacked, msgs...)
+	return nil
+}
+
+func (f *FakeSubscription) DeadLetter(msg *Message, cause error, attempts int) error {
+	f.DeadLettered = append(f.DeadLettered, msg)
+	f.Attempts = attempts
+	return f.DeadLetterErr
+}
+
+func (f *FakeSubscription) Close() error {
+	f.Closed = true
+	return nil
+}
@@ -0,0 +1,205 @@
+package event
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+const (
+	HeaderDeadLetterError     = "x-dlq-error"
+	HeaderDeadLetterTopic     = "x-dlq-original-topic"
+	HeaderDeadLetterPartition = "x-dlq-original-partition"
+	HeaderDeadLetterOffset    = "x-dlq-original-offset"
+	HeaderDeadLetterAttempts  = "x-dlq-attempts"
+
+	deadLetterHeaderPrefix = "x-dlq-"
+)
+
+type DeadLetterPublisher interface {
+	Publish(msg *kafka.Message, cause error, attempts int) error
+	Close(timeout time.Duration)
+}
+
+// DeadLetterProducer copies messages that could not be processed to the dead-letter topic, adding
+// headers that describe why and where they came from.
+type DeadLetterProducer struct {
+	producer interface {
+		Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+		Flush(timeoutMs int) int
+		Close()
+	}
+	topic        string
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+}
+
+func NewDeadLetterProducer(configs KafkaConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) (*DeadLetterProducer, error) {
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers": configs.BootstrapServers,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create dead letter producer: %s", err)
+		return nil, err
+	}
+	go handleDeliveryReports(producer.Events(), metricsHooks, logger)
+	return &DeadLetterProducer{
+		producer:     producer,
+		topic:        configs.DeadLetterTopic,
+		metricsHooks: metricsHooks,
+		logger:       logger,
+	}, nil
+}
+
+// Publish copies msg to the dead-letter topic and waits until it is delivered, so that msg is only
+// acknowledged once its copy can't be lost. It returns the delivery error when it couldn't be.
+func (p *DeadLetterProducer) Publish(msg *kafka.Message, cause error, attempts int) error {
+	headers := append([]kafka.Header{}, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderDeadLetterError, Value: []byte(cause.Error())},
+		kafka.Header{Key: HeaderDeadLetterPartition, Value: []byte(strconv.Itoa(int(msg.TopicPartition.Partition)))},
+		kafka.Header{Key: HeaderDeadLetterOffset, Value: []byte(msg.TopicPartition.Offset.String())},
+		kafka.Header{Key: HeaderDeadLetterAttempts, Value: []byte(strconv.Itoa(attempts))},
+	)
+	if msg.TopicPartition.Topic != nil {
+		headers = append(headers, kafka.Header{Key: HeaderDeadLetterTopic, Value: []byte(*msg.TopicPartition.Topic)})
+	}
+	dlqMsg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{
+			Topic:     &p.topic,
+			Partition: kafka.PartitionAny,
+		},
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+		Opaque:  time.Now(),
+	}
+	p.logger.Debug("Publishing message to dead letter topic", "topic", p.topic, "attempts", attempts, "error", cause)
+	deliveryChan := make(chan kafka.Event, 1)
+	if err := p.producer.Produce(dlqMsg, deliveryChan); err != nil {
+		p.logger.Error("Failed to publish message to dead letter topic", "error", err)
+		return err
+	}
+	delivered, ok := (<-deliveryChan).(*kafka.Message)
+	if !ok {
+		return nil
+	}
+	reportDelivery(delivered, p.metricsHooks, p.logger)
+	if delivered.TopicPartition.Error != nil {
+		return fmt.Errorf("publishing message at offset %s to the dead letter topic: %w", msg.TopicPartition.Offset, delivered.TopicPartition.Error)
+	}
+	return nil
+}
+
+func (p *DeadLetterProducer) Close(timeout time.Duration) {
+	closeProducer(p.producer, timeout, p.logger)
+}
+
+// DeadLetterRedriver moves messages from the dead-letter topic back to the main topic so they
+// get processed again once the underlying problem is fixed.
+type DeadLetterRedriver struct {
+	Consumer interface {
+		ReadMessage(timeout time.Duration) (*kafka.Message, error)
+		CommitMessage(m *kafka.Message) ([]kafka.TopicPartition, error)
+		Close() error
+	}
+	producer interface {
+		Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+		Flush(timeoutMs int) int
+		Close()
+	}
+	topic  string
+	logger *slog.Logger
+}
+
+func NewDeadLetterRedriver(configs KafkaConfigs, logger *slog.Logger) (*DeadLetterRedriver, error) {
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  configs.BootstrapServers,
+		"group.id":           configs.GroupId + "-redrive",
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = consumer.SubscribeTopics([]string{configs.DeadLetterTopic}, nil); err != nil {
+		consumer.Close()
+		return nil, err
+	}
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers": configs.BootstrapServers,
+	})
+	if err != nil {
+		consumer.Close()
+		return nil, err
+	}
+	return &DeadLetterRedriver{
+		Consumer: consumer,
+		producer: producer,
+		topic:    configs.Topic,
+		logger:   logger,
+	}, nil
+}
+
+// Redrive republishes up to max messages (0 means no limit) and stops once the dead-letter topic
+// has been idle for idleTimeout. It returns how many messages were moved.
+func (r *DeadLetterRedriver) Redrive(max int, idleTimeout time.Duration) (int, error) {
+	redriven := 0
+	for max <= 0 || redriven < max {
+		msg, err := r.Consumer.ReadMessage(idleTimeout)
+		if err != nil {
+			if isTimeout(err) {
+				r.logger.Debug("Dead letter topic is idle, stopping redrive", "redriven", redriven)
+				return redriven, nil
+			}
+			return redriven, err
+		}
+
+		deliveryChan := make(chan kafka.Event, 1)
+		err = r.producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{
+				Topic:     &r.topic,
+				Partition: kafka.PartitionAny,
+			},
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: withoutDeadLetterHeaders(msg.Headers),
+		}, deliveryChan)
+		if err != nil {
+			return redriven, err
+		}
+		if delivered, ok := (<-deliveryChan).(*kafka.Message); ok && delivered.TopicPartition.Error != nil {
+			return redriven, fmt.Errorf("redriving message at offset %s: %w", msg.TopicPartition.Offset, delivered.TopicPartition.Error)
+		}
+
+		if _, err = r.Consumer.CommitMessage(msg); err != nil {
+			return redriven, err
+		}
+		redriven++
+	}
+	return redriven, nil
+}
+
+// Close closes the consumer of the dead-letter topic and the producer, waiting up to timeout for
+// the messages still in flight.
+func (r *DeadLetterRedriver) Close(timeout time.Duration) {
+	if err := r.Consumer.Close(); err != nil {
+		r.logger.Error("Error closing the dead letter consumer", "error", err)
+	}
+	closeProducer(r.producer, timeout, r.logger)
+}
+
+func withoutDeadLetterHeaders(headers []kafka.Header) []kafka.Header {
+	var result []kafka.Header
+	for _, header := range headers {
+		if !strings.HasPrefix(header.Key, deadLetterHeaderPrefix) {
+			result = append(result, header)
+		}
+	}
+	return result
+}
@@ -0,0 +1,210 @@
+package event
+
+import (
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterProducer_Publish(t *testing.T) {
+	tests := []struct {
+		name        string
+		produceErr  error
+		deliveryErr error
+		wantErr     bool
+	}{
+		{
+			name: "when the message is delivered, return nil",
+		},
+		{
+			name:       "when producing fails, return the error",
+			produceErr: errors.New("queue full"),
+			wantErr:    true,
+		},
+		{
+			name:        "when the delivery fails, return its error",
+			deliveryErr: kafka.NewError(kafka.ErrMsgTimedOut, "timed out", false),
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			topic := "shortn"
+			var published *kafka.Message
+			p := &DeadLetterProducer{
+				producer: &FakeProducer{
+					ProduceFn: func(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+						if tt.produceErr != nil {
+							return tt.produceErr
+						}
+						published = msg
+						delivered := *msg
+						delivered.TopicPartition.Error = tt.deliveryErr
+						deliveryChan <- &delivered
+						return nil
+					},
+				},
+				topic:  "shortn-dlq",
+				logger: logger,
+			}
+
+			err := p.Publish(&kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 2, Offset: 42},
+				Value:          []byte("hello world"),
+			}, errors.New("expected error"), 3)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.deliveryErr != nil {
+				assert.ErrorIs(t, err, tt.deliveryErr)
+			}
+			if tt.produceErr != nil {
+				return
+			}
+			assert.Equal(t, "shortn-dlq", *published.TopicPartition.Topic)
+			assert.Equal(t, []byte("hello world"), published.Value)
+			headers := map[string]string{}
+			for _, header := range published.Headers {
+				headers[header.Key] = string(header.Value)
+			}
+			assert.Equal(t, map[string]string{
+				HeaderDeadLetterError:     "expected error",
+				HeaderDeadLetterTopic:     "shortn",
+				HeaderDeadLetterPartition: "2",
+				HeaderDeadLetterOffset:    "42",
+				HeaderDeadLetterAttempts:  "3",
+			}, headers)
+		})
+	}
+}
+
+func TestDeadLetterRedriver_Redrive(t *testing.T) {
+	type args struct {
+		max int
+	}
+	tests := []struct {
+		name          string
+		messages      []*kafka.Message
+		produceErr    error
+		args          args
+		want          int
+		wantErr       bool
+		wantCommitted int
+	}{
+		{
+			name: "when the dead letter topic becomes idle, stop and return the redriven count",
+			messages: []*kafka.Message{
+				{Value: []byte("1"), Headers: []kafka.Header{{Key: HeaderDeadLetterError, Value: []byte("boom")}}},
+				{Value: []byte("2")},
+			},
+			want:          2,
+			wantCommitted: 2,
+		},
+		{
+			name: "when max is reached, stop before reading more messages",
+			messages: []*kafka.Message{
+				{Value: []byte("1")},
+				{Value: []byte("2")},
+			},
+			args:          args{max: 1},
+			want:          1,
+			wantCommitted: 1,
+		},
+		{
+			name: "when producing fails, return the error without committing",
+			messages: []*kafka.Message{
+				{Value: []byte("1")},
+			},
+			produceErr: errors.New("expected error"),
+			want:       0,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			consumer := &FakeKafkaConsumer{Messages: tt.messages}
+			r := &DeadLetterRedriver{
+				Consumer: consumer,
+				producer: &FakeProducer{
+					ProduceFn: func(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+						if tt.produceErr != nil {
+							return tt.produceErr
+						}
+						for _, header := range msg.Headers {
+							assert.NotEqual(t, HeaderDeadLetterError, header.Key, "dead letter headers should be removed")
+						}
+						deliveryChan <- msg
+						return nil
+					},
+				},
+				topic:  "shortn",
+				logger: logger,
+			}
+			got, err := r.Redrive(tt.args.max, time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Redrive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, "redriven count does not match")
+			assert.Equal(t, tt.wantCommitted, consumer.Commits, "commits do not match")
+
+			r.Close(time.Millisecond)
+			assert.True(t, consumer.Closed, "the consumer should be closed")
+			assert.True(t, r.producer.(*FakeProducer).Closed, "the producer should be closed")
+		})
+	}
+}
+
+// FakeKafkaConsumer returns the given messages in order and then times out
+type FakeKafkaConsumer struct {
+	Messages []*kafka.Message
+	Commits  int
+	Stored   []kafka.TopicPartition
+	Seeks    []kafka.TopicPartition
+	Closed   bool
+	// HighWatermark is reported for every partition
+	HighWatermark int64
+}
+
+func (f *FakeKafkaConsumer) ReadMessage(timeout time.Duration) (*kafka.Message, error) {
+	if len(f.Messages) == 0 {
+		return nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)
+	}
+	msg := f.Messages[0]
+	f.Messages = f.Messages[1:]
+	return msg, nil
+}
+
+func (f *FakeKafkaConsumer) CommitMessage(m *kafka.Message) ([]kafka.TopicPartition, error) {
+	f.Commits++
+	return nil, nil
+}
+
+func (f *FakeKafkaConsumer) StoreOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	f.Stored = append(f.Stored, offsets...)
+	return offsets, nil
+}
+
+func (f *FakeKafkaConsumer) Seek(partition kafka.TopicPartition, timeoutMs int) error {
+	f.Seeks = append(f.Seeks, partition)
+	return nil
+}
+
+func (f *FakeKafkaConsumer) GetWatermarkOffsets(topic string, partition int32) (low, high int64, err error) {
+	return 0, f.HighWatermark, nil
+}
+
+func (f *FakeKafkaConsumer) Close() error {
+	f.Closed = true
+	return nil
+}
@@ -0,0 +1,255 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.5
+// 	protoc        (unknown)
+// source: shortn/event/v1/link_event.proto
+
+package eventpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type LinkEventType int32
+
+const (
+	LinkEventType_LINK_EVENT_TYPE_UNSPECIFIED LinkEventType = 0
+	LinkEventType_LINK_EVENT_TYPE_CREATED     LinkEventType = 1
+	LinkEventType_LINK_EVENT_TYPE_DELETED     LinkEventType = 2
+)
+
+// Enum value maps for LinkEventType.
+var (
+	LinkEventType_name = map[int32]string{
+		0: "LINK_EVENT_TYPE_UNSPECIFIED",
+		1: "LINK_EVENT_TYPE_CREATED",
+		2: "LINK_EVENT_TYPE_DELETED",
+	}
+	LinkEventType_value = map[string]int32{
+		"LINK_EVENT_TYPE_UNSPECIFIED": 0,
+		"LINK_EVENT_TYPE_CREATED":     1,
+		"LINK_EVENT_TYPE_DELETED":     2,
+	}
+)
+
+func (x LinkEventType) Enum() *LinkEventType {
+	p := new(LinkEventType)
+	*p = x
+	return p
+}
+
+func (x LinkEventType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (LinkEventType) Descriptor() protoreflect.EnumDescriptor {
+	return file_shortn_event_v1_link_event_proto_enumTypes[0].Descriptor()
+}
+
+func (LinkEventType) Type() protoreflect.EnumType {
+	return &file_shortn_event_v1_link_event_proto_enumTypes[0]
+}
+
+func (x LinkEventType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use LinkEventType.Descriptor instead.
+func (LinkEventType) EnumDescriptor() ([]byte, []int) {
+	return file_shortn_event_v1_link_event_proto_rawDescGZIP(), []int{0}
+}
+
+// LinkEvent describes a change in the lifecycle of a short link.
+//
+// Fields may be added, but never renumbered or reused. Changes that old consumers can't read bump
+// schema_version, which is also sent in the schema-version message header.
+type LinkEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SchemaVersion uint32                 `protobuf:"varint,1,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	Type          LinkEventType          `protobuf:"varint,2,opt,name=type,proto3,enum=shortn.event.v1.LinkEventType" json:"type,omitempty"`
+	ShortUrl      string                 `protobuf:"bytes,3,opt,name=short_url,json=shortUrl,proto3" json:"short_url,omitempty"`
+	LongUrl       string                 `protobuf:"bytes,4,opt,name=long_url,json=longUrl,proto3" json:"long_url,omitempty"`
+	// created_at is when the shorten request was received
+	CreatedAt *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	// expires_at is when the short url stops redirecting, unset for the default TTL from when it is
+	// stored
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LinkEvent) Reset() {
+	*x = LinkEvent{}
+	mi := &file_shortn_event_v1_link_event_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LinkEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LinkEvent) ProtoMessage() {}
+
+func (x *LinkEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_shortn_event_v1_link_event_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LinkEvent.ProtoReflect.Descriptor instead.
+func (*LinkEvent) Descriptor() ([]byte, []int) {
+	return file_shortn_event_v1_link_event_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LinkEvent) GetSchemaVersion() uint32 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *LinkEvent) GetType() LinkEventType {
+	if x != nil {
+		return x.Type
+	}
+	return LinkEventType_LINK_EVENT_TYPE_UNSPECIFIED
+}
+
+func (x *LinkEvent) GetShortUrl() string {
+	if x != nil {
+		return x.ShortUrl
+	}
+	return ""
+}
+
+func (x *LinkEvent) GetLongUrl() string {
+	if x != nil {
+		return x.LongUrl
+	}
+	return ""
+}
+
+func (x *LinkEvent) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *LinkEvent) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+var File_shortn_event_v1_link_event_proto protoreflect.FileDescriptor
+
+var file_shortn_event_v1_link_event_proto_rawDesc = string([]byte{
+	0x0a, 0x20, 0x73, 0x68, 0x6f, 0x72, 0x74, 0x6e, 0x2f, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x2f, 0x76,
+	0x31, 0x2f, 0x6c, 0x69, 0x6e, 0x6b, 0x5f, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x12, 0x0f, 0x73, 0x68, 0x6f, 0x72, 0x74, 0x6e, 0x2e, 0x65, 0x76, 0x65, 0x6e, 0x74,
+	0x2e, 0x76, 0x31, 0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x22, 0x94, 0x02, 0x0a, 0x09, 0x4c, 0x69, 0x6e, 0x6b, 0x45, 0x76, 0x65,
+	0x6e, 0x74, 0x12, 0x25, 0x0a, 0x0e, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x5f, 0x76, 0x65, 0x72,
+	0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0d, 0x73, 0x63, 0x68, 0x65,
+	0x6d, 0x61, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x32, 0x0a, 0x04, 0x74, 0x79, 0x70,
+	0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1e, 0x2e, 0x73, 0x68, 0x6f, 0x72, 0x74, 0x6e,
+	0x2e, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x69, 0x6e, 0x6b, 0x45, 0x76,
+	0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x1b, 0x0a,
+	0x09, 0x73, 0x68, 0x6f, 0x72, 0x74, 0x5f, 0x75, 0x72, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x08, 0x73, 0x68, 0x6f, 0x72, 0x74, 0x55, 0x72, 0x6c, 0x12, 0x19, 0x0a, 0x08, 0x6c, 0x6f,
+	0x6e, 0x67, 0x5f, 0x75, 0x72, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6c, 0x6f,
+	0x6e, 0x67, 0x55, 0x72, 0x6c, 0x12, 0x39, 0x0a, 0x0a, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64,
+	0x5f, 0x61, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67,
+	0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65,
+	0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74,
+	0x12, 0x39, 0x0a, 0x0a, 0x65, 0x78, 0x70, 0x69, 0x72, 0x65, 0x73, 0x5f, 0x61, 0x74, 0x18, 0x06,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70,
+	0x52, 0x09, 0x65, 0x78, 0x70, 0x69, 0x72, 0x65, 0x73, 0x41, 0x74, 0x2a, 0x6a, 0x0a, 0x0d, 0x4c,
+	0x69, 0x6e, 0x6b, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x1f, 0x0a, 0x1b,
+	0x4c, 0x49, 0x4e, 0x4b, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f,
+	0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x1b, 0x0a,
+	0x17, 0x4c, 0x49, 0x4e, 0x4b, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45,
+	0x5f, 0x43, 0x52, 0x45, 0x41, 0x54, 0x45, 0x44, 0x10, 0x01, 0x12, 0x1b, 0x0a, 0x17, 0x4c, 0x49,
+	0x4e, 0x4b, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x44, 0x45,
+	0x4c, 0x45, 0x54, 0x45, 0x44, 0x10, 0x02, 0x42, 0x1d, 0x5a, 0x1b, 0x75, 0x72, 0x6c, 0x73, 0x68,
+	0x6f, 0x72, 0x74, 0x6e, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x2f, 0x65,
+	0x76, 0x65, 0x6e, 0x74, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+})
+
+var (
+	file_shortn_event_v1_link_event_proto_rawDescOnce sync.Once
+	file_shortn_event_v1_link_event_proto_rawDescData []byte
+)
+
+func file_shortn_event_v1_link_event_proto_rawDescGZIP() []byte {
+	file_shortn_event_v1_link_event_proto_rawDescOnce.Do(func() {
+		file_shortn_event_v1_link_event_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_shortn_event_v1_link_event_proto_rawDesc), len(file_shortn_event_v1_link_event_proto_rawDesc)))
+	})
+	return file_shortn_event_v1_link_event_proto_rawDescData
+}
+
+var file_shortn_event_v1_link_event_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_shortn_event_v1_link_event_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_shortn_event_v1_link_event_proto_goTypes = []any{
+	(LinkEventType)(0),            // 0: shortn.event.v1.LinkEventType
+	(*LinkEvent)(nil),             // 1: shortn.event.v1.LinkEvent
+	(*timestamppb.Timestamp)(nil), // 2: google.protobuf.Timestamp
+}
+var file_shortn_event_v1_link_event_proto_depIdxs = []int32{
+	0, // 0: shortn.event.v1.LinkEvent.type:type_name -> shortn.event.v1.LinkEventType
+	2, // 1: shortn.event.v1.LinkEvent.created_at:type_name -> google.protobuf.Timestamp
+	2, // 2: shortn.event.v1.LinkEvent.expires_at:type_name -> google.protobuf.Timestamp
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_shortn_event_v1_link_event_proto_init() }
+func file_shortn_event_v1_link_event_proto_init() {
+	if File_shortn_event_v1_link_event_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_shortn_event_v1_link_event_proto_rawDesc), len(file_shortn_event_v1_link_event_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_shortn_event_v1_link_event_proto_goTypes,
+		DependencyIndexes: file_shortn_event_v1_link_event_proto_depIdxs,
+		EnumInfos:         file_shortn_event_v1_link_event_proto_enumTypes,
+		MessageInfos:      file_shortn_event_v1_link_event_proto_msgTypes,
+	}.Build()
+	File_shortn_event_v1_link_event_proto = out.File
+	file_shortn_event_v1_link_event_proto_goTypes = nil
+	file_shortn_event_v1_link_event_proto_depIdxs = nil
+}
@@ -0,0 +1,232 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"log"
+	"log/slog"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+// KafkaBus publishes events with a ShortUrlEventProducer and consumes them through a consumer group.
+type KafkaBus struct {
+	*ShortUrlEventProducer
+	configs      KafkaConfigs
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+}
+
+func NewKafkaBus(configs KafkaConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) (*KafkaBus, error) {
+	producer, err := NewShortUrlProducer(configs, metricsHooks, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaBus{
+		ShortUrlEventProducer: producer,
+		configs:               configs,
+		metricsHooks:          metricsHooks,
+		logger:                logger,
+	}, nil
+}
+
+func (b *KafkaBus) Subscribe() (Subscription, error) {
+	return NewKafkaSubscription(b.configs, b.metricsHooks, b.logger)
+}
+
+type KafkaSubscription struct {
+	Consumer interface {
+		ReadMessage(timeout time.Duration) (*kafka.Message, error)
+		StoreOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+		Seek(partition kafka.TopicPartition, timeoutMs int) error
+		GetWatermarkOffsets(topic string, partition int32) (low, high int64, err error)
+		Close() error
+	}
+	DeadLetterPublisher DeadLetterPublisher
+	MetricsHooks        *metrics.MetricsHooks
+	logger              *slog.Logger
+}
+
+func NewKafkaSubscription(configs KafkaConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) (*KafkaSubscription, error) {
+	commitInterval := configs.CommitInterval
+	if commitInterval <= 0 {
+		commitInterval = time.Second
+	}
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": configs.BootstrapServers,
+		"group.id":          configs.GroupId,
+		"auto.offset.reset": configs.Offset,
+		// offsets are only stored by Ack once events are stored, see ShortUrlEventConsumer.Start, and
+		// committed in the background every commitInterval, when partitions are revoked and on Close,
+		// rather than waiting on the broker after every batch
+		"enable.auto.commit":       true,
+		"enable.auto.offset.store": false,
+		"auto.commit.interval.ms":  int(max(commitInterval.Milliseconds(), 1)),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create consumer: %s", err)
+		return nil, err
+	}
+	err = consumer.SubscribeTopics([]string{configs.Topic}, nil)
+	if err != nil {
+		log.Fatalf("Failed to subscribe: %s", err)
+		return nil, err
+	}
+	deadLetter, err := NewDeadLetterProducer(configs, metricsHooks, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaSubscription{
+		Consumer:            consumer,
+		DeadLetterPublisher: deadLetter,
+		MetricsHooks:        metricsHooks,
+		logger:              logger,
+	}, nil
+}
+
+func (s *KafkaSubscription) Fetch(ctx context.Context, max int, timeout time.Duration) ([]*Message, error) {
+	msg, err := s.Consumer.ReadMessage(pollTimeout)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	batch := []*Message{fromKafkaMessage(msg)}
+	deadline := time.Now().Add(timeout)
+	for len(batch) < max && ctx.Err() == nil {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		msg, err = s.Consumer.ReadMessage(remaining)
+		if err != nil {
+			if !isTimeout(err) {
+				s.logger.Error("Error reading from kafka", "error", err)
+			}
+			break
+		}
+		batch = append(batch, fromKafkaMessage(msg))
+	}
+	return batch, nil
+}
+
+// Ack stores, for every partition, the offset following the last message in msgs, to be committed
+// with the next commit.
+func (s *KafkaSubscription) Ack(msgs []*Message) error {
+	offsets := map[partitionKey]kafka.TopicPartition{}
+	for _, msg := range msgs {
+		tp := msg.raw.(*kafka.Message).TopicPartition
+		key := partitionKey{msg.Topic, msg.Partition}
+		if current, ok := offsets[key]; !ok || current.Offset <= tp.Offset {
+			offsets[key] = kafka.TopicPartition{Topic: tp.Topic, Partition: tp.Partition, Offset: tp.Offset + 1}
+		}
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	partitions := make([]kafka.TopicPartition, 0, len(offsets))
+	for _, tp := range offsets {
+		partitions = append(partitions, tp)
+	}
+	if _, err := s.Consumer.StoreOffsets(partitions); err != nil {
+		return err
+	}
+	s.logger.Debug("Stored offsets", "partitions", len(partitions))
+	s.reportLag(partitions)
+	return nil
+}
+
+// Nack rewinds every partition in msgs to its first message, so they are all read again.
+func (s *KafkaSubscription) Nack(msgs []*Message) error {
+	first := map[partitionKey]kafka.TopicPartition{}
+	for _, msg := range msgs {
+		tp := msg.raw.(*kafka.Message).TopicPartition
+		key := partitionKey{msg.Topic, msg.Partition}
+		if current, ok := first[key]; !ok || tp.Offset < current.Offset {
+			first[key] = tp
+		}
+	}
+	var errs []error
+	for _, tp := range first {
+		if err := s.Consumer.Seek(tp, 0); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *KafkaSubscription) DeadLetter(msg *Message, cause error, attempts int) error {
+	if s.DeadLetterPublisher == nil {
+		s.logger.Error("Dropping event, no dead letter topic configured", "error", cause)
+		return nil
+	}
+	return s.DeadLetterPublisher.Publish(msg.raw.(*kafka.Message), cause, attempts)
+}
+
+func (s *KafkaSubscription) Close() error {
+	err := s.Consumer.Close()
+	if s.DeadLetterPublisher != nil {
+		s.DeadLetterPublisher.Close(flushTimeout)
+	}
+	return err
+}
+
+// reportLag reports how far behind the end of each partition the consumer is, using the high
+// watermarks cached from the last fetch so no extra round trip to the broker is needed.
+func (s *KafkaSubscription) reportLag(stored []kafka.TopicPartition) {
+	for _, tp := range stored {
+		if tp.Topic == nil {
+			continue
+		}
+		_, high, err := s.Consumer.GetWatermarkOffsets(*tp.Topic, tp.Partition)
+		if err != nil || high < 0 {
+			continue
+		}
+		lag := high - int64(tp.Offset)
+		if lag < 0 {
+			lag = 0
+		}
+		s.MetricsHooks.OnConsumerLag(*tp.Topic, tp.Partition, lag)
+	}
+}
+
+func fromKafkaMessage(msg *kafka.Message) *Message {
+	var topic string
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	return &Message{
+		Topic:     topic,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
+		Value:     msg.Value,
+		Headers:   fromKafkaHeaders(msg.Headers),
+		raw:       msg,
+	}
+}
+
+func toKafkaHeaders(headers map[string]string) []kafka.Header {
+	var kafkaHeaders []kafka.Header
+	for key, value := range headers {
+		kafkaHeaders = append(kafkaHeaders, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return kafkaHeaders
+}
+
+func fromKafkaHeaders(kafkaHeaders []kafka.Header) map[string]string {
+	if len(kafkaHeaders) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(kafkaHeaders))
+	for _, header := range kafkaHeaders {
+		headers[header.Key] = string(header.Value)
+	}
+	return headers
+}
+
+func isTimeout(err error) bool {
+	var kafkaErr kafka.Error
+	return errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrTimedOut
+}
@@ -0,0 +1,146 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+func TestKafkaSubscription_Fetch(t *testing.T) {
+	topic := "shortn"
+	tests := []struct {
+		name     string
+		messages []*kafka.Message
+		max      int
+		want     []int64
+	}{
+		{
+			name: "when there are no messages, return an empty batch",
+			max:  10,
+			want: nil,
+		},
+		{
+			name: "when there are fewer messages than max, return them once the topic is idle",
+			messages: []*kafka.Message{
+				{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 1}},
+				{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 2}},
+			},
+			max:  10,
+			want: []int64{1, 2},
+		},
+		{
+			name: "when there are more messages than max, return max messages",
+			messages: []*kafka.Message{
+				{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 1}},
+				{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 2}},
+				{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 3}},
+			},
+			max:  2,
+			want: []int64{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			s := &KafkaSubscription{
+				Consumer: &FakeKafkaConsumer{Messages: tt.messages},
+				logger:   logger,
+			}
+			got, err := s.Fetch(context.Background(), tt.max, time.Second)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, offsetsOf(got))
+		})
+	}
+}
+
+func TestKafkaSubscription_Ack(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	topic := "shortn"
+	consumer := &FakeKafkaConsumer{HighWatermark: 10}
+	lag := map[int32]int64{}
+	s := &KafkaSubscription{
+		Consumer: consumer,
+		MetricsHooks: &metrics.MetricsHooks{
+			OnConsumerLagFn: func(topic string, partition int32, l int64) {
+				lag[partition] = l
+			},
+		},
+		logger: logger,
+	}
+
+	err := s.Ack([]*Message{
+		fromKafkaMessage(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 5}}),
+		fromKafkaMessage(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 6}}),
+		fromKafkaMessage(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: 2}}),
+	})
+
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []kafka.TopicPartition{
+		{Topic: &topic, Partition: 0, Offset: 7},
+		{Topic: &topic, Partition: 1, Offset: 3},
+	}, consumer.Stored, "stored offsets should be the ones following the last message of every partition")
+	assert.Zero(t, consumer.Commits, "offsets should be committed in the background rather than on every ack")
+	assert.Equal(t, map[int32]int64{0: 3, 1: 7}, lag, "lag does not match")
+}
+
+func TestKafkaSubscription_Nack(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	topic := "shortn"
+	consumer := &FakeKafkaConsumer{}
+	s := &KafkaSubscription{
+		Consumer: consumer,
+		logger:   logger,
+	}
+
+	err := s.Nack([]*Message{
+		fromKafkaMessage(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 5}}),
+		fromKafkaMessage(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 6}}),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []kafka.TopicPartition{{Topic: &topic, Partition: 0, Offset: 5}}, consumer.Seeks, "partition should be rewound to its first message")
+}
+
+func TestKafkaSubscription_DeadLetter(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	deadLetter := &FakeDeadLetterPublisher{err: errors.New("expected error")}
+	s := &KafkaSubscription{
+		DeadLetterPublisher: deadLetter,
+		logger:              logger,
+	}
+
+	err := s.DeadLetter(fromKafkaMessage(&kafka.Message{}), errors.New("cause"), 3)
+
+	assert.NotNil(t, err, "dead letter errors should be returned")
+	assert.True(t, deadLetter.published)
+	assert.Equal(t, 3, deadLetter.attempts)
+}
+
+type FakeDeadLetterPublisher struct {
+	published bool
+	attempts  int
+	err       error
+}
+
+func (f *FakeDeadLetterPublisher) Publish(msg *kafka.Message, cause error, attempts int) error {
+	f.published = true
+	f.attempts = attempts
+	return f.err
+}
+
+func (f *FakeDeadLetterPublisher) Close(timeout time.Duration) {
+}
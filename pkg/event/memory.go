@@ -0,0 +1,134 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+var ErrBufferFull = errors.New("event buffer is full")
+
+type MemoryConfigs struct {
+	Topic      string
+	BufferSize int
+}
+
+// MemoryBus is an in-process Bus backed by a buffered channel. Events don't survive a restart,
+// so it is meant for local runs and tests rather than production.
+type MemoryBus struct {
+	topic        string
+	messages     chan *Message
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+
+	mu          sync.Mutex
+	offset      int64
+	deadLetters []*Message
+}
+
+func NewMemoryBus(configs MemoryConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) *MemoryBus {
+	return &MemoryBus{
+		topic:        configs.Topic,
+		messages:     make(chan *Message, configs.BufferSize),
+		metricsHooks: metricsHooks,
+		logger:       logger,
+	}
+}
+
+func (b *MemoryBus) Produce(value []byte, headers map[string]string) error {
+	b.mu.Lock()
+	b.offset++
+	msg := &Message{Topic: b.topic, Offset: b.offset, Value: value, Headers: headers}
+	b.mu.Unlock()
+
+	select {
+	case b.messages <- msg:
+		b.metricsHooks.OnEventDelivered(b.topic, 0, nil)
+		return nil
+	default:
+		b.logger.Error("Dropping event, in-memory bus is full", "topic", b.topic)
+		b.metricsHooks.OnEventDelivered(b.topic, 0, ErrBufferFull)
+		return ErrBufferFull
+	}
+}
+
+// ProduceBatch produces every event in turn, as none of them has to wait on anything.
+func (b *MemoryBus) ProduceBatch(events []OutgoingEvent) []error {
+	errs := make([]error, len(events))
+	for i, event := range events {
+		errs[i] = b.Produce(event.Value, event.Headers)
+	}
+	return errs
+}
+
+func (b *MemoryBus) Subscribe() (Subscription, error) {
+	return &memorySubscription{bus: b}, nil
+}
+
+func (b *MemoryBus) Close(timeout time.Duration) {
+}
+
+// DeadLetters returns the messages that were dead-lettered so far.
+func (b *MemoryBus) DeadLetters() []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Message{}, b.deadLetters...)
+}
+
+type memorySubscription struct {
+	bus *MemoryBus
+}
+
+func (s *memorySubscription) Fetch(ctx context.Context, max int, timeout time.Duration) ([]*Message, error) {
+	var batch []*Message
+	select {
+	case msg := <-s.bus.messages:
+		batch = append(batch, msg)
+	case <-time.After(pollTimeout):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, nil
+	}
+
+	deadline := time.After(timeout)
+	for len(batch) < max {
+		select {
+		case msg := <-s.bus.messages:
+			batch = append(batch, msg)
+		case <-deadline:
+			return batch, nil
+		case <-ctx.Done():
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+func (s *memorySubscription) Ack(msgs []*Message) error {
+	return nil
+}
+
+func (s *memorySubscription) Nack(msgs []*Message) error {
+	// sent from a goroutine so a full buffer can't block the consumer that has to drain it
+	go func() {
+		for _, msg := range msgs {
+			s.bus.messages <- msg
+		}
+	}()
+	return nil
+}
+
+func (s *memorySubscription) DeadLetter(msg *Message, cause error, attempts int) error {
+	s.bus.logger.Debug("Dead lettering in-memory event", "error", cause, "attempts", attempts)
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.deadLetters = append(s.bus.deadLetters, msg)
+	return nil
+}
+
+func (s *memorySubscription) Close() error {
+	return nil
+}
@@ -0,0 +1,51 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryBus_Produce(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	b := NewMemoryBus(MemoryConfigs{Topic: "shortn", BufferSize: 1}, nil, logger)
+
+	assert.Nil(t, b.Produce([]byte("first"), nil))
+	assert.ErrorIs(t, b.Produce([]byte("second"), nil), ErrBufferFull, "producing to a full buffer should fail instead of blocking")
+}
+
+func TestMemoryBus_Subscribe(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	b := NewMemoryBus(MemoryConfigs{Topic: "shortn", BufferSize: 10}, nil, logger)
+	subscription, err := b.Subscribe()
+	assert.Nil(t, err)
+
+	batch, err := subscription.Fetch(context.Background(), 10, 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Empty(t, batch, "an empty bus should return an empty batch")
+
+	assert.Nil(t, b.Produce([]byte("first"), nil))
+	assert.Nil(t, b.Produce([]byte("second"), nil))
+	assert.Nil(t, b.Produce([]byte("third"), nil))
+
+	batch, err = subscription.Fetch(context.Background(), 2, 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2}, offsetsOf(batch))
+	assert.Equal(t, "shortn", batch[0].Topic)
+
+	assert.Nil(t, subscription.Nack(batch[:1]))
+	assert.Nil(t, subscription.DeadLetter(batch[1], errors.New("expected error"), 1))
+	assert.Equal(t, []int64{2}, offsetsOf(b.DeadLetters()))
+
+	batch, err = subscription.Fetch(context.Background(), 10, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []int64{1, 3}, offsetsOf(batch), "handed back messages should be delivered again")
+}
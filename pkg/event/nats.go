@@ -0,0 +1,296 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"log/slog"
+	"strconv"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+type NatsConfigs struct {
+	Url               string
+	Stream            string
+	Subject           string
+	Durable           string
+	DeadLetterSubject string
+	// MaxDeliver is how many times a message that keeps being handed back, or left unacknowledged
+	// for AckWait, is delivered before it is sent to the dead-letter subject instead
+	MaxDeliver int
+	// AckWait is how long a delivered message may stay unacknowledged before it is redelivered
+	AckWait time.Duration
+}
+
+// NatsBus is a Bus on top of a JetStream stream and a durable pull consumer. Messages are
+// acknowledged explicitly once stored, so they are delivered at least once: messages handed back,
+// or left unacknowledged for AckWait, are redelivered up to MaxDeliver times. JetStream itself
+// redelivers them without limit, as it would drop a message whose last delivery went unacknowledged
+// without telling anyone, so the subscription dead-letters them once past the limit.
+type NatsBus struct {
+	conn         *nats.Conn
+	js           jetstream.JetStream
+	configs      NatsConfigs
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+}
+
+// NewNatsBus connects to NATS and creates the stream holding both the event and the dead-letter
+// subjects, or updates it when it already exists.
+func NewNatsBus(configs NatsConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) (*NatsBus, error) {
+	logger.Debug("Connecting to nats", "configs", configs)
+	conn, err := nats.Connect(configs.Url)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:     configs.Stream,
+		Subjects: []string{configs.Subject, configs.DeadLetterSubject},
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NatsBus{
+		conn:         conn,
+		js:           js,
+		configs:      configs,
+		metricsHooks: metricsHooks,
+		logger:       logger,
+	}, nil
+}
+
+// Produce publishes value and waits for JetStream to acknowledge that it was stored.
+func (b *NatsBus) Produce(value []byte, headers map[string]string) error {
+	startedAt := time.Now()
+	_, err := b.js.PublishMsg(context.Background(), b.newMsg(value, headers))
+	b.delivered(startedAt, err)
+	return err
+}
+
+// ProduceBatch publishes every event without waiting for its acknowledgement, then waits up to
+// flushTimeout for all of them. The events not acknowledged by then fail with ErrNotDelivered.
+func (b *NatsBus) ProduceBatch(events []OutgoingEvent) []error {
+	startedAt := time.Now()
+	errs := make([]error, len(events))
+	acks := make([]jetstream.PubAckFuture, len(events))
+	for i, event := range events {
+		acks[i], errs[i] = b.js.PublishMsgAsync(b.newMsg(event.Value, event.Headers))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	select {
+	case <-b.js.PublishAsyncComplete():
+	case <-ctx.Done():
+	}
+	for i, ack := range acks {
+		if errs[i] == nil {
+			select {
+			case <-ack.Ok():
+			case errs[i] = <-ack.Err():
+			case <-ctx.Done():
+				errs[i] = ErrNotDelivered
+			}
+		}
+		b.delivered(startedAt, errs[i])
+	}
+	return errs
+}
+
+func (b *NatsBus) newMsg(value []byte, headers map[string]string) *nats.Msg {
+	msg := nats.NewMsg(b.configs.Subject)
+	msg.Data = value
+	for key, header := range headers {
+		msg.Header.Set(key, header)
+	}
+	return msg
+}
+
+func (b *NatsBus) delivered(startedAt time.Time, err error) {
+	if err != nil {
+		b.logger.Error("Failed to publish event to nats", "subject", b.configs.Subject, "error", err)
+	}
+	b.metricsHooks.OnEventDelivered(b.configs.Subject, time.Since(startedAt), err)
+}
+
+func (b *NatsBus) Subscribe() (Subscription, error) {
+	consumer, err := b.js.CreateOrUpdateConsumer(context.Background(), b.configs.Stream, jetstream.ConsumerConfig{
+		Durable:       b.configs.Durable,
+		FilterSubject: b.configs.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       b.configs.AckWait,
+		// the limit is enforced by the subscription, see NatsBus
+		MaxDeliver: -1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &NatsSubscription{
+		consumer:     consumer,
+		js:           b.js,
+		configs:      b.configs,
+		metricsHooks: b.metricsHooks,
+		logger:       b.logger,
+	}, nil
+}
+
+// Close drains the connection, waiting up to timeout for pending publishes and acks.
+func (b *NatsBus) Close(timeout time.Duration) {
+	done := make(chan struct{})
+	b.conn.SetClosedHandler(func(*nats.Conn) { close(done) })
+	if err := b.conn.Drain(); err != nil {
+		b.logger.Error("Error draining nats connection", "error", err)
+		b.conn.Close()
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		b.logger.Error("Nats connection closed before draining")
+		b.conn.Close()
+	}
+}
+
+var errRedeliveryLimit = errors.New("redelivery limit reached")
+
+type NatsSubscription struct {
+	consumer     jetstream.Consumer
+	js           jetstream.JetStream
+	configs      NatsConfigs
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+}
+
+// Fetch sends a single pull request for max messages. JetStream keeps the request open until the
+// batch is full, so it returns after pollTimeout plus timeout at the latest.
+func (s *NatsSubscription) Fetch(ctx context.Context, max int, timeout time.Duration) ([]*Message, error) {
+	if max < 1 {
+		max = 1
+	}
+	fetched, err := s.consumer.Fetch(max, jetstream.FetchMaxWait(pollTimeout+timeout))
+	if err != nil {
+		return nil, err
+	}
+	var batch []*Message
+	for msg := range fetched.Messages() {
+		// a message past the limit was left unacknowledged on its last delivery, e.g. by a consumer
+		// that crashed, as one handed back then would have been dead-lettered by Nack
+		if s.configs.MaxDeliver > 0 && deliveries(msg) > s.configs.MaxDeliver {
+			s.deadLetterExhausted(s.fromNatsMessage(msg))
+			continue
+		}
+		batch = append(batch, s.fromNatsMessage(msg))
+	}
+	if err := fetched.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) && len(batch) == 0 {
+		return nil, err
+	}
+	return batch, nil
+}
+
+func (s *NatsSubscription) Ack(msgs []*Message) error {
+	var errs []error
+	for _, msg := range msgs {
+		errs = append(errs, msg.raw.(jetstream.Msg).Ack())
+	}
+	s.reportLag()
+	return errors.Join(errs...)
+}
+
+// Nack asks JetStream to redeliver msgs. A message already delivered MaxDeliver times would never be
+// delivered again, so it goes to the dead-letter subject instead.
+func (s *NatsSubscription) Nack(msgs []*Message) error {
+	var errs []error
+	for _, msg := range msgs {
+		natsMsg := msg.raw.(jetstream.Msg)
+		if s.configs.MaxDeliver > 0 && deliveries(natsMsg) >= s.configs.MaxDeliver {
+			errs = append(errs, s.DeadLetter(msg, errRedeliveryLimit, deliveries(natsMsg)))
+			continue
+		}
+		errs = append(errs, natsMsg.Nak())
+	}
+	return errors.Join(errs...)
+}
+
+// deadLetterExhausted dead-letters a message fetched past MaxDeliver. When it can't be, the message is
+// handed back to be dead-lettered on its next delivery.
+func (s *NatsSubscription) deadLetterExhausted(msg *Message) {
+	natsMsg := msg.raw.(jetstream.Msg)
+	s.logger.Warn("Dead lettering nats message left unacknowledged on its last delivery", "offset", msg.Offset, "deliveries", deliveries(natsMsg))
+	if err := s.DeadLetter(msg, errRedeliveryLimit, s.configs.MaxDeliver); err != nil {
+		s.logger.Error("Failed to dead letter nats message", "offset", msg.Offset, "error", err)
+		if err := natsMsg.Nak(); err != nil {
+			s.logger.Error("Failed to hand back nats message", "offset", msg.Offset, "error", err)
+		}
+	}
+}
+
+// DeadLetter publishes msg to the dead-letter subject, with the same headers the kafka transport uses,
+// and then terminates it so it is not redelivered.
+func (s *NatsSubscription) DeadLetter(msg *Message, cause error, attempts int) error {
+	natsMsg := msg.raw.(jetstream.Msg)
+	dlqMsg := nats.NewMsg(s.configs.DeadLetterSubject)
+	dlqMsg.Data = msg.Value
+	for key, header := range msg.Headers {
+		dlqMsg.Header.Set(key, header)
+	}
+	dlqMsg.Header.Set(HeaderDeadLetterError, cause.Error())
+	dlqMsg.Header.Set(HeaderDeadLetterTopic, msg.Topic)
+	dlqMsg.Header.Set(HeaderDeadLetterPartition, strconv.Itoa(int(msg.Partition)))
+	dlqMsg.Header.Set(HeaderDeadLetterOffset, strconv.FormatInt(msg.Offset, 10))
+	dlqMsg.Header.Set(HeaderDeadLetterAttempts, strconv.Itoa(attempts))
+
+	startedAt := time.Now()
+	_, err := s.js.PublishMsg(context.Background(), dlqMsg)
+	s.metricsHooks.OnEventDelivered(s.configs.DeadLetterSubject, time.Since(startedAt), err)
+	if err != nil {
+		return err
+	}
+	return natsMsg.Term()
+}
+
+func (s *NatsSubscription) Close() error {
+	return nil
+}
+
+// reportLag reports the number of messages the durable consumer has yet to receive.
+func (s *NatsSubscription) reportLag() {
+	info, err := s.consumer.Info(context.Background())
+	if err != nil {
+		return
+	}
+	s.metricsHooks.OnConsumerLag(s.configs.Subject, 0, int64(info.NumPending))
+}
+
+func (s *NatsSubscription) fromNatsMessage(msg jetstream.Msg) *Message {
+	m := &Message{
+		Topic: msg.Subject(),
+		Value: msg.Data(),
+		raw:   msg,
+	}
+	for key := range msg.Headers() {
+		if m.Headers == nil {
+			m.Headers = map[string]string{}
+		}
+		m.Headers[key] = msg.Headers().Get(key)
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		m.Offset = int64(meta.Sequence.Stream)
+	}
+	return m
+}
+
+func deliveries(msg jetstream.Msg) int {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return 0
+	}
+	return int(meta.NumDelivered)
+}
@@ -0,0 +1,202 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+func TestNatsSubscription_Ack(t *testing.T) {
+	var lag int64 = -1
+	bus := newTestNatsBus(t, &metrics.MetricsHooks{
+		OnConsumerLagFn: func(topic string, partition int32, l int64) {
+			lag = l
+		},
+	})
+	sub := subscribe(t, bus)
+	require.NoError(t, bus.Produce([]byte("first"), map[string]string{HeaderContentType: ContentTypeProtobuf}))
+	require.NoError(t, bus.Produce([]byte("second"), nil))
+
+	batch, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, valuesOf(batch))
+	assert.Equal(t, []int64{1, 2}, []int64{batch[0].Offset, batch[1].Offset})
+	assert.Equal(t, map[string]string{HeaderContentType: ContentTypeProtobuf}, batch[0].Headers)
+
+	require.NoError(t, sub.Ack(batch))
+
+	info, err := sub.(*NatsSubscription).consumer.Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, info.NumAckPending, "acknowledged messages should not be pending")
+	assert.Equal(t, int64(0), lag, "lag should be reported")
+}
+
+func TestNatsBus_ProduceBatch(t *testing.T) {
+	bus := newTestNatsBus(t, nil)
+	sub := subscribe(t, bus)
+
+	errs := bus.ProduceBatch([]OutgoingEvent{
+		{Value: []byte("first"), Headers: map[string]string{HeaderContentType: ContentTypeProtobuf}},
+		{Value: []byte("second")},
+	})
+	assert.Equal(t, []error{nil, nil}, errs)
+
+	batch, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, valuesOf(batch), "events should be published in order")
+	assert.Equal(t, map[string]string{HeaderContentType: ContentTypeProtobuf}, batch[0].Headers)
+}
+
+func TestNatsSubscription_Nack(t *testing.T) {
+	bus := newTestNatsBus(t, nil)
+	sub := subscribe(t, bus)
+	require.NoError(t, bus.Produce([]byte("first"), nil))
+
+	batch, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, sub.Nack(batch))
+
+	redelivered, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first"}, valuesOf(redelivered))
+	assert.Equal(t, batch[0].Offset, redelivered[0].Offset)
+	assert.Empty(t, deadLetters(t, bus))
+}
+
+func TestNatsSubscription_Nack_redeliveryLimit(t *testing.T) {
+	bus := newTestNatsBus(t, nil)
+	sub := subscribe(t, bus)
+	require.NoError(t, bus.Produce([]byte("first"), nil))
+
+	for i := 0; i < bus.configs.MaxDeliver; i++ {
+		batch, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+		require.NoError(t, err)
+		require.Len(t, batch, 1, "delivery %d", i+1)
+		require.NoError(t, sub.Nack(batch))
+	}
+
+	batch, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, batch, "message should not be delivered past the limit")
+	dlq := deadLetters(t, bus)
+	require.Len(t, dlq, 1)
+	assert.Equal(t, "first", string(dlq[0].Data()))
+	assert.Equal(t, "3", dlq[0].Headers().Get(HeaderDeadLetterAttempts))
+}
+
+func TestNatsSubscription_Fetch_ackWaitLimit(t *testing.T) {
+	bus := newTestNatsBus(t, nil)
+	bus.configs.AckWait = 50 * time.Millisecond
+	sub := subscribe(t, bus)
+	require.NoError(t, bus.Produce([]byte("first"), nil))
+
+	// left unacknowledged every time, as by a consumer that crashes while handling it, so it is
+	// redelivered once AckWait is over, which a Fetch waiting for a message outlasts
+	for i := 0; i < bus.configs.MaxDeliver; i++ {
+		batch, err := sub.Fetch(context.Background(), 1, 10*time.Millisecond)
+		require.NoError(t, err)
+		require.Len(t, batch, 1, "delivery %d", i+1)
+	}
+
+	batch, err := sub.Fetch(context.Background(), 1, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, batch, "message should not be delivered past the limit")
+	dlq := deadLetters(t, bus)
+	require.Len(t, dlq, 1, "message should be dead-lettered rather than lost")
+	assert.Equal(t, "first", string(dlq[0].Data()))
+	assert.Equal(t, "3", dlq[0].Headers().Get(HeaderDeadLetterAttempts))
+
+	again, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, again, "dead-lettered message should not be redelivered")
+}
+
+func TestNatsSubscription_DeadLetter(t *testing.T) {
+	bus := newTestNatsBus(t, nil)
+	sub := subscribe(t, bus)
+	require.NoError(t, bus.Produce([]byte("not json"), nil))
+
+	batch, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, sub.DeadLetter(batch[0], errors.New("cause"), 1))
+
+	dlq := deadLetters(t, bus)
+	require.Len(t, dlq, 1)
+	assert.Equal(t, "not json", string(dlq[0].Data()))
+	assert.Equal(t, "cause", dlq[0].Headers().Get(HeaderDeadLetterError))
+	assert.Equal(t, "shortn.urls", dlq[0].Headers().Get(HeaderDeadLetterTopic))
+	assert.Equal(t, "1", dlq[0].Headers().Get(HeaderDeadLetterOffset))
+	assert.Equal(t, "1", dlq[0].Headers().Get(HeaderDeadLetterAttempts))
+
+	again, err := sub.Fetch(context.Background(), 10, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, again, "dead-lettered message should not be redelivered")
+}
+
+func newTestNatsBus(t *testing.T, metricsHooks *metrics.MetricsHooks) *NatsBus {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	require.True(t, srv.ReadyForConnections(5*time.Second), "nats server did not start")
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	bus, err := NewNatsBus(NatsConfigs{
+		Url:               srv.ClientURL(),
+		Stream:            "shortn",
+		Subject:           "shortn.urls",
+		Durable:           "shortn",
+		DeadLetterSubject: "shortn.dlq",
+		MaxDeliver:        3,
+		AckWait:           time.Minute,
+	}, metricsHooks, logger)
+	require.NoError(t, err)
+	t.Cleanup(func() { bus.Close(time.Second) })
+	return bus
+}
+
+func subscribe(t *testing.T, bus Bus) Subscription {
+	t.Helper()
+	sub, err := bus.Subscribe()
+	require.NoError(t, err)
+	return sub
+}
+
+func deadLetters(t *testing.T, bus *NatsBus) []jetstream.Msg {
+	t.Helper()
+	consumer, err := bus.js.CreateOrUpdateConsumer(context.Background(), bus.configs.Stream, jetstream.ConsumerConfig{
+		FilterSubject: bus.configs.DeadLetterSubject,
+		AckPolicy:     jetstream.AckNonePolicy,
+	})
+	require.NoError(t, err)
+	fetched, err := consumer.Fetch(10, jetstream.FetchMaxWait(100*time.Millisecond))
+	require.NoError(t, err)
+	var msgs []jetstream.Msg
+	for msg := range fetched.Messages() {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func valuesOf(msgs []*Message) []string {
+	values := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		values = append(values, string(msg.Value))
+	}
+	return values
+}
@@ -0,0 +1,160 @@
+package event
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"time"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+)
+
+type OutboxConfigs struct {
+	// Interval is how often the outbox is checked for pending entries
+	Interval  time.Duration
+	BatchSize int
+	// MaxBackoff caps the wait between attempts while publishing keeps failing, which doubles from
+	// Interval
+	MaxBackoff time.Duration
+	// LeaseTTL is how long a relay keeps the outbox to itself without renewing its lease, so how long
+	// the others wait for one that stopped
+	LeaseTTL time.Duration
+}
+
+// OutboxRelay publishes the entries written to the outbox by UrlHandler.ShortenUrl when urls are
+// stored synchronously. Entries are only marked as sent once Produce returned, so they are published
+// at least once; entries of a failed round stay pending and are tried again in the next one.
+//
+// Produce only waits for the event to be handed to the transport, so on kafka an entry counts as
+// sent once it is queued by the producer.
+//
+// Every replica runs a relay, but they share the outbox, so a relay only publishes while it holds
+// the lease of the outbox. Otherwise every replica would publish every entry.
+type OutboxRelay struct {
+	Outbox interface {
+		Pending(ctx context.Context, max int) ([]storage.OutboxEntry, error)
+		MarkSent(ctx context.Context, entry storage.OutboxEntry) error
+		Depth(ctx context.Context) (int64, error)
+		Lease(ctx context.Context, owner string, ttl time.Duration) (bool, error)
+		Release(ctx context.Context, owner string) error
+	}
+	Producer     Producer
+	configs      OutboxConfigs
+	MetricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+	// owner tells the lease of this relay apart from the ones of the other replicas
+	owner string
+}
+
+func NewOutboxRelay(outbox storage.Outbox, producer Producer, configs OutboxConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) *OutboxRelay {
+	if configs.LeaseTTL <= 0 {
+		configs.LeaseTTL = 10 * time.Second
+	}
+	return &OutboxRelay{
+		Outbox:       outbox,
+		Producer:     producer,
+		configs:      configs,
+		MetricsHooks: metricsHooks,
+		logger:       logger,
+		owner:        rand.Text(),
+	}
+}
+
+// Start relays pending entries until ctx is cancelled.
+func (r *OutboxRelay) Start(ctx context.Context) {
+	r.logger.Debug("starting outbox relay")
+	backoff := RetryPolicy{InitialBackoff: r.configs.Interval, MaxBackoff: r.configs.MaxBackoff}
+	failures := 0
+	for ctx.Err() == nil {
+		wait := r.configs.Interval
+		if err := r.relay(ctx); err != nil {
+			failures++
+			wait = backoff.backoff(failures)
+			r.logger.Error("Error relaying outbox entries", "error", err, "attempt", failures, "retry_in", wait)
+		} else {
+			failures = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+	r.logger.Debug("stopping outbox relay")
+}
+
+// relay publishes pending entries, oldest first, until the outbox is empty or one of them fails. It
+// does nothing while another relay holds the lease, and renews its own for every batch.
+func (r *OutboxRelay) relay(ctx context.Context) error {
+	// the depth and the lease are still seen to once ctx is done, so they are given one of their own
+	defer r.reportDepth(context.WithoutCancel(ctx))
+	max := r.configs.BatchSize
+	if max < 1 {
+		max = 1
+	}
+	if held, err := r.lease(ctx); err != nil || !held {
+		return err
+	}
+	defer r.release(context.WithoutCancel(ctx))
+	for ctx.Err() == nil {
+		entries, err := r.pending(ctx, max)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := r.Producer.Produce(entry.Value, entry.Headers); err != nil {
+				r.MetricsHooks.OnEventFailed(metrics.FailureOutbox, err)
+				return err
+			}
+			if err := r.markSent(ctx, entry); err != nil {
+				// the entry is published again in the next round, which consumers tolerate
+				r.MetricsHooks.OnEventFailed(metrics.FailureOutbox, err)
+				return err
+			}
+		}
+		if len(entries) < max {
+			return nil
+		}
+		if held, err := r.lease(ctx); err != nil || !held {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *OutboxRelay) lease(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	return r.Outbox.Lease(ctx, r.owner, r.configs.LeaseTTL)
+}
+
+// release gives up the lease so the other relays don't wait for it to run out.
+func (r *OutboxRelay) release(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	if err := r.Outbox.Release(ctx, r.owner); err != nil {
+		r.logger.Error("Error releasing the outbox lease", "error", err)
+	}
+}
+
+func (r *OutboxRelay) pending(ctx context.Context, max int) ([]storage.OutboxEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	return r.Outbox.Pending(ctx, max)
+}
+
+func (r *OutboxRelay) markSent(ctx context.Context, entry storage.OutboxEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	return r.Outbox.MarkSent(ctx, entry)
+}
+
+func (r *OutboxRelay) reportDepth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	depth, err := r.Outbox.Depth(ctx)
+	if err != nil {
+		r.logger.Error("Error getting outbox depth", "error", err)
+		return
+	}
+	r.MetricsHooks.OnOutboxDepth(depth)
+}
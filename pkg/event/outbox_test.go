@@ -0,0 +1,243 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"urlshortn/pkg/metrics"
+	"urlshortn/pkg/storage"
+)
+
+func TestOutboxRelay_relay(t *testing.T) {
+	tests := []struct {
+		name         string
+		produceErr   map[string]error
+		wantProduced []string
+		wantPending  []string
+		wantFailures int
+		wantErr      bool
+	}{
+		{
+			name:         "when every entry is published, the outbox is emptied in order",
+			wantProduced: []string{"a", "b", "c"},
+			wantPending:  []string{},
+			wantErr:      false,
+		},
+		{
+			name:         "when an entry can't be published, it and the later ones stay pending",
+			produceErr:   map[string]error{"b": errors.New("expected error")},
+			wantProduced: []string{"a"},
+			wantPending:  []string{"b", "c"},
+			wantFailures: 1,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			outbox := newListOutbox("a", "b", "c")
+			var produced []string
+			var failures int
+			var depth int64 = -1
+			r := &OutboxRelay{
+				Outbox: outbox.fake(),
+				Producer: &FakeEventProducer{
+					ProduceFn: func(value []byte, headers map[string]string) error {
+						if err := tt.produceErr[string(value)]; err != nil {
+							return err
+						}
+						produced = append(produced, string(value))
+						return nil
+					},
+				},
+				configs: OutboxConfigs{BatchSize: 2},
+				MetricsHooks: &metrics.MetricsHooks{
+					OnEventFailedFn: func(reason string, err error) {
+						assert.Equal(t, metrics.FailureOutbox, reason)
+						failures++
+					},
+					OnOutboxDepthFn: func(d int64) {
+						depth = d
+					},
+				},
+				logger: logger,
+			}
+
+			err := r.relay(context.Background())
+
+			assert.Equal(t, tt.wantErr, err != nil, "error does not match")
+			assert.Equal(t, tt.wantProduced, produced)
+			assert.Equal(t, tt.wantPending, outbox.pending())
+			assert.Equal(t, tt.wantFailures, failures)
+			assert.Equal(t, int64(len(tt.wantPending)), depth, "depth should be reported")
+		})
+	}
+}
+
+func TestOutboxRelay_relay_lease(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	outbox := newListOutbox("a", "b", "c")
+	var mu sync.Mutex
+	produced := map[string]int{}
+	producer := &FakeEventProducer{
+		ProduceFn: func(value []byte, headers map[string]string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			produced[string(value)]++
+			return nil
+		},
+	}
+	configs := OutboxConfigs{BatchSize: 1}
+
+	outbox.holder = "another replica"
+	r := NewOutboxRelay(outbox.fake(), producer, configs, &metrics.MetricsHooks{}, logger)
+	assert.Nil(t, r.relay(context.Background()))
+	assert.Empty(t, produced, "a relay without the lease should not publish")
+	assert.Equal(t, []string{"a", "b", "c"}, outbox.pending())
+
+	outbox.holder = ""
+	relays := []*OutboxRelay{
+		NewOutboxRelay(outbox.fake(), producer, configs, &metrics.MetricsHooks{}, logger),
+		NewOutboxRelay(outbox.fake(), producer, configs, &metrics.MetricsHooks{}, logger),
+	}
+	var wg sync.WaitGroup
+	for _, r := range relays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for len(outbox.pending()) > 0 {
+				assert.Nil(t, r.relay(context.Background()))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1}, produced, "every entry should be published once")
+	assert.Empty(t, outbox.holder, "the lease should be released")
+}
+
+func TestOutboxRelay_Start(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	outbox := newListOutbox("a")
+	attempts := 0
+	r := NewOutboxRelay(outbox.fake(), &FakeEventProducer{
+		ProduceFn: func(value []byte, headers map[string]string) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("expected error")
+			}
+			return nil
+		},
+	}, OutboxConfigs{Interval: time.Millisecond, BatchSize: 10, MaxBackoff: 5 * time.Millisecond}, nil, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Start(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return len(outbox.pending()) == 0 }, time.Second, time.Millisecond,
+		"entry should be published once the producer recovers")
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("relay did not stop after the context was cancelled")
+	}
+	assert.Equal(t, 3, attempts)
+}
+
+type FakeEventProducer struct {
+	ProduceFn func(value []byte, headers map[string]string) error
+}
+
+func (f *FakeEventProducer) Produce(value []byte, headers map[string]string) error {
+	return f.ProduceFn(value, headers)
+}
+
+func (f *FakeEventProducer) ProduceBatch(events []OutgoingEvent) []error {
+	errs := make([]error, len(events))
+	for i, event := range events {
+		errs[i] = f.ProduceFn(event.Value, event.Headers)
+	}
+	return errs
+}
+
+// listOutbox is an in-memory outbox, oldest entry first
+type listOutbox struct {
+	mu      sync.Mutex
+	entries []string
+	holder  string
+}
+
+func newListOutbox(values ...string) *listOutbox {
+	return &listOutbox{entries: values}
+}
+
+func (o *listOutbox) pending() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.entries...)
+}
+
+func (o *listOutbox) fake() *storage.FakeOutbox {
+	return &storage.FakeOutbox{
+		PendingFn: func(ctx context.Context, max int) ([]storage.OutboxEntry, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				return nil, errors.New("the relay should not wait on the outbox forever")
+			}
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			var entries []storage.OutboxEntry
+			for i := 0; i < len(o.entries) && i < max; i++ {
+				entries = append(entries, storage.OutboxEntry{Value: []byte(o.entries[i])})
+			}
+			return entries, nil
+		},
+		MarkSentFn: func(ctx context.Context, entry storage.OutboxEntry) error {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			for i, value := range o.entries {
+				if value == string(entry.Value) {
+					o.entries = append(o.entries[:i], o.entries[i+1:]...)
+					break
+				}
+			}
+			return nil
+		},
+		DepthFn: func(ctx context.Context) (int64, error) {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			return int64(len(o.entries)), nil
+		},
+		LeaseFn: func(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			if o.holder != "" && o.holder != owner {
+				return false, nil
+			}
+			o.holder = owner
+			return true, nil
+		},
+		ReleaseFn: func(ctx context.Context, owner string) error {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			if o.holder == owner {
+				o.holder = ""
+			}
+			return nil
+		},
+	}
+}
@@ -1,8 +1,21 @@
 package event
 
+import "time"
+
+const (
+	pollTimeout  = 100 * time.Millisecond
+	flushTimeout = 5 * time.Second
+	// storeTimeout bounds each call the click counter and the outbox relay make to their store
+	storeTimeout = 5 * time.Second
+)
+
 type ShortUrlEvent struct {
 	ShortUrl string `json:"short_url"`
 	LongUrl  string `json:"long_url"`
+	// CreatedAt is when the shorten request was received, used to measure the end to end latency
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	// ExpiresAt is when the short url stops redirecting, zero for the default TTL from when it is stored
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
 }
 
 type KafkaConfigs struct {
@@ -10,4 +23,32 @@ type KafkaConfigs struct {
 	Topic            string
 	GroupId          string
 	Offset           string
+	DeadLetterTopic  string
+	// CommitInterval is how often the offsets of the stored events are committed
+	CommitInterval time.Duration
+}
+
+type ConsumerConfigs struct {
+	Retry        RetryPolicy
+	BatchSize    int
+	BatchTimeout time.Duration
+}
+
+// RetryPolicy controls how many times a transient failure is retried before the message is sent
+// to the dead-letter topic. The wait between attempts doubles up to MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return backoff
 }
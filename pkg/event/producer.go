@@ -1,24 +1,61 @@
 package event
 
 import (
+	"context"
+	"errors"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"log"
 	"log/slog"
+	"maps"
+	"time"
+	"urlshortn/pkg/metrics"
 )
 
+var tracer = otel.Tracer("urlshortn/pkg/event")
+
+// ErrNotDelivered means an event was handed to the transport, but whether it was published was not
+// known before giving up on it
+var ErrNotDelivered = errors.New("event delivery not confirmed in time")
+
 type Producer interface {
-	Produce(content string) error
+	// Produce publishes an encoded event along with the headers describing its encoding, see
+	// EncodeShortUrlEvent.
+	Produce(value []byte, headers map[string]string) error
+	// ProduceBatch publishes events at once, waiting for them together rather than for each in
+	// turn, and returns the error of each event in order, nil for the ones published.
+	ProduceBatch(events []OutgoingEvent) []error
+}
+
+// OutgoingEvent is an encoded event along with its headers, as Produce takes them.
+type OutgoingEvent struct {
+	Value   []byte
+	Headers map[string]string
+}
+
+// batchDelivery is the Opaque of a message produced by ProduceBatch, telling its delivery report
+// which event of the batch it is about
+type batchDelivery struct {
+	index      int
+	producedAt time.Time
 }
 
 type ShortUrlEventProducer struct {
 	producer interface {
 		Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+		Flush(timeoutMs int) int
+		Close()
 	}
-	topic  string
-	logger *slog.Logger
+	topic        string
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
 }
 
-func NewShortUrlProducer(configs KafkaConfigs, logger *slog.Logger) (*ShortUrlEventProducer, error) {
+func NewShortUrlProducer(configs KafkaConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) (*ShortUrlEventProducer, error) {
 	logger.Debug("Starting kafka producer", "configs", configs)
 	producer, err := kafka.NewProducer(&kafka.ConfigMap{
 		"bootstrap.servers": configs.BootstrapServers,
@@ -27,27 +64,147 @@ func NewShortUrlProducer(configs KafkaConfigs, logger *slog.Logger) (*ShortUrlEv
 		log.Fatalf("Failed to create producer: %s", err)
 		return nil, err
 	}
+	go handleDeliveryReports(producer.Events(), metricsHooks, logger)
 	return &ShortUrlEventProducer{
-		producer: producer,
-		topic:    configs.Topic,
-		logger:   logger,
+		producer:     producer,
+		topic:        configs.Topic,
+		metricsHooks: metricsHooks,
+		logger:       logger,
 	}, nil
 }
 
-func (p *ShortUrlEventProducer) Produce(content string) error {
-	msg := &kafka.Message{
+// Produce publishes value to the topic. The trace context found in headers, if any, is continued by a
+// producer span that is passed on in the message headers.
+func (p *ShortUrlEventProducer) Produce(value []byte, headers map[string]string) error {
+	msg, span := p.newMessage(value, headers)
+	defer span.End()
+	// read back by handleDeliveryReports to measure the delivery latency
+	msg.Opaque = time.Now()
+	p.logger.Debug("Producing kafka msg")
+	if err := p.producer.Produce(msg, nil); err != nil {
+		p.produceFailed(span, err)
+		return err
+	}
+	p.logger.Debug("Producing kafka msg finished")
+	return nil
+}
+
+// ProduceBatch produces every event, flushes the producer once and then waits up to flushTimeout for
+// their delivery reports. The events whose report didn't arrive by then fail with ErrNotDelivered.
+func (p *ShortUrlEventProducer) ProduceBatch(events []OutgoingEvent) []error {
+	errs := make([]error, len(events))
+	deliveries := make(chan kafka.Event, len(events))
+	produced := 0
+	for i, event := range events {
+		msg, span := p.newMessage(event.Value, event.Headers)
+		msg.Opaque = batchDelivery{index: i, producedAt: time.Now()}
+		if err := p.producer.Produce(msg, deliveries); err != nil {
+			p.produceFailed(span, err)
+			errs[i] = err
+		} else {
+			errs[i] = ErrNotDelivered
+			produced++
+		}
+		span.End()
+	}
+	if produced == 0 {
+		return errs
+	}
+	p.logger.Debug("Flushing kafka batch", "size", produced)
+	p.producer.Flush(int(flushTimeout.Milliseconds()))
+	timeout := time.After(flushTimeout)
+	for ; produced > 0; produced-- {
+		select {
+		case e := <-deliveries:
+			msg, ok := e.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			reportDelivery(msg, p.metricsHooks, p.logger)
+			if delivery, ok := msg.Opaque.(batchDelivery); ok {
+				errs[delivery.index] = msg.TopicPartition.Error
+			}
+		case <-timeout:
+			p.logger.Error("Kafka batch delivery not confirmed in time", "remaining", produced)
+			return errs
+		}
+	}
+	return errs
+}
+
+// newMessage returns a message to the topic holding value. The trace context found in headers, if
+// any, is continued by the producer span returned along with it, which is passed on in the message
+// headers.
+func (p *ShortUrlEventProducer) newMessage(value []byte, headers map[string]string) (*kafka.Message, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(headers))
+	ctx, span := tracer.Start(ctx, p.topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(semconv.MessagingSystemKafka, semconv.MessagingDestinationName(p.topic)),
+	)
+	headers = maps.Clone(headers)
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+
+	return &kafka.Message{
 		TopicPartition: kafka.TopicPartition{
 			Topic:     &p.topic,
 			Partition: kafka.PartitionAny,
 		},
-		Value: []byte(content),
+		Value:   value,
+		Headers: toKafkaHeaders(headers),
+	}, span
+}
+
+func (p *ShortUrlEventProducer) produceFailed(span trace.Span, err error) {
+	p.logger.Debug("Failed to produce kafka msg", "err", err)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	p.metricsHooks.OnEventDelivered(p.topic, 0, err)
+}
+
+// Close waits up to timeout for queued messages to be delivered and closes the producer.
+func (p *ShortUrlEventProducer) Close(timeout time.Duration) {
+	closeProducer(p.producer, timeout, p.logger)
+}
+
+func closeProducer(producer interface {
+	Flush(timeoutMs int) int
+	Close()
+}, timeout time.Duration, logger *slog.Logger) {
+	if remaining := producer.Flush(int(timeout.Milliseconds())); remaining > 0 {
+		logger.Error("Kafka producer closed with undelivered messages", "remaining", remaining)
 	}
-	p.logger.Debug("Producing kafka msg")
-	err := p.producer.Produce(msg, nil)
-	if err != nil {
-		p.logger.Debug("Failed to produce kafka msg", "err", err)
-		return err
+	producer.Close()
+}
+
+// handleDeliveryReports reports the outcome of every produced message until the producer is closed.
+func handleDeliveryReports(events chan kafka.Event, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) {
+	for e := range events {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			reportDelivery(ev, metricsHooks, logger)
+		case kafka.Error:
+			logger.Error("Kafka producer error", "error", ev)
+		}
 	}
-	p.logger.Debug("Producing kafka msg finished")
-	return nil
+}
+
+func reportDelivery(msg *kafka.Message, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) {
+	var topic string
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	var latency time.Duration
+	switch opaque := msg.Opaque.(type) {
+	case time.Time:
+		latency = time.Since(opaque)
+	case batchDelivery:
+		latency = time.Since(opaque.producedAt)
+	}
+	if msg.TopicPartition.Error != nil {
+		logger.Error("Failed to deliver kafka msg", "topic", topic, "error", msg.TopicPartition.Error)
+	}
+	metricsHooks.OnEventDelivered(topic, latency, msg.TopicPartition.Error)
 }
@@ -3,20 +3,26 @@ package event
 import (
 	"errors"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
 	"log/slog"
 	"os"
 	"testing"
+	"time"
+	"urlshortn/pkg/metrics"
 )
 
 func TestShortUrlEventProducer_Produce(t *testing.T) {
 	type fields struct {
 		producer interface {
 			Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+			Flush(timeoutMs int) int
+			Close()
 		}
 		topic string
 	}
 	type args struct {
-		content string
+		content []byte
+		headers map[string]string
 	}
 	tests := []struct {
 		name    string
@@ -35,7 +41,7 @@ func TestShortUrlEventProducer_Produce(t *testing.T) {
 				topic: "testing",
 			},
 			args: args{
-				content: "hello world",
+				content: []byte("hello world"),
 			},
 			wantErr: true,
 		},
@@ -44,13 +50,17 @@ func TestShortUrlEventProducer_Produce(t *testing.T) {
 			fields: fields{
 				producer: &FakeProducer{
 					ProduceFn: func(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+						if len(msg.Headers) != 1 || msg.Headers[0].Key != HeaderContentType {
+							return errors.New("headers were not set")
+						}
 						return nil
 					},
 				},
 				topic: "testing",
 			},
 			args: args{
-				content: "hello world",
+				content: []byte("hello world"),
+				headers: map[string]string{HeaderContentType: ContentTypeJSON},
 			},
 			wantErr: false,
 		},
@@ -65,17 +75,113 @@ func TestShortUrlEventProducer_Produce(t *testing.T) {
 				topic:    tt.fields.topic,
 				logger:   logger,
 			}
-			if err := p.Produce(tt.args.content); (err != nil) != tt.wantErr {
+			if err := p.Produce(tt.args.content, tt.args.headers); (err != nil) != tt.wantErr {
 				t.Errorf("Produce() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
+func TestShortUrlEventProducer_ProduceBatch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	produced := 0
+	p := &ShortUrlEventProducer{
+		producer: &FakeProducer{
+			ProduceFn: func(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+				produced++
+				switch string(msg.Value) {
+				case "queue full":
+					return errors.New("queue full")
+				case "undelivered":
+					msg.TopicPartition.Error = errors.New("message timed out")
+				}
+				// reported right away, as the producer would on the flush
+				deliveryChan <- msg
+				return nil
+			},
+		},
+		topic:  "testing",
+		logger: logger,
+	}
+
+	errs := p.ProduceBatch([]OutgoingEvent{
+		{Value: []byte("first")},
+		{Value: []byte("queue full")},
+		{Value: []byte("undelivered")},
+		{Value: []byte("last"), Headers: map[string]string{HeaderContentType: ContentTypeJSON}},
+	})
+
+	assert.Equal(t, 4, produced)
+	assert.Len(t, errs, 4)
+	assert.Nil(t, errs[0])
+	assert.EqualError(t, errs[1], "queue full", "an event that can't be produced should fail")
+	assert.EqualError(t, errs[2], "message timed out", "an event that isn't delivered should fail")
+	assert.Nil(t, errs[3])
+}
+
+func Test_reportDelivery(t *testing.T) {
+	topic := "shortn"
+	tests := []struct {
+		name        string
+		msg         *kafka.Message
+		wantErr     bool
+		wantLatency bool
+	}{
+		{
+			name: "when the message was delivered, report its latency",
+			msg: &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &topic},
+				Opaque:         time.Now().Add(-time.Second),
+			},
+			wantErr:     false,
+			wantLatency: true,
+		},
+		{
+			name: "when the message could not be delivered, report the error",
+			msg: &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &topic, Error: errors.New("expected error")},
+				Opaque:         time.Now(),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var gotTopic string
+			var gotLatency time.Duration
+			var gotErr error
+			reportDelivery(tt.msg, &metrics.MetricsHooks{
+				OnEventDeliveredFn: func(topic string, latency time.Duration, err error) {
+					gotTopic, gotLatency, gotErr = topic, latency, err
+				},
+			}, logger)
+			assert.Equal(t, topic, gotTopic)
+			assert.Equal(t, tt.wantErr, gotErr != nil, "delivery error does not match")
+			if tt.wantLatency {
+				assert.GreaterOrEqual(t, gotLatency, time.Second)
+			}
+		})
+	}
+}
+
 type FakeProducer struct {
 	ProduceFn func(msg *kafka.Message, deliveryChan chan kafka.Event) error
+	Closed    bool
 }
 
 func (f *FakeProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
 	return f.ProduceFn(msg, deliveryChan)
 }
+
+func (f *FakeProducer) Flush(timeoutMs int) int {
+	return 0
+}
+
+func (f *FakeProducer) Close() {
+	f.Closed = true
+}
@@ -0,0 +1,338 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+const (
+	streamFieldEvent          = "event"
+	streamFieldError          = "error"
+	streamFieldOriginalStream = "original_stream"
+	streamFieldOriginalId     = "original_id"
+	streamFieldAttempts       = "attempts"
+)
+
+type RedisStreamConfigs struct {
+	Addr             string
+	Password         string
+	Stream           string
+	Group            string
+	Consumer         string
+	DeadLetterStream string
+	// MinIdle is how long a delivered but unacknowledged entry waits before another consumer of
+	// the group may reclaim it
+	MinIdle time.Duration
+	// MaxLen caps the stream length (approximately), 0 means no cap
+	MaxLen int64
+}
+
+type redisStreamClient interface {
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+	XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd
+	XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
+	XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd
+	XAutoClaim(ctx context.Context, a *redis.XAutoClaimArgs) *redis.XAutoClaimCmd
+	XInfoGroups(ctx context.Context, key string) *redis.XInfoGroupsCmd
+	Close() error
+}
+
+// RedisStreamBus is a Bus on top of a Redis stream and a consumer group, for deployments that
+// run Redis but not Kafka. Entries stay in the group's pending list until acknowledged, so they
+// are delivered at least once: entries left unacknowledged by a consumer (because it crashed or
+// handed them back) are reclaimed with XAUTOCLAIM once they have been idle for MinIdle.
+type RedisStreamBus struct {
+	client       redisStreamClient
+	configs      RedisStreamConfigs
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+}
+
+func NewRedisStreamBus(configs RedisStreamConfigs, metricsHooks *metrics.MetricsHooks, logger *slog.Logger) *RedisStreamBus {
+	client := redis.NewClient(&redis.Options{
+		Addr:     configs.Addr,
+		Password: configs.Password,
+		DB:       0,
+	})
+	if err := redisotel.InstrumentTracing(client); err != nil {
+		logger.Error("Error instrumenting the redis client", "error", err)
+	}
+	return &RedisStreamBus{
+		client:       client,
+		configs:      configs,
+		metricsHooks: metricsHooks,
+		logger:       logger,
+	}
+}
+
+// Produce adds an entry holding value in the event field and every header in a field of its own.
+func (b *RedisStreamBus) Produce(value []byte, headers map[string]string) error {
+	startedAt := time.Now()
+	err := b.client.XAdd(context.Background(), b.xAddArgs(value, headers)).Err()
+	b.delivered(startedAt, err)
+	return err
+}
+
+// ProduceBatch adds an entry for every event in a single pipelined round trip.
+func (b *RedisStreamBus) ProduceBatch(events []OutgoingEvent) []error {
+	ctx := context.Background()
+	startedAt := time.Now()
+	cmds := make([]*redis.StringCmd, len(events))
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, event := range events {
+			cmds[i] = pipe.XAdd(ctx, b.xAddArgs(event.Value, event.Headers))
+		}
+		return nil
+	})
+	errs := make([]error, len(events))
+	for i, cmd := range cmds {
+		errs[i] = cmd.Err()
+		// the commands of a pipeline that couldn't be sent have neither an error nor an id
+		if errs[i] == nil && cmd.Val() == "" {
+			errs[i] = err
+		}
+		b.delivered(startedAt, errs[i])
+	}
+	return errs
+}
+
+// xAddArgs adds an entry holding value in the event field and every header in a field of its own.
+func (b *RedisStreamBus) xAddArgs(value []byte, headers map[string]string) *redis.XAddArgs {
+	values := map[string]interface{}{streamFieldEvent: string(value)}
+	for key, header := range headers {
+		values[key] = header
+	}
+	return &redis.XAddArgs{
+		Stream: b.configs.Stream,
+		MaxLen: b.configs.MaxLen,
+		Approx: b.configs.MaxLen > 0,
+		Values: values,
+	}
+}
+
+func (b *RedisStreamBus) delivered(startedAt time.Time, err error) {
+	if err != nil {
+		b.logger.Error("Failed to add event to redis stream", "stream", b.configs.Stream, "error", err)
+	}
+	b.metricsHooks.OnEventDelivered(b.configs.Stream, time.Since(startedAt), err)
+}
+
+func (b *RedisStreamBus) Subscribe() (Subscription, error) {
+	err := b.client.XGroupCreateMkStream(context.Background(), b.configs.Stream, b.configs.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+	return &RedisStreamSubscription{
+		client:       b.client,
+		configs:      b.configs,
+		metricsHooks: b.metricsHooks,
+		logger:       b.logger,
+	}, nil
+}
+
+func (b *RedisStreamBus) Close(timeout time.Duration) {
+	if err := b.client.Close(); err != nil {
+		b.logger.Error("Error closing redis stream client", "error", err)
+	}
+}
+
+type RedisStreamSubscription struct {
+	client       redisStreamClient
+	configs      RedisStreamConfigs
+	metricsHooks *metrics.MetricsHooks
+	logger       *slog.Logger
+
+	mu          sync.Mutex
+	lastReclaim time.Time
+	claimCursor string
+}
+
+// Fetch first reclaims entries other consumers (or this one) left pending for longer than
+// MinIdle, and otherwise reads new entries for the group.
+func (s *RedisStreamSubscription) Fetch(ctx context.Context, max int, timeout time.Duration) ([]*Message, error) {
+	if max < 1 {
+		max = 1
+	}
+	reclaimed, err := s.reclaim(ctx, max)
+	if err != nil {
+		return nil, err
+	}
+	if len(reclaimed) > 0 {
+		return reclaimed, nil
+	}
+
+	batch, err := s.read(ctx, max, pollTimeout)
+	if err != nil || len(batch) == 0 {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for len(batch) < max && ctx.Err() == nil {
+		// a block of 0 would wait forever, so stop once less than a millisecond is left
+		remaining := time.Until(deadline)
+		if remaining < time.Millisecond {
+			break
+		}
+		more, err := s.read(ctx, max-len(batch), remaining)
+		if err != nil {
+			s.logger.Error("Error reading from redis stream", "error", err)
+			break
+		}
+		if len(more) == 0 {
+			break
+		}
+		batch = append(batch, more...)
+	}
+	return batch, nil
+}
+
+func (s *RedisStreamSubscription) read(ctx context.Context, count int, block time.Duration) ([]*Message, error) {
+	streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    s.configs.Group,
+		Consumer: s.configs.Consumer,
+		Streams:  []string{s.configs.Stream, ">"},
+		Count:    int64(count),
+		Block:    block,
+	}).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) || errors.Is(err, context.Canceled) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var batch []*Message
+	for _, stream := range streams {
+		for _, entry := range stream.Messages {
+			batch = append(batch, s.fromStreamEntry(entry))
+		}
+	}
+	return batch, nil
+}
+
+func (s *RedisStreamSubscription) reclaim(ctx context.Context, max int) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastReclaim) < s.configs.MinIdle {
+		return nil, nil
+	}
+	if s.claimCursor == "" {
+		s.claimCursor = "0-0"
+	}
+	entries, cursor, err := s.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   s.configs.Stream,
+		Group:    s.configs.Group,
+		Consumer: s.configs.Consumer,
+		MinIdle:  s.configs.MinIdle,
+		Start:    s.claimCursor,
+		Count:    int64(max),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	// keep scanning from the cursor until the whole pending list was walked, then wait for MinIdle
+	s.claimCursor = cursor
+	if cursor == "0-0" {
+		s.lastReclaim = time.Now()
+	}
+	if len(entries) > 0 {
+		s.logger.Debug("Reclaimed pending redis stream entries", "count", len(entries))
+	}
+	batch := make([]*Message, 0, len(entries))
+	for _, entry := range entries {
+		batch = append(batch, s.fromStreamEntry(entry))
+	}
+	return batch, nil
+}
+
+func (s *RedisStreamSubscription) Ack(msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	if err := s.client.XAck(context.Background(), s.configs.Stream, s.configs.Group, idsOf(msgs)...).Err(); err != nil {
+		return err
+	}
+	s.reportLag()
+	return nil
+}
+
+// Nack leaves msgs in the pending list, from where they are reclaimed once MinIdle has passed.
+func (s *RedisStreamSubscription) Nack(msgs []*Message) error {
+	s.logger.Debug("Leaving redis stream entries pending to be reclaimed", "count", len(msgs))
+	return nil
+}
+
+// DeadLetter copies msg to the dead-letter stream along with why and where it came from, and then
+// acknowledges it.
+func (s *RedisStreamSubscription) DeadLetter(msg *Message, cause error, attempts int) error {
+	id := msg.raw.(string)
+	values := map[string]interface{}{}
+	for key, header := range msg.Headers {
+		values[key] = header
+	}
+	values[streamFieldEvent] = string(msg.Value)
+	values[streamFieldError] = cause.Error()
+	values[streamFieldOriginalStream] = s.configs.Stream
+	values[streamFieldOriginalId] = id
+	values[streamFieldAttempts] = strconv.Itoa(attempts)
+	err := s.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: s.configs.DeadLetterStream,
+		Values: values,
+	}).Err()
+	s.metricsHooks.OnEventDelivered(s.configs.DeadLetterStream, 0, err)
+	if err != nil {
+		return err
+	}
+	return s.client.XAck(context.Background(), s.configs.Stream, s.configs.Group, id).Err()
+}
+
+func (s *RedisStreamSubscription) Close() error {
+	return nil
+}
+
+// reportLag reports the number of entries not yet delivered to the group, as tracked by Redis.
+func (s *RedisStreamSubscription) reportLag() {
+	groups, err := s.client.XInfoGroups(context.Background(), s.configs.Stream).Result()
+	if err != nil {
+		return
+	}
+	for _, group := range groups {
+		if group.Name == s.configs.Group {
+			s.metricsHooks.OnConsumerLag(s.configs.Stream, 0, group.Lag)
+		}
+	}
+}
+
+func (s *RedisStreamSubscription) fromStreamEntry(entry redis.XMessage) *Message {
+	msg := &Message{
+		Topic: s.configs.Stream,
+		raw:   entry.ID,
+	}
+	for key, field := range entry.Values {
+		value, _ := field.(string)
+		if key == streamFieldEvent {
+			msg.Value = []byte(value)
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = map[string]string{}
+		}
+		msg.Headers[key] = value
+	}
+	return msg
+}
+
+func idsOf(msgs []*Message) []string {
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.raw.(string))
+	}
+	return ids
+}
@@ -0,0 +1,357 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+	"urlshortn/pkg/metrics"
+)
+
+var testStreamConfigs = RedisStreamConfigs{
+	Stream:           "shortn",
+	Group:            "shortn",
+	Consumer:         "consumer-1",
+	DeadLetterStream: "shortn-dlq",
+	MinIdle:          time.Minute,
+	MaxLen:           1000,
+}
+
+func TestRedisStreamBus_Produce(t *testing.T) {
+	tests := []struct {
+		name    string
+		xAddErr error
+		wantErr bool
+	}{
+		{
+			name:    "when the entry is added, report it as delivered",
+			wantErr: false,
+		},
+		{
+			name:    "when adding the entry fails, return the error",
+			xAddErr: errors.New("expected error"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var added *redis.XAddArgs
+			var delivered error
+			b := &RedisStreamBus{
+				client: &FakeRedisStreamClient{
+					XAddFn: func(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+						added = a
+						return redis.NewStringResult("1-0", tt.xAddErr)
+					},
+				},
+				configs: testStreamConfigs,
+				metricsHooks: &metrics.MetricsHooks{
+					OnEventDeliveredFn: func(topic string, latency time.Duration, err error) {
+						delivered = err
+					},
+				},
+				logger: logger,
+			}
+
+			err := b.Produce([]byte("hello world"), nil)
+
+			assert.Equal(t, tt.wantErr, err != nil, "error does not match")
+			assert.Equal(t, tt.wantErr, delivered != nil, "delivery report does not match")
+			assert.Equal(t, "shortn", added.Stream)
+			assert.Equal(t, int64(1000), added.MaxLen)
+			assert.True(t, added.Approx, "trimming should be approximate")
+			assert.Equal(t, map[string]interface{}{streamFieldEvent: "hello world"}, added.Values)
+		})
+	}
+}
+
+func TestRedisStreamBus_ProduceBatch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	delivered := 0
+	b := &RedisStreamBus{
+		client:  client,
+		configs: testStreamConfigs,
+		metricsHooks: &metrics.MetricsHooks{
+			OnEventDeliveredFn: func(topic string, latency time.Duration, err error) {
+				delivered++
+			},
+		},
+		logger: logger,
+	}
+
+	errs := b.ProduceBatch([]OutgoingEvent{
+		{Value: []byte("first"), Headers: map[string]string{HeaderContentType: ContentTypeJSON}},
+		{Value: []byte("second")},
+	})
+
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, 2, delivered, "every event should be reported")
+	entries, err := client.XRange(context.Background(), "shortn", "-", "+").Result()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, map[string]interface{}{streamFieldEvent: "first", HeaderContentType: ContentTypeJSON}, entries[0].Values)
+	assert.Equal(t, map[string]interface{}{streamFieldEvent: "second"}, entries[1].Values)
+
+	server.Close()
+	errs = b.ProduceBatch([]OutgoingEvent{{Value: []byte("third")}})
+	assert.Len(t, errs, 1)
+	assert.NotNil(t, errs[0], "when redis is down, every event should fail")
+}
+
+func TestRedisStreamBus_Subscribe(t *testing.T) {
+	tests := []struct {
+		name      string
+		createErr error
+		wantErr   bool
+	}{
+		{
+			name:    "when the group is created, subscribe",
+			wantErr: false,
+		},
+		{
+			name:      "when the group already exists, subscribe",
+			createErr: errors.New("BUSYGROUP Consumer Group name already exists"),
+			wantErr:   false,
+		},
+		{
+			name:      "when the group cannot be created, return the error",
+			createErr: errors.New("expected error"),
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			b := &RedisStreamBus{
+				client: &FakeRedisStreamClient{
+					XGroupCreateMkStreamFn: func(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+						return redis.NewStatusResult("OK", tt.createErr)
+					},
+				},
+				configs: testStreamConfigs,
+				logger:  logger,
+			}
+			_, err := b.Subscribe()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Subscribe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedisStreamSubscription_Fetch(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastReclaim time.Time
+		claimed     []redis.XMessage
+		read        []redis.XMessage
+		readErr     error
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name:    "when there are idle pending entries, they are reclaimed first",
+			claimed: []redis.XMessage{{ID: "1-0", Values: map[string]interface{}{streamFieldEvent: "a"}}},
+			read:    []redis.XMessage{{ID: "2-0", Values: map[string]interface{}{streamFieldEvent: "b"}}},
+			want:    []string{"1-0"},
+		},
+		{
+			name:        "when it is not time to reclaim yet, new entries are read",
+			lastReclaim: time.Now(),
+			claimed:     []redis.XMessage{{ID: "1-0", Values: map[string]interface{}{streamFieldEvent: "a"}}},
+			read:        []redis.XMessage{{ID: "2-0", Values: map[string]interface{}{streamFieldEvent: "b"}}},
+			want:        []string{"2-0"},
+		},
+		{
+			name:    "when there are no entries, return an empty batch",
+			readErr: redis.Nil,
+			want:    nil,
+		},
+		{
+			name:    "when reading fails, return the error",
+			readErr: errors.New("expected error"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			reads := 0
+			s := &RedisStreamSubscription{
+				client: &FakeRedisStreamClient{
+					XAutoClaimFn: func(ctx context.Context, a *redis.XAutoClaimArgs) *redis.XAutoClaimCmd {
+						cmd := redis.NewXAutoClaimCmd(ctx)
+						cmd.SetVal(tt.claimed, "0-0")
+						return cmd
+					},
+					XReadGroupFn: func(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+						reads++
+						if reads > 1 || tt.readErr != nil {
+							err := tt.readErr
+							if err == nil {
+								err = redis.Nil
+							}
+							return redis.NewXStreamSliceCmdResult(nil, err)
+						}
+						return redis.NewXStreamSliceCmdResult([]redis.XStream{{Stream: "shortn", Messages: tt.read}}, nil)
+					},
+				},
+				configs:     testStreamConfigs,
+				lastReclaim: tt.lastReclaim,
+				logger:      logger,
+			}
+			got, err := s.Fetch(context.Background(), 10, 10*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var ids []string
+			if len(got) > 0 {
+				ids = idsOf(got)
+			}
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+}
+
+func TestRedisStreamSubscription_Ack(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	var acked []string
+	var lag int64
+	s := &RedisStreamSubscription{
+		client: &FakeRedisStreamClient{
+			XAckFn: func(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+				acked = append(acked, ids...)
+				return redis.NewIntResult(int64(len(ids)), nil)
+			},
+			XInfoGroupsFn: func(ctx context.Context, key string) *redis.XInfoGroupsCmd {
+				cmd := redis.NewXInfoGroupsCmd(ctx, key)
+				cmd.SetVal([]redis.XInfoGroup{{Name: "other", Lag: 100}, {Name: "shortn", Lag: 7}})
+				return cmd
+			},
+		},
+		configs: testStreamConfigs,
+		metricsHooks: &metrics.MetricsHooks{
+			OnConsumerLagFn: func(topic string, partition int32, l int64) {
+				lag = l
+			},
+		},
+		logger: logger,
+	}
+
+	err := s.Ack([]*Message{{raw: "1-0"}, {raw: "2-0"}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1-0", "2-0"}, acked)
+	assert.Equal(t, int64(7), lag, "lag should be the one of the consumer group")
+}
+
+func TestRedisStreamSubscription_DeadLetter(t *testing.T) {
+	tests := []struct {
+		name      string
+		xAddErr   error
+		wantErr   bool
+		wantAcked []string
+	}{
+		{
+			name:      "when the entry is copied to the dead letter stream, it is acknowledged",
+			wantAcked: []string{"1-0"},
+		},
+		{
+			name:    "when the entry cannot be copied to the dead letter stream, it stays pending",
+			xAddErr: errors.New("expected error"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var added *redis.XAddArgs
+			var acked []string
+			s := &RedisStreamSubscription{
+				client: &FakeRedisStreamClient{
+					XAddFn: func(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+						added = a
+						return redis.NewStringResult("9-0", tt.xAddErr)
+					},
+					XAckFn: func(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+						acked = append(acked, ids...)
+						return redis.NewIntResult(int64(len(ids)), nil)
+					},
+				},
+				configs: testStreamConfigs,
+				logger:  logger,
+			}
+
+			err := s.DeadLetter(&Message{Value: []byte("not json"), raw: "1-0"}, errors.New("cause"), 3)
+
+			assert.Equal(t, tt.wantErr, err != nil, "error does not match")
+			assert.Equal(t, tt.wantAcked, acked)
+			assert.Equal(t, "shortn-dlq", added.Stream)
+			assert.Equal(t, map[string]interface{}{
+				streamFieldEvent:          "not json",
+				streamFieldError:          "cause",
+				streamFieldOriginalStream: "shortn",
+				streamFieldOriginalId:     "1-0",
+				streamFieldAttempts:       "3",
+			}, added.Values)
+		})
+	}
+}
+
+type FakeRedisStreamClient struct {
+	XAddFn                 func(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XGroupCreateMkStreamFn func(ctx context.Context, stream, group, start string) *redis.StatusCmd
+	XReadGroupFn           func(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
+	XAckFn                 func(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd
+	XAutoClaimFn           func(ctx context.Context, a *redis.XAutoClaimArgs) *redis.XAutoClaimCmd
+	XInfoGroupsFn          func(ctx context.Context, key string) *redis.XInfoGroupsCmd
+	PipelinedFn            func(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+}
+
+func (f *FakeRedisStreamClient) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	return f.XAddFn(ctx, a)
+}
+func (f *FakeRedisStreamClient) Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	return f.PipelinedFn(ctx, fn)
+}
+func (f *FakeRedisStreamClient) XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	return f.XGroupCreateMkStreamFn(ctx, stream, group, start)
+}
+func (f *FakeRedisStreamClient) XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	return f.XReadGroupFn(ctx, a)
+}
+func (f *FakeRedisStreamClient) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	return f.XAckFn(ctx, stream, group, ids...)
+}
+func (f *FakeRedisStreamClient) XAutoClaim(ctx context.Context, a *redis.XAutoClaimArgs) *redis.XAutoClaimCmd {
+	return f.XAutoClaimFn(ctx, a)
+}
+func (f *FakeRedisStreamClient) XInfoGroups(ctx context.Context, key string) *redis.XInfoGroupsCmd {
+	if f.XInfoGroupsFn == nil {
+		return redis.NewXInfoGroupsCmd(ctx, key)
+	}
+	return f.XInfoGroupsFn(ctx, key)
+}
+func (f *FakeRedisStreamClient) Close() error {
+	return nil
+}
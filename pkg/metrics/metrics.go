@@ -1,8 +1,8 @@
 package metrics
 
 import (
-	"context"
 	"github.com/prometheus/client_golang/prometheus"
+	"time"
 )
 
 type Metrics struct {
@@ -11,50 +11,108 @@ type Metrics struct {
 	requestsDuration prometheus.HistogramVec
 }
 
+const (
+	FailureUnmarshal = "unmarshal"
+	FailureStore     = "store"
+	FailureOutbox    = "outbox"
+
+	ClickBufferPublisher = "publisher"
+	ClickBufferCounter   = "counter"
+
+	// error kinds passed to OnRequestFailed, a fixed set so they can be used as metric labels
+	ErrorKindInvalidRequest = "invalid_request"
+	ErrorKindNotFound       = "not_found"
+	ErrorKindToken          = "token"
+	ErrorKindEncode         = "encode"
+	ErrorKindStore          = "store"
+	ErrorKindExpired        = "expired"
+	ErrorKindConflict       = "conflict"
+	ErrorKindUnavailable    = "unavailable"
+	ErrorKindTimeout        = "timeout"
+	ErrorKindCanceled       = "canceled"
+	ErrorKindUnknownHost    = "unknown_host"
+	ErrorKindTooLarge       = "too_large"
+	ErrorKindNotEnabled     = "not_enabled"
+)
+
 type MetricsHooks struct {
-	OnShortenUrlCalledFn         func(ctx context.Context, longUrl string) context.Context
-	OnShortenUrlFinishedFn       func(ctx context.Context, longUrl string, err error)
-	OnGetLongUrlCalledFn         func(ctx context.Context, shortenUrl string) context.Context
-	OnGetLongUrlFinishedFn       func(ctx context.Context, shortenUrl string, err error)
-	OnDeleteShortenUrlCalledFn   func(ctx context.Context, shortenUrl string) context.Context
-	OnDeleteShortenUrlFinishedFn func(ctx context.Context, shortenUrl string, err error)
+	OnRequestFailedFn   func(errorKind string)
+	OnBatchFlushedFn    func(size int, duration time.Duration, err error)
+	OnEventDeliveredFn  func(topic string, latency time.Duration, err error)
+	OnEventConsumedFn   func(topic string)
+	OnEventFailedFn     func(reason string, err error)
+	OnEventStoredFn     func(createdAt time.Time)
+	OnConsumerLagFn     func(topic string, partition int32, lag int64)
+	OnOutboxDepthFn     func(depth int64)
+	OnClickRecordedFn   func(shortUrl string, isBot bool)
+	OnClickDroppedFn    func(buffer string)
+	OnTopLinkVisitorsFn func(visitors map[string]int64)
+}
+
+// OnRequestFailed is called with the reason an http request failed. The status, latency and size of
+// every response are recorded by the http middleware instead.
+func (m *MetricsHooks) OnRequestFailed(errorKind string) {
+	if m != nil && m.OnRequestFailedFn != nil {
+		m.OnRequestFailedFn(errorKind)
+	}
+}
+
+func (m *MetricsHooks) OnBatchFlushed(size int, duration time.Duration, err error) {
+	if m != nil && m.OnBatchFlushedFn != nil {
+		m.OnBatchFlushedFn(size, duration, err)
+	}
+}
+
+func (m *MetricsHooks) OnEventDelivered(topic string, latency time.Duration, err error) {
+	if m != nil && m.OnEventDeliveredFn != nil {
+		m.OnEventDeliveredFn(topic, latency, err)
+	}
+}
+
+func (m *MetricsHooks) OnEventConsumed(topic string) {
+	if m != nil && m.OnEventConsumedFn != nil {
+		m.OnEventConsumedFn(topic)
+	}
+}
+
+func (m *MetricsHooks) OnEventFailed(reason string, err error) {
+	if m != nil && m.OnEventFailedFn != nil {
+		m.OnEventFailedFn(reason, err)
+	}
 }
 
-func (m *MetricsHooks) OnShortenUrlCalled(ctx context.Context, longUrl string) context.Context {
-	if m != nil && m.OnShortenUrlCalledFn != nil {
-		return m.OnShortenUrlCalledFn(ctx, longUrl)
+func (m *MetricsHooks) OnEventStored(createdAt time.Time) {
+	if m != nil && m.OnEventStoredFn != nil {
+		m.OnEventStoredFn(createdAt)
 	}
-	return ctx
 }
 
-func (m *MetricsHooks) OnShortenUrlFinished(ctx context.Context, longUrl string, err error) {
-	if m != nil && m.OnShortenUrlFinishedFn != nil {
-		m.OnShortenUrlFinishedFn(ctx, longUrl, err)
+func (m *MetricsHooks) OnConsumerLag(topic string, partition int32, lag int64) {
+	if m != nil && m.OnConsumerLagFn != nil {
+		m.OnConsumerLagFn(topic, partition, lag)
 	}
 }
 
-func (m *MetricsHooks) OnGetLongUrlCalled(ctx context.Context, shortenUrl string) context.Context {
-	if m != nil && m.OnGetLongUrlCalledFn != nil {
-		return m.OnGetLongUrlCalledFn(ctx, shortenUrl)
+func (m *MetricsHooks) OnOutboxDepth(depth int64) {
+	if m != nil && m.OnOutboxDepthFn != nil {
+		m.OnOutboxDepthFn(depth)
 	}
-	return ctx
 }
 
-func (m *MetricsHooks) OnGetLongUrlFinished(ctx context.Context, shortenUrl string, err error) {
-	if m != nil && m.OnGetLongUrlFinishedFn != nil {
-		m.OnGetLongUrlFinishedFn(ctx, shortenUrl, err)
+func (m *MetricsHooks) OnClickRecorded(shortUrl string, isBot bool) {
+	if m != nil && m.OnClickRecordedFn != nil {
+		m.OnClickRecordedFn(shortUrl, isBot)
 	}
 }
 
-func (m *MetricsHooks) OnDeleteShortenUrlCalled(ctx context.Context, shortenUrl string) context.Context {
-	if m != nil && m.OnDeleteShortenUrlCalledFn != nil {
-		return m.OnDeleteShortenUrlCalledFn(ctx, shortenUrl)
+func (m *MetricsHooks) OnClickDropped(buffer string) {
+	if m != nil && m.OnClickDroppedFn != nil {
+		m.OnClickDroppedFn(buffer)
 	}
-	return ctx
 }
 
-func (m *MetricsHooks) OnDeleteShortenUrlFinished(ctx context.Context, shortenUrl string, err error) {
-	if m != nil && m.OnDeleteShortenUrlFinishedFn != nil {
-		m.OnDeleteShortenUrlFinishedFn(ctx, shortenUrl, err)
+func (m *MetricsHooks) OnTopLinkVisitors(visitors map[string]int64) {
+	if m != nil && m.OnTopLinkVisitorsFn != nil {
+		m.OnTopLinkVisitorsFn(visitors)
 	}
 }
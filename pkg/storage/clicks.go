@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+const (
+	GranularityHour = "hour"
+	GranularityDay  = "day"
+
+	hourBucketLayout = "2006010215"
+	dayBucketLayout  = "20060102"
+
+	// hourRetention is how long the hourly buckets of a day are kept, after which only its daily
+	// bucket is left
+	hourRetention = defaultTTL
+	// visitorSaltTTL is how long the visitor salt of a day is kept from when it is created, long
+	// enough to outlast the day
+	visitorSaltTTL = 48 * time.Hour
+)
+
+// Click is a redirect to be counted.
+type Click struct {
+	ShortUrl string
+	At       time.Time
+	// Referrer, Browser and Country are counted in the top lists when not empty
+	Referrer string
+	Browser  string
+	Country  string
+	// Visitor is a fingerprint of the client counted in the daily unique visitors, when not empty
+	Visitor string
+	// IsBot clicks are also counted in the bot total
+	IsBot bool
+}
+
+type ClickBucket struct {
+	Time   time.Time `json:"time"`
+	Clicks int64     `json:"clicks"`
+}
+
+type ClickCount struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+// ClickStats are the clicks on a short url. Bots is how many of the Total clicks were made by bots.
+// UniqueVisitors is estimated over the days of the range, and DailyVisitors has the estimate for
+// each of those days.
+type ClickStats struct {
+	Total          int64
+	Bots           int64
+	Series         []ClickBucket
+	UniqueVisitors int64
+	DailyVisitors  []ClickBucket
+	TopReferrers   []ClickCount
+	TopBrowsers    []ClickCount
+	TopCountries   []ClickCount
+}
+
+type ClickStore interface {
+	IncrementClicks(ctx context.Context, clicks []Click) error
+	ClickStats(ctx context.Context, shortUrl string, from time.Time, to time.Time, granularity string, top int) (ClickStats, error)
+	TopLinkVisitors(ctx context.Context, day time.Time, top int) (map[string]int64, error)
+}
+
+// RedisClickStore counts clicks per short url in a total counter, hourly and daily buckets (hashes
+// keyed by the UTC hour or day, with a hash of hours per day) and sorted sets for the top lists.
+// Unique visitors are estimated with a HyperLogLog per short url and day, and the most clicked links
+// of each day are kept in a sorted set. The keys of a short url expire with its tombstone, so its
+// stats are kept for as long as it is told apart from one that never existed, except the hourly
+// buckets, which expire hourRetention after their day.
+type RedisClickStore struct {
+	client interface {
+		Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+		Close() error
+	}
+	logger *slog.Logger
+}
+
+func NewRedisClickStore(redisClientAddr string, redisClientPassword string, logger *slog.Logger) *RedisClickStore {
+	client := newRedisClient(redisClientAddr, redisClientPassword, logger)
+	return &RedisClickStore{client: client, logger: logger}
+}
+
+// IncrementClicks counts clicks in two pipelined round trips, one reading how long their short urls
+// are kept and one counting them. Expiries are only set on keys that don't have one yet, so clicks
+// don't keep pushing them back.
+func (store *RedisClickStore) IncrementClicks(ctx context.Context, clicks []Click) error {
+	linkTTLs := map[string]*redis.DurationCmd{}
+	if _, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, click := range clicks {
+			if _, ok := linkTTLs[click.ShortUrl]; !ok {
+				linkTTLs[click.ShortUrl] = pipe.PTTL(ctx, tombstoneKey(click.ShortUrl))
+			}
+		}
+		return nil
+	}); err != nil {
+		return redisError(err)
+	}
+
+	_, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		expiries := map[string]time.Duration{}
+		for _, click := range clicks {
+			at := click.At.UTC()
+			day := at.Format(dayBucketLayout)
+			// short urls stored without a tombstone, or whose tombstone is gone, get the default TTL
+			ttl := linkTTLs[click.ShortUrl].Val()
+			if ttl <= 0 {
+				ttl = defaultTTL
+			}
+			pipe.Incr(ctx, clickKey(click.ShortUrl, "total"))
+			if click.IsBot {
+				pipe.Incr(ctx, clickKey(click.ShortUrl, "bots"))
+			}
+			pipe.HIncrBy(ctx, bucketsKey(click.ShortUrl, GranularityHour, at), at.Format(hourBucketLayout), 1)
+			pipe.HIncrBy(ctx, clickKey(click.ShortUrl, GranularityDay), at.Format(dayBucketLayout), 1)
+			if click.Referrer != "" {
+				pipe.ZIncrBy(ctx, clickKey(click.ShortUrl, "referrers"), 1, click.Referrer)
+			}
+			if click.Browser != "" {
+				pipe.ZIncrBy(ctx, clickKey(click.ShortUrl, "browsers"), 1, click.Browser)
+			}
+			if click.Country != "" {
+				pipe.ZIncrBy(ctx, clickKey(click.ShortUrl, "countries"), 1, click.Country)
+			}
+			if click.Visitor != "" {
+				pipe.PFAdd(ctx, clickKey(click.ShortUrl, "visitors:"+day), click.Visitor)
+				expiries[clickKey(click.ShortUrl, "visitors:"+day)] = ttl
+			}
+			pipe.ZIncrBy(ctx, topLinksKey(day), 1, click.ShortUrl)
+			expiries[topLinksKey(day)] = defaultTTL
+			expiries[bucketsKey(click.ShortUrl, GranularityHour, at)] = hourRetention
+			for _, suffix := range []string{"total", "bots", GranularityDay, "referrers", "browsers", "countries"} {
+				expiries[clickKey(click.ShortUrl, suffix)] = ttl
+			}
+		}
+		for key, ttl := range expiries {
+			pipe.ExpireNX(ctx, key, ttl)
+		}
+		return nil
+	})
+	return redisError(err)
+}
+
+// ClickStats returns the clicks on shortUrl between from and to, bucketed by granularity, along
+// with the all-time top values. Buckets without clicks are included with a count of zero.
+func (store *RedisClickStore) ClickStats(ctx context.Context, shortUrl string, from time.Time, to time.Time, granularity string, top int) (ClickStats, error) {
+	var step time.Duration
+	var layout string
+	switch granularity {
+	case GranularityHour:
+		step, layout = time.Hour, hourBucketLayout
+		from = from.UTC().Truncate(time.Hour)
+	case GranularityDay:
+		step, layout = 24*time.Hour, dayBucketLayout
+		from = from.UTC().Truncate(24 * time.Hour)
+	default:
+		return ClickStats{}, fmt.Errorf("unknown granularity %q", granularity)
+	}
+	var buckets []time.Time
+	var keys, fields []string
+	for t := from; !t.After(to); t = t.Add(step) {
+		buckets = append(buckets, t)
+		keys = append(keys, bucketsKey(shortUrl, granularity, t))
+		fields = append(fields, t.Format(layout))
+	}
+	var days []time.Time
+	var visitorKeys []string
+	for t := from.Truncate(24 * time.Hour); !t.After(to); t = t.Add(24 * time.Hour) {
+		days = append(days, t)
+		visitorKeys = append(visitorKeys, clickKey(shortUrl, "visitors:"+t.Format(dayBucketLayout)))
+	}
+
+	var total, bots *redis.StringCmd
+	var series []*redis.SliceCmd
+	var referrers, browsers, countries *redis.ZSliceCmd
+	var uniqueVisitors *redis.IntCmd
+	dailyVisitors := make([]*redis.IntCmd, len(visitorKeys))
+	cmds, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		total = pipe.Get(ctx, clickKey(shortUrl, "total"))
+		bots = pipe.Get(ctx, clickKey(shortUrl, "bots"))
+		// consecutive buckets in the same hash are read at once
+		for start := 0; start < len(fields); {
+			end := start + 1
+			for end < len(fields) && keys[end] == keys[start] {
+				end++
+			}
+			series = append(series, pipe.HMGet(ctx, keys[start], fields[start:end]...))
+			start = end
+		}
+		if len(visitorKeys) > 0 {
+			// counting several HyperLogLogs at once estimates the size of their union
+			uniqueVisitors = pipe.PFCount(ctx, visitorKeys...)
+		}
+		for i, key := range visitorKeys {
+			dailyVisitors[i] = pipe.PFCount(ctx, key)
+		}
+		referrers = pipe.ZRevRangeWithScores(ctx, clickKey(shortUrl, "referrers"), 0, int64(top-1))
+		browsers = pipe.ZRevRangeWithScores(ctx, clickKey(shortUrl, "browsers"), 0, int64(top-1))
+		countries = pipe.ZRevRangeWithScores(ctx, clickKey(shortUrl, "countries"), 0, int64(top-1))
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return ClickStats{}, redisError(err)
+	}
+	// the pipeline only returns the first error, and a redis.Nil there, a count that is missing
+	// because nothing was clicked, would hide the errors of the other commands
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
+			return ClickStats{}, redisError(err)
+		}
+	}
+
+	stats := ClickStats{
+		TopReferrers: toClickCounts(referrers.Val()),
+		TopBrowsers:  toClickCounts(browsers.Val()),
+		TopCountries: toClickCounts(countries.Val()),
+	}
+	stats.Total, _ = total.Int64()
+	stats.Bots, _ = bots.Int64()
+	var values []interface{}
+	for _, cmd := range series {
+		values = append(values, cmd.Val()...)
+	}
+	for i, t := range buckets {
+		bucket := ClickBucket{Time: t}
+		if value, ok := values[i].(string); ok {
+			bucket.Clicks, _ = strconv.ParseInt(value, 10, 64)
+		}
+		stats.Series = append(stats.Series, bucket)
+	}
+	if uniqueVisitors != nil {
+		stats.UniqueVisitors = uniqueVisitors.Val()
+	}
+	for i, t := range days {
+		stats.DailyVisitors = append(stats.DailyVisitors, ClickBucket{Time: t, Clicks: dailyVisitors[i].Val()})
+	}
+	return stats, nil
+}
+
+// TopLinkVisitors returns the estimated unique visitors on day of the top most clicked links that day.
+func (store *RedisClickStore) TopLinkVisitors(ctx context.Context, day time.Time, top int) (map[string]int64, error) {
+	dayBucket := day.UTC().Format(dayBucketLayout)
+	var links *redis.StringSliceCmd
+	if _, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		links = pipe.ZRevRange(ctx, topLinksKey(dayBucket), 0, int64(top-1))
+		return nil
+	}); err != nil {
+		return nil, redisError(err)
+	}
+
+	visitors := make(map[string]*redis.IntCmd, len(links.Val()))
+	if _, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, shortUrl := range links.Val() {
+			visitors[shortUrl] = pipe.PFCount(ctx, clickKey(shortUrl, "visitors:"+dayBucket))
+		}
+		return nil
+	}); err != nil {
+		return nil, redisError(err)
+	}
+	counts := make(map[string]int64, len(visitors))
+	for shortUrl, cmd := range visitors {
+		counts[shortUrl] = cmd.Val()
+	}
+	return counts, nil
+}
+
+// VisitorSalt returns the salt of the visitor ids of the UTC day of day. It is a random one, created
+// by whichever replica asks for it first, and it is gone visitorSaltTTL later, so once the day is
+// over its ids can't be computed again from anything left.
+func (store *RedisClickStore) VisitorSalt(ctx context.Context, day time.Time) (string, error) {
+	key := visitorSaltKey(day.UTC().Format(dayBucketLayout))
+	var salt *redis.StringCmd
+	_, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, rand.Text(), visitorSaltTTL)
+		salt = pipe.Get(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return "", redisError(err)
+	}
+	return salt.Val(), nil
+}
+
+func (store *RedisClickStore) Close() error {
+	return store.client.Close()
+}
+
+func clickKey(shortUrl string, suffix string) string {
+	return "shortn:clicks:" + shortUrl + ":" + suffix
+}
+
+// bucketsKey is the hash with the bucket of shortUrl at t, one per day for hours.
+func bucketsKey(shortUrl string, granularity string, t time.Time) string {
+	if granularity == GranularityHour {
+		return clickKey(shortUrl, GranularityHour+":"+t.UTC().Format(dayBucketLayout))
+	}
+	return clickKey(shortUrl, granularity)
+}
+
+func visitorSaltKey(day string) string {
+	return "shortn:clicks:salt:" + day
+}
+
+func topLinksKey(day string) string {
+	return "shortn:clicks:top:" + day
+}
+
+func toClickCounts(members []redis.Z) []ClickCount {
+	counts := make([]ClickCount, 0, len(members))
+	for _, member := range members {
+		value, _ := member.Member.(string)
+		counts = append(counts, ClickCount{Value: value, Clicks: int64(member.Score)})
+	}
+	return counts
+}
+
+type FakeClickStore struct {
+	IncrementClicksFn func(context.Context, []Click) error
+	ClickStatsFn      func(context.Context, string, time.Time, time.Time, string, int) (ClickStats, error)
+	TopLinkVisitorsFn func(context.Context, time.Time, int) (map[string]int64, error)
+}
+
+func (store *FakeClickStore) IncrementClicks(ctx context.Context, clicks []Click) error {
+	return store.IncrementClicksFn(ctx, clicks)
+}
+func (store *FakeClickStore) ClickStats(ctx context.Context, shortUrl string, from time.Time, to time.Time, granularity string, top int) (ClickStats, error) {
+	return store.ClickStatsFn(ctx, shortUrl, from, to, granularity, top)
+}
+func (store *FakeClickStore) TopLinkVisitors(ctx context.Context, day time.Time, top int) (map[string]int64, error) {
+	return store.TopLinkVisitorsFn(ctx, day, top)
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRedisClickStore_ClickStats(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	server := miniredis.RunT(t)
+	store := &RedisClickStore{
+		client: redis.NewClient(&redis.Options{Addr: server.Addr()}),
+		logger: logger,
+	}
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	err := store.IncrementClicks(context.Background(), []Click{
+		{ShortUrl: "abc", At: day.Add(time.Hour + time.Minute), Referrer: "google.com", Browser: "Chrome", Country: "AR", Visitor: "v1"},
+		{ShortUrl: "abc", At: day.Add(time.Hour + 2*time.Minute), Referrer: "google.com", Browser: "Firefox", Visitor: "v1"},
+		{ShortUrl: "abc", At: day.Add(3 * time.Hour), Referrer: "t.co", Browser: "Chrome", Country: "AR", Visitor: "v2"},
+		{ShortUrl: "abc", At: day.Add(26 * time.Hour), Browser: "Chrome", Visitor: "v3", IsBot: true},
+		{ShortUrl: "other", At: day.Add(time.Hour)},
+	})
+	assert.Nil(t, err)
+	assert.True(t, server.TTL(clickKey("abc", "total")) > 0, "click keys should expire")
+	// its total is missing, so the error of its referrers comes after a redis.Nil in the pipeline
+	assert.Nil(t, server.Set(clickKey("broken", "referrers"), "not a sorted set"))
+
+	tests := []struct {
+		name        string
+		shortUrl    string
+		from        time.Time
+		to          time.Time
+		granularity string
+		want        ClickStats
+		wantErr     bool
+	}{
+		{
+			name:        "when asking for hours, every hour in the range is returned",
+			shortUrl:    "abc",
+			from:        day.Add(time.Hour + 30*time.Minute),
+			to:          day.Add(4 * time.Hour),
+			granularity: GranularityHour,
+			want: ClickStats{
+				Total: 4,
+				Bots:  1,
+				Series: []ClickBucket{
+					{Time: day.Add(time.Hour), Clicks: 2},
+					{Time: day.Add(2 * time.Hour), Clicks: 0},
+					{Time: day.Add(3 * time.Hour), Clicks: 1},
+					{Time: day.Add(4 * time.Hour), Clicks: 0},
+				},
+				UniqueVisitors: 2,
+				DailyVisitors:  []ClickBucket{{Time: day, Clicks: 2}},
+				TopReferrers:   []ClickCount{{Value: "google.com", Clicks: 2}, {Value: "t.co", Clicks: 1}},
+				TopBrowsers:    []ClickCount{{Value: "Chrome", Clicks: 3}, {Value: "Firefox", Clicks: 1}},
+				TopCountries:   []ClickCount{{Value: "AR", Clicks: 2}},
+			},
+		},
+		{
+			name:        "when asking for days, clicks are grouped by day",
+			shortUrl:    "abc",
+			from:        day,
+			to:          day.Add(24 * time.Hour),
+			granularity: GranularityDay,
+			want: ClickStats{
+				Total: 4,
+				Bots:  1,
+				Series: []ClickBucket{
+					{Time: day, Clicks: 3},
+					{Time: day.Add(24 * time.Hour), Clicks: 1},
+				},
+				UniqueVisitors: 3,
+				DailyVisitors:  []ClickBucket{{Time: day, Clicks: 2}, {Time: day.Add(24 * time.Hour), Clicks: 1}},
+				TopReferrers:   []ClickCount{{Value: "google.com", Clicks: 2}, {Value: "t.co", Clicks: 1}},
+				TopBrowsers:    []ClickCount{{Value: "Chrome", Clicks: 3}, {Value: "Firefox", Clicks: 1}},
+				TopCountries:   []ClickCount{{Value: "AR", Clicks: 2}},
+			},
+		},
+		{
+			name:        "when the link was never clicked, counts are zero",
+			shortUrl:    "unknown",
+			from:        day,
+			to:          day,
+			granularity: GranularityDay,
+			want: ClickStats{
+				Series:        []ClickBucket{{Time: day}},
+				DailyVisitors: []ClickBucket{{Time: day}},
+				TopReferrers:  []ClickCount{},
+				TopBrowsers:   []ClickCount{},
+				TopCountries:  []ClickCount{},
+			},
+		},
+		{
+			name:        "when a command fails after a missing count, return error",
+			shortUrl:    "broken",
+			from:        day,
+			to:          day,
+			granularity: GranularityDay,
+			wantErr:     true,
+		},
+		{
+			name:        "when the granularity is unknown, return error",
+			shortUrl:    "abc",
+			from:        day,
+			to:          day,
+			granularity: "minute",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.ClickStats(context.Background(), tt.shortUrl, tt.from, tt.to, tt.granularity, 2)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ClickStats() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	visitors, err := store.TopLinkVisitors(context.Background(), day, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"abc": 2}, visitors, "only the most clicked links of the day should be returned")
+	visitors, err = store.TopLinkVisitors(context.Background(), day.Add(24*time.Hour), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"abc": 1}, visitors)
+}
+
+func TestRedisClickStore_expiry(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	server := miniredis.RunT(t)
+	store := &RedisClickStore{
+		client: redis.NewClient(&redis.Options{Addr: server.Addr()}),
+		logger: logger,
+	}
+	tombstoneTTL := 48 * time.Hour
+	assert.Nil(t, server.Set(tombstoneKey("abc"), "1"))
+	server.SetTTL(tombstoneKey("abc"), tombstoneTTL)
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, store.IncrementClicks(context.Background(), []Click{
+		{ShortUrl: "abc", At: day, Visitor: "v1"},
+		{ShortUrl: "untracked", At: day},
+	}))
+	assert.Equal(t, tombstoneTTL, server.TTL(clickKey("abc", "total")), "click keys should expire with the tombstone of the url")
+	assert.Equal(t, tombstoneTTL, server.TTL(clickKey("abc", "visitors:20240102")))
+	assert.Equal(t, hourRetention, server.TTL(bucketsKey("abc", GranularityHour, day)), "hourly buckets should expire on their own")
+	assert.Equal(t, defaultTTL, server.TTL(clickKey("untracked", "total")), "urls without a tombstone should get the default TTL")
+
+	server.FastForward(time.Hour)
+	assert.Nil(t, store.IncrementClicks(context.Background(), []Click{{ShortUrl: "abc", At: day.Add(time.Hour)}}))
+	assert.Equal(t, tombstoneTTL-time.Hour, server.TTL(clickKey("abc", "total")), "clicks should not push the expiry back")
+	assert.Equal(t, hourRetention-time.Hour, server.TTL(bucketsKey("abc", GranularityHour, day)))
+
+	assert.Nil(t, store.IncrementClicks(context.Background(), []Click{{ShortUrl: "abc", At: day.Add(24 * time.Hour)}}))
+	assert.Equal(t, hourRetention, server.TTL(bucketsKey("abc", GranularityHour, day.Add(24*time.Hour))), "every day should have its own hourly buckets")
+}
+
+func TestRedisClickStore_VisitorSalt(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	newStore := func(server *miniredis.Miniredis) *RedisClickStore {
+		return &RedisClickStore{
+			client: redis.NewClient(&redis.Options{Addr: server.Addr()}),
+			logger: logger,
+		}
+	}
+	server := miniredis.RunT(t)
+	store, replica := newStore(server), newStore(server)
+	yesterday := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	salt, err := store.VisitorSalt(context.Background(), yesterday)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, salt)
+	again, err := replica.VisitorSalt(context.Background(), yesterday.Add(20*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, salt, again, "every replica should share the salt of the day")
+	today, err := store.VisitorSalt(context.Background(), yesterday.Add(24*time.Hour))
+	assert.Nil(t, err)
+	assert.NotEqual(t, salt, today, "every day should have a salt of its own")
+
+	// another deployment with the same configuration
+	elsewhere, err := newStore(miniredis.RunT(t)).VisitorSalt(context.Background(), yesterday)
+	assert.Nil(t, err)
+	assert.NotEqual(t, salt, elsewhere, "the salt of a day should not be derivable from the configuration")
+
+	server.FastForward(visitorSaltTTL)
+	assert.False(t, server.Exists(visitorSaltKey("20240102")), "the salt of a past day should be destroyed")
+	recreated, err := store.VisitorSalt(context.Background(), yesterday)
+	assert.Nil(t, err)
+	assert.NotEqual(t, salt, recreated, "a destroyed salt should not come back")
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+)
+
+const domainsKey = "shortn:domains"
+
+// DomainKey returns the key the short url code is stored at on domain. The default domain, empty,
+// keeps the bare code so the urls shortened before branded domains existed are still found, while
+// the others are namespaced so the same code can exist on several domains.
+func DomainKey(domain string, code string) string {
+	if domain == "" {
+		return code
+	}
+	return domain + "/" + code
+}
+
+// DomainStore keeps the branded domains short urls can be served at, besides the default one. Its
+// calls give up with an error once ctx is done.
+type DomainStore interface {
+	Register(ctx context.Context, domain string) error
+	IsRegistered(ctx context.Context, domain string) (bool, error)
+	Domains(ctx context.Context) ([]string, error)
+	Remove(ctx context.Context, domain string) error
+}
+
+// RedisDomainStore keeps the domains in a set, which never expires.
+type RedisDomainStore struct {
+	client interface {
+		SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+		SIsMember(ctx context.Context, key string, member interface{}) *redis.BoolCmd
+		SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+		SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+		Close() error
+	}
+	logger *slog.Logger
+}
+
+func NewRedisDomainStore(redisClientAddr string, redisClientPassword string, logger *slog.Logger) *RedisDomainStore {
+	client := newRedisClient(redisClientAddr, redisClientPassword, logger)
+	return &RedisDomainStore{client: client, logger: logger}
+}
+
+// Register adds domain, doing nothing if it was already registered.
+func (store *RedisDomainStore) Register(ctx context.Context, domain string) error {
+	return redisError(store.client.SAdd(ctx, domainsKey, domain).Err())
+}
+
+func (store *RedisDomainStore) IsRegistered(ctx context.Context, domain string) (bool, error) {
+	registered, err := store.client.SIsMember(ctx, domainsKey, domain).Result()
+	return registered, redisError(err)
+}
+
+// Domains returns the registered domains in no particular order.
+func (store *RedisDomainStore) Domains(ctx context.Context) ([]string, error) {
+	domains, err := store.client.SMembers(ctx, domainsKey).Result()
+	return domains, redisError(err)
+}
+
+// Remove unregisters domain, returning ErrNotFound if it wasn't registered. The short urls on it are
+// left in place, so registering it again serves them again.
+func (store *RedisDomainStore) Remove(ctx context.Context, domain string) error {
+	removed, err := store.client.SRem(ctx, domainsKey, domain).Result()
+	if err != nil {
+		return redisError(err)
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (store *RedisDomainStore) Close() error {
+	return store.client.Close()
+}
+
+type FakeDomainStore struct {
+	RegisterFn     func(context.Context, string) error
+	IsRegisteredFn func(context.Context, string) (bool, error)
+	DomainsFn      func(context.Context) ([]string, error)
+	RemoveFn       func(context.Context, string) error
+}
+
+func (store *FakeDomainStore) Register(ctx context.Context, domain string) error {
+	return store.RegisterFn(ctx, domain)
+}
+func (store *FakeDomainStore) IsRegistered(ctx context.Context, domain string) (bool, error) {
+	return store.IsRegisteredFn(ctx, domain)
+}
+func (store *FakeDomainStore) Domains(ctx context.Context) ([]string, error) {
+	return store.DomainsFn(ctx)
+}
+func (store *FakeDomainStore) Remove(ctx context.Context, domain string) error {
+	return store.RemoveFn(ctx, domain)
+}
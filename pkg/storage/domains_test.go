@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestDomainKey(t *testing.T) {
+	assert.Equal(t, "abc", DomainKey("", "abc"))
+	assert.Equal(t, "go.brand-a.com/abc", DomainKey("go.brand-a.com", "abc"))
+}
+
+func TestRedisDomainStore_Remove(t *testing.T) {
+	tests := []struct {
+		name      string
+		removed   int64
+		sremErr   error
+		wantErrIs error
+	}{
+		{
+			name:    "when the domain is registered, it is removed",
+			removed: 1,
+		},
+		{
+			name:      "when the domain is not registered, return not found",
+			removed:   0,
+			wantErrIs: ErrNotFound,
+		},
+		{
+			name:      "when redis can't be reached, return unavailable",
+			sremErr:   redis.ErrClosed,
+			wantErrIs: ErrUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			store := &RedisDomainStore{
+				client: &FakeRedisDomainClient{
+					SRemFn: func(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+						assert.Equal(t, domainsKey, key)
+						assert.Equal(t, []interface{}{"go.brand-a.com"}, members)
+						return redis.NewIntResult(tt.removed, tt.sremErr)
+					},
+				},
+				logger: logger,
+			}
+			err := store.Remove(context.Background(), "go.brand-a.com")
+			if tt.wantErrIs == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestRedisDomainStore_IsRegistered(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	store := &RedisDomainStore{
+		client: &FakeRedisDomainClient{
+			SIsMemberFn: func(ctx context.Context, key string, member interface{}) *redis.BoolCmd {
+				return redis.NewBoolResult(member == "go.brand-a.com", nil)
+			},
+		},
+		logger: logger,
+	}
+
+	registered, err := store.IsRegistered(context.Background(), "go.brand-a.com")
+	assert.Nil(t, err)
+	assert.True(t, registered)
+	registered, err = store.IsRegistered(context.Background(), "lnk.brand-b.io")
+	assert.Nil(t, err)
+	assert.False(t, registered)
+
+	store.client = &FakeRedisDomainClient{
+		SIsMemberFn: func(ctx context.Context, key string, member interface{}) *redis.BoolCmd {
+			return redis.NewBoolResult(false, errors.New("expected error"))
+		},
+	}
+	_, err = store.IsRegistered(context.Background(), "go.brand-a.com")
+	assert.NotNil(t, err)
+}
+
+type FakeRedisDomainClient struct {
+	SAddFn      func(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SIsMemberFn func(ctx context.Context, key string, member interface{}) *redis.BoolCmd
+	SMembersFn  func(ctx context.Context, key string) *redis.StringSliceCmd
+	SRemFn      func(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+}
+
+func (f *FakeRedisDomainClient) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return f.SAddFn(ctx, key, members...)
+}
+func (f *FakeRedisDomainClient) SIsMember(ctx context.Context, key string, member interface{}) *redis.BoolCmd {
+	return f.SIsMemberFn(ctx, key, member)
+}
+func (f *FakeRedisDomainClient) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	return f.SMembersFn(ctx, key)
+}
+func (f *FakeRedisDomainClient) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return f.SRemFn(ctx, key, members...)
+}
+func (f *FakeRedisDomainClient) Close() error {
+	return nil
+}
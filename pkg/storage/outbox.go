@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	outboxKey      = "shortn:outbox"
+	outboxLeaseKey = "shortn:outbox:lease"
+)
+
+// OutboxEntry is an event waiting to be published.
+type OutboxEntry struct {
+	Value   []byte            `json:"value"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// raw is the entry as stored, used to remove it once it was sent
+	raw string
+}
+
+// Outbox stores urls together with the event announcing them, so that neither is written without
+// the other. A relay publishes the pending entries and marks them as sent afterward.
+type Outbox interface {
+	StoreWithOutbox(ctx context.Context, key string, link Link, entry OutboxEntry) error
+	StoreBatchWithOutbox(ctx context.Context, links map[string]Link, entries map[string]OutboxEntry) error
+	Pending(ctx context.Context, max int) ([]OutboxEntry, error)
+	MarkSent(ctx context.Context, entry OutboxEntry) error
+	Depth(ctx context.Context) (int64, error)
+	// Lease makes owner the only relay publishing the entries for ttl, or renews its lease when it
+	// already holds it. It returns false when another relay holds it.
+	Lease(ctx context.Context, owner string, ttl time.Duration) (bool, error)
+	// Release gives up the lease of owner, if it still holds it.
+	Release(ctx context.Context, owner string) error
+}
+
+// ConflictError is returned by the batch writes when some of their keys are already taken by another
+// url. It wraps ErrConflict, and every other key was written.
+type ConflictError struct {
+	Keys []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s already taken", ErrConflict, strings.Join(e.Keys, ", "))
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// storeWithOutboxScript sets every url that doesn't exist yet along with its tombstone and pushes its
+// entry to the outbox, the last key, and returns the keys taken by another url. The keys come in pairs
+// of a url and its tombstone. A key that already has the same url is left as it is without pushing
+// its entry, since its event was already published.
+var storeWithOutboxScript = redis.NewScript(`
+local outbox = KEYS[#KEYS]
+local taken = {}
+for i = 1, (#KEYS - 1) / 2 do
+  local key, tombstone = KEYS[2 * i - 1], KEYS[2 * i]
+  local url, ttl, tombstoneTtl, entry = ARGV[4 * i - 3], ARGV[4 * i - 2], ARGV[4 * i - 1], ARGV[4 * i]
+  if redis.call('SET', key, url, 'NX', 'PX', ttl) then
+    redis.call('SET', tombstone, 1, 'NX', 'PX', tombstoneTtl)
+    redis.call('PEXPIRE', tombstone, tombstoneTtl, 'GT')
+    redis.call('LPUSH', outbox, entry)
+  elseif redis.call('GET', key) ~= url then
+    table.insert(taken, key)
+  end
+end
+return taken
+`)
+
+// leaseOutboxScript makes ARGV[1] the holder of the lease, the key, for ARGV[2] milliseconds unless
+// another relay holds it, and returns whether ARGV[1] holds it.
+var leaseOutboxScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// releaseOutboxScript deletes the lease, the key, if ARGV[1] still holds it.
+var releaseOutboxScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// RedisOutbox keeps pending entries in a list, newest first, next to the urls.
+type RedisOutbox struct {
+	client interface {
+		redis.Scripter
+		LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd
+		LRem(ctx context.Context, key string, count int64, value interface{}) *redis.IntCmd
+		LLen(ctx context.Context, key string) *redis.IntCmd
+		Close() error
+	}
+	logger *slog.Logger
+}
+
+func NewRedisOutbox(redisClientAddr string, redisClientPassword string, logger *slog.Logger) *RedisOutbox {
+	client := newRedisClient(redisClientAddr, redisClientPassword, logger)
+	return &RedisOutbox{client: client, logger: logger}
+}
+
+// StoreWithOutbox writes the url, with the same idempotency as RedisStore.Store, and pushes entry to
+// the outbox only if the url was written, both in a single atomic script.
+func (outbox *RedisOutbox) StoreWithOutbox(ctx context.Context, key string, link Link, entry OutboxEntry) error {
+	err := outbox.StoreBatchWithOutbox(ctx, map[string]Link{key: link}, map[string]OutboxEntry{key: entry})
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return fmt.Errorf("%w: %s is already taken", ErrConflict, key)
+	}
+	return err
+}
+
+// StoreBatchWithOutbox writes the links as StoreWithOutbox does, each one along with its entry in
+// entries, all in a single atomic script. The keys taken by another url are returned in a
+// ConflictError, and the links that expired before they could be stored are skipped with their entry.
+func (outbox *RedisOutbox) StoreBatchWithOutbox(ctx context.Context, links map[string]Link, entries map[string]OutboxEntry) error {
+	now := time.Now()
+	var keys []string
+	var args []interface{}
+	for _, key := range slices.Sorted(maps.Keys(links)) {
+		ttl := links[key].ttl(now)
+		if ttl <= 0 {
+			continue
+		}
+		raw, err := json.Marshal(entries[key])
+		if err != nil {
+			return err
+		}
+		ttl = max(ttl, time.Millisecond)
+		keys = append(keys, key, tombstoneKey(key))
+		args = append(args, links[key].LongUrl, ttl.Milliseconds(), (ttl + expiredRetention).Milliseconds(), raw)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	taken, err := storeWithOutboxScript.Run(ctx, outbox.client, append(keys, outboxKey), args...).StringSlice()
+	if err != nil {
+		return redisError(err)
+	}
+	if len(taken) > 0 {
+		return &ConflictError{Keys: taken}
+	}
+	return nil
+}
+
+// Pending returns up to max of the oldest entries not sent yet, oldest first.
+func (outbox *RedisOutbox) Pending(ctx context.Context, max int) ([]OutboxEntry, error) {
+	raws, err := outbox.client.LRange(ctx, outboxKey, -int64(max), -1).Result()
+	if err != nil {
+		return nil, redisError(err)
+	}
+	entries := make([]OutboxEntry, 0, len(raws))
+	for i := len(raws) - 1; i >= 0; i-- {
+		var entry OutboxEntry
+		if err := json.Unmarshal([]byte(raws[i]), &entry); err != nil {
+			// an entry that can't be read would block the outbox forever, so it is dropped
+			outbox.logger.Error("Dropping malformed outbox entry", "entry", raws[i], "error", err)
+			outbox.client.LRem(ctx, outboxKey, 1, raws[i])
+			continue
+		}
+		entry.raw = raws[i]
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (outbox *RedisOutbox) MarkSent(ctx context.Context, entry OutboxEntry) error {
+	return redisError(outbox.client.LRem(ctx, outboxKey, 1, entry.raw).Err())
+}
+
+func (outbox *RedisOutbox) Depth(ctx context.Context) (int64, error) {
+	depth, err := outbox.client.LLen(ctx, outboxKey).Result()
+	return depth, redisError(err)
+}
+
+func (outbox *RedisOutbox) Lease(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	held, err := leaseOutboxScript.Run(ctx, outbox.client, []string{outboxLeaseKey}, owner, max(ttl, time.Millisecond).Milliseconds()).Bool()
+	return held, redisError(err)
+}
+
+func (outbox *RedisOutbox) Release(ctx context.Context, owner string) error {
+	return redisError(releaseOutboxScript.Run(ctx, outbox.client, []string{outboxLeaseKey}, owner).Err())
+}
+
+func (outbox *RedisOutbox) Close() error {
+	return outbox.client.Close()
+}
+
+type FakeOutbox struct {
+	StoreWithOutboxFn      func(context.Context, string, Link, OutboxEntry) error
+	StoreBatchWithOutboxFn func(context.Context, map[string]Link, map[string]OutboxEntry) error
+	PendingFn              func(context.Context, int) ([]OutboxEntry, error)
+	MarkSentFn             func(context.Context, OutboxEntry) error
+	DepthFn                func(context.Context) (int64, error)
+	LeaseFn                func(context.Context, string, time.Duration) (bool, error)
+	ReleaseFn              func(context.Context, string) error
+}
+
+func (outbox *FakeOutbox) StoreWithOutbox(ctx context.Context, key string, link Link, entry OutboxEntry) error {
+	return outbox.StoreWithOutboxFn(ctx, key, link, entry)
+}
+func (outbox *FakeOutbox) StoreBatchWithOutbox(ctx context.Context, links map[string]Link, entries map[string]OutboxEntry) error {
+	return outbox.StoreBatchWithOutboxFn(ctx, links, entries)
+}
+func (outbox *FakeOutbox) Pending(ctx context.Context, max int) ([]OutboxEntry, error) {
+	return outbox.PendingFn(ctx, max)
+}
+func (outbox *FakeOutbox) MarkSent(ctx context.Context, entry OutboxEntry) error {
+	return outbox.MarkSentFn(ctx, entry)
+}
+func (outbox *FakeOutbox) Depth(ctx context.Context) (int64, error) {
+	return outbox.DepthFn(ctx)
+}
+func (outbox *FakeOutbox) Lease(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	return outbox.LeaseFn(ctx, owner, ttl)
+}
+func (outbox *FakeOutbox) Release(ctx context.Context, owner string) error {
+	return outbox.ReleaseFn(ctx, owner)
+}
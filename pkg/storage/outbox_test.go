@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRedisOutbox_StoreWithOutbox(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    string
+		down        bool
+		wantErr     error
+		wantUrl     string
+		wantPending int
+	}{
+		{
+			name:        "when the url is new, it is stored along with its entry",
+			wantUrl:     "http://google.com",
+			wantPending: 1,
+		},
+		{
+			name:        "when the key already has the same url, it is left as it is without pushing the entry",
+			existing:    "http://google.com",
+			wantUrl:     "http://google.com",
+			wantPending: 0,
+		},
+		{
+			name:        "when the key is taken by another url, return a conflict without pushing the entry",
+			existing:    "http://mercadolibre.com.ar",
+			wantErr:     ErrConflict,
+			wantUrl:     "http://mercadolibre.com.ar",
+			wantPending: 0,
+		},
+		{
+			name:    "when redis can't be reached, return unavailable",
+			down:    true,
+			wantErr: ErrUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			server := miniredis.RunT(t)
+			if tt.existing != "" {
+				assert.Nil(t, server.Set("abc", tt.existing))
+			}
+			outbox := &RedisOutbox{
+				client: redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1}),
+				logger: logger,
+			}
+			if tt.down {
+				server.Close()
+			}
+
+			err := outbox.StoreWithOutbox(context.Background(), "abc", Link{LongUrl: "http://google.com"}, OutboxEntry{Value: []byte("event")})
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			if tt.down {
+				return
+			}
+			got, _ := server.Get("abc")
+			assert.Equal(t, tt.wantUrl, got)
+			pending, _ := server.List(outboxKey)
+			assert.Len(t, pending, tt.wantPending)
+		})
+	}
+}
+
+func TestRedisOutbox_StoreBatchWithOutbox(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	server := miniredis.RunT(t)
+	assert.Nil(t, server.Set("ghi", "http://mercadolibre.com.ar"))
+	outbox := &RedisOutbox{
+		client: redis.NewClient(&redis.Options{Addr: server.Addr()}),
+		logger: logger,
+	}
+	links := map[string]Link{
+		"abc": {LongUrl: "http://google.com", ExpiresAt: time.Now().Add(time.Hour)},
+		"def": {LongUrl: "http://google.com", ExpiresAt: time.Now().Add(-time.Second)},
+		"ghi": {LongUrl: "http://google.com"},
+	}
+	entries := map[string]OutboxEntry{"abc": {Value: []byte("1")}, "def": {Value: []byte("2")}, "ghi": {Value: []byte("3")}}
+
+	err := outbox.StoreBatchWithOutbox(context.Background(), links, entries)
+
+	var conflict *ConflictError
+	assert.ErrorAs(t, err, &conflict)
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Equal(t, []string{"ghi"}, conflict.Keys, "only the key taken by another url should conflict")
+	got, _ := server.Get("abc")
+	assert.Equal(t, "http://google.com", got)
+	assert.InDelta(t, time.Hour, server.TTL("abc"), float64(time.Minute), "the link should expire when requested")
+	assert.False(t, server.Exists("def"), "the expired link should not be stored")
+	got, _ = server.Get("ghi")
+	assert.Equal(t, "http://mercadolibre.com.ar", got, "the taken key should keep its url")
+	pending, err := outbox.Pending(context.Background(), 10)
+	assert.Nil(t, err)
+	assert.Len(t, pending, 1, "only the stored link should have its entry pushed")
+	assert.Equal(t, "1", string(pending[0].Value))
+}
+
+func TestRedisOutbox_Lease(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	server := miniredis.RunT(t)
+	outbox := &RedisOutbox{
+		client: redis.NewClient(&redis.Options{Addr: server.Addr()}),
+		logger: logger,
+	}
+	ctx := context.Background()
+
+	held, err := outbox.Lease(ctx, "a", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, held, "a free lease should be taken")
+	held, err = outbox.Lease(ctx, "b", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, held, "a lease held by another relay should not be taken")
+	server.FastForward(30 * time.Second)
+	held, err = outbox.Lease(ctx, "a", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, held, "the holder should renew its lease")
+	assert.Equal(t, time.Minute, server.TTL(outboxLeaseKey))
+
+	assert.Nil(t, outbox.Release(ctx, "b"))
+	assert.True(t, server.Exists(outboxLeaseKey), "a relay should not release a lease it doesn't hold")
+	assert.Nil(t, outbox.Release(ctx, "a"))
+	held, err = outbox.Lease(ctx, "b", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, held, "a released lease should be taken")
+
+	server.FastForward(time.Minute)
+	held, err = outbox.Lease(ctx, "a", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, held, "a lease that ran out should be taken")
+
+	server.Close()
+	_, err = outbox.Lease(ctx, "a", time.Minute)
+	assert.NotNil(t, err)
+}
+
+func TestRedisOutbox_Pending(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	var removed []interface{}
+	outbox := &RedisOutbox{
+		client: &FakeRedisOutboxClient{
+			LRangeFn: func(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
+				assert.Equal(t, int64(-3), start, "the oldest entries are at the tail of the list")
+				return redis.NewStringSliceResult([]string{
+					`{"value":"Mw=="}`,
+					`not json`,
+					`{"value":"MQ==","headers":{"content-type":"application/json"}}`,
+				}, nil)
+			},
+			LRemFn: func(ctx context.Context, key string, count int64, value interface{}) *redis.IntCmd {
+				removed = append(removed, value)
+				return redis.NewIntResult(1, nil)
+			},
+		},
+		logger: logger,
+	}
+
+	entries, err := outbox.Pending(context.Background(), 3)
+
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "1", string(entries[0].Value), "entries should be returned oldest first")
+	assert.Equal(t, map[string]string{"content-type": "application/json"}, entries[0].Headers)
+	assert.Equal(t, "3", string(entries[1].Value))
+	assert.Equal(t, []interface{}{"not json"}, removed, "malformed entries should be dropped")
+
+	removed = nil
+	assert.Nil(t, outbox.MarkSent(context.Background(), entries[0]))
+	assert.Equal(t, []interface{}{`{"value":"MQ==","headers":{"content-type":"application/json"}}`}, removed)
+}
+
+type FakeRedisOutboxClient struct {
+	// Scripter is left nil, the scripts are tested against miniredis instead
+	redis.Scripter
+	LRangeFn func(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd
+	LRemFn   func(ctx context.Context, key string, count int64, value interface{}) *redis.IntCmd
+	LLenFn   func(ctx context.Context, key string) *redis.IntCmd
+}
+
+func (f *FakeRedisOutboxClient) LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
+	return f.LRangeFn(ctx, key, start, stop)
+}
+func (f *FakeRedisOutboxClient) LRem(ctx context.Context, key string, count int64, value interface{}) *redis.IntCmd {
+	return f.LRemFn(ctx, key, count, value)
+}
+func (f *FakeRedisOutboxClient) LLen(ctx context.Context, key string) *redis.IntCmd {
+	return f.LLenFn(ctx, key)
+}
+func (f *FakeRedisOutboxClient) Close() error {
+	return nil
+}
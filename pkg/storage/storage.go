@@ -2,63 +2,223 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
+	"io"
 	"log/slog"
+	"net"
 	"time"
 )
 
 const (
 	defaultTTL = time.Hour * 24 * 31 //assuming max number of days in a month
+	// expiredRetention is how long an expired short url is told apart from one that never existed
+	expiredRetention = defaultTTL
 )
 
+// The errors every storage backend maps its own errors to, so callers can tell them apart without
+// knowing the backend. Backends wrap them along with their original error.
+var (
+	// ErrNotFound means the key doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrExpired means the key existed but its TTL ran out. Redis drops expired keys, so RedisStore
+	// keeps a tombstone of every key for expiredRetention past its TTL to tell them apart, and keys
+	// that expired longer ago are ErrNotFound
+	ErrExpired = errors.New("expired")
+	// ErrConflict means the key already exists with a different value
+	ErrConflict = errors.New("conflict")
+	// ErrUnavailable means the backend couldn't be reached, so the call may succeed if retried
+	ErrUnavailable = errors.New("storage unavailable")
+)
+
+// Link is the long url a short url redirects to until ExpiresAt, or for the default TTL from when it
+// is stored when ExpiresAt is zero.
+type Link struct {
+	LongUrl   string
+	ExpiresAt time.Time
+}
+
+// ttl returns how long link is kept when stored at now, not positive once it expired.
+func (link Link) ttl(now time.Time) time.Duration {
+	if link.ExpiresAt.IsZero() {
+		return defaultTTL
+	}
+	return link.ExpiresAt.Sub(now)
+}
+
+// Store keeps the long url of every short url. Its calls give up with an error once ctx is done.
 type Store interface {
-	Fetch(string) (string, error)
-	Store(string, string) error
-	Remove(string) error
+	Fetch(context.Context, string) (string, error)
+	Store(context.Context, string, Link) error
+	StoreBatch(context.Context, map[string]Link) error
+	Remove(context.Context, string) error
 }
 
 type RedisStore struct {
 	client interface {
 		Get(ctx context.Context, key string) *redis.StringCmd
-		Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-		Del(ctx context.Context, keys ...string) *redis.IntCmd
+		SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+		Exists(ctx context.Context, keys ...string) *redis.IntCmd
+		Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+		Close() error
 	}
 	logger *slog.Logger
 }
 
+// tombstoneKey is the key that marks key as stored, and outlives it by expiredRetention.
+func tombstoneKey(key string) string {
+	return "shortn:expired:" + key
+}
+
+// setTombstone queues on pipe the writes of the tombstone of a key stored for ttl. Its TTL only ever
+// grows, so writing it again for a key that already existed can't make it go away before the key.
+func setTombstone(ctx context.Context, pipe redis.Pipeliner, key string, ttl time.Duration) {
+	pipe.SetNX(ctx, tombstoneKey(key), 1, ttl+expiredRetention)
+	pipe.ExpireGT(ctx, tombstoneKey(key), ttl+expiredRetention)
+}
+
 func NewRedisStore(redisClientAddr string, redisClientPassword string, logger *slog.Logger) *RedisStore {
+	client := newRedisClient(redisClientAddr, redisClientPassword, logger)
+	return &RedisStore{client: client, logger: logger}
+}
+
+// newRedisClient connects to redis with a client that traces every command.
+func newRedisClient(addr string, password string, logger *slog.Logger) *redis.Client {
 	client := redis.NewClient(&redis.Options{
-		Addr:     redisClientAddr,
-		Password: redisClientPassword,
+		Addr:     addr,
+		Password: password,
 		DB:       0,
 	})
-	return &RedisStore{client: client, logger: logger}
+	if err := redisotel.InstrumentTracing(client); err != nil {
+		logger.Error("Error instrumenting the redis client", "error", err)
+	}
+	return client
 }
 
-func (store *RedisStore) Fetch(key string) (string, error) {
-	return store.client.Get(context.Background(), key).Result()
+// Fetch returns the long url of key, ErrExpired when key is gone but its tombstone is still there.
+func (store *RedisStore) Fetch(ctx context.Context, key string) (string, error) {
+	url, err := store.client.Get(ctx, key).Result()
+	if !errors.Is(err, redis.Nil) {
+		return url, redisError(err)
+	}
+	expired, existsErr := store.client.Exists(ctx, tombstoneKey(key)).Result()
+	switch {
+	case existsErr != nil:
+		return "", redisError(existsErr)
+	case expired > 0:
+		return "", fmt.Errorf("%w: %s", ErrExpired, key)
+	}
+	return "", redisError(err)
+}
+
+// Store only writes keys that don't exist yet, so storing the same link twice (e.g. when its alias is
+// claimed again) leaves the first write and its TTL untouched. Storing a different long url for an
+// existing key returns ErrConflict, and since the key is set with SETNX only one of two concurrent
+// calls for the same key can write it. When the existing key expires before it is read, it is free
+// again, so the SETNX is tried once more.
+func (store *RedisStore) Store(ctx context.Context, key string, link Link) error {
+	// a link that expired while being stored still gets the shortest TTL, so it is claimed and gone
+	ttl := max(link.ttl(time.Now()), time.Millisecond)
+	for {
+		set, err := store.client.SetNX(ctx, key, link.LongUrl, ttl).Result()
+		if err != nil {
+			return redisError(err)
+		}
+		if set {
+			break
+		}
+		existing, err := store.client.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return redisError(err)
+		}
+		if existing != link.LongUrl {
+			return fmt.Errorf("%w: %s is already taken", ErrConflict, key)
+		}
+		break
+	}
+	_, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		setTombstone(ctx, pipe, key, ttl)
+		return nil
+	})
+	return redisError(err)
+}
+
+// StoreBatch writes all links in a single pipelined round trip, with the same idempotency as Store.
+// Links whose key already exists are skipped without checking their value, and so are the ones that
+// expired before they could be stored.
+func (store *RedisStore) StoreBatch(ctx context.Context, links map[string]Link) error {
+	now := time.Now()
+	_, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, link := range links {
+			if ttl := link.ttl(now); ttl > 0 {
+				pipe.SetNX(ctx, key, link.LongUrl, ttl)
+				setTombstone(ctx, pipe, key, ttl)
+			}
+		}
+		return nil
+	})
+	return redisError(err)
+}
+
+// Remove deletes key along with its tombstone, so it is not found rather than expired afterward. It
+// returns ErrNotFound when key didn't exist.
+func (store *RedisStore) Remove(ctx context.Context, key string) error {
+	var removed *redis.IntCmd
+	_, err := store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.Del(ctx, key)
+		pipe.Del(ctx, tombstoneKey(key))
+		return nil
+	})
+	if err != nil {
+		return redisError(err)
+	}
+	if removed.Val() == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return nil
 }
 
-func (store *RedisStore) Store(key string, data string) error {
-	return store.client.Set(context.Background(), key, data, defaultTTL).Err()
+func (store *RedisStore) Close() error {
+	return store.client.Close()
 }
 
-func (store *RedisStore) Remove(key string) error {
-	return store.client.Del(context.Background(), key).Err()
+// redisError maps the errors of the redis client to the storage errors: a missing key is ErrNotFound,
+// and a connection that can't be made or was lost is ErrUnavailable.
+func redisError(err error) error {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, redis.Nil):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, redis.ErrClosed):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	default:
+		return err
+	}
 }
 
 type FakeUrlStore struct {
-	FetchFn  func(string) (string, error)
-	StoreFn  func(string, string) error
-	RemoveFn func(string) error
+	FetchFn      func(context.Context, string) (string, error)
+	StoreFn      func(context.Context, string, Link) error
+	StoreBatchFn func(context.Context, map[string]Link) error
+	RemoveFn     func(context.Context, string) error
 }
 
-func (store *FakeUrlStore) Fetch(key string) (string, error) {
-	return store.FetchFn(key)
+func (store *FakeUrlStore) Fetch(ctx context.Context, key string) (string, error) {
+	return store.FetchFn(ctx, key)
+}
+func (store *FakeUrlStore) Store(ctx context.Context, key string, link Link) error {
+	return store.StoreFn(ctx, key, link)
 }
-func (store *FakeUrlStore) Store(key string, data string) error {
-	return store.StoreFn(key, data)
+func (store *FakeUrlStore) StoreBatch(ctx context.Context, links map[string]Link) error {
+	return store.StoreBatchFn(ctx, links)
 }
-func (store *FakeUrlStore) Remove(key string) error {
-	return store.RemoveFn(key)
+func (store *FakeUrlStore) Remove(ctx context.Context, key string) error {
+	return store.RemoveFn(ctx, key)
 }
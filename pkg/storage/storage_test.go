@@ -3,8 +3,11 @@ package storage
 import (
 	"context"
 	"errors"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
 	"log/slog"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -14,19 +17,22 @@ func TestRedisStore_Fetch(t *testing.T) {
 	type fields struct {
 		client interface {
 			Get(ctx context.Context, key string) *redis.StringCmd
-			Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-			Del(ctx context.Context, keys ...string) *redis.IntCmd
+			SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+			Exists(ctx context.Context, keys ...string) *redis.IntCmd
+			Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+			Close() error
 		}
 	}
 	type args struct {
 		key string
 	}
 	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		want    string
-		wantErr bool
+		name      string
+		fields    fields
+		args      args
+		want      string
+		wantErr   bool
+		wantErrIs error
 	}{
 		{
 			name: "when fetching if there is an error, return it",
@@ -46,6 +52,72 @@ func TestRedisStore_Fetch(t *testing.T) {
 			want:    "",
 			wantErr: true,
 		},
+		{
+			name: "when the key does not exist, return not found",
+			fields: fields{
+				client: &FakeRedisStore{
+					GetFn: func(ctx context.Context, key string) *redis.StringCmd {
+						result := &redis.StringCmd{}
+						result.SetErr(redis.Nil)
+						return result
+					},
+					ExistsFn: func(ctx context.Context, keys ...string) *redis.IntCmd {
+						result := &redis.IntCmd{}
+						result.SetVal(0)
+						return result
+					},
+				},
+			},
+			args: args{
+				key: "something",
+			},
+			want:      "",
+			wantErr:   true,
+			wantErrIs: ErrNotFound,
+		},
+		{
+			name: "when the key is gone but its tombstone is there, return expired",
+			fields: fields{
+				client: &FakeRedisStore{
+					GetFn: func(ctx context.Context, key string) *redis.StringCmd {
+						result := &redis.StringCmd{}
+						result.SetErr(redis.Nil)
+						return result
+					},
+					ExistsFn: func(ctx context.Context, keys ...string) *redis.IntCmd {
+						result := &redis.IntCmd{}
+						if len(keys) == 1 && keys[0] == "shortn:expired:something" {
+							result.SetVal(1)
+						}
+						return result
+					},
+				},
+			},
+			args: args{
+				key: "something",
+			},
+			want:      "",
+			wantErr:   true,
+			wantErrIs: ErrExpired,
+		},
+		{
+			name: "when redis can't be reached, return unavailable",
+			fields: fields{
+				client: &FakeRedisStore{
+					GetFn: func(ctx context.Context, key string) *redis.StringCmd {
+						result := &redis.StringCmd{}
+						result.SetErr(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+						return result
+					},
+				},
+			},
+			args: args{
+				key: "something",
+			},
+			want:      "",
+			wantErr:   true,
+			wantErrIs: ErrUnavailable,
+		},
 		{
 			name: "when fetching if there is no error, return val",
 			fields: fields{
@@ -74,11 +146,14 @@ func TestRedisStore_Fetch(t *testing.T) {
 				client: tt.fields.client,
 				logger: logger,
 			}
-			got, err := store.Fetch(tt.args.key)
+			got, err := store.Fetch(context.Background(), tt.args.key)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Fetch() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("Fetch() error = %v, want %v", err, tt.wantErrIs)
+			}
 			if got != tt.want {
 				t.Errorf("Fetch() got = %v, want %v", got, tt.want)
 			}
@@ -90,26 +165,29 @@ func TestRedisStore_Store(t *testing.T) {
 	type fields struct {
 		client interface {
 			Get(ctx context.Context, key string) *redis.StringCmd
-			Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-			Del(ctx context.Context, keys ...string) *redis.IntCmd
+			SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+			Exists(ctx context.Context, keys ...string) *redis.IntCmd
+			Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+			Close() error
 		}
 	}
 	type args struct {
 		key  string
-		data string
+		link Link
 	}
 	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		wantErr bool
+		name      string
+		fields    fields
+		args      args
+		wantErr   bool
+		wantErrIs error
 	}{
 		{
 			name: "when storing, if there's an error, return it",
 			fields: fields{
 				client: &FakeRedisStore{
-					SetFn: func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
-						result := &redis.StatusCmd{}
+					SetNXFn: func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+						result := &redis.BoolCmd{}
 						result.SetErr(errors.New("expected error"))
 						return result
 					},
@@ -117,24 +195,104 @@ func TestRedisStore_Store(t *testing.T) {
 			},
 			args: args{
 				key:  "key",
-				data: "value",
+				link: Link{LongUrl: "value"},
 			},
 			wantErr: true,
 		},
+		{
+			name: "when storing a key that already exists with the same value, keep the first write and return nil",
+			fields: fields{
+				client: &FakeRedisStore{
+					SetNXFn: func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+						result := &redis.BoolCmd{}
+						result.SetVal(false)
+						return result
+					},
+					GetFn: func(ctx context.Context, key string) *redis.StringCmd {
+						result := &redis.StringCmd{}
+						result.SetVal("value")
+						return result
+					},
+					PipelinedFn: func(ctx context.Context, cmds []redis.Cmder) error {
+						return nil
+					},
+				},
+			},
+			args: args{
+				key:  "key",
+				link: Link{LongUrl: "value"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "when storing a key that already exists with another value, return conflict",
+			fields: fields{
+				client: &FakeRedisStore{
+					SetNXFn: func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+						result := &redis.BoolCmd{}
+						result.SetVal(false)
+						return result
+					},
+					GetFn: func(ctx context.Context, key string) *redis.StringCmd {
+						result := &redis.StringCmd{}
+						result.SetVal("other value")
+						return result
+					},
+				},
+			},
+			args: args{
+				key:  "key",
+				link: Link{LongUrl: "value"},
+			},
+			wantErr:   true,
+			wantErrIs: ErrConflict,
+		},
+		{
+			name: "when the existing key expires before it is read, store it again and return nil",
+			fields: fields{
+				client: func() *FakeRedisStore {
+					taken := true
+					return &FakeRedisStore{
+						SetNXFn: func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+							result := &redis.BoolCmd{}
+							result.SetVal(!taken)
+							return result
+						},
+						GetFn: func(ctx context.Context, key string) *redis.StringCmd {
+							taken = false
+							result := &redis.StringCmd{}
+							result.SetErr(redis.Nil)
+							return result
+						},
+						PipelinedFn: func(ctx context.Context, cmds []redis.Cmder) error {
+							return nil
+						},
+					}
+				}(),
+			},
+			args: args{
+				key:  "key",
+				link: Link{LongUrl: "value"},
+			},
+			wantErr: false,
+		},
 		{
 			name: "when storing, if there's no error, return nil",
 			fields: fields{
 				client: &FakeRedisStore{
-					SetFn: func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
-						result := &redis.StatusCmd{}
-						result.SetErr(nil)
+					SetNXFn: func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+						result := &redis.BoolCmd{}
+						result.SetVal(true)
 						return result
 					},
+					PipelinedFn: func(ctx context.Context, cmds []redis.Cmder) error {
+						return nil
+					},
 				},
 			},
 			args: args{
 				key:  "key",
-				data: "value",
+				link: Link{LongUrl: "value"},
 			},
 			wantErr: false,
 		},
@@ -148,38 +306,81 @@ func TestRedisStore_Store(t *testing.T) {
 				client: tt.fields.client,
 				logger: logger,
 			}
-			if err := store.Store(tt.args.key, tt.args.data); (err != nil) != tt.wantErr {
+			err := store.Store(context.Background(), tt.args.key, tt.args.link)
+			if (err != nil) != tt.wantErr {
 				t.Errorf("Store() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("Store() error = %v, want %v", err, tt.wantErrIs)
+			}
 		})
 	}
 }
 
+func TestRedisStore_expiry(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	server := miniredis.RunT(t)
+	store := NewRedisStore(server.Addr(), "", logger)
+	defer store.Close()
+	outbox := NewRedisOutbox(server.Addr(), "", logger)
+	defer outbox.Close()
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+
+	assert.Nil(t, store.Store(ctx, "abc", Link{LongUrl: "http://google.com", ExpiresAt: expiresAt}))
+	assert.Nil(t, store.StoreBatch(ctx, map[string]Link{"def": {LongUrl: "http://google.com", ExpiresAt: expiresAt}}))
+	assert.Nil(t, outbox.StoreWithOutbox(ctx, "ghi", Link{LongUrl: "http://google.com", ExpiresAt: expiresAt}, OutboxEntry{Value: []byte("event")}))
+	assert.Nil(t, store.Store(ctx, "removed", Link{LongUrl: "http://google.com", ExpiresAt: expiresAt}))
+	assert.Nil(t, store.Remove(ctx, "removed"))
+	for _, key := range []string{"abc", "def", "ghi"} {
+		url, err := store.Fetch(ctx, key)
+		assert.Nil(t, err, key)
+		assert.Equal(t, "http://google.com", url, key)
+	}
+
+	server.FastForward(2 * time.Hour)
+	for _, key := range []string{"abc", "def", "ghi"} {
+		_, err := store.Fetch(ctx, key)
+		assert.ErrorIs(t, err, ErrExpired, "%s should be expired", key)
+	}
+	_, err := store.Fetch(ctx, "removed")
+	assert.ErrorIs(t, err, ErrNotFound, "a removed key should not be found")
+	_, err = store.Fetch(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound, "a key never stored should not be found")
+
+	server.FastForward(expiredRetention)
+	_, err = store.Fetch(ctx, "abc")
+	assert.ErrorIs(t, err, ErrNotFound, "a key that expired longer ago than the retention should not be found")
+}
+
 func TestRedisStore_Remove(t *testing.T) {
 	type fields struct {
 		client interface {
 			Get(ctx context.Context, key string) *redis.StringCmd
-			Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-			Del(ctx context.Context, keys ...string) *redis.IntCmd
+			SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+			Exists(ctx context.Context, keys ...string) *redis.IntCmd
+			Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+			Close() error
 		}
 	}
 	type args struct {
 		key string
 	}
 	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		wantErr bool
+		name      string
+		fields    fields
+		args      args
+		wantErr   bool
+		wantErrIs error
 	}{
 		{
 			name: "when there is an error removing a key, return it",
 			fields: fields{
 				client: &FakeRedisStore{
-					DelFn: func(ctx context.Context, keys ...string) *redis.IntCmd {
-						result := &redis.IntCmd{}
-						result.SetErr(errors.New("expected error"))
-						return result
+					PipelinedFn: func(ctx context.Context, cmds []redis.Cmder) error {
+						return errors.New("expected error")
 					},
 				},
 			},
@@ -189,13 +390,32 @@ func TestRedisStore_Remove(t *testing.T) {
 			wantErr: true,
 		},
 		{
-			name: "when there is an error removing a key, return it",
+			name: "when the key does not exist, return not found",
 			fields: fields{
 				client: &FakeRedisStore{
-					DelFn: func(ctx context.Context, keys ...string) *redis.IntCmd {
-						result := &redis.IntCmd{}
-						result.SetErr(nil)
-						return result
+					PipelinedFn: func(ctx context.Context, cmds []redis.Cmder) error {
+						// the key is deleted first, then its tombstone
+						cmds[0].(*redis.IntCmd).SetVal(0)
+						cmds[1].(*redis.IntCmd).SetVal(1)
+						return nil
+					},
+				},
+			},
+			args: args{
+				key: "something",
+			},
+			wantErr:   true,
+			wantErrIs: ErrNotFound,
+		},
+		{
+			name: "when the key is removed, return nil",
+			fields: fields{
+				client: &FakeRedisStore{
+					PipelinedFn: func(ctx context.Context, cmds []redis.Cmder) error {
+						// the key is deleted first, then its tombstone
+						cmds[0].(*redis.IntCmd).SetVal(1)
+						cmds[1].(*redis.IntCmd).SetVal(1)
+						return nil
 					},
 				},
 			},
@@ -214,25 +434,140 @@ func TestRedisStore_Remove(t *testing.T) {
 				client: tt.fields.client,
 				logger: logger,
 			}
-			if err := store.Remove(tt.args.key); (err != nil) != tt.wantErr {
+			err := store.Remove(context.Background(), tt.args.key)
+			if (err != nil) != tt.wantErr {
 				t.Errorf("Remove() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("Remove() error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestRedisStore_StoreBatch(t *testing.T) {
+	type fields struct {
+		pipelinedErr error
+	}
+	type args struct {
+		entries map[string]Link
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		args     args
+		wantCmds int
+		wantErr  bool
+	}{
+		{
+			name: "when storing a batch, every entry is queued in a single pipeline along with its tombstone",
+			args: args{
+				entries: map[string]Link{"a": {LongUrl: "http://google.com"}, "b": {LongUrl: "http://mercadolibre.com.ar", ExpiresAt: time.Now().Add(time.Hour)}},
+			},
+			wantCmds: 6,
+			wantErr:  false,
+		},
+		{
+			name: "when a link already expired, it is not stored",
+			args: args{
+				entries: map[string]Link{"a": {LongUrl: "http://google.com"}, "b": {LongUrl: "http://mercadolibre.com.ar", ExpiresAt: time.Now().Add(-time.Second)}},
+			},
+			wantCmds: 3,
+			wantErr:  false,
+		},
+		{
+			name:   "when the pipeline fails, return the error",
+			fields: fields{pipelinedErr: errors.New("expected error")},
+			args: args{
+				entries: map[string]Link{"a": {LongUrl: "http://google.com"}},
+			},
+			wantCmds: 3,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+			}))
+			var queued []redis.Cmder
+			store := &RedisStore{
+				client: &FakeRedisStore{
+					PipelinedFn: func(ctx context.Context, cmds []redis.Cmder) error {
+						queued = cmds
+						return tt.fields.pipelinedErr
+					},
+				},
+				logger: logger,
+			}
+			if err := store.StoreBatch(context.Background(), tt.args.entries); (err != nil) != tt.wantErr {
+				t.Errorf("StoreBatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(queued) != tt.wantCmds {
+				t.Errorf("StoreBatch() queued %d commands, want %d", len(queued), tt.wantCmds)
+			}
+			for _, cmd := range queued {
+				if cmd.Name() != "set" && cmd.Name() != "expire" {
+					t.Errorf("StoreBatch() queued %s, want an idempotent set or an expire", cmd.Name())
+				}
+			}
 		})
 	}
 }
 
 type FakeRedisStore struct {
-	GetFn func(ctx context.Context, key string) *redis.StringCmd
-	SetFn func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-	DelFn func(ctx context.Context, keys ...string) *redis.IntCmd
+	GetFn    func(ctx context.Context, key string) *redis.StringCmd
+	SetNXFn  func(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	ExistsFn func(ctx context.Context, keys ...string) *redis.IntCmd
+	// PipelinedFn receives the commands queued by the pipeline function
+	PipelinedFn func(ctx context.Context, cmds []redis.Cmder) error
 }
 
 func (f *FakeRedisStore) Get(ctx context.Context, key string) *redis.StringCmd {
 	return f.GetFn(ctx, key)
 }
-func (f *FakeRedisStore) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
-	return f.SetFn(ctx, key, value, expiration)
+func (f *FakeRedisStore) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	return f.SetNXFn(ctx, key, value, expiration)
+}
+func (f *FakeRedisStore) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	return f.ExistsFn(ctx, keys...)
+}
+func (f *FakeRedisStore) Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	var cmds []redis.Cmder
+	pipe := &FakePipeliner{cmds: &cmds}
+	if err := fn(pipe); err != nil {
+		return nil, err
+	}
+	return cmds, f.PipelinedFn(ctx, cmds)
+}
+func (f *FakeRedisStore) Close() error {
+	return nil
+}
+
+// FakePipeliner records the commands queued on it instead of sending them
+type FakePipeliner struct {
+	redis.Pipeliner
+	cmds *[]redis.Cmder
+}
+
+func (f *FakePipeliner) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	cmd := redis.NewBoolCmd(ctx, "set", key, value, "ex", int(expiration.Seconds()), "nx")
+	*f.cmds = append(*f.cmds, cmd)
+	return cmd
+}
+
+func (f *FakePipeliner) ExpireGT(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	cmd := redis.NewBoolCmd(ctx, "expire", key, int(expiration.Seconds()), "gt")
+	*f.cmds = append(*f.cmds, cmd)
+	return cmd
 }
-func (f *FakeRedisStore) Del(ctx context.Context, keys ...string) *redis.IntCmd {
-	return f.DelFn(ctx, keys...)
+
+func (f *FakePipeliner) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	args := []interface{}{"del"}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	cmd := redis.NewIntCmd(ctx, args...)
+	*f.cmds = append(*f.cmds, cmd)
+	return cmd
 }
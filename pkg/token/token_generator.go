@@ -8,46 +8,63 @@ import (
 
 type TokenGenerator interface {
 	GenerateToken() (snowflake.ID, error)
+	// GenerateTokens returns n tokens that are distinct from each other
+	GenerateTokens(n int) ([]snowflake.ID, error)
 }
 
+// SnowflakeTokenGenerator generates every token on the same node, whose sequence keeps the tokens of
+// the same millisecond apart. It is safe for concurrent use.
 type SnowflakeTokenGenerator struct {
-	epoch  string
+	node   *snowflake.Node
 	logger *slog.Logger
 }
 
-func NewSnowflakeTokenGenerator(epoch string, log *slog.Logger) TokenGenerator {
-	return SnowflakeTokenGenerator{
-		epoch:  epoch,
-		logger: log,
-	}
-}
-
-func (s SnowflakeTokenGenerator) GenerateToken() (snowflake.ID, error) {
-	s.logger.Debug("Generating token", "epoch", s.epoch)
-	epoch, err := time.Parse(time.RFC3339, s.epoch)
+// NewSnowflakeTokenGenerator returns a generator of tokens counted from epoch, an RFC 3339 time.
+// snowflake.Epoch is global, so it is set once here rather than on every call.
+func NewSnowflakeTokenGenerator(epoch string, log *slog.Logger) (TokenGenerator, error) {
+	start, err := time.Parse(time.RFC3339, epoch)
 	if err != nil {
-		s.logger.Error("Failed to parse epoch", "err", err)
-		return 0, err
+		log.Error("Failed to parse epoch", "err", err)
+		return nil, err
 	}
 
-	snowflake.Epoch = epoch.UnixNano() / 1e6 //TODO check:apparently this converst it to ms
+	snowflake.Epoch = start.UnixNano() / 1e6 //TODO check:apparently this converst it to ms
 
 	node, err := snowflake.NewNode(1) //TODO this is the machine id, if I get this right this is the instance
 	if err != nil {
-		s.logger.Error("Failed to create node", "err", err)
-		return 0, err
+		log.Error("Failed to create node", "err", err)
+		return nil, err
 	}
+	return &SnowflakeTokenGenerator{
+		node:   node,
+		logger: log,
+	}, nil
+}
 
-	id := node.Generate()
+func (s *SnowflakeTokenGenerator) GenerateToken() (snowflake.ID, error) {
+	id := s.node.Generate()
 	s.logger.Debug("Generated token", "id", id)
 
 	return id, nil
 }
 
+func (s *SnowflakeTokenGenerator) GenerateTokens(n int) ([]snowflake.ID, error) {
+	s.logger.Debug("Generating tokens", "count", n)
+	ids := make([]snowflake.ID, n)
+	for i := range ids {
+		ids[i] = s.node.Generate()
+	}
+	return ids, nil
+}
+
 type FakeTokenGenerator struct {
-	GenerateTokenFn func() (snowflake.ID, error)
+	GenerateTokenFn  func() (snowflake.ID, error)
+	GenerateTokensFn func(n int) ([]snowflake.ID, error)
 }
 
 func (f *FakeTokenGenerator) GenerateToken() (snowflake.ID, error) {
 	return f.GenerateTokenFn()
 }
+func (f *FakeTokenGenerator) GenerateTokens(n int) ([]snowflake.ID, error) {
+	return f.GenerateTokensFn(n)
+}